@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig obtains and renews the server's certificate from an ACME CA
+// such as Let's Encrypt, so the public hostname doesn't need certificates
+// copied in and rotated by hand.
+type ACMEConfig struct {
+	Domains      []string `json:"domains,omitempty"`       // Hostnames to request certificates for; others are refused
+	Email        string   `json:"email,omitempty"`         // Contact address for expiry notices from the CA
+	CacheDir     string   `json:"cache_dir,omitempty"`     // Where the account key and certificates are kept (default: "acme-cache")
+	DirectoryURL string   `json:"directory_url,omitempty"` // ACME directory (default: Let's Encrypt production)
+	Challenge    string   `json:"challenge,omitempty"`     // "tls-alpn-01" (default) or "http-01"
+	HTTPListen   string   `json:"http_listen,omitempty"`   // Address answering http-01 challenges (default: ":80")
+}
+
+// acmeTLSConfig returns a TLS configuration whose certificates are issued
+// and renewed on demand by an autocert manager. Certificates are renewed
+// ahead of expiry by the manager itself, and persisted in the cache
+// directory so restarts don't count against the CA's rate limits.
+func acmeTLSConfig(cfg ACMEConfig) (*tls.Config, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, errors.New("acme.domains is required")
+	}
+	cacheDir := cfg.CacheDir
+	if cacheDir == "" {
+		cacheDir = "acme-cache"
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Email:      cfg.Email,
+	}
+	if cfg.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	}
+
+	// Connection adoption hijacks the underlying connection, which HTTP/2 doesn't allow
+	nextProtos := []string{"http/1.1"}
+	switch cfg.Challenge {
+	case "", "tls-alpn-01":
+		// The CA connects to port 443 of each domain, so the relay port
+		// must be reachable there
+		nextProtos = append(nextProtos, acme.ALPNProto)
+	case "http-01":
+		listen := cfg.HTTPListen
+		if listen == "" {
+			listen = ":80"
+		}
+		go func() {
+			err := http.ListenAndServe(listen, manager.HTTPHandler(nil))
+			log.Printf("❌ ACME http-01 listener on %s stopped: %v", listen, err)
+		}()
+		log.Printf("🔒 Answering ACME http-01 challenges on %s", listen)
+	default:
+		return nil, fmt.Errorf("unknown ACME challenge %q", cfg.Challenge)
+	}
+
+	log.Printf("🔒 OOB certificates for %v managed by ACME (cache: %s)", cfg.Domains, cacheDir)
+	return &tls.Config{
+		GetCertificate: manager.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     nextProtos,
+	}, nil
+}
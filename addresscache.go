@@ -0,0 +1,111 @@
+//go:build !relay
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cached target addresses
+//
+// The oob strategy keeps a hostname out of the client's network by having
+// the relay resolve it, so the client connects to an address it never
+// looked up. When the relay can't be reached, falling back to a strategy
+// that resolves and dials the name locally gives that away; the client
+// remembers the addresses relays resolved instead, and as long as it holds
+// one for a host, a failed resolution connects there rather than failing
+// the strategy. Addresses go stale as hosts move, so they're only kept for
+// the configured ttl, and one that can't be connected to is forgotten.
+//
+// Connecting to a cached address hides no more than the lookup: the
+// ClientHello still names the host. Destinations that must be concealed
+// don't use the cache, since no relay vouched for the address.
+
+// AddressCacheConfig bounds the addresses relays resolved that the oob
+// strategy falls back to.
+type AddressCacheConfig struct {
+	TTL        int `json:"ttl,omitempty"`         // Minutes a resolved address is used; negative disables the cache (default: 360)
+	MaxEntries int `json:"max_entries,omitempty"` // Hosts kept; the one resolved longest ago is dropped first (default: 4096)
+}
+
+// Defaults of AddressCacheConfig.
+const (
+	defaultAddressTTL         = 6 * time.Hour
+	defaultMaxCachedAddresses = 4096
+)
+
+type cachedAddress struct {
+	ip       string
+	resolved time.Time
+}
+
+// addressCache maps hostnames to the address a relay last resolved them to.
+type addressCache struct {
+	ttl        time.Duration // Zero when disabled
+	maxEntries int
+
+	mu    sync.Mutex
+	hosts map[string]cachedAddress
+}
+
+func newAddressCache(cfg AddressCacheConfig) *addressCache {
+	c := &addressCache{ttl: defaultAddressTTL, maxEntries: cfg.MaxEntries, hosts: make(map[string]cachedAddress)}
+	if cfg.TTL < 0 {
+		c.ttl = 0
+	} else if cfg.TTL > 0 {
+		c.ttl = time.Duration(cfg.TTL) * time.Minute
+	}
+	if c.maxEntries <= 0 {
+		c.maxEntries = defaultMaxCachedAddresses
+	}
+	return c
+}
+
+// Put records that a relay resolved host to ip.
+func (c *addressCache) Put(host, ip string) {
+	if host == "" || ip == "" || c.ttl == 0 {
+		return
+	}
+	host = strings.ToLower(host)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.hosts[host]; !exists && len(c.hosts) >= c.maxEntries {
+		oldest := ""
+		for h, a := range c.hosts {
+			if oldest == "" || a.resolved.Before(c.hosts[oldest].resolved) {
+				oldest = h
+			}
+		}
+		delete(c.hosts, oldest)
+	}
+	c.hosts[host] = cachedAddress{ip: ip, resolved: time.Now()}
+}
+
+// Lookup returns the address host was last resolved to and how long ago,
+// or "" if it's unknown or stale.
+func (c *addressCache) Lookup(host string) (string, time.Duration) {
+	host = strings.ToLower(host)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, ok := c.hosts[host]
+	if !ok {
+		return "", 0
+	}
+	age := time.Since(a.resolved)
+	if age > c.ttl {
+		delete(c.hosts, host)
+		return "", 0
+	}
+	return a.ip, age
+}
+
+// Forget drops the address of host, once connecting to it failed.
+func (c *addressCache) Forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.hosts, strings.ToLower(host))
+}
@@ -0,0 +1,58 @@
+//go:build !relay
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAddressCache(t *testing.T) {
+	c := newAddressCache(AddressCacheConfig{TTL: 10})
+	c.Put("Example.com", "192.0.2.1")
+	if ip, _ := c.Lookup("example.COM"); ip != "192.0.2.1" {
+		t.Errorf("Lookup = %q, want 192.0.2.1", ip)
+	}
+
+	// Addresses older than the ttl are dropped
+	c.hosts["example.com"] = cachedAddress{ip: "192.0.2.1", resolved: time.Now().Add(-11 * time.Minute)}
+	if ip, _ := c.Lookup("example.com"); ip != "" {
+		t.Errorf("stale address %q returned", ip)
+	}
+
+	// So are addresses that couldn't be connected to
+	c.Put("example.com", "192.0.2.2")
+	c.Forget("EXAMPLE.com")
+	if ip, _ := c.Lookup("example.com"); ip != "" {
+		t.Errorf("forgotten address %q returned", ip)
+	}
+
+	disabled := newAddressCache(AddressCacheConfig{TTL: -1})
+	disabled.Put("example.com", "192.0.2.1")
+	if ip, _ := disabled.Lookup("example.com"); ip != "" {
+		t.Errorf("disabled cache returned %q", ip)
+	}
+
+	if d := newAddressCache(AddressCacheConfig{}); d.ttl != defaultAddressTTL || d.maxEntries != defaultMaxCachedAddresses {
+		t.Errorf("defaults: ttl %s, max entries %d", d.ttl, d.maxEntries)
+	}
+}
+
+func TestAddressCacheEvictsOldest(t *testing.T) {
+	c := newAddressCache(AddressCacheConfig{MaxEntries: 3})
+	for i := range 4 {
+		c.Put(fmt.Sprintf("host%d.example", i), fmt.Sprintf("192.0.2.%d", i))
+		c.hosts[fmt.Sprintf("host%d.example", i)] = cachedAddress{
+			ip: fmt.Sprintf("192.0.2.%d", i), resolved: time.Now().Add(time.Duration(i-10) * time.Minute)}
+	}
+	if len(c.hosts) != 3 {
+		t.Fatalf("%d hosts kept, want 3", len(c.hosts))
+	}
+	if ip, _ := c.Lookup("host0.example"); ip != "" {
+		t.Errorf("oldest host kept: %s", ip)
+	}
+	if ip, _ := c.Lookup("host3.example"); ip != "192.0.2.3" {
+		t.Errorf("newest host = %q", ip)
+	}
+}
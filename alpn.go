@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+
+	sultrytls "sultry/pkg/tls"
+)
+
+// Relay buffers by application protocol. HTTP/2 connections stay open and
+// mostly idle between multiplexed frames, so large buffers held for their
+// whole lifetime are wasted; HTTP/1.1 connections carry one bulk transfer
+// after another and benefit from them.
+const (
+	relayBufferHTTP2   = 64 * 1024
+	relayBufferDefault = 1048576
+)
+
+// negotiatedALPN returns the application protocol a server picked in the
+// ServerHello among its responses. known is false when that can't be seen,
+// as with TLS 1.3, which sends it encrypted.
+func negotiatedALPN(serverResponses [][]byte) (alpn string, known bool) {
+	hello, err := sultrytls.ParseServerHello(bytes.Join(serverResponses, nil))
+	if err != nil {
+		return "", false
+	}
+	return hello.ALPN, hello.ALPNKnown
+}
+
+// relayBufferSize returns the relay buffer size for connections speaking
+// alpn, with "" for HTTP/1.1 and unknown protocols.
+func relayBufferSize(alpn string) int {
+	if alpn == "h2" {
+		return relayBufferHTTP2
+	}
+	return relayBufferDefault
+}
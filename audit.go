@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AuditConfig enables the audit log: one JSON object per line for every
+// connection outcome and strategy fallback, meant for later analysis rather
+// than for reading along like the regular log. Exporters can forward the
+// same events elsewhere.
+type AuditConfig struct {
+	Path     string            `json:"path,omitempty"`      // File audit events are appended to; empty disables the audit log
+	MaxSize  int               `json:"max_size,omitempty"`  // Megabytes after which the audit log is rotated (default: never)
+	MaxFiles int               `json:"max_files,omitempty"` // Rotated audit logs kept next to it, as path.1 (newest) to path.N (default: 5)
+	IPFIX    IPFIXConfig       `json:"ipfix,omitempty"`     // Flow records sent to an IPFIX collector
+	Syslog   AuditSyslogConfig `json:"syslog,omitempty"`    // Events sent to a syslog collector as RFC 5424 messages
+	SQLite   string            `json:"sqlite,omitempty"`    // Database file events are inserted into, with an SQLite driver built in
+}
+
+// auditEvent is one line of the audit log.
+type auditEvent struct {
+	Time        time.Time     `json:"time"`
+	Event       string        `json:"event"` // "connect", "fallback", "failed", "close", "dry_run" or "coalescing"
+	Session     string        `json:"session,omitempty"`
+	Dest        string        `json:"dest,omitempty"` // host:port from the CONNECT request
+	SNI         string        `json:"sni,omitempty"`
+	Strategy    string        `json:"strategy,omitempty"`
+	Next        string        `json:"next,omitempty"`        // Strategy tried after a fallback, if any
+	Planned     string        `json:"planned,omitempty"`     // Strategy a dry run would have tried first
+	Concealment string        `json:"concealment,omitempty"` // A dry run's verdict on whether concealment is needed
+	Cause       FallbackCause `json:"cause,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	LatencyMs   int64         `json:"latency_ms,omitempty"`
+	Coalesced   string        `json:"coalesced,omitempty"` // Host whose h2 tunnel requests for Dest may travel in
+
+	// Set on "close" events, when a tunnel's relay ended
+	Client     string `json:"client,omitempty"`      // Address the tunnel was accepted from
+	BytesUp    int64  `json:"bytes_up,omitempty"`    // Bytes sent to the destination
+	BytesDown  int64  `json:"bytes_down,omitempty"`  // Bytes received from the destination
+	DurationMs int64  `json:"duration_ms,omitempty"` // From connecting to the end of the relay
+	Class      string `json:"class,omitempty"`       // "web" or "websocket", see tunnelclass.go
+}
+
+// auditExporter receives every audit event, to store or forward it.
+// Export is called from many sessions at once and shouldn't block them.
+type auditExporter interface {
+	Export(event auditEvent)
+}
+
+// auditExporterFactory builds an exporter from the audit configuration,
+// returning nil if it isn't configured.
+type auditExporterFactory func(cfg AuditConfig) (auditExporter, error)
+
+var (
+	auditExporterFactories   = make(map[string]auditExporterFactory)
+	auditExporterFactoriesMu sync.Mutex
+
+	// auditExporters are the exporters set up by setupAudit; none means
+	// auditing is disabled.
+	auditExporters []auditExporter
+)
+
+// registerAuditExporter makes an exporter available to setupAudit. The
+// audit log registers itself from init; exporters in other files do the
+// same.
+func registerAuditExporter(name string, factory auditExporterFactory) {
+	auditExporterFactoriesMu.Lock()
+	defer auditExporterFactoriesMu.Unlock()
+
+	if _, exists := auditExporterFactories[name]; exists {
+		panic("sultry: audit exporter registered twice: " + name)
+	}
+	auditExporterFactories[name] = factory
+}
+
+func init() {
+	registerAuditExporter("file", newAuditWriter)
+}
+
+// setupAudit sets up every exporter the configuration enables.
+func setupAudit(cfg AuditConfig) error {
+	auditExporterFactoriesMu.Lock()
+	defer auditExporterFactoriesMu.Unlock()
+
+	names := make([]string, 0, len(auditExporterFactories))
+	for name := range auditExporterFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		exporter, err := auditExporterFactories[name](cfg)
+		if err != nil {
+			return err
+		}
+		if exporter != nil {
+			auditExporters = append(auditExporters, exporter)
+		}
+	}
+	return nil
+}
+
+// audit hands event to every exporter, if auditing is enabled.
+func audit(event auditEvent) {
+	if len(auditExporters) == 0 {
+		return
+	}
+	event.Time = time.Now()
+	redactAuditEvent(&event)
+	for _, exporter := range auditExporters {
+		exporter.Export(event)
+	}
+}
+
+// auditWriter appends events to the audit log as JSON lines, rotating it
+// once it reaches its maximum size.
+type auditWriter struct {
+	path     string
+	maxSize  int64 // 0 never rotates
+	maxFiles int
+	file     *os.File
+	size     int64
+	mu       sync.Mutex
+}
+
+func newAuditWriter(cfg AuditConfig) (auditExporter, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	w := &auditWriter{path: cfg.Path, maxSize: int64(cfg.MaxSize) << 20, maxFiles: orDefault(cfg.MaxFiles, 5)}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	log.Printf("📒 Audit log written to %s", cfg.Path)
+	return w, nil
+}
+
+func (w *auditWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	w.file, w.size = file, info.Size()
+	return nil
+}
+
+// rotate moves the log to path.1, shifting older ones up and dropping the
+// oldest, and starts a new one. The caller holds w.mu.
+func (w *auditWriter) rotate() error {
+	w.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxFiles))
+	for i := w.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		log.Printf("⚠️ Failed to rotate audit log: %v", err)
+	}
+	return w.open()
+}
+
+func (w *auditWriter) Export(event auditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(line))+1 > w.maxSize {
+		if err := w.rotate(); err != nil {
+			log.Printf("⚠️ %v", err)
+			return
+		}
+	}
+	n, err := w.file.Write(append(line, '\n'))
+	w.size += int64(n)
+	if err != nil {
+		log.Printf("⚠️ Failed to write audit log: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// SQLite audit storage
+//
+// Events can be kept in an SQLite database for deployments that query them
+// rather than grep them. The database is written through database/sql, so
+// the driver has to be built in: sultry doesn't depend on one, and a build
+// that wants this adds a file importing one that registers as "sqlite",
+// such as modernc.org/sqlite. Without it, configuring audit.sqlite is an
+// error at startup.
+
+// sqliteAuditDriver is the database/sql driver name the exporter opens.
+const sqliteAuditDriver = "sqlite"
+
+// sqliteAuditQueue bounds the events waiting to be inserted; Export drops
+// events rather than block a session when the database falls behind.
+const sqliteAuditQueue = 1024
+
+const sqliteAuditSchema = `CREATE TABLE IF NOT EXISTS audit (
+	time TEXT NOT NULL,
+	event TEXT NOT NULL,
+	session TEXT,
+	dest TEXT,
+	strategy TEXT,
+	bytes_up INTEGER,
+	bytes_down INTEGER,
+	duration_ms INTEGER,
+	data TEXT NOT NULL
+)`
+
+// sqliteAuditExporter inserts events from a queue in the background.
+type sqliteAuditExporter struct {
+	db     *sql.DB
+	events chan auditEvent
+}
+
+func init() {
+	registerAuditExporter("sqlite", newSQLiteAuditExporter)
+}
+
+func newSQLiteAuditExporter(cfg AuditConfig) (auditExporter, error) {
+	if cfg.SQLite == "" {
+		return nil, nil
+	}
+	db, err := sql.Open(sqliteAuditDriver, cfg.SQLite)
+	if err != nil {
+		return nil, fmt.Errorf("audit.sqlite needs a build with an SQLite driver registered as %q: %w",
+			sqliteAuditDriver, err)
+	}
+	if _, err := db.Exec(sqliteAuditSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set up audit database: %w", err)
+	}
+	e := &sqliteAuditExporter{db: db, events: make(chan auditEvent, sqliteAuditQueue)}
+	go e.insert()
+	log.Printf("📒 Audit events stored in %s", cfg.SQLite)
+	return e, nil
+}
+
+func (e *sqliteAuditExporter) Export(event auditEvent) {
+	select {
+	case e.events <- event:
+	default:
+		log.Printf("⚠️ Audit database is falling behind, dropped a %s event", event.Event)
+	}
+}
+
+func (e *sqliteAuditExporter) insert() {
+	for event := range e.events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		_, err = e.db.Exec(`INSERT INTO audit (time, event, session, dest, strategy, bytes_up, bytes_down, duration_ms, data)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, event.Time.UTC().Format(time.RFC3339Nano), event.Event, event.Session,
+			event.Dest, event.Strategy, event.BytesUp, event.BytesDown, event.DurationMs, string(data))
+		if err != nil {
+			log.Printf("⚠️ Failed to store audit event: %v", err)
+		}
+	}
+}
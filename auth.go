@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthConfig protects the OOB API with pre-shared bearer tokens. The server
+// accepts any token in Tokens; the client sends Token on every OOB request.
+type AuthConfig struct {
+	Tokens    []string `json:"tokens,omitempty" secret:"true"` // Server: accepted tokens; empty disables authentication
+	Token     string   `json:"token,omitempty" secret:"true"`  // Client: token sent to OOB peers
+	RateLimit float64  `json:"rate_limit,omitempty"`           // Server: sustained requests per second allowed per token (0 = unlimited)
+	Burst     int      `json:"burst,omitempty"`                // Server: requests a token may make in a burst (default: 2x rate_limit)
+}
+
+// authorizationHeader returns the header value that carries token.
+func authorizationHeader(token string) string {
+	return "Bearer " + token
+}
+
+// tokenBucket is a simple token-bucket rate limiter.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// authMiddleware rejects requests without a valid bearer token and enforces
+// a rate limit per token. With no tokens configured it returns next unchanged.
+// Rejected requests are passed to unauthorized if set, instead of answering 401.
+func authMiddleware(cfg AuthConfig, next, unauthorized http.Handler) http.Handler {
+	if len(cfg.Tokens) == 0 {
+		return next
+	}
+
+	burst := float64(cfg.Burst)
+	if burst <= 0 {
+		burst = math.Max(2*cfg.RateLimit, 1)
+	}
+
+	var mu sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+
+	allow := func(token string) bool {
+		if cfg.RateLimit <= 0 {
+			return true
+		}
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := time.Now()
+		bucket, ok := buckets[token]
+		if !ok {
+			bucket = &tokenBucket{tokens: burst, last: now}
+			buckets[token] = bucket
+		}
+		bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*cfg.RateLimit)
+		bucket.last = now
+		if bucket.tokens < 1 {
+			return false
+		}
+		bucket.tokens--
+		return true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		token, valid := matchToken(cfg.Tokens, presented)
+		if !found || !valid {
+			log.Printf("❌ Rejected unauthenticated request to %s from %s", r.URL.Path, redacted(sensitiveClientIP, r.RemoteAddr))
+			recordAuthFailure(r.RemoteAddr)
+			if unauthorized != nil {
+				unauthorized.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sultry"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !allow(token) {
+			log.Printf("⚠️ Rate limit exceeded for token %s… from %s", token[:min(4, len(token))], redacted(sensitiveClientIP, r.RemoteAddr))
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// matchToken compares presented against every accepted token in constant
+// time, so neither the match nor its position leaks through timing.
+func matchToken(accepted []string, presented string) (string, bool) {
+	var matched string
+	found := 0
+	for _, token := range accepted {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(presented)) == 1 {
+			matched = token
+			found = 1
+		}
+	}
+	return matched, found == 1
+}
+
+// authTransport adds the bearer token to every OOB request.
+type authTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", authorizationHeader(t.token))
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,369 @@
+//go:build !relay
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LoadBalancerConfig controls how OOB sessions are spread across the
+// configured server components.
+type LoadBalancerConfig struct {
+	Strategy         string `json:"strategy,omitempty"`          // round_robin (default), weighted or latency
+	FailureThreshold int    `json:"failure_threshold,omitempty"` // Consecutive failures before a peer's circuit opens
+	Cooldown         int    `json:"cooldown,omitempty"`          // Milliseconds an open circuit stays open
+	SlowThreshold    int    `json:"slow_threshold,omitempty"`    // Milliseconds after which a response counts as a failure
+	Failover         int    `json:"failover,omitempty"`          // Standby peers tried when a peer fails mid-setup (default: 1, -1 disables)
+}
+
+// oobPeer tracks the health of a single OOB server endpoint.
+type oobPeer struct {
+	Addr   string
+	Scheme string // "http", "https", "webtransport", "ssh" or "loopback"
+	Weight int
+
+	latency   time.Duration // Exponentially weighted moving average of request latency
+	failures  int           // Consecutive failures
+	openUntil time.Time     // Circuit is open (peer skipped) until this time
+	current   int           // Running weight for smooth weighted round-robin
+	rtt       time.Duration // Round-trip time of the last heartbeat
+	srtt      time.Duration // Smoothed heartbeat round-trip time
+	rttvar    time.Duration // Variation of the heartbeat round-trip time
+	down      bool          // Missed too many heartbeats; skipped until it answers again
+}
+
+// peerBalancer picks an OOB peer for each new session and keeps a circuit
+// breaker per endpoint, so one slow or dead server component doesn't stall
+// every handshake while healthy peers are available.
+type peerBalancer struct {
+	peers            []*oobPeer
+	strategy         string
+	failureThreshold int
+	cooldown         time.Duration
+	slowThreshold    time.Duration
+	next             int
+	mu               sync.Mutex
+}
+
+// newPeerBalancer builds a balancer over the HTTP(S), WebTransport and SSH OOB channels.
+func newPeerBalancer(channels []OOBChannelConfig, cfg LoadBalancerConfig) *peerBalancer {
+	b := &peerBalancer{
+		strategy:         cfg.Strategy,
+		failureThreshold: cfg.FailureThreshold,
+		cooldown:         time.Duration(cfg.Cooldown) * time.Millisecond,
+		slowThreshold:    time.Duration(cfg.SlowThreshold) * time.Millisecond,
+	}
+	if b.strategy == "" {
+		b.strategy = "round_robin"
+	}
+	if b.failureThreshold <= 0 {
+		b.failureThreshold = 3
+	}
+	if b.cooldown == 0 {
+		b.cooldown = 30 * time.Second
+	}
+	if b.slowThreshold == 0 {
+		b.slowThreshold = 3 * time.Second
+	}
+
+	for _, channel := range channels {
+		if channel.Type == "loopback" && channel.Address == "" {
+			channel.Address = "loopback" // In-process, so only a name
+		}
+		if (channel.Type != "http" && channel.Type != "https" && channel.Type != "webtransport" && channel.Type != "ssh" &&
+			channel.Type != "loopback") || len(channel.Address) == 0 {
+			continue
+		}
+		weight := channel.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		b.peers = append(b.peers, &oobPeer{
+			Addr:   net.JoinHostPort(channel.Address, strconv.Itoa(int(channel.Port))),
+			Scheme: channel.Type,
+			Weight: weight,
+		})
+	}
+
+	return b
+}
+
+// Pick returns the address of the peer to use for a new session.
+// Peers with an open circuit are skipped; once the cooldown has elapsed a
+// peer becomes eligible again and the next result decides its state.
+func (b *peerBalancer) Pick() (string, error) {
+	return b.PickStandby(nil)
+}
+
+// PickStandby is like Pick, but never returns one of the exclude peers. It
+// finds a standby to take over a session whose peer failed.
+func (b *peerBalancer) PickStandby(exclude []string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	var available []*oobPeer
+	for _, peer := range b.peers {
+		if now.After(peer.openUntil) && !peer.down && !slices.Contains(exclude, peer.Addr) {
+			available = append(available, peer)
+		}
+	}
+	if len(available) == 0 {
+		if len(exclude) > 0 {
+			return "", fmt.Errorf("no standby OOB peer available (%d configured, %d already tried)", len(b.peers), len(exclude))
+		}
+		return "", fmt.Errorf("no available OOB peers (%d configured, all circuits open)", len(b.peers))
+	}
+
+	var chosen *oobPeer
+	switch b.strategy {
+	case "weighted":
+		// Smooth weighted round-robin: spreads picks evenly within a cycle
+		total := 0
+		for _, peer := range available {
+			peer.current += peer.Weight
+			total += peer.Weight
+			if chosen == nil || peer.current > chosen.current {
+				chosen = peer
+			}
+		}
+		chosen.current -= total
+	case "latency":
+		// Unmeasured peers go first so every endpoint gets sampled
+		for _, peer := range available {
+			if chosen == nil || peer.score() < chosen.score() {
+				chosen = peer
+			}
+		}
+	default:
+		chosen = available[b.next%len(available)]
+		b.next++
+	}
+
+	return chosen.Addr, nil
+}
+
+// ReportSuccess records a completed request to addr. Responses slower than
+// the slow threshold are counted against the peer's circuit.
+func (b *peerBalancer) ReportSuccess(addr string, latency time.Duration) {
+	if latency > b.slowThreshold {
+		log.Printf("⚠️ OOB peer %s responded slowly (%s)", addr, latency)
+		b.ReportFailure(addr)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	peer := b.find(addr)
+	if peer == nil {
+		return
+	}
+	if peer.latency == 0 {
+		peer.latency = latency
+	} else {
+		peer.latency = (peer.latency*7 + latency) / 8
+	}
+	peer.failures = 0
+	peer.openUntil = time.Time{}
+}
+
+// ReportFailure records a failed request to addr and opens the peer's
+// circuit once the failure threshold is reached.
+func (b *peerBalancer) ReportFailure(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	peer := b.find(addr)
+	if peer == nil {
+		return
+	}
+	peer.failures++
+	if peer.failures >= b.failureThreshold {
+		peer.openUntil = time.Now().Add(b.cooldown)
+		log.Printf("🔌 Circuit opened for OOB peer %s after %d failures (cooldown %s)",
+			addr, peer.failures, b.cooldown)
+		b.notifyIfAllDown()
+	}
+}
+
+// Trip opens the peer's circuit immediately, e.g. when it fails the
+// startup reachability probe.
+func (b *peerBalancer) Trip(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if peer := b.find(addr); peer != nil {
+		peer.failures = b.failureThreshold
+		peer.openUntil = time.Now().Add(b.cooldown)
+		b.notifyIfAllDown()
+	}
+}
+
+// MarkUp records a successful heartbeat from addr. A peer that was down,
+// or whose circuit was open, is available again right away.
+func (b *peerBalancer) MarkUp(addr string, rtt time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	peer := b.find(addr)
+	if peer == nil {
+		return
+	}
+	peer.sampleRTT(rtt)
+	if peer.down || time.Now().Before(peer.openUntil) {
+		log.Printf("💓 OOB peer %s is up again (rtt %s)", addr, rtt.Truncate(time.Microsecond))
+	}
+	peer.down = false
+	peer.failures = 0
+	peer.openUntil = time.Time{}
+}
+
+// SRTT returns the smoothed heartbeat round-trip time to addr, or 0 before
+// the first heartbeat.
+func (b *peerBalancer) SRTT(addr string) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if peer := b.find(addr); peer != nil {
+		return peer.srtt
+	}
+	return 0
+}
+
+// RTO returns how long a reply from addr may take on top of the time the
+// server spends on a request, or 0 before the first heartbeat.
+func (b *peerBalancer) RTO(addr string) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if peer := b.find(addr); peer != nil && peer.srtt > 0 {
+		return peer.srtt + 4*peer.rttvar
+	}
+	return 0
+}
+
+// MarkDown takes addr out of rotation until it answers a heartbeat again.
+func (b *peerBalancer) MarkDown(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if peer := b.find(addr); peer != nil && !peer.down {
+		peer.down = true
+		log.Printf("💔 OOB peer %s is down, new sessions go to other peers", addr)
+		b.notifyIfAllDown()
+	}
+}
+
+// notifyIfAllDown tells the operator when no peer is left to take new
+// sessions. The caller holds b.mu.
+func (b *peerBalancer) notifyIfAllDown() {
+	now := time.Now()
+	for _, peer := range b.peers {
+		if now.After(peer.openUntil) && !peer.down {
+			return
+		}
+	}
+	peers := make([]string, 0, len(b.peers))
+	for _, peer := range b.peers {
+		peers = append(peers, peer.Addr)
+	}
+	notifyOperator(eventPeersDown, fmt.Sprintf("All %d OOB peers are down or failing, handshakes can't be relayed", len(b.peers)),
+		map[string]any{"peers": peers})
+}
+
+// peerStatus is the state of a peer as reported by the status endpoint.
+type peerStatus struct {
+	Addr        string  `json:"addr"`
+	Scheme      string  `json:"scheme"`
+	Up          bool    `json:"up"`
+	CircuitOpen bool    `json:"circuit_open"`
+	Failures    int     `json:"failures"`
+	RTT         float64 `json:"rtt_ms"`     // Last heartbeat round trip
+	SRTT        float64 `json:"srtt_ms"`    // Smoothed heartbeat round trip
+	RTTVar      float64 `json:"rttvar_ms"`  // Variation of the heartbeat round trip
+	Latency     float64 `json:"latency_ms"` // Moving average of request latency
+}
+
+// Status returns the current state of every peer.
+func (b *peerBalancer) Status() []peerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	status := make([]peerStatus, 0, len(b.peers))
+	for _, peer := range b.peers {
+		status = append(status, peerStatus{
+			Addr:        peer.Addr,
+			Scheme:      peer.Scheme,
+			Up:          !peer.down,
+			CircuitOpen: now.Before(peer.openUntil),
+			Failures:    peer.failures,
+			RTT:         float64(peer.rtt) / float64(time.Millisecond),
+			SRTT:        float64(peer.srtt) / float64(time.Millisecond),
+			RTTVar:      float64(peer.rttvar) / float64(time.Millisecond),
+			Latency:     float64(peer.latency) / float64(time.Millisecond),
+		})
+	}
+	return status
+}
+
+// Peers returns the addresses of all configured peers.
+func (b *peerBalancer) Peers() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	addrs := make([]string, 0, len(b.peers))
+	for _, peer := range b.peers {
+		addrs = append(addrs, peer.Addr)
+	}
+	return addrs
+}
+
+// Scheme returns the URL scheme used to reach addr.
+func (b *peerBalancer) Scheme(addr string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if peer := b.find(addr); peer != nil {
+		return peer.Scheme
+	}
+	return "http"
+}
+
+// sampleRTT folds a heartbeat round trip into the smoothed RTT and its
+// variation, the way TCP does (RFC 6298).
+func (p *oobPeer) sampleRTT(rtt time.Duration) {
+	p.rtt = rtt
+	if p.srtt == 0 {
+		p.srtt, p.rttvar = rtt, rtt/2
+		return
+	}
+	p.rttvar = (3*p.rttvar + (p.srtt - rtt).Abs()) / 4
+	p.srtt = (7*p.srtt + rtt) / 8
+}
+
+// score ranks peers for the latency strategy. The heartbeat RTT measures
+// the network alone, so it is preferred over request latency, which also
+// includes the server's time talking to targets.
+func (p *oobPeer) score() time.Duration {
+	if p.srtt > 0 {
+		return p.srtt
+	}
+	return p.latency
+}
+
+func (b *peerBalancer) find(addr string) *oobPeer {
+	for _, peer := range b.peers {
+		if peer.Addr == addr {
+			return peer
+		}
+	}
+	return nil
+}
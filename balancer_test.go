@@ -0,0 +1,24 @@
+//go:build !relay
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPeerBalancerPorts(t *testing.T) {
+	var config Config
+	err := json.Unmarshal([]byte(`{"oob_channels": [
+		{"type": "http", "address": "relay.example", "port": 443},
+		{"type": "http", "address": "relay.example", "port": 40443},
+		{"type": "http", "address": "relay.example", "port": 65535}]}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newPeerBalancer(config.OOBChannels, LoadBalancerConfig{})
+	if got := strings.Join(b.Peers(), " "); got != "relay.example:443 relay.example:40443 relay.example:65535" {
+		t.Errorf("peers %s", got)
+	}
+}
@@ -0,0 +1,289 @@
+//go:build !relay
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Handshake benchmarks
+//
+// Concealment costs time: the oob strategy relays the handshake through a
+// peer before connecting, and cover carries the whole session through one.
+// "bench handshake" measures what that costs on the current network, by
+// timing TLS handshakes with each target through every strategy on its own
+// and comparing them with connecting directly. Rounds alternate between the
+// strategies, so a network that slows down during the run affects them all
+// alike.
+
+// defaultBenchStrategies compare no concealment, the SNI concealed, and
+// the whole session concealed.
+const defaultBenchStrategies = "direct,oob,cover"
+
+// benchConcealment is what each strategy hides from the client's network.
+var benchConcealment = map[string]string{
+	"direct":   "none",
+	"fragment": "none",
+	"desync":   "none",
+	"oob":      "sni",
+	"cover":    "full",
+}
+
+// benchResult summarizes the handshakes with one target through one
+// strategy. Times are in milliseconds.
+type benchResult struct {
+	Target      string    `json:"target"`
+	Strategy    string    `json:"strategy"`
+	Concealment string    `json:"concealment"`
+	Attempts    int       `json:"attempts"`
+	Failures    int       `json:"failures"`
+	MinMs       float64   `json:"min_ms,omitempty"`
+	MedianMs    float64   `json:"median_ms,omitempty"`
+	P90Ms       float64   `json:"p90_ms,omitempty"`
+	MeanMs      float64   `json:"mean_ms,omitempty"`
+	OverheadMs  *float64  `json:"overhead_ms,omitempty"` // Median above the direct median, when both are known
+	LastError   string    `json:"last_error,omitempty"`
+	SamplesMs   []float64 `json:"samples_ms,omitempty"`
+}
+
+// benchHandshake times handshakes with each target through each strategy
+// and reports the overhead of concealment.
+func benchHandshake(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("bench handshake", flag.ContinueOnError)
+	path := flags.String("config", "config.json", "configuration file")
+	names := flags.String("strategies", defaultBenchStrategies, "comma-separated strategies to compare")
+	list := flags.String("targets", "", "file listing targets, one host[:port] per line")
+	rounds := flags.Int("n", 5, "handshakes timed per target and strategy")
+	warmup := flags.Int("warmup", 1, "untimed handshakes first, so resolution and OOB connections are set up")
+	timeout := flags.Duration("timeout", 15*time.Second, "time allowed for each handshake")
+	insecure := flags.Bool("insecure", false, "skip certificate verification, for test servers")
+	format := flags.String("format", "table", "output format: table, csv or json")
+	verbose := flags.Bool("v", false, "print the proxy's logs")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "table" && *format != "csv" && *format != "json" {
+		return fmt.Errorf("unknown format %q (use table, csv or json)", *format)
+	}
+	if *rounds < 1 {
+		return errors.New("-n must be at least 1")
+	}
+	targets := flags.Args()
+	if *list != "" {
+		listed, err := readBenchTargets(*list)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, listed...)
+	}
+	if len(targets) == 0 {
+		return errors.New("usage: sultry bench handshake [flags] host[:port]... (or -targets file)")
+	}
+
+	config, err := LoadConfig(*path)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if !*verbose {
+		defer log.SetOutput(log.Writer())
+		log.SetOutput(io.Discard)
+	}
+	if err := setupUpstreamProxies(config.UpstreamProxies); err != nil {
+		return err
+	}
+	setupUserAgent(config.OOBUserAgent)
+	proxy, err := newClientProxy(config)
+	if err != nil {
+		return err
+	}
+	proxy.DryRun = false // Dry runs connect directly whatever the strategy
+	proxy.doh = nil      // Resolvers would otherwise only be reached by concealing strategies
+
+	// Only the strategy being timed may connect, with no fallback to another
+	strategies := splitList(*names)
+	orchestrators := make(map[string]*strategyOrchestrator)
+	for _, name := range strategies {
+		if orchestrators[name], err = newStrategyOrchestrator(proxy, []string{name},
+			newFailureDiary(FailureDiaryConfig{})); err != nil {
+			return err
+		}
+	}
+
+	var results []*benchResult
+	for _, target := range targets {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil {
+			host, port = target, "443"
+		}
+		byStrategy := make(map[string]*benchResult)
+		for _, name := range strategies {
+			r := &benchResult{Target: net.JoinHostPort(host, port), Strategy: name, Concealment: benchConcealment[name]}
+			byStrategy[name] = r
+			results = append(results, r)
+		}
+		for round := 0; round < *warmup+*rounds; round++ {
+			for _, name := range strategies {
+				proxy.strategies = orchestrators[name]
+				elapsed, err := timeHandshake(proxy, name, host, port, *timeout, *insecure)
+				if round < *warmup {
+					continue
+				}
+				r := byStrategy[name]
+				r.Attempts++
+				if err != nil {
+					r.Failures++
+					r.LastError = err.Error()
+					continue
+				}
+				r.SamplesMs = append(r.SamplesMs, float64(elapsed.Microseconds())/1000)
+			}
+		}
+		for _, r := range byStrategy {
+			r.summarize()
+		}
+		if direct := byStrategy["direct"]; direct != nil && direct.MedianMs > 0 {
+			for _, r := range byStrategy {
+				if r != direct && r.MedianMs > 0 {
+					overhead := math.Round((r.MedianMs-direct.MedianMs)*1000) / 1000
+					r.OverheadMs = &overhead
+				}
+			}
+		}
+	}
+
+	switch *format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	case "csv":
+		return writeBenchCSV(out, results)
+	}
+	printBenchTable(out, results)
+	return nil
+}
+
+// readBenchTargets reads a target list, skipping blank lines and comments.
+func readBenchTargets(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var targets []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			targets = append(targets, line)
+		}
+	}
+	return targets, scanner.Err()
+}
+
+// timeHandshake completes one TLS handshake with host over a tunnel
+// established by proxy's strategies, returning how long it took from
+// opening the tunnel.
+func timeHandshake(proxy *TLSProxy, strategy, host, port string, timeout time.Duration,
+	insecure bool) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tunnelCtx := withSessionLogger(context.Background(),
+		newSessionLogger().Redacting(sensitiveSNI, host).With("bench", strategy, "dest", destHash(host)))
+
+	start := time.Now()
+	tlsConn := tls.Client(proxy.pipeTunnel(tunnelCtx, host, port),
+		&tls.Config{ServerName: host, InsecureSkipVerify: insecure, KeyLogWriter: keyLog})
+	defer tlsConn.Close()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		if errors.Is(err, io.EOF) {
+			// The tunnel closes without a word when the strategy can't connect
+			err = errors.New("the strategy failed to connect (-v shows why)")
+		}
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// summarize computes the statistics of the samples.
+func (r *benchResult) summarize() {
+	if len(r.SamplesMs) == 0 {
+		return
+	}
+	sorted := slices.Clone(r.SamplesMs)
+	slices.Sort(sorted)
+	var sum float64
+	for _, ms := range sorted {
+		sum += ms
+	}
+	r.MinMs = sorted[0]
+	r.MedianMs = percentile(sorted, 0.5)
+	r.P90Ms = percentile(sorted, 0.9)
+	r.MeanMs = sum / float64(len(sorted))
+}
+
+// percentile returns the nearest-rank percentile p of sorted samples.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(float64(len(sorted))*p+0.999999) - 1
+	return sorted[max(0, min(rank, len(sorted)-1))]
+}
+
+// printBenchTable prints the results for reading.
+func printBenchTable(out io.Writer, results []*benchResult) {
+	ms := func(v float64) string { return strconv.FormatFloat(v, 'f', 1, 64) + "ms" }
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tSTRATEGY\tCONCEALS\tOK\tMIN\tMEDIAN\tP90\tMEAN\tOVERHEAD")
+	for _, r := range results {
+		ok := fmt.Sprintf("%d/%d", r.Attempts-r.Failures, r.Attempts)
+		if len(r.SamplesMs) == 0 {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t-\t-\t-\t-\t❌ %s\n", r.Target, r.Strategy, r.Concealment, ok, r.LastError)
+			continue
+		}
+		overhead := "-"
+		if r.OverheadMs != nil {
+			overhead = fmt.Sprintf("%+.1fms", *r.OverheadMs)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Target, r.Strategy, r.Concealment, ok,
+			ms(r.MinMs), ms(r.MedianMs), ms(r.P90Ms), ms(r.MeanMs), overhead)
+	}
+	tw.Flush()
+}
+
+// writeBenchCSV writes one row per target and strategy.
+func writeBenchCSV(out io.Writer, results []*benchResult) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"target", "strategy", "concealment", "attempts", "failures", "min_ms", "median_ms", "p90_ms",
+		"mean_ms", "overhead_ms", "last_error"})
+	ms := func(v float64) string {
+		if v == 0 {
+			return ""
+		}
+		return strconv.FormatFloat(v, 'f', 3, 64)
+	}
+	for _, r := range results {
+		overhead := ""
+		if r.OverheadMs != nil {
+			overhead = strconv.FormatFloat(*r.OverheadMs, 'f', 3, 64)
+		}
+		w.Write([]string{r.Target, r.Strategy, r.Concealment, strconv.Itoa(r.Attempts), strconv.Itoa(r.Failures),
+			ms(r.MinMs), ms(r.MedianMs), ms(r.P90Ms), ms(r.MeanMs), overhead, r.LastError})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,167 @@
+//go:build !relay
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBenchResultSummarize(t *testing.T) {
+	tests := []struct {
+		samples                []float64
+		min, median, p90, mean float64
+	}{
+		{nil, 0, 0, 0, 0},
+		{[]float64{12}, 12, 12, 12, 12},
+		{[]float64{30, 10, 20}, 10, 20, 30, 20},
+		{[]float64{4, 1, 3, 2}, 1, 2, 4, 2.5},
+		{[]float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, 1, 5, 9, 5.5},
+	}
+	for _, tt := range tests {
+		r := &benchResult{SamplesMs: tt.samples}
+		r.summarize()
+		if r.MinMs != tt.min || r.MedianMs != tt.median || r.P90Ms != tt.p90 || r.MeanMs != tt.mean {
+			t.Errorf("%v: min %v, median %v, p90 %v, mean %v, want %v, %v, %v, %v", tt.samples,
+				r.MinMs, r.MedianMs, r.P90Ms, r.MeanMs, tt.min, tt.median, tt.p90, tt.mean)
+		}
+	}
+	r := &benchResult{SamplesMs: []float64{3, 1, 2}}
+	r.summarize()
+	if r.SamplesMs[0] != 3 {
+		t.Error("summarize sorted the samples in place")
+	}
+}
+
+func TestBenchReports(t *testing.T) {
+	overhead := 42.5
+	results := []*benchResult{
+		{Target: "example.com:443", Strategy: "direct", Concealment: "none", Attempts: 2, SamplesMs: []float64{10, 20}},
+		{Target: "example.com:443", Strategy: "oob", Concealment: "sni", Attempts: 2, SamplesMs: []float64{50, 60}, OverheadMs: &overhead},
+		{Target: "example.com:443", Strategy: "cover", Concealment: "full", Attempts: 2, Failures: 2, LastError: "refused"},
+	}
+	for _, r := range results {
+		r.summarize()
+	}
+
+	var table strings.Builder
+	printBenchTable(&table, results)
+	for _, want := range []string{"+42.5ms", "2/2", "0/2", "❌ refused"} {
+		if !strings.Contains(table.String(), want) {
+			t.Errorf("table lacks %q\n%s", want, table.String())
+		}
+	}
+
+	var csv strings.Builder
+	if err := writeBenchCSV(&csv, results); err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	want := []string{
+		"example.com:443,direct,none,2,0,10.000,10.000,20.000,15.000,,",
+		"example.com:443,oob,sni,2,0,50.000,50.000,60.000,55.000,42.500,",
+		"example.com:443,cover,full,2,2,,,,,,refused",
+	}
+	if len(rows) != 4 || strings.Join(rows[1:], "\n") != strings.Join(want, "\n") {
+		t.Errorf("csv:\n%s", csv.String())
+	}
+}
+
+func TestReadBenchTargets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets")
+	os.WriteFile(path, []byte("# Blocked here\nexample.com\n\n  example.org:8443  \n"), 0o600)
+	targets, err := readBenchTargets(path)
+	if err != nil || strings.Join(targets, "|") != "example.com|example.org:8443" {
+		t.Errorf("readBenchTargets = %q, %v", targets, err)
+	}
+	if _, err := readBenchTargets(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing target list read")
+	}
+}
+
+// benchSetup starts a target and a relay resolving names for the oob
+// strategy, and writes a configuration using the relay. It returns the
+// target's address and the configuration's path.
+func benchSetup(t testing.TB) (string, string) {
+	target := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(target.Close)
+	api := http.NewServeMux()
+	api.HandleFunc("/create_connection", handleCreateConnection)
+	relay := httptest.NewServer(api)
+	t.Cleanup(relay.Close)
+
+	addr := relay.Listener.Addr().(*net.TCPAddr)
+	config := fmt.Sprintf(`{"oob_channels": [{"type": "http", "address": "127.0.0.1", "port": %d}]}`, addr.Port)
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return target.Listener.Addr().String(), path
+}
+
+// benchResults runs "bench handshake" with args and decodes its report.
+func benchResults(t testing.TB, args ...string) []*benchResult {
+	var out bytes.Buffer
+	if err := benchHandshake(append([]string{"-format", "json", "-insecure"}, args...), &out); err != nil {
+		t.Fatal(err)
+	}
+	var results []*benchResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("%v in %s", err, out.String())
+	}
+	return results
+}
+
+func TestBenchHandshake(t *testing.T) {
+	target, config := benchSetup(t)
+	results := benchResults(t, "-config", config, "-strategies", "direct,oob", "-n", "3", target)
+	if len(results) != 2 {
+		t.Fatalf("%d results, want 2", len(results))
+	}
+	for _, r := range results {
+		if r.Target != target || r.Attempts != 3 || r.Failures != 0 || len(r.SamplesMs) != 3 || r.MedianMs <= 0 {
+			t.Errorf("%s: %+v", r.Strategy, r)
+		}
+	}
+	if direct, oob := results[0], results[1]; direct.OverheadMs != nil || oob.OverheadMs == nil ||
+		*oob.OverheadMs != math.Round((oob.MedianMs-direct.MedianMs)*1000)/1000 {
+		t.Errorf("overheads %v and %v", direct.OverheadMs, oob.OverheadMs)
+	}
+
+	var out strings.Builder
+	for _, args := range [][]string{{"-format", "xml", target}, {"-n", "0", target}, {"-config", config}} {
+		if err := benchHandshake(args, &out); err == nil {
+			t.Errorf("bench handshake %q succeeded", args)
+		}
+	}
+}
+
+// BenchmarkHandshakeOverhead reports the median handshake through the oob
+// strategy, with its relay on the same host, and its overhead over
+// connecting directly.
+func BenchmarkHandshakeOverhead(b *testing.B) {
+	target, config := benchSetup(b)
+	b.ResetTimer()
+	results := benchResults(b, "-config", config, "-strategies", "direct,oob", "-warmup", "0",
+		"-n", strconv.Itoa(b.N), target)
+	b.StopTimer()
+	for _, r := range results {
+		if r.Failures > 0 {
+			b.Fatalf("%s: %s", r.Strategy, r.LastError)
+		}
+		b.ReportMetric(r.MedianMs, r.Strategy+"-ms")
+		if r.OverheadMs != nil {
+			b.ReportMetric(*r.OverheadMs, "overhead-ms")
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// protocolVersion is the version of the OOB protocol spoken by this build.
+// It's raised when a change needs more than a new capability flag.
+const protocolVersion = 2
+
+// Capabilities a component may support. Clients only use a feature with a
+// peer that lists it, and peers that predate the exchange are assumed to
+// support everything, with the fallbacks that worked before it.
+const (
+	capBinaryFraming    = "binary_framing"    // Binary frames for handshake and app data messages
+	capEvents           = "events"            // Handshake responses streamed over /events
+	capMux              = "mux"               // Multiplexed sessions over /mux
+	capAdoption         = "adopt_connection"  // Hijacked target connections handed to the client
+	capCover            = "cover"             // Cover relays over /cover_open and /cover_attach
+	capStructuredErrors = "structured_errors" // JSON error bodies with a code
+	capSessionSync      = "session_sync"      // Sessions reconciled over /sessions after a dropped connection
+)
+
+// supportedCapabilities are the capabilities of this build.
+var supportedCapabilities = []string{capBinaryFraming, capEvents, capMux, capAdoption, capCover, capStructuredErrors,
+	capSessionSync}
+
+// capabilitySet is what each side of an OOB connection tells the other on
+// first contact.
+type capabilitySet struct {
+	Protocol     int      `json:"protocol"`
+	Version      string   `json:"version"` // Build of the component, for logs
+	Capabilities []string `json:"capabilities"`
+	Auth         []string `json:"auth,omitempty"` // Authentication schemes in use, e.g. "bearer"
+}
+
+// localCapabilities returns the capability set of this build; auth lists
+// the authentication schemes it uses.
+func localCapabilities(auth []string) capabilitySet {
+	return capabilitySet{Protocol: protocolVersion, Version: buildVersion(), Capabilities: supportedCapabilities, Auth: auth}
+}
+
+// serverCapabilities is what the server answers capability requests with,
+// set from the configuration when it starts.
+var serverCapabilities = localCapabilities(nil)
+
+// handleCapabilities answers a client's capability set with the server's.
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	var client capabilitySet
+	if err := json.NewDecoder(r.Body).Decode(&client); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	log.Printf("🤝 Client %s speaks OOB protocol %d (%s): %s", redacted(sensitiveClientIP, r.RemoteAddr), client.Protocol, client.Version,
+		strings.Join(client.Capabilities, ", "))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serverCapabilities)
+}
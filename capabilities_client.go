@@ -0,0 +1,58 @@
+//go:build !relay
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// negotiate exchanges capability sets with peer and remembers the peer's.
+// Peers that don't know the exchange are recorded as unknown, so every
+// feature is tried with them as before.
+func (o *OOBModule) negotiate(peer string) {
+	auth := []string(nil)
+	if o.authToken != "" {
+		auth = []string{"bearer"}
+	}
+	body, _ := json.Marshal(localCapabilities(auth))
+	resp, err := o.Client(o.Timeout(peer, 5*time.Second)).Post(o.URL(peer, "/capabilities"), "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		log.Printf("⚠️ Failed to exchange capabilities with OOB peer %s: %v", peer, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var caps capabilitySet
+	if resp.StatusCode == http.StatusUnauthorized {
+		log.Printf("⚠️ OOB peer %s rejected the capability exchange: it requires a bearer token (auth.token)", peer)
+		return
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&caps) != nil || caps.Protocol == 0 {
+		// Servers predating the exchange answer 404, or with a decoy page
+		log.Printf("🤝 OOB peer %s predates capability exchange, assuming it supports everything", peer)
+		o.mu.Lock()
+		delete(o.peerCaps, peer)
+		o.mu.Unlock()
+		return
+	}
+	log.Printf("🤝 OOB peer %s speaks OOB protocol %d (%s): %s", peer, caps.Protocol, caps.Version,
+		strings.Join(caps.Capabilities, ", "))
+	o.mu.Lock()
+	o.peerCaps[peer] = &caps
+	o.mu.Unlock()
+}
+
+// Supports reports whether peer supports capability, as far as is known.
+func (o *OOBModule) Supports(peer, capability string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	caps, ok := o.peerCaps[peer]
+	return !ok || slices.Contains(caps.Capabilities, capability)
+}
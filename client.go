@@ -1,8 +1,11 @@
+//go:build !relay
+
 package main
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,21 +13,30 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	sultrytls "sultry/pkg/tls"
 )
 
 // TargetInfo holds information about the target server
 type TargetInfo struct {
-	TargetHost    string `json:"target_host"`
-	TargetIP      string `json:"target_ip"`
-	TargetPort    int    `json:"target_port"`
-	SNI           string `json:"sni"`
-	SessionTicket []byte `json:"session_ticket"`
-	MasterSecret  []byte `json:"master_secret"`
-	Version       int    `json:"tls_version"`
+	TargetHost     string `json:"target_host"`
+	TargetIP       string `json:"target_ip"`
+	TargetPort     int    `json:"target_port"`
+	SNI            string `json:"sni"`
+	SessionTicket  []byte `json:"session_ticket"`
+	TicketLifetime int    `json:"ticket_lifetime,omitempty"` // Seconds the session ticket stays valid
+	MasterSecret   []byte `json:"master_secret"`
+	Version        int    `json:"tls_version"`
+	ALPN           string `json:"alpn,omitempty"`       // Negotiated application protocol, when the ServerHello shows it
+	SessionID      []byte `json:"session_id,omitempty"` // TLS 1.2 session ID from the ServerHello
 }
 
 // DirectConnectCommand is the command sent to clients
@@ -48,20 +60,52 @@ type DirectConnectCommand struct {
 // SNI information from network monitors or firewalls, as the ClientHello containing
 // the SNI is sent via HTTP to the OOB server rather than directly to the target.
 type TLSProxy struct {
-	OOB              *OOBModule // Out-of-Band communication module for handshake relay
-	FakeSNI          string     // Optional SNI value to use instead of the actual target
-	PrioritizeSNI    bool       // Whether to prioritize SNI concealment over direct tunneling
-	HandshakeTimeout int        // Timeout in milliseconds for handshake operations
+	OOB              *OOBModule           // Out-of-Band communication module for handshake relay
+	FakeSNI          string               // Optional SNI value to use instead of the actual target
+	PrioritizeSNI    bool                 // Whether to prioritize SNI concealment over direct tunneling
+	HandshakeTimeout int                  // Timeout in milliseconds for handshake operations
+	Fragment         FragmentConfig       // ClientHello splitting for DPI evasion on direct connections
+	Desync           DesyncConfig         // Low-TTL fake segment injection on direct connections
+	Shaping          ShapingConfig        // Randomized segment sizes and padding for the first flight
+	HandshakeEvents  bool                 // Receive handshake responses over the /events stream instead of polling
+	ProxyProtocol    []ProxyProtocolRoute // Targets that get a PROXY protocol header
+	TunnelLifetimes  []TunnelLifetime     // Destinations whose tunnels are rotated after a while
+	TunnelClasses    TunnelClassesConfig  // WebSocket detection and idle timeouts by tunnel class
+	DryRun           bool                 // Connect every tunnel directly, only logging the strategy that would have been used
+	MITM             MITMConfig           // Hosts whose TLS is terminated locally, for inspection
+	DoH              DoHConfig            // DNS-over-HTTPS resolvers, which are always concealed
+	PAC              PACConfig            // Hosts the served proxy.pac sends through the proxy
+	Race             RaceConfig           // Racing handshakes over several addresses of the target
+	HTTPFetch        HTTPFetchConfig      // Size and time limits of plain HTTP requests forwarded by the proxy
+	Rules            []RoutingRule        // How tunnels to matching hosts connect, in place of the strategies
+	CoverRules       []CoverRule          // Cover SNIs of tunnels to matching hosts, in place of FakeSNI
+	KillSwitch       bool                 // Refuse tunnels concealment fails for instead of exposing their SNI
+
+	strategies    *strategyOrchestrator        // Connection strategies tried in order for each tunnel
+	tickets       *ticketCache                 // Session tickets captured by relays, per host
+	coalescing    *coalescingTracker           // Live tunnels browsers may coalesce h2 requests onto, if enabled
+	sessionIDs    *sessionIDCache              // Addresses that issued TLS 1.2 session IDs
+	addresses     *addressCache                // Addresses relays resolved hosts to, for when none can
+	mitm          *mitmProxy                   // Terminates TLS for intercepted hosts, if configured
+	doh           *dohResolvers                // Recognizes tunnels to DoH resolvers, unless routed like other hosts
+	rules         atomic.Pointer[routingTable] // Compiled Rules, swapped when they are reloaded
+	covers        *hostMatcher                 // Hosts of CoverRules, numbered by rule
+	httpClient    *http.Client                 // Forwards plain HTTP requests, reusing connections to targets
+	httpsFallback *http.Client                 // Fetches plain HTTP requests over HTTPS for targets that only serve it, if enabled
 }
 
 // Start runs the TLS proxy.
-func (p *TLSProxy) Start(localAddr string) {
-	listener, err := net.Listen("tcp", localAddr)
+func (p *TLSProxy) Start(cfg ListenerConfig) {
+	listener, err := cfg.listen()
 	if err != nil {
 		log.Fatalf("❌ Failed to start TLS Proxy: %v", err)
 	}
 	defer listener.Close()
-	fmt.Println("🔹 TLS Proxy listening on", localAddr)
+	fmt.Println("🔹 TLS Proxy listening on", cfg.Listen)
+	auth := ProxyAuthConfig{Users: cfg.Users, Realm: cfg.Realm}
+	if len(auth.Users) > 0 {
+		log.Printf("🔒 HTTP proxy on %s requires authentication (%d user(s))", cfg.Listen, len(auth.Users))
+	}
 
 	for {
 		conn, err := listener.Accept()
@@ -69,17 +113,25 @@ func (p *TLSProxy) Start(localAddr string) {
 			log.Println("❌ Connection error:", err)
 			continue
 		}
-		go p.handleConnection(conn)
+		go p.handleConnection(conn, auth)
 	}
 }
 
 func client(config *Config) {
-	oobModule := NewOOBModule(config.OOBChannels)
-	proxy := TLSProxy{
-		OOB:              oobModule, 
-		FakeSNI:          config.CoverSNI,
-		PrioritizeSNI:    config.PrioritizeSNI,
-		HandshakeTimeout: config.HandshakeTimeout,
+	proxy, err := newClientProxy(config)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	strategies := proxy.strategies
+	handleStatus("/strategies", func() any { return strategies.Stats() })
+	handleStatus("/tickets", func() any { return proxy.tickets.Status() })
+	handleStatus("/tunnels", func() any { return tunnelClasses.Snapshot() })
+	relayedAlerts.handleStatus()
+	startCoverChecks(config)
+	log.Printf("🔹 Connection strategies: %s", strings.Join(strategies.Names(), " → "))
+	if proxy.DryRun {
+		handleStatus("/dry_run", func() any { return strategies.dryRun.Stats() })
+		log.Println("🔍 Dry run - every tunnel connects directly, strategies are only logged")
 	}
 	
 	if proxy.PrioritizeSNI {
@@ -87,12 +139,83 @@ func client(config *Config) {
 	} else {
 		log.Println("🔹 Standard mode - direct tunnel will be used with OOB as fallback")
 	}
+	if len(proxy.Rules) > 0 {
+		log.Printf("🧭 %d routing rule(s) override the strategies for matching hosts", len(proxy.Rules))
+	}
+	if strategies.killSwitch {
+		log.Println("🛑 Kill switch on - tunnels are refused when concealing their SNI fails, never connected in the clear")
+	}
+	go proxy.watchRules(configPath, config.RulesWatch)
+	if config.Tun.Device != "" {
+		go proxy.StartTun(config.Tun)
+	}
 	
+	proxy.serveListeners(config.clientListeners())
+}
+
+// newClientProxy builds the client proxy described by config, without
+// starting to listen.
+func newClientProxy(config *Config) (*TLSProxy, error) {
+	proxy := &TLSProxy{
+		OOB:              NewOOBModule(config),
+		FakeSNI:          config.CoverSNI,
+		PrioritizeSNI:    config.PrioritizeSNI,
+		HandshakeTimeout: config.HandshakeTimeout,
+		Fragment:         config.Fragment,
+		Desync:           config.Desync,
+		Shaping:          config.Shaping,
+		HandshakeEvents:  config.HandshakeEvents,
+		ProxyProtocol:    config.ProxyProtocol,
+		TunnelLifetimes:  config.TunnelLifetimes,
+		TunnelClasses:    config.TunnelClasses,
+		DryRun:           config.DryRun,
+		MITM:             config.MITM,
+		DoH:              config.DoH,
+		PAC:              config.PAC,
+		Race:             config.Race,
+		HTTPFetch:        config.HTTPFetch,
+		Rules:            config.Rules,
+		CoverRules:       config.CoverRules,
+		KillSwitch:       config.KillSwitch,
+	}
 	if proxy.HandshakeTimeout == 0 {
 		proxy.HandshakeTimeout = 5000 // Default to 5 seconds if not specified
 	}
-	
-	proxy.Start(config.LocalProxyAddr)
+
+	if err := proxy.HTTPFetch.validate(); err != nil {
+		return nil, err
+	}
+	var err error
+	rules, err := compileRules(proxy.Rules, config.OOBChannels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routing rules: %w", err)
+	}
+	proxy.rules.Store(rules)
+	if proxy.covers, err = compileCoverRules(proxy.CoverRules); err != nil {
+		return nil, fmt.Errorf("invalid cover rules: %w", err)
+	}
+
+	strategies, err := newStrategyOrchestrator(proxy, config.Strategies, newFailureDiary(config.FailureDiary))
+	if err != nil {
+		return nil, fmt.Errorf("invalid strategies: %w", err)
+	}
+	strategies.budget = newErrorBudget(config.ErrorBudget)
+	proxy.strategies = strategies
+	proxy.tickets = newTicketCache(config.TicketCache)
+	proxy.httpClient = newDirectHttpClient(proxy.HTTPFetch)
+	if config.HTTPSFallback {
+		proxy.httpsFallback = newHTTPSFallbackClient(proxy)
+	}
+	proxy.coalescing = newCoalescingTracker(config.H2Coalescing)
+	proxy.sessionIDs = newSessionIDCache()
+	proxy.addresses = newAddressCache(config.AddressCache)
+	if proxy.doh, err = newDoHResolvers(proxy.DoH); err != nil {
+		return nil, err
+	}
+	if proxy.mitm, err = newMITMProxy(proxy.MITM, proxy); err != nil {
+		return nil, fmt.Errorf("invalid mitm configuration: %w", err)
+	}
+	return proxy, nil
 }
 
 // handleConnection analyzes incoming connections and routes them to the appropriate handler.
@@ -103,21 +226,23 @@ func client(config *Config) {
 //
 // The connection strategy is determined by analyzing the initial data from the client,
 // which allows us to properly handle both HTTP and HTTPS traffic transparently.
-func (p *TLSProxy) handleConnection(clientConn net.Conn) {
+func (p *TLSProxy) handleConnection(clientConn net.Conn, auth ProxyAuthConfig) {
 	defer clientConn.Close()
+	ctx := withSessionLogger(context.Background(),
+		newSessionLogger().Redacting(sensitiveClientIP, clientConn.RemoteAddr().String()))
+	logger := sessionLog(ctx)
 
 	// Read the first 1024 bytes to analyze the request type
 	// We need enough bytes to identify request type and extract important information
 	buffer := make([]byte, 1024)
 	n, err := clientConn.Read(buffer)
 	if err != nil {
-		log.Println("❌ ERROR: Failed to read initial bytes:", err)
+		logger.Printf("❌ ERROR: Failed to read initial bytes: %v", err)
 		return
 	}
 
 	// Debug logging
-	log.Printf("DEBUG: Read %d bytes", n)
-	log.Printf("DEBUG: First 16 bytes as hex: % x", buffer[:min(n, 16)])
+	logger.Printf("DEBUG: Read %d bytes", n)
 
 	// Create a buffered reader with the already read data
 	// Use a larger buffer size to ensure we don't fragment TLS records
@@ -137,212 +262,356 @@ func (p *TLSProxy) handleConnection(clientConn net.Conn) {
 		strings.HasPrefix(dataStr, "PUT ") ||
 		strings.HasPrefix(dataStr, "DELETE ")
 
+	// Browsers fetch the PAC file like from a web server, without credentials
+	if fields := strings.Fields(dataStr); len(fields) > 1 && fields[0] == "GET" &&
+		strings.Split(fields[1], "?")[0] == pacPath {
+		p.servePAC(logger, clientConn, buffer[:n])
+		return
+	}
+
+	// Clients on the LAN must log in, if users are configured; their
+	// credentials are checked once the request head is parsed
+	if len(auth.Users) > 0 && !isConnect && !isDirectHttp {
+		logger.Printf("❌ Refusing unknown protocol from %s: proxy authentication is required", clientConn.RemoteAddr())
+		return
+	}
+
 	// Handle based on the request type and configuration
 	if isConnect {
-		log.Println("🔹 Detected HTTP CONNECT request (HTTPS tunneling)")
-
-		// Extract the target host from the CONNECT request
-		parts := strings.Split(dataStr, " ")
-		if len(parts) >= 2 {
-			hostPort := strings.TrimSpace(parts[1])
-			
-			// Always use direct tunnel method for HTTPS
-			// SNI concealment will happen internally if configured
-			log.Printf("🔹 Using direct tunnel for: %s", hostPort)
-			if p.PrioritizeSNI {
-				log.Printf("🔒 SNI concealment will be applied via tunnel")
+		logger.Printf("🔹 Detected HTTP CONNECT request (HTTPS tunneling)")
+
+		// Parse the whole request head, however many reads it arrived in,
+		// so neither the credentials nor the tunnel's first bytes are cut off
+		in, err := http.ReadRequest(bufReader)
+		if err != nil || in.RequestURI == "" {
+			logger.Printf("❌ Malformed CONNECT request without a target")
+			clientConn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			return
+		}
+		if len(auth.Users) > 0 {
+			user, ok := authorizeProxyRequest(logger, clientConn, auth, in.Header)
+			if !ok {
+				return
 			}
-			p.handleTunnelConnect(clientConn, hostPort)
-		} else {
-			// Fall back to normal proxy connection if we can't parse the host
-			p.handleTunnelConnect(clientConn, "unknown:443")
+			ctx = withSessionLogger(ctx, logger.With("user", user))
+			logger = sessionLog(ctx)
+			logger.Printf("🔑 Proxy user %s authenticated", user)
+		}
+
+		hostPort := in.RequestURI
+		host, _, err := net.SplitHostPort(hostPort)
+		if err == nil {
+			ctx = withSessionLogger(ctx, logger.Redacting(sensitiveSNI, host))
+			logger = sessionLog(ctx)
+		}
+
+		// Always use direct tunnel method for HTTPS; how the tunnel
+		// connects is up to the rule matching the host, or else the
+		// strategies
+		logger.Printf("🔹 Using direct tunnel for: %s", hostPort)
+		if rule := p.route(host); rule != nil {
+			logger.Printf("🧭 Routing rule for %s: %s", host, rule.Action)
 		}
+		p.handleTunnelConnect(ctx, &bufferedConn{Conn: clientConn, reader: bufReader}, hostPort)
 	} else if isDirectHttp {
-		log.Println("🔹 Detected direct HTTP request (not TLS)")
+		logger.Printf("🔹 Detected direct HTTP request (not TLS)")
 		// Handle regular HTTP request directly
-		p.handleDirectHttpRequest(clientConn, bufReader, dataStr)
+		p.handleDirectHttpRequest(ctx, clientConn, bufReader, auth)
 	} else {
-		log.Println("🔹 Detected unknown protocol or direct TLS")
-		
-		// Unknown protocol - use direct tunnel
-		log.Printf("🔹 Using direct tunnel for unknown protocol")
-		p.handleTunnelConnect(clientConn, "unknown:443")
+		// Without a CONNECT there is no destination to tunnel to
+		logger.Printf("❌ Refusing unknown protocol or direct TLS from %s", clientConn.RemoteAddr())
 	}
 }
 
 // handleDirectHttpRequest handles regular HTTP requests (not HTTPS).
 //
 // This function implements a standard HTTP proxy for plain HTTP traffic:
-// 1. Parses the original HTTP request from the client
-// 2. Creates a new request to the target server
+// 1. Parses each HTTP request the client sends on the connection
+// 2. Creates a new request to the target server, streaming the client's body
 // 3. Forwards the request and retrieves the response
-// 4. Returns the response to the client
+// 4. Streams the response back to the client
 //
 // Unlike the HTTPS handling strategies, this method doesn't require tunneling
 // or special handshake procedures, making it simpler and more reliable for
 // plain HTTP traffic. It properly handles headers, status codes, and content.
-func (p *TLSProxy) handleDirectHttpRequest(clientConn net.Conn, reader *bufio.Reader, requestLine string) {
+// Bodies are never held in memory whole: request bodies, sized by
+// Content-Length or chunked, are read from the client as the target takes
+// them, and responses are relayed as they arrive, so long-polling and large
+// downloads work as they would without the proxy.
+//
+// Connections are kept alive: requests the client sends one after the
+// other, or pipelined without waiting for the responses, are answered in
+// order, and connections to targets are reused across clients. With users
+// configured, every request must carry credentials, not only the first.
+func (p *TLSProxy) handleDirectHttpRequest(ctx context.Context, clientConn net.Conn, reader *bufio.Reader,
+	auth ProxyAuthConfig) {
 	defer clientConn.Close()
+	connCtx, logger := ctx, sessionLog(ctx)
+	var user string
+
+	for served := 0; ; served++ {
+		if served > 0 {
+			// Wait for the client's next request, unless it has gone quiet
+			clientConn.SetReadDeadline(time.Now().Add(httpKeepAliveTimeout()))
+			_, err := reader.Peek(1)
+			clientConn.SetReadDeadline(time.Time{})
+			if err != nil {
+				logger.Printf("🔹 Client connection closed after %d HTTP request(s)", served)
+				return
+			}
+		}
 
-	// Extract URL from request line
-	parts := strings.Split(requestLine, " ")
-	if len(parts) < 2 {
-		log.Println("❌ ERROR: Malformed HTTP request")
-		clientConn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
-		return
-	}
-
-	// Get the URL
-	urlStr := parts[1]
-	log.Printf("🔹 Handling direct HTTP request for: %s", urlStr)
-
-	// Read the entire request into a buffer to parse it
-	requestBuf := new(bytes.Buffer)
-	requestBuf.WriteString(requestLine)
-
-	// Read headers until we find empty line
-	for {
-		line, err := reader.ReadString('\n')
+		// Parse the request line and headers; the body is left to be streamed
+		in, err := http.ReadRequest(reader)
 		if err != nil {
-			log.Printf("❌ ERROR reading HTTP headers: %v", err)
+			logger.Printf("❌ ERROR: Malformed HTTP request: %v", err)
+			clientConn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
 			return
 		}
-
-		requestBuf.WriteString(line)
-		if line == "\r\n" {
-			break
+		if len(auth.Users) > 0 {
+			authenticated, ok := authorizeProxyRequest(logger, clientConn, auth, in.Header)
+			if !ok {
+				return
+			}
+			if authenticated != user {
+				user = authenticated
+				ctx = withSessionLogger(connCtx, sessionLog(connCtx).With("user", user))
+				logger = sessionLog(ctx)
+				logger.Printf("🔑 Proxy user %s authenticated", user)
+			}
+		}
+		if in.Method == http.MethodConnect {
+			// A kept-alive connection may go on as a tunnel
+			logger.Printf("🔹 Client switched to a CONNECT tunnel after %d HTTP request(s)", served)
+			if host, _, err := net.SplitHostPort(in.RequestURI); err == nil {
+				ctx = withSessionLogger(ctx, logger.Redacting(sensitiveSNI, host))
+			}
+			p.handleTunnelConnect(ctx, &bufferedConn{Conn: clientConn, reader: reader}, in.RequestURI)
+			return
+		}
+		if !p.forwardHttpRequest(ctx, clientConn, reader, in) {
+			return
 		}
 	}
+}
 
-	// Parse the URL for validation and potential modification
-	var fullURL string
-
-	// If URL doesn't start with http:// or https://, assume http://
-	if !strings.HasPrefix(urlStr, "http://") && !strings.HasPrefix(urlStr, "https://") {
-		log.Printf("🔹 URL doesn't have scheme, adding http://")
-		fullURL = "http://" + urlStr
-	} else {
-		fullURL = urlStr
-	}
-
-	parsedURL, err := url.Parse(fullURL)
-	if err != nil {
-		log.Printf("❌ ERROR parsing URL: %v", err)
-		clientConn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"))
-		return
-	}
-
-	log.Printf("🔹 Parsed URL: %s", parsedURL.String())
-
-	// Update the URL to use for the request
-	urlStr = parsedURL.String()
-
-	// Use a custom client with no redirects
-	client := &http.Client{
+// newDirectHttpClient returns the client plain HTTP requests are forwarded
+// with. It follows no redirects, relays responses as the target encoded
+// them, and keeps connections to targets open for the next request.
+func newDirectHttpClient(cfg HTTPFetchConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: millis(cfg.ConnectTimeout, 10000)}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 func(r *http.Request) (*url.URL, error) { return upstream.Proxy(r) },
+			DialContext:           dialer.DialContext,
+			DisableCompression:    true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: cfg.readTimeout(),
+		},
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 	}
+}
 
-	// Create a new request
-	req, err := http.NewRequest(parts[0], urlStr, nil)
-	if err != nil {
-		log.Printf("❌ ERROR creating HTTP request: %v", err)
-		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
-		return
-
+// httpKeepAliveTimeout is how long a kept-alive client connection may wait
+// for its next request: idle_timeout if configured, otherwise a minute.
+func httpKeepAliveTimeout() time.Duration {
+	if timeouts.idle > 0 {
+		return timeouts.idle
 	}
+	return time.Minute
+}
 
-	// Parse and copy the original headers
-	headerStr := requestBuf.String()
-	headerLines := strings.Split(headerStr, "\r\n")
+// forwardHttpRequest forwards one request read from the client and streams
+// the response back, reporting whether the connection can carry the next
+// request.
+func (p *TLSProxy) forwardHttpRequest(ctx context.Context, clientConn net.Conn, reader *bufio.Reader,
+	in *http.Request) bool {
+	logger := sessionLog(ctx)
+	defer in.Body.Close()
 
-	// Skip the first line (request line) and add all headers
-	for _, line := range headerLines[1:] {
-		if line == "" {
-			continue
-		}
+	// Get the URL
+	urlStr := in.RequestURI
+	logger = logger.Redacting(sensitiveURL, urlStr)
+	logger.Printf("🔹 Handling direct HTTP request for: %s", urlStr)
 
-		colonIdx := strings.Index(line, ":")
+	// Requests in origin form name the host only in the Host header
+	parsedURL := in.URL
+	if parsedURL.Host == "" {
+		logger.Printf("🔹 URL doesn't have scheme, adding http://")
+		parsedURL.Scheme, parsedURL.Host = "http", in.Host
+	}
+	if parsedURL.Host == "" {
+		logger.Printf("❌ ERROR: No host in HTTP request for %s", urlStr)
+		clientConn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+		return false
+	}
 
-		// Extract and set host header if needed
-		host := parsedURL.Host
-		if host != "" {
-			req.Host = host
-			log.Printf("🔹 Setting Host header to: %s", host)
-		}
+	logger = logger.Redacting(sensitiveURL, parsedURL.String()).Redacting(sensitiveSNI, parsedURL.Hostname())
+	logger.Printf("🔹 Parsed URL: %s", parsedURL.String())
+	if p.blocks(parsedURL.Hostname()) {
+		logger.Printf("🚫 Refusing request to %s, which a rule blocks", parsedURL.Hostname())
+		clientConn.Write([]byte("HTTP/1.1 403 Forbidden\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+		return false
+	}
 
-		if colonIdx == -1 {
-			continue
-		}
+	// Update the URL to use for the request
+	urlStr = parsedURL.String()
+
+	// WebSocket handshakes turn the connection into a relay of frames
+	if isWebSocketUpgrade(in) {
+		p.relayWebSocket(ctx, clientConn, reader, in, parsedURL)
+		return false
+	}
 
-		key := strings.TrimSpace(line[:colonIdx])
-		value := strings.TrimSpace(line[colonIdx+1:])
+	// The request and its response are bounded by http_fetch
+	ctx, cancel := p.HTTPFetch.context(ctx)
+	defer cancel()
 
-		// Skip proxy-specific headers
-		if strings.ToLower(key) == "proxy-connection" {
+	// Create a new request, with the client's body read as it is sent on
+	req, err := http.NewRequestWithContext(ctx, in.Method, urlStr, in.Body)
+	if err != nil {
+		logger.Printf("❌ ERROR creating HTTP request: %v", err)
+		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+		return false
+	}
+	req.ContentLength = in.ContentLength // -1 sends the body chunked, as the client did
+	req.Host = parsedURL.Host
+	logger.Printf("🔹 Setting Host header to: %s", req.Host)
+
+	// Copy the original headers, but not proxy-specific ones
+	for key, values := range in.Header {
+		switch http.CanonicalHeaderKey(key) {
+		case "Proxy-Connection", "Proxy-Authorization", "Expect", "Connection", "Keep-Alive":
 			continue
 		}
+		req.Header[key] = values
+	}
 
-		req.Header.Add(key, value)
+	// Clients waiting to be told to send their body are told right away
+	if in.ProtoAtLeast(1, 1) && strings.EqualFold(in.Header.Get("Expect"), "100-continue") && in.ContentLength != 0 {
+		clientConn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
 	}
 
 	// Execute the request
-	log.Printf("🔹 Forwarding HTTP request to: %s", urlStr)
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("❌ ERROR executing HTTP request: %v", err)
-		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
-		return
+	logger.Printf("🔹 Forwarding HTTP request to: %s", urlStr)
+	resp, err := p.httpClient.Do(req)
+	if secure := p.httpsFallbackURL(in, parsedURL, resp, err); secure != nil {
+		// Targets that only serve HTTPS are asked again over a tunnel
+		logger := logger.Redacting(sensitiveURL, secure.String())
+		logger.Printf("🔐 %s only serves HTTPS, fetching %s through a tunnel", parsedURL.Host, secure)
+		fallback, fallbackErr := p.fetchOverHTTPS(ctx, in, req.Header, secure)
+		if fallbackErr != nil {
+			logger.Printf("⚠️ HTTPS fallback for %s failed: %v", parsedURL.Host, fallbackErr)
+		} else {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			resp, err = fallback, nil
+		}
 	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("❌ ERROR reading response body: %v", err)
-		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
-		return
+		logger.Printf("❌ ERROR executing HTTP request: %v", err)
+		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+		return false
+	}
+	if limit := p.HTTPFetch.MaxResponse; limit > 0 && resp.ContentLength > limit {
+		resp.Body.Close()
+		logger.Printf("❌ ERROR: Response of %d bytes exceeds http_fetch.max_response (%d)", resp.ContentLength, limit)
+		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+		return false
 	}
+	resp.Body = p.HTTPFetch.limitBody(resp.Body, cancel)
+	defer resp.Body.Close()
 
 	// Log response info
-	log.Printf("✅ Received HTTP response: %s, %d bytes", resp.Status, len(body))
+	logger.Printf("✅ Received HTTP response: %s, %d bytes", resp.Status, resp.ContentLength)
 
-	// Create response buffer
-	var responseBuffer bytes.Buffer
+	// Stream the response to the client
+	var sent atomic.Int64
+	keepAlive, err := writeProxiedResponse(countingConn{clientConn, &sent}, resp, in, !in.Close)
+	if err != nil {
+		logger.Printf("❌ ERROR writing response to client after %d bytes: %v", sent.Load(), err)
+		return false
+	}
+	logger.Printf("✅ Successfully forwarded HTTP response to client: %d bytes", sent.Load())
 
-	// Status line
-	responseBuffer.WriteString(fmt.Sprintf("HTTP/%d.%d %d %s\r\n",
-		resp.ProtoMajor, resp.ProtoMinor, resp.StatusCode, resp.Status[4:]))
+	// The next request starts after whatever of this one's body the target
+	// didn't read
+	return keepAlive && in.Body.Close() == nil
+}
 
-	// Headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			responseBuffer.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
+// hopByHopHeaders describe a single connection rather than the message, so
+// they aren't relayed from the target to the client.
+var hopByHopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// writeProxiedResponse writes resp to the client that sent in, sending the
+// headers right away and then the body as it is read from the target. A
+// body of unknown length is sent chunked, with the target's trailers, to
+// HTTP/1.1 clients, while HTTP/1.0 clients, which don't know chunks, read it
+// until the connection closes. It reports whether the connection is kept
+// alive for another request, as asked by keepAlive if the body's end can be
+// marked without closing it.
+func writeProxiedResponse(w io.Writer, resp *http.Response, in *http.Request, keepAlive bool) (bool, error) {
+	header := resp.Header.Clone()
+	for _, name := range strings.Split(header.Get("Connection"), ",") {
+		// Connection names more hop-by-hop headers of the target's
+		header.Del(strings.TrimSpace(name))
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+
+	bodyless := in.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified
+	chunked := !bodyless && resp.ContentLength < 0 && in.ProtoAtLeast(1, 1)
+	keepAlive = keepAlive && (bodyless || chunked || resp.ContentLength >= 0)
+	switch {
+	case !keepAlive:
+		header.Set("Connection", "close")
+	case !in.ProtoAtLeast(1, 1):
+		header.Set("Connection", "keep-alive") // HTTP/1.0 closes unless told otherwise
+	}
+	if chunked {
+		header.Set("Transfer-Encoding", "chunked")
+		if len(resp.Trailer) > 0 {
+			names := make([]string, 0, len(resp.Trailer))
+			for name := range resp.Trailer {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			header.Set("Trailer", strings.Join(names, ", "))
 		}
 	}
 
-	// Set content length and end headers
-	responseBuffer.WriteString(fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body)))
-
-	// Add body
-	responseBuffer.Write(body)
-
-	// Send to client
-	responseData := responseBuffer.Bytes()
-	log.Printf("🔹 Sending HTTP response: %d bytes", len(responseData))
-
-	// Show a preview of the response for debugging
-	previewLen := min(200, len(responseData))
-	log.Printf("🔹 Response preview: %s", string(responseData[:previewLen]))
-
-	_, err = clientConn.Write(responseData)
-	if err != nil {
-		log.Printf("❌ ERROR writing response to client: %v", err)
-		return
+	head := bufio.NewWriter(w)
+	fmt.Fprintf(head, "HTTP/1.1 %s\r\n", resp.Status)
+	header.Write(head)
+	head.WriteString("\r\n")
+	if err := head.Flush(); err != nil || bodyless {
+		return keepAlive, err
 	}
 
-	log.Printf("✅ Successfully forwarded HTTP response to client")
+	if !chunked {
+		_, err := io.Copy(w, resp.Body)
+		return keepAlive, err
+	}
+	chunks := httputil.NewChunkedWriter(w)
+	if _, err := io.Copy(chunks, resp.Body); err != nil {
+		return false, err
+	}
+	if err := chunks.Close(); err != nil {
+		return false, err
+	}
+	// Trailers are only known once the body has been read
+	if err := resp.Trailer.Write(w); err != nil {
+		return false, err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return keepAlive, err
 }
 
 // handleTunnelConnect implements a proper CONNECT tunnel for HTTPS connections.
@@ -355,7 +624,7 @@ func (p *TLSProxy) handleDirectHttpRequest(clientConn net.Conn, reader *bufio.Re
 // IMPORTANT: While this method offers the highest reliability and compatibility,
 // it does NOT conceal SNI information as the TLS handshake passes through directly.
 // For SNI concealment, the OOB handshake relay mode should be used instead.
-func (p *TLSProxy) handleTunnelConnect(clientConn net.Conn, hostPort string) {
+func (p *TLSProxy) handleTunnelConnect(ctx context.Context, clientConn net.Conn, hostPort string) {
 	defer clientConn.Close()
 
 	// Parse host and port
@@ -365,114 +634,180 @@ func (p *TLSProxy) handleTunnelConnect(clientConn net.Conn, hostPort string) {
 		var err error
 		host, port, err = net.SplitHostPort(hostPort)
 		if err != nil {
-			log.Printf("❌ Failed to parse host:port: %v", err)
+			sessionLog(ctx).Printf("❌ Failed to parse host:port: %v", err)
 			clientConn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
 			return
 		}
 	}
+	if !connectPorts.allows(port) {
+		sessionLog(ctx).Printf("🚫 Refusing CONNECT to port %s, which connect_ports doesn't allow", port)
+		clientConn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	if p.blocks(host) {
+		sessionLog(ctx).Printf("🚫 Refusing CONNECT to %s, which a rule blocks", host)
+		clientConn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
 
-	log.Printf("🔹 TUNNEL: Target host is %s", host)
+	p.openTunnel(ctx, clientConn, host, port, func(mode string) {
+		// Send 200 Connection Established to the client to signal tunnel is ready
+		clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n" +
+			"X-Proxy: Sultry-" + mode + "-Mode\r\n" +
+			"X-Target-Host: " + host + "\r\n\r\n"))
+	})
+}
+
+// openTunnel serves a tunnel a client asked for to host:port, such as a
+// CONNECT request or a SOCKS5 one. established is called to tell the client
+// the tunnel is ready, with "MITM" for intercepted hosts or "Direct", after
+// which the client starts TLS.
+func (p *TLSProxy) openTunnel(ctx context.Context, clientConn net.Conn, host, port string, established func(mode string)) {
+	ctx = withSessionLogger(ctx, sessionLog(ctx).Redacting(sensitiveSNI, host).With("dest", destHash(host)))
+	logger := sessionLog(ctx)
+	logger.Printf("🔹 TUNNEL: Target host is %s", host)
+
+	// Intercepted hosts are answered by the local TLS terminator, whose
+	// requests go out through tunnels of their own
+	if p.mitm.intercepts(host, port) {
+		established("MITM")
+		p.mitm.serve(ctx, clientConn, host, port)
+		return
+	}
 
-	// Send 200 Connection Established to the client to signal tunnel is ready
-	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n" +
-		"X-Proxy: Sultry-Direct-Mode\r\n" +
-		"X-Target-Host: " + host + "\r\n\r\n"))
+	// Start resolving and connecting while the client sets up TLS
+	pipeline := p.startPipeline(ctx, host, port)
+	defer pipeline.Close()
+	established("Direct")
 
-	// At this point, the CONNECT tunnel is established, and the client will start TLS
+	// At this point, the tunnel is established, and the client will start TLS
 
-	// Read the ClientHello to extract SNI if needed
-	clientHelloBuffer := make([]byte, 4096)
-	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	n, err := clientConn.Read(clientHelloBuffer)
-	clientConn.SetReadDeadline(time.Time{})
-	
+	// Read the whole ClientHello to extract SNI if needed
+	clientHello, err := readClientHello(clientConn, timeouts.handshake)
 	if err != nil {
-		log.Printf("❌ Failed to read ClientHello: %v", err)
+		logger.Printf("❌ Failed to read ClientHello: %v", err)
 		return
 	}
-	
-	clientHello := clientHelloBuffer[:n]
-	log.Printf("🔹 Read ClientHello (%d bytes)", n)
+	logger.Printf("🔹 Read ClientHello (%d bytes)", len(clientHello))
+
+	// Extract SNI from ClientHello, using the CONNECT hostname as fallback
+	sni, err := extractSNI(singleRecordHello(clientHello))
+	if err != nil {
+		logger.Printf("⚠️ Failed to extract SNI from ClientHello: %v", err)
+		sni = host
+	}
+	ctx = withSessionLogger(ctx, logger.Redacting(sensitiveSNI, sni))
+
+	p.tunnel(ctx, clientConn, pipeline, host, port, sni, clientHello)
+}
 
+// tunnel connects to host:port with the configured strategies, forwarding
+// the ClientHello the client already sent, and relays the connection.
+func (p *TLSProxy) tunnel(ctx context.Context, clientConn net.Conn, pipeline *connectPipeline, host, port, sni string, clientHello []byte) {
+	logger := sessionLog(ctx)
+	hostPort := net.JoinHostPort(host, port)
+	if err := checkLegacyClientHello(logger.Printf, clientHello); err != nil {
+		clientConn.Write(alertProtocolVersion)
+		audit(auditEvent{Event: "failed", Session: logger.ID(), Dest: hostPort, SNI: sni, Error: err.Error()})
+		return
+	}
+	dest := p.routed(ctx, pipeline.Destination(Destination{
+		Host:          host,
+		Port:          port,
+		SNI:           sni,
+		ClientHello:   clientHello,
+		ProxyProtocol: proxyProtocolVersion(p.ProxyProtocol, host, port),
+		Source:        clientConn.RemoteAddr(),
+		Affinity:      p.sessionIDs.Lookup(host, clientHello),
+	}))
+	if dest.Conceal {
+		logger.Printf("🔒 %s is a DNS-over-HTTPS resolver, only concealing strategies may connect", hostPort)
+	}
+	if dest.Route == routeBlock {
+		// The SNI may name a blocked host the CONNECT didn't
+		logger.Printf("🚫 Resetting tunnel to %s (SNI %s), which a rule blocks", hostPort, sni)
+		audit(auditEvent{Event: "failed", Session: logger.ID(), Dest: hostPort, SNI: sni, Error: "blocked by a routing rule"})
+		resetOnClose(clientConn)
+		return
+	}
 	var targetConn net.Conn
-	
-	// Apply SNI concealment if configured
-	if p.PrioritizeSNI {
-		// Extract SNI from ClientHello
-		sni, err := extractSNI(clientHello)
-		if err != nil {
-			log.Printf("⚠️ Failed to extract SNI from ClientHello: %v", err)
-			// Use hostname from CONNECT request as fallback
-			sni = host
-		}
-		
-		log.Printf("🔒 SNI concealment: Using OOB to protect SNI: %s", sni)
-		
-		// Use OOB channel to get a connection to the target
-		targetConn, err = p.getTargetConnViaOOB(sni, port)
-		if err != nil {
-			log.Printf("❌ Failed to establish connection via OOB: %v", err)
-			
-			// Fallback to direct connection
-			log.Printf("⚠️ Falling back to direct connection to %s:%s", host, port)
-			targetConn, err = net.DialTimeout("tcp", host+":"+port, 10*time.Second)
-			if err != nil {
-				log.Printf("❌ Failed to connect to target: %v", err)
-				return
-			}
-		}
+	var strategy string
+	var fallbacks []Fallback
+	var err error
+	start := time.Now()
+	if p.DryRun {
+		targetConn, err = p.strategies.Observe(pipeline.ctx, clientConn, dest)
+		strategy = "direct"
 	} else {
-		// Direct connection without SNI concealment
-		log.Printf("🔹 TUNNEL: Connecting directly to %s", hostPort)
-		targetConn, err = net.DialTimeout("tcp", hostPort, 10*time.Second)
-		if err != nil {
-			log.Printf("❌ TUNNEL: Failed to connect to target: %v", err)
-			return
-		}
+		targetConn, strategy, fallbacks, err = p.strategies.Establish(pipeline.ctx, clientConn, dest)
 	}
-	
-	defer targetConn.Close()
-	
-	// Send ClientHello to the target server
-	targetConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-	_, err = targetConn.Write(clientHello)
-	targetConn.SetWriteDeadline(time.Time{})
+	pipeline.transcript.Outcome(err)
 	if err != nil {
-		log.Printf("❌ Failed to send ClientHello to target: %v", err)
+		logger.With("fallbacks", fallbackSummary(fallbacks)).Printf("❌ TUNNEL: Failed to connect to %s: %v", hostPort, err)
+		if p.strategies.failsClosed(dest) {
+			logger.Printf("🛑 KILL SWITCH: Refusing %s rather than connecting it with its SNI in the clear", hostPort)
+			resetOnClose(clientConn)
+		}
 		return
 	}
-	log.Printf("✅ Forwarded ClientHello to target")
+	logger = logger.With("strategy", strategy)
+	if len(fallbacks) > 0 {
+		logger = logger.With("fallbacks", fallbackSummary(fallbacks))
+	}
+	defer targetConn.Close()
+	logger.Printf("✅ Forwarded ClientHello to target using %s strategy", strategy)
 
 	// Set up bidirectional relay
-	log.Printf("✅ TUNNEL: Connected to target, starting bidirectional relay")
+	logger.Printf("✅ TUNNEL: Connected to target, starting bidirectional relay")
 
 	// Improve relay performance
-	if tcpConn, ok := targetConn.(*net.TCPConn); ok {
-		tcpConn.SetNoDelay(true)
-		tcpConn.SetKeepAlive(true)
-	}
-
-	// Use wait group to manage relay goroutines
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// Client -> Target
-	go func() {
-		defer wg.Done()
-		buffer := make([]byte, 1048576) // 1MB buffer for large requests
-		relayData(clientConn, targetConn, buffer, "Client -> Target")
-	}()
-
-	// Target -> Client
-	go func() {
-		defer wg.Done()
-		buffer := make([]byte, 1048576) // 1MB buffer for large responses
-		relayData(targetConn, clientConn, buffer, "Target -> Client")
+	connTuner.Tune(targetConn, hostPort)
+
+	// Hosts sharing an address may have their h2 requests coalesced onto this tunnel
+	ips, _ := pipeline.dns.wait(ctx)
+	var coalescable *coalescableTunnel
+	if p.coalescing != nil {
+		coalescable = p.coalescing.add(logger, host, port, strategy, ips, func() { targetConn.Close() })
+		defer coalescable.remove()
+	}
+	toClient := tapLegacyTLS(logger, p.sessionIDs.tap(coalescable.tap(clientConn), host, targetConn, ips))
+
+	// Volumes and duration go to the audit log when the relay ends
+	connected := time.Now()
+	var up, down atomic.Int64
+	up.Add(int64(len(clientHello)))
+	// WebSockets get their own idle policy and counts
+	class := classifyTunnel(logger, p.TunnelClasses, clientHello, port, &up, &down, func() { targetConn.Close() })
+	defer func() {
+		class.stop(up.Load(), down.Load(), time.Since(connected))
+		audit(auditEvent{Event: "close", Session: logger.ID(), Dest: hostPort, SNI: sni, Strategy: strategy,
+			Client: clientConn.RemoteAddr().String(), BytesUp: up.Load(), BytesDown: down.Load(),
+			LatencyMs: connected.Sub(start).Milliseconds(), DurationMs: time.Since(start).Milliseconds(),
+			Class: class.Class()})
 	}()
 
-	// Wait for both directions to complete
-	wg.Wait()
-	log.Printf("✅ TUNNEL: Bidirectional relay completed for %s", hostPort)
+	// Long-lived tunnels are closed between requests once their lifetime ends
+	stopRotation := scheduleRotation(logger, tunnelLifetime(p.TunnelLifetimes, host, port), class, &up, &down,
+		func() { targetConn.Close() })
+	defer stopRotation()
+
+	phase := newRelayTimeouts(clientHello)
+	limit := throttling.open(clientConn.RemoteAddr())
+	defer limit.close()
+	err = relayPair(ctx, clientConn, targetConn,
+		func() error {
+			buffer := make([]byte, 1048576) // 1MB buffer for large requests
+			return relayData(logger, clientConn, countingConn{targetConn, &up}, buffer, "Client -> Target", phase, limit, true)
+		},
+		func() error {
+			buffer := make([]byte, 1048576) // 1MB buffer for large responses
+			return relayData(logger, targetConn, countingConn{toClient, &down}, buffer, "Target -> Client", phase, limit, false)
+		})
+	if err != nil {
+		logger.Printf("⚠️ TUNNEL: Relay for %s ended early: %v", hostPort, err)
+		return
+	}
+	logger.Printf("✅ TUNNEL: Bidirectional relay completed for %s", hostPort)
 }
 
 // handleProxyConnection implements the OOB (Out-of-Band) handshake relay strategy.
@@ -575,13 +910,37 @@ func (p *TLSProxy) handleProxyConnection(clientConn net.Conn, reader *bufio.Read
 
 	// Create a unique session ID for this connection
 	sessionID := fmt.Sprintf("%d", time.Now().UnixNano())
-	log.Printf("🔹 Initiating handshake for session %s with SNI %s", sessionID, sni)
+	log.Printf("🔹 Initiating handshake for session %s with SNI %s", sessionID, redacted(sensitiveSNI, sni))
 
 	// Initialize handshake with server proxy via OOB
 	err = p.OOB.InitiateHandshake(sessionID, clientHelloData, sni)
 	if err != nil {
 		log.Println("❌ ERROR: Failed to initiate handshake:", err)
-		return
+		// Nothing has reached the client yet, so a standby peer can take over
+		if sessionID, err = p.OOB.Failover(sessionID); err != nil {
+			log.Println("❌ ERROR: Failover failed:", err)
+			return
+		}
+	}
+
+	// Subscribe to pushed responses instead of polling, if configured and
+	// the session's peer streams them
+	useEvents := p.HandshakeEvents && p.OOB.Supports(p.OOB.PeerForSession(sessionID), capEvents)
+	var events <-chan HandshakeResponse
+	if useEvents {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events, err = p.OOB.StreamHandshakeResponses(ctx, sessionID)
+		if err != nil {
+			log.Println("❌ ERROR: Failed to open handshake event stream:", err)
+			if sessionID, err = p.OOB.Failover(sessionID); err == nil {
+				events, err = p.OOB.StreamHandshakeResponses(ctx, sessionID)
+			}
+			if err != nil {
+				log.Println("❌ ERROR: Failover failed:", err)
+				return
+			}
+		}
 	}
 
 	// Set up a bidirectional relay for the rest of the handshake
@@ -591,6 +950,30 @@ func (p *TLSProxy) handleProxyConnection(clientConn net.Conn, reader *bufio.Read
 	completedChan := make(chan struct{})
 	errorChan := make(chan error, 2)
 
+	// Both directions are followed record by record, so completion doesn't
+	// wait for the server's signal or the timeout. Records are tracked
+	// before they are forwarded, so an answer can't be tracked before what
+	// it answers, and completion is marked once they have been.
+	var handshake sultrytls.Handshake
+	var handshakeMu sync.Mutex
+	handshakeDeadline := time.Now().Add(timeouts.handshake)
+	var completeOnce sync.Once
+	markComplete := func() { completeOnce.Do(func() { close(completedChan) }) }
+	trackHandshake := func(fromClient bool, data []byte) bool {
+		handshakeMu.Lock()
+		defer handshakeMu.Unlock()
+		if fromClient {
+			handshake.FromClient(data)
+		} else {
+			handshake.FromServer(data)
+		}
+		if handshake.Complete() {
+			log.Printf("✅ Handshake complete (%s)", versionName(handshake.Version()))
+		}
+		return handshake.Complete()
+	}
+	trackHandshake(true, clientHelloData)
+
 	// Goroutine to receive server responses via OOB and forward to client
 	go func() {
 		defer func() {
@@ -598,7 +981,6 @@ func (p *TLSProxy) handleProxyConnection(clientConn net.Conn, reader *bufio.Read
 		}()
 
 		responseCount := 0
-		maxEmptyResponses := 5 // Allow a few empty responses before completing
 		emptyResponseCount := 0
 
 		// CRITICAL: Initial ServerHello must be obtained and forwarded to client immediately
@@ -626,7 +1008,8 @@ func (p *TLSProxy) handleProxyConnection(clientConn net.Conn, reader *bufio.Read
 			}
 
 			log.Printf("🔹 Forwarding ServerHello (%d bytes) to client", len(initialResponse.Data))
-			clientConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			complete := trackHandshake(false, initialResponse.Data)
+			clientConn.SetWriteDeadline(handshakeDeadline)
 			n, err := clientConn.Write(initialResponse.Data)
 			clientConn.SetWriteDeadline(time.Time{})
 			if err != nil {
@@ -635,12 +1018,49 @@ func (p *TLSProxy) handleProxyConnection(clientConn net.Conn, reader *bufio.Read
 				return
 			}
 			log.Printf("✅ Successfully forwarded ServerHello to client (%d/%d bytes)", n, len(initialResponse.Data))
+			if complete {
+				markComplete()
+			}
 		} else {
 			log.Printf("⚠️ Received empty ServerHello response - this is unexpected")
 		}
 
+		// With an event stream the server pushes each response as it arrives
+		// and says when the handshake is done, so there's nothing to poll
+		if useEvents {
+			for response := range events {
+				if response.HandshakeComplete {
+					log.Printf("✅ Server marked handshake as complete")
+					markComplete()
+					return
+				}
+				responseCount++
+				log.Printf("🔹 Streamed server response #%d: %d bytes", responseCount, len(response.Data))
+				complete := trackHandshake(false, response.Data)
+				clientConn.SetWriteDeadline(handshakeDeadline)
+				_, err := clientConn.Write(response.Data)
+				clientConn.SetWriteDeadline(time.Time{})
+				if err != nil {
+					errorChan <- fmt.Errorf("failed to write server response to client: %w", err)
+					return
+				}
+				if complete {
+					markComplete()
+				}
+			}
+			errorChan <- fmt.Errorf("event stream ended before handshake completed")
+			return
+		}
+
 		// Now continue with subsequent handshake messages
 		for {
+			// Once the client finished, the rest is relayed after adoption
+			select {
+			case <-completedChan:
+				return
+			default:
+			}
+
 			// Poll for response from server
 			log.Printf("🔹 Polling for handshake response #%d from server", responseCount+1)
 			response, err := p.OOB.GetHandshakeResponse(sessionID)
@@ -650,10 +1070,19 @@ func (p *TLSProxy) handleProxyConnection(clientConn net.Conn, reader *bufio.Read
 				return
 			}
 
-			// Check if handshake is complete
+			// Check if handshake is complete. After a HelloRetryRequest, the
+			// ServerHello answering the updated ClientHello is still to come
+			// as the response to it, which the client may not have sent yet
+			handshakeMu.Lock()
+			retrying := handshake.Retried() && handshake.State() == sultrytls.StateClientHello
+			handshakeMu.Unlock()
+			if response.HandshakeComplete && retrying {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
 			if response.HandshakeComplete {
 				log.Printf("✅ Server marked handshake as complete")
-				close(completedChan)
+				markComplete()
 				return
 			}
 
@@ -662,13 +1091,6 @@ func (p *TLSProxy) handleProxyConnection(clientConn net.Conn, reader *bufio.Read
 				emptyResponseCount++
 				log.Printf("💤 Received empty response #%d", emptyResponseCount)
 
-				// After receiving several empty responses, consider handshake may be complete
-				if emptyResponseCount >= maxEmptyResponses {
-					log.Printf("✅ Assuming handshake complete after %d empty responses", emptyResponseCount)
-					close(completedChan)
-					return
-				}
-
 				// Sleep briefly to avoid tight polling
 				time.Sleep(100 * time.Millisecond)
 				continue
@@ -681,32 +1103,20 @@ func (p *TLSProxy) handleProxyConnection(clientConn net.Conn, reader *bufio.Read
 			responseCount++
 			log.Printf("🔹 Received server response #%d: %d bytes", responseCount, len(response.Data))
 
-			// Log TLS record info if possible
-			if len(response.Data) >= 5 {
-				recordType := response.Data[0]
-				// Only interpret as TLS record if it's a valid TLS record type (20-24)
-				if recordType >= 20 && recordType <= 24 {
-					version := (uint16(response.Data[1]) << 8) | uint16(response.Data[2])
-					length := (uint16(response.Data[3]) << 8) | uint16(response.Data[4])
-					log.Printf("🔹 TLS Record from server: Type=%d, Version=0x%04x, Length=%d",
-						recordType, version, length)
-					log.Printf("🔹 First 16 bytes: %x", response.Data[:min(16, len(response.Data))])
-				} else {
-					// This is likely application data
-					log.Printf("🔹 Server application data: %d bytes", len(response.Data))
-				}
-			}
-
 			log.Printf("🔹 Forwarding %d bytes from server to client", len(response.Data))
-			clientConn.SetWriteDeadline(time.Now().Add(10 * time.Second)) // NEW: Add write deadline
+			complete := trackHandshake(false, response.Data)
+			clientConn.SetWriteDeadline(handshakeDeadline)
 			n, err := clientConn.Write(response.Data)
-			clientConn.SetWriteDeadline(time.Time{}) // NEW: Reset write deadline
+			clientConn.SetWriteDeadline(time.Time{})
 			if err != nil {
 				log.Printf("❌ ERROR writing server response to client: %v", err)
 				errorChan <- fmt.Errorf("failed to write server response to client: %w", err)
 				return
 			}
 			log.Printf("✅ Successfully wrote %d/%d bytes to client", n, len(response.Data))
+			if complete {
+				markComplete()
+			}
 		}
 	}()
 
@@ -723,8 +1133,8 @@ func (p *TLSProxy) handleProxyConnection(clientConn net.Conn, reader *bufio.Read
 		clientMsgCount := 0
 
 		for {
-			// Set a longer read deadline for handshake
-			clientConn.SetReadDeadline(time.Now().Add(30 * time.Second))
+			// The rest of the handshake shares its deadline
+			clientConn.SetReadDeadline(handshakeDeadline)
 			n, err := clientConn.Read(buffer)
 			clientConn.SetReadDeadline(time.Time{})
 
@@ -740,8 +1150,8 @@ func (p *TLSProxy) handleProxyConnection(clientConn net.Conn, reader *bufio.Read
 					case <-completedChan:
 						return
 					default:
-						log.Printf("🔹 Read timeout from client, checking handshake status")
-						continue
+						errorChan <- errHandshakeTimeout
+						return
 					}
 				}
 
@@ -754,48 +1164,44 @@ func (p *TLSProxy) handleProxyConnection(clientConn net.Conn, reader *bufio.Read
 				clientMsgCount++
 				log.Printf("🔹 Received client message #%d: %d bytes", clientMsgCount, n)
 
-				// Log TLS record info if possible
-				if n >= 5 {
-					recordType := buffer[0]
-					// Only interpret as TLS record if it's a valid TLS record type (20-24)
-					if recordType >= 20 && recordType <= 24 {
-						version := (uint16(buffer[1]) << 8) | uint16(buffer[2])
-						length := (uint16(buffer[3]) << 8) | uint16(buffer[4])
-						log.Printf("🔹 TLS Record from client: Type=%d, Version=0x%04x, Length=%d",
-							recordType, version, length)
-						log.Printf("🔹 First 16 bytes: %x", buffer[:min(16, n)])
-					} else {
-						// This is likely application data
-						log.Printf("🔹 Client application data: %d bytes", n)
-					}
-				}
-
 				log.Printf("🔹 Forwarding %d bytes from client to server", n)
-				err = p.OOB.SendHandshakeData(sessionID, buffer[:n])
+				complete := trackHandshake(true, buffer[:n])
+				if useEvents {
+					err = p.OOB.SendData(sessionID, buffer[:n])
+				} else {
+					err = p.OOB.SendHandshakeData(sessionID, buffer[:n])
+				}
 				if err != nil {
 					log.Printf("❌ ERROR sending data to server: %v", err)
 					errorChan <- fmt.Errorf("failed to send client data to server: %w", err)
 					return
 				}
 				log.Printf("✅ Successfully forwarded client message #%d to server", clientMsgCount)
+				if complete {
+					markComplete()
+				}
+				select {
+				case <-completedChan:
+					return // The rest goes over the adopted connection
+				default:
+				}
 			}
 		}
 	}()
 
-	// Wait for handshake completion with configurable timeout
-	timeoutDuration := time.Duration(p.HandshakeTimeout) * time.Millisecond
-	if timeoutDuration == 0 {
-		timeoutDuration = 5 * time.Second // Default to 5 seconds
-	}
-	log.Printf("🔹 Waiting for handshake completion with %s timeout", timeoutDuration)
-	timeoutChan := time.After(timeoutDuration)
+	// Wait for handshake completion until the handshake deadline
+	log.Printf("🔹 Waiting for handshake completion with %s timeout", timeouts.handshake)
+	timeoutChan := time.After(time.Until(handshakeDeadline))
 
 	select {
 	case <-completedChan:
 		log.Println("✅ TLS handshake completed successfully via signal")
 	case <-timeoutChan:
-		// Handshake timeout - assume it's complete for practical purposes
-		log.Printf("⚠️ Handshake timeout after %s - assuming it's complete for practical purposes", timeoutDuration)
+		// The handshake may still finish while the connection is adopted
+		handshakeMu.Lock()
+		state := handshake.State()
+		handshakeMu.Unlock()
+		log.Printf("⚠️ Handshake timeout after %s in state %s, adopting the connection anyway", timeouts.handshake, state)
 	case err := <-errorChan:
 		log.Println("❌ ERROR during handshake:", err)
 		// Continue anyway - we'll try adoptConnection as a fallback
@@ -821,11 +1227,14 @@ func (p *TLSProxy) handleProxyConnection(clientConn net.Conn, reader *bufio.Read
 func (p *TLSProxy) signalHandshakeCompletion(sessionID string) error {
 	// Signal to the server that handshake is complete
 	reqBody := fmt.Sprintf(`{"session_id":"%s", "action":"complete_handshake"}`, sessionID)
-	resp, err := http.Post(
-		fmt.Sprintf("http://%s/complete_handshake", p.OOB.GetServerAddress()),
-		"application/json",
-		strings.NewReader(reqBody),
-	)
+	peer := p.OOB.PeerForSession(sessionID)
+	resp, err := p.OOB.withRetry(peer, "/complete_handshake", true, func() (*http.Response, error) {
+		return p.OOB.Client(0).Post(
+			p.OOB.URL(peer, "/complete_handshake"),
+			"application/json",
+			strings.NewReader(reqBody),
+		)
+	})
 
 	if err != nil {
 		return fmt.Errorf("failed to signal handshake completion: %w", err)
@@ -884,12 +1293,15 @@ func (p *TLSProxy) getTargetInfo(sessionID string, clientHelloData []byte) (*Tar
 	}
 
 	// Send request to OOB server with timeout
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Post(
-		fmt.Sprintf("http://%s/get_target_info", p.OOB.GetServerAddress()),
-		"application/json",
-		bytes.NewReader(requestBytes),
-	)
+	peer := p.OOB.PeerForSession(sessionID)
+	client := p.OOB.Client(p.OOB.Timeout(peer, 5*time.Second))
+	resp, err := p.OOB.withRetry(peer, "/get_target_info", true, func() (*http.Response, error) {
+		return client.Post(
+			p.OOB.URL(peer, "/get_target_info"),
+			"application/json",
+			bytes.NewReader(requestBytes),
+		)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get target info: %w", err)
 	}
@@ -910,6 +1322,14 @@ func (p *TLSProxy) getTargetInfo(sessionID string, clientHelloData []byte) (*Tar
 	if targetInfo.TargetHost == "" || targetInfo.TargetPort == 0 {
 		return nil, fmt.Errorf("received incomplete target info")
 	}
+	if len(targetInfo.SessionTicket) > 0 {
+		log.Printf("🎫 Relay captured a session ticket for %s (%d bytes)", redacted(sensitiveSNI, targetInfo.SNI), len(targetInfo.SessionTicket))
+		p.tickets.Store(targetInfo.SNI, targetInfo.SessionTicket, time.Duration(targetInfo.TicketLifetime)*time.Second)
+	}
+	if len(targetInfo.SessionID) > 0 {
+		p.sessionIDs.Put(targetInfo.SNI, targetInfo.SessionID, net.JoinHostPort(targetInfo.TargetIP, strconv.Itoa(targetInfo.TargetPort)))
+	}
+	p.addresses.Put(targetInfo.SNI, targetInfo.TargetIP)
 
 	return &targetInfo, nil
 }
@@ -919,9 +1339,10 @@ func (p *TLSProxy) releaseOOBConnection(sessionID string) error {
 	reqBody := fmt.Sprintf(`{"session_id":"%s","action":"release_connection"}`, sessionID)
 
 	// Use a client with short timeout to avoid hanging
-	client := &http.Client{Timeout: 3 * time.Second}
+	peer := p.OOB.PeerForSession(sessionID)
+	client := p.OOB.Client(p.OOB.Timeout(peer, 3*time.Second))
 	resp, err := client.Post(
-		fmt.Sprintf("http://%s/release_connection", p.OOB.GetServerAddress()),
+		p.OOB.URL(peer, "/release_connection"),
 		"application/json",
 		strings.NewReader(reqBody),
 	)
@@ -947,9 +1368,9 @@ func (p *TLSProxy) fallbackToRelayMode(clientConn net.Conn, sessionID string) {
 	log.Printf("🔹 Establishing direct connection for session %s", sessionID)
 
 	// Create a connection to the OOB server
-	serverAddr := p.OOB.GetServerAddress()
+	serverAddr := p.OOB.PeerForSession(sessionID)
 	log.Printf("🔹 Connecting to relay server at %s", serverAddr)
-	conn, err := net.Dial("tcp", serverAddr)
+	conn, err := p.OOB.Dial(serverAddr)
 	if err != nil {
 		log.Printf("❌ ERROR: Failed to connect to OOB server: %v", err)
 		return
@@ -959,10 +1380,8 @@ func (p *TLSProxy) fallbackToRelayMode(clientConn net.Conn, sessionID string) {
 
 	// Optimize TCP connection settings for both connections
 	for _, c := range []net.Conn{conn, clientConn} {
+		connTuner.Tune(c, c.RemoteAddr().String())
 		if tcpConn, ok := c.(*net.TCPConn); ok {
-			tcpConn.SetNoDelay(true)
-			tcpConn.SetKeepAlive(true)
-			tcpConn.SetKeepAlivePeriod(30 * time.Second)
 			tcpConn.SetReadBuffer(1048576)  // 1MB buffer
 			tcpConn.SetWriteBuffer(1048576) // 1MB buffer
 		}
@@ -970,20 +1389,30 @@ func (p *TLSProxy) fallbackToRelayMode(clientConn net.Conn, sessionID string) {
 	log.Printf("✅ TCP connections optimized")
 
 	// Send the adoption request
-	// Get the target information for ALPN protocol detection
-	_, err = p.getTargetInfo(sessionID, nil)
-
-	// Don't force a specific protocol version - let client and server negotiate
+	// The negotiated application protocol decides how the connection is relayed
 	var protocol string
-	log.Printf("🔹 Using dynamic protocol negotiation - allowing client to determine TLS version")
+	if targetInfo, err := p.getTargetInfo(sessionID, nil); err != nil {
+		log.Printf("⚠️ No target info for session %s, relaying as HTTP/1.1: %v", sessionID, err)
+	} else if protocol = targetInfo.ALPN; protocol != "" {
+		log.Printf("🔹 Target negotiated %s for session %s", protocol, sessionID)
+	}
 
-	reqBody := fmt.Sprintf(`{"session_id":"%s","protocol":"%s"}`, sessionID, protocol)
-	req := fmt.Sprintf("POST /adopt_connection HTTP/1.1\r\n"+
-		"Host: %s\r\n"+
-		"Content-Type: application/json\r\n"+
-		"Connection: close\r\n"+
-		"Content-Length: %d\r\n\r\n%s",
-		serverAddr, len(reqBody), reqBody)
+	reqBody, _ := json.Marshal(struct {
+		SessionID string `json:"session_id"`
+		Protocol  string `json:"protocol,omitempty"`
+	}{sessionID, protocol})
+	headers := []string{
+		"Host: " + serverAddr,
+		"Content-Type: application/json",
+		"User-Agent: " + oobUserAgent,
+		"Connection: close",
+		fmt.Sprintf("Content-Length: %d", len(reqBody)),
+	}
+	if auth := p.OOB.AuthHeader(); auth != "" {
+		headers = append(headers, auth)
+	}
+	headers = shapeHeaders(headers, p.Shaping)
+	req := "POST /adopt_connection HTTP/1.1\r\n" + strings.Join(headers, "\r\n") + "\r\n\r\n" + string(reqBody)
 
 	log.Printf("🔹 Sending adoption request (length: %d bytes)", len(req))
 	if _, err := conn.Write([]byte(req)); err != nil {
@@ -1049,40 +1478,27 @@ func (p *TLSProxy) fallbackToRelayMode(clientConn net.Conn, sessionID string) {
 	log.Printf("🔹 Using pure TCP relay mode - no protocol interpretation")
 	log.Printf("🔹 Enabling graceful shutdown behavior to handle connection resets")
 
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("❌ PANIC in bidirectional relay: %v", r)
-		}
-
-		// Close connections
-		conn.Close()
-		clientConn.Close()
-		log.Printf("✅ Connections closed for session %s", sessionID)
-	}()
-
 	// Begin bidirectional relay immediately
 	log.Printf("🔹 Starting bidirectional relay without artificial delays")
-
-	// Use wait group for the two copy operations
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// Client -> Target with enhanced progress logging
-	go func() {
-		defer wg.Done()
-		buffer := make([]byte, 1048576) // 1MB buffer for large requests
-		relayData(clientConn, conn, buffer, "Client -> Target")
-	}()
-
-	// Target -> Client with enhanced progress logging
-	go func() {
-		defer wg.Done()
-		buffer := make([]byte, 1048576) // 1MB buffer for large responses
-		relayData(conn, clientConn, buffer, "Target -> Client")
-	}()
-
-	// Wait for both directions to complete
-	wg.Wait()
+	relayLogger := sessionLog(context.Background()).With("session", sessionID)
+
+	// Both connections are closed once the relay ends
+	phase := newRelayTimeouts(nil)
+	limit := throttling.open(clientConn.RemoteAddr())
+	defer limit.close()
+	err = relayPair(context.Background(), clientConn, conn,
+		func() error {
+			buffer := make([]byte, relayBufferSize(protocol))
+			return relayData(relayLogger, clientConn, conn, buffer, "Client -> Target", phase, limit, true)
+		},
+		func() error {
+			buffer := make([]byte, relayBufferSize(protocol))
+			return relayData(relayLogger, conn, clientConn, buffer, "Target -> Client", phase, limit, false)
+		})
+	if err != nil {
+		log.Printf("❌ Bidirectional relay failed for session %s: %v", sessionID, err)
+		return
+	}
 	log.Printf("✅ Bidirectional relay completed for session %s", sessionID)
 }
 
@@ -1103,50 +1519,60 @@ func (p *TLSProxy) fallbackToRelayMode(clientConn net.Conn, sessionID string) {
 // The extracted SNI is used both for establishing connections to the correct target
 // and for potential SNI concealment in the OOB handshake relay strategy.
 func extractSNI(clientHello []byte) (string, error) {
+	start, end, err := locateSNI(clientHello)
+	if err != nil {
+		return "", err
+	}
+	return string(clientHello[start:end]), nil
+}
+
+// locateSNI returns the byte range of the SNI hostname within the ClientHello,
+// for callers that need to split or rewrite the record around it.
+func locateSNI(clientHello []byte) (int, int, error) {
 	if len(clientHello) < 43 { // Minimum length for a valid ClientHello
-		return "", errors.New("ClientHello too short")
+		return 0, 0, errors.New("ClientHello too short")
 	}
 
 	// Ensure this is a TLS ClientHello by checking the first few bytes
 	if clientHello[0] != 0x16 { // TLS handshake type
-		return "", errors.New("Not a TLS handshake")
+		return 0, 0, errors.New("Not a TLS handshake")
 	}
 	if clientHello[5] != 0x01 { // ClientHello message type
-		return "", errors.New("Not a ClientHello message")
+		return 0, 0, errors.New("Not a ClientHello message")
 	}
 
 	// Find the TLS extensions section
 	var pos = 43 // Start after fixed-length fields
 	if pos+2 > len(clientHello) {
-		return "", errors.New("Malformed ClientHello")
+		return 0, 0, errors.New("Malformed ClientHello")
 	}
 
 	// Skip session ID
 	sessionIDLen := int(clientHello[pos])
 	pos += 1 + sessionIDLen
 	if pos+2 > len(clientHello) {
-		return "", errors.New("Malformed ClientHello (session ID too short)")
+		return 0, 0, errors.New("Malformed ClientHello (session ID too short)")
 	}
 
 	// Skip cipher suites
 	cipherSuitesLen := int(clientHello[pos])<<8 | int(clientHello[pos+1])
 	pos += 2 + cipherSuitesLen
 	if pos+1 > len(clientHello) {
-		return "", errors.New("Malformed ClientHello (cipher suites too short)")
+		return 0, 0, errors.New("Malformed ClientHello (cipher suites too short)")
 	}
 
 	// Skip compression methods
 	compressionLen := int(clientHello[pos])
 	pos += 1 + compressionLen
 	if pos+2 > len(clientHello) {
-		return "", errors.New("Malformed ClientHello (compression methods too short)")
+		return 0, 0, errors.New("Malformed ClientHello (compression methods too short)")
 	}
 
 	// Read extensions length
 	extensionsLen := int(clientHello[pos])<<8 | int(clientHello[pos+1])
 	pos += 2
 	if pos+extensionsLen > len(clientHello) {
-		return "", errors.New("Malformed ClientHello (extensions too short)")
+		return 0, 0, errors.New("Malformed ClientHello (extensions too short)")
 	}
 
 	// Iterate through TLS extensions to find the SNI
@@ -1158,18 +1584,18 @@ func extractSNI(clientHello []byte) (string, error) {
 		// Check if this is the SNI extension (type 0x0000)
 		if extType == 0x0000 {
 			if pos+2 > len(clientHello) {
-				return "", errors.New("Malformed SNI extension")
+				return 0, 0, errors.New("Malformed SNI extension")
 			}
 			sniListLen := int(clientHello[pos])<<8 | int(clientHello[pos+1])
 			pos += 2
 
 			if pos+sniListLen > len(clientHello) {
-				return "", errors.New("SNI list length mismatch")
+				return 0, 0, errors.New("SNI list length mismatch")
 			}
 
 			// Only one name is typically present
 			if sniListLen < 3 || clientHello[pos] != 0x00 { // Ensure it's a valid host_name entry
-				return "", errors.New("Invalid SNI entry")
+				return 0, 0, errors.New("Invalid SNI entry")
 			}
 
 			// Read the hostname length
@@ -1177,158 +1603,117 @@ func extractSNI(clientHello []byte) (string, error) {
 			pos += 3
 
 			if pos+hostnameLen > len(clientHello) {
-				return "", errors.New("Hostname length mismatch")
+				return 0, 0, errors.New("Hostname length mismatch")
 			}
 
-			// Extract the hostname
-			sni := string(clientHello[pos : pos+hostnameLen])
-			return sni, nil
+			return pos, pos + hostnameLen, nil
 		}
 
 		// Move to next extension
 		pos += extLen
 	}
 
-	return "", errors.New("SNI not found in ClientHello")
+	return 0, 0, errors.New("SNI not found in ClientHello")
 }
 
-// relayData implements an efficient bidirectional data relay with TLS inspection.
-//
-// This function is the core of all connection strategies, providing:
-// 1. Reliable TCP data transfer with proper timeout handling
-// 2. TLS record inspection for debugging without modifying the data
-// 3. Detailed logging of transfer progress and connection state
-// 4. Graceful handling of connection resets and network errors
-//
-// By relaying data without attempting to modify TLS records, this approach
-// avoids the "decryption failed or bad record mac" errors that would occur
-// when modifying TLS handshake data or attempting to split/merge TLS records.
-func relayData(source, destination net.Conn, buffer []byte, label string) {
-	var totalBytes int64
-
-	for {
-		// Read from source with timeout
-		source.SetReadDeadline(time.Now().Add(60 * time.Second))
-		n, err := source.Read(buffer)
-		source.SetReadDeadline(time.Time{})
-
-		if err != nil {
-			if err == io.EOF || strings.Contains(err.Error(), "use of closed") {
-				log.Printf("🔹 %s: Connection closed normally", label)
-			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				log.Printf("🔹 %s: Read timeout, continuing...", label)
-				continue
-			} else {
-				log.Printf("❌ %s: Error reading: %v", label, err)
-			}
-			break
+// getTargetConnViaOOB connects to the address a relay resolved the target
+// to, keeping the lookup out of the client's network; the ClientHello still
+// carries the real SNI. If no relay resolves it, the address a relay
+// resolved it to before is used instead, when there is one and dest needn't
+// be concealed (see addresscache.go).
+func (p *TLSProxy) getTargetConnViaOOB(ctx context.Context, dest Destination) (net.Conn, error) {
+	logger := sessionLog(ctx)
+	sni, port := dest.SNI, dest.Port
+	address, targetPort, err := p.resolveViaOOB(ctx, dest)
+	if err != nil {
+		if dest.mustConceal() {
+			return nil, err
 		}
-
-		if n > 0 {
-			// Log what we're relaying (first few bytes only)
-			if n >= 5 {
-				recordType := buffer[0]
-				// Only interpret as TLS record if it's a valid TLS record type (20-24)
-				if recordType >= 20 && recordType <= 24 {
-					version := (uint16(buffer[1]) << 8) | uint16(buffer[2])
-					length := (uint16(buffer[3]) << 8) | uint16(buffer[4])
-					log.Printf("🔹 %s: TLS Record: Type=%d, Version=0x%04x, Length=%d",
-						label, recordType, version, length)
-				} else {
-					// This is likely application data
-					log.Printf("🔹 %s: Application data: %d bytes", label, n)
-				}
-			}
-
-			// Write to destination
-			destination.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			written, err := destination.Write(buffer[:n])
-			destination.SetWriteDeadline(time.Time{})
-
-			if err != nil {
-				log.Printf("❌ %s: Error writing: %v", label, err)
-				break
-			}
-
-			if written != n {
-				log.Printf("⚠️ %s: Short write: %d/%d bytes", label, written, n)
-			} else {
-				totalBytes += int64(written)
-				if totalBytes%32768 == 0 { // Log every 32KB
-					log.Printf("✅ %s: Relayed %d bytes total", label, totalBytes)
-				}
-			}
+		cached, age := p.addresses.Lookup(sni)
+		if cached == "" {
+			return nil, err
 		}
+		logger.Printf("🔁 OOB resolution failed, using the address a relay resolved %s ago: %v",
+			age.Truncate(time.Second), err)
+		address, targetPort = cached, port
+	} else {
+		p.addresses.Put(sni, address)
 	}
 
-	log.Printf("✅ %s: Relay complete, %d bytes transferred", label, totalBytes)
+	// Connect to the target information returned by OOB server
+	targetAddr := net.JoinHostPort(address, targetPort)
+	logger.Printf("🔒 DNS CONCEALED: Connecting directly to IP %s (the ClientHello names %s)", targetAddr, sni)
+	
+	// Connect to the real target
+	logger.Printf("🔹 Creating TCP connection to %s", targetAddr)
+	conn, err := upstream.DialContext(ctx, &net.Dialer{Timeout: 10 * time.Second}, targetAddr)
+	if err != nil {
+		logger.Printf("❌ Failed to connect to the address resolved by OOB: %v", err)
+		p.addresses.Forget(sni)
+		return nil, fmt.Errorf("failed to connect to target via OOB: %w", err)
+	}
+	
+	// Optimize connection
+	connTuner.Tune(conn, targetAddr)
+	logger.Printf("🔹 TCP connection optimized with NoDelay and KeepAlive")
+	
+	logger.Printf("✅ Connected to %s via IP %s", sni, targetAddr)
+	return conn, nil
 }
 
-// getTargetConnViaOOB connects to the target server via OOB to conceal SNI
-func (p *TLSProxy) getTargetConnViaOOB(sni string, port string) (net.Conn, error) {
-	log.Printf("🔒 SNI CONCEALMENT: Initiating connection to %s:%s via OOB", sni, port)
+// resolveViaOOB has a relay resolve dest's SNI, returning the address and port to
+// connect to.
+func (p *TLSProxy) resolveViaOOB(ctx context.Context, dest Destination) (string, string, error) {
+	logger := sessionLog(ctx)
+	sni, port := dest.SNI, dest.Port
+	logger.Printf("🔒 SNI CONCEALMENT: Initiating connection to %s:%s via OOB", sni, port)
 	
-	// Create a simple request to the OOB server to signal SNI
-	serverAddr := p.OOB.GetServerAddress()
-	
-	// Check for empty server address
+	// Pick an OOB server, unless a rule names one; peers with an open
+	// circuit are skipped
+	serverAddr := p.OOB.PeerFor(dest)
 	if serverAddr == "" {
-		log.Printf("❌ ERROR: No OOB server address available!")
-		
-		// Try to find a server by probing each channel directly
-		for _, channel := range p.OOB.Channels {
-			if channel.Type == "http" && len(channel.Address) > 0 {
-				possibleAddr := fmt.Sprintf("%s:%d", channel.Address, channel.Port)
-				log.Printf("🔹 Attempting to reach OOB server at %s", possibleAddr)
-				
-				// Try a quick connection test
-				conn, err := net.DialTimeout("tcp", possibleAddr, 2*time.Second)
-				if err == nil {
-					conn.Close()
-					serverAddr = possibleAddr
-					log.Printf("✅ Successfully connected to OOB server at %s", serverAddr)
-					break
-				}
-			}
-		}
-		
-		if serverAddr == "" {
-			return nil, fmt.Errorf("no available OOB server for SNI concealment")
-		}
+		logger.Printf("❌ ERROR: No OOB server address available!")
+		return "", "", fmt.Errorf("%w for SNI concealment", errNoPeer)
 	}
 	
-	log.Printf("🔹 Using OOB server at %s", serverAddr)
+	logger = logger.With("peer", serverAddr)
+	logger.Printf("🔹 Using OOB server at %s", serverAddr)
 	
 	// Create a session ID
 	sessionID := fmt.Sprintf("%d", time.Now().UnixNano())
-	log.Printf("🔹 Created session ID: %s", sessionID)
+	logger.Printf("🔹 Created session ID: %s", sessionID)
 	
 	// Send a simple OOB request with just the SNI info
 	reqBody := fmt.Sprintf(`{"session_id":"%s","sni":"%s","port":"%s"}`, 
 		sessionID, sni, port)
 	
-	log.Printf("🔹 Sending SNI resolution request to OOB server")
-	req, _ := http.NewRequest("POST", 
-		fmt.Sprintf("http://%s/create_connection", serverAddr),
+	logger.Printf("🔹 Sending SNI resolution request to OOB server")
+	req, _ := http.NewRequestWithContext(ctx, "POST",
+		p.OOB.URL(serverAddr, "/create_connection"),
 		strings.NewReader(reqBody))
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "Sultry-Client/1.0")
 	
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := p.OOB.Client(p.OOB.Timeout(serverAddr, 10*time.Second))
+	start := time.Now()
 	resp, err := client.Do(req)
+	if err == nil && resp.StatusCode >= 500 {
+		p.OOB.ReportPeerResult(serverAddr, 0, fmt.Errorf("HTTP %d", resp.StatusCode))
+	} else {
+		p.OOB.ReportPeerResult(serverAddr, time.Since(start), err)
+	}
 	
 	if err != nil {
-		log.Printf("❌ SNI CONCEALMENT ERROR: Failed to send OOB request: %v", err)
-		return nil, fmt.Errorf("failed to send OOB request: %w", err)
+		logger.Printf("❌ SNI CONCEALMENT ERROR: Failed to send OOB request: %v", err)
+		return "", "", &oobError{Peer: serverAddr, Err: fmt.Errorf("failed to send OOB request: %w", err)}
 	}
 	defer resp.Body.Close()
 	
-	log.Printf("🔹 Received response from OOB server: HTTP %d", resp.StatusCode)
+	logger.Printf("🔹 Received response from OOB server: HTTP %d", resp.StatusCode)
 	
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		log.Printf("❌ SNI CONCEALMENT ERROR: OOB server returned error: %s", string(body))
-		return nil, fmt.Errorf("OOB server error: %s", string(body))
+		logger.Printf("❌ SNI CONCEALMENT ERROR: OOB server returned error: %s", string(body))
+		return "", "", &oobError{Peer: serverAddr, Status: resp.StatusCode, Err: fmt.Errorf("OOB server error: %s", string(body))}
 	}
 	
 	// Parse response to get connection details
@@ -1339,38 +1724,17 @@ func (p *TLSProxy) getTargetConnViaOOB(sni string, port string) (net.Conn, error
 	}
 	
 	if err := json.NewDecoder(resp.Body).Decode(&connResponse); err != nil {
-		log.Printf("❌ SNI CONCEALMENT ERROR: Failed to decode OOB response: %v", err)
-		return nil, fmt.Errorf("failed to decode OOB response: %w", err)
+		logger.Printf("❌ SNI CONCEALMENT ERROR: Failed to decode OOB response: %v", err)
+		return "", "", fmt.Errorf("failed to decode OOB response: %w", err)
 	}
 	
-	log.Printf("📝 OOB RESPONSE: Status=%s, Address=%s, Port=%s", 
+	logger.Printf("📝 OOB RESPONSE: Status=%s, Address=%s, Port=%s", 
 		connResponse.Status, connResponse.Address, connResponse.Port)
 	
 	if connResponse.Status != "ok" {
-		log.Printf("❌ SNI CONCEALMENT ERROR: OOB returned non-OK status: %s", connResponse.Status)
-		return nil, fmt.Errorf("OOB error: %s", connResponse.Status)
-	}
-	
-	// Connect to the target information returned by OOB server
-	targetAddr := fmt.Sprintf("%s:%s", connResponse.Address, connResponse.Port)
-	log.Printf("🔒 SNI CONCEALED: Connecting directly to IP %s (real hostname: %s)", targetAddr, sni)
-	
-	// Connect to the real target
-	log.Printf("🔹 Creating TCP connection to %s", targetAddr)
-	conn, err := net.DialTimeout("tcp", targetAddr, 10*time.Second)
-	if err != nil {
-		log.Printf("❌ SNI CONCEALMENT ERROR: Failed to connect to target: %v", err)
-		return nil, fmt.Errorf("failed to connect to target via OOB: %w", err)
-	}
-	
-	// Optimize connection
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		tcpConn.SetNoDelay(true)
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(30 * time.Second)
-		log.Printf("🔹 TCP connection optimized with NoDelay and KeepAlive")
+		logger.Printf("❌ SNI CONCEALMENT ERROR: OOB returned non-OK status: %s", connResponse.Status)
+		return "", "", fmt.Errorf("OOB error: %s", connResponse.Status)
 	}
-	
-	log.Printf("✅ SNI CONCEALMENT SUCCESSFUL: Connected to %s via IP %s", sni, targetAddr)
-	return conn, nil
+
+	return connResponse.Address, connResponse.Port, nil
 }
@@ -0,0 +1,184 @@
+//go:build !relay
+
+package main
+
+import (
+	"crypto/x509"
+	"net"
+	"sync"
+
+	sultrytls "sultry/pkg/tls"
+)
+
+// CoalescingConfig watches for HTTP/2 connection coalescing: a browser
+// with an h2 connection to one host sends requests for another host over
+// it, without a CONNECT of its own, when both resolve to a shared address
+// and the certificate covers both. Whatever the tunnel's policy was decided
+// on, the first host's, then silently applies to the second.
+type CoalescingConfig struct {
+	Detect          bool `json:"detect,omitempty"`           // Log and audit hosts whose requests may travel in another host's tunnel under a different policy
+	SeparateTunnels bool `json:"separate_tunnels,omitempty"` // Close such a tunnel when the other host connects, so each CONNECT authority keeps its own
+}
+
+// maxTappedHandshake bounds how much of a tunnel's server flight is parsed
+// for its ALPN and certificate.
+const maxTappedHandshake = 64 * 1024
+
+// coalescingTracker keeps the live tunnels that could carry coalesced
+// requests, by port and resolved address.
+type coalescingTracker struct {
+	cfg CoalescingConfig
+
+	mu    sync.Mutex
+	byKey map[string][]*coalescableTunnel
+}
+
+// coalescableTunnel is a live tunnel as far as coalescing goes.
+type coalescableTunnel struct {
+	tracker   *coalescingTracker
+	authority string
+	strategy  string
+	keys      []string // Port and resolved address pairs it's reachable by
+	close     func()   // Ends the tunnel
+
+	// The server's flight, followed until its ALPN and certificate are known
+	handshake sultrytls.Handshake
+	tapped    int
+
+	// Learned from the server's flight; guarded by tracker.mu
+	notH2 bool              // ALPN settled on something other than h2
+	leaf  *x509.Certificate // TLS 1.2 only, the certificate is encrypted in TLS 1.3
+}
+
+func newCoalescingTracker(cfg CoalescingConfig) *coalescingTracker {
+	if !cfg.Detect && !cfg.SeparateTunnels {
+		return nil
+	}
+	return &coalescingTracker{cfg: cfg, byKey: make(map[string][]*coalescableTunnel)}
+}
+
+// add registers a tunnel to authority, which resolved to ips, and compares
+// it with the live tunnels sharing an address. A nil tracker returns a nil
+// tunnel, whose methods do nothing.
+func (t *coalescingTracker) add(logger *sessionLogger, authority, port, strategy string, ips []net.IPAddr, close func()) *coalescableTunnel {
+	if t == nil {
+		return nil
+	}
+	tunnel := &coalescableTunnel{tracker: t, authority: authority, strategy: strategy, close: close}
+	for _, ip := range ips {
+		tunnel.keys = append(tunnel.keys, net.JoinHostPort(ip.IP.String(), port))
+	}
+
+	t.mu.Lock()
+	var shared []*coalescableTunnel
+	seen := make(map[*coalescableTunnel]bool)
+	for _, key := range tunnel.keys {
+		for _, other := range t.byKey[key] {
+			if !seen[other] && other.strategy != strategy && other.carries(authority) {
+				seen[other] = true
+				shared = append(shared, other)
+			}
+		}
+		t.byKey[key] = append(t.byKey[key], tunnel)
+	}
+	t.mu.Unlock()
+
+	for _, other := range shared {
+		logger.Printf("🔀 COALESCING: Requests for %s may travel in the h2 tunnel of %s, which uses %s rather than %s",
+			authority, other.authority, other.strategy, strategy)
+		audit(auditEvent{Event: "coalescing", Session: logger.ID(), Dest: authority, Strategy: strategy,
+			Coalesced: other.authority})
+		if t.cfg.SeparateTunnels {
+			logger.Printf("🔀 COALESCING: Closing the tunnel of %s so %s keeps its own", other.authority, authority)
+			other.close()
+		}
+	}
+	return tunnel
+}
+
+// carries reports whether a browser could send requests for authority over
+// the tunnel: it's h2, or may be, to a different host whose certificate
+// covers authority, or may. Called with tracker.mu held.
+func (c *coalescableTunnel) carries(authority string) bool {
+	if c.notH2 || c.authority == authority {
+		return false
+	}
+	return c.leaf == nil || c.leaf.VerifyHostname(authority) == nil
+}
+
+// remove unregisters the tunnel when it ends.
+func (c *coalescableTunnel) remove() {
+	if c == nil {
+		return
+	}
+	t := c.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range c.keys {
+		tunnels := t.byKey[key]
+		for i, tunnel := range tunnels {
+			if tunnel == c {
+				tunnels = append(tunnels[:i:i], tunnels[i+1:]...)
+				break
+			}
+		}
+		if len(tunnels) == 0 {
+			delete(t.byKey, key)
+		} else {
+			t.byKey[key] = tunnels
+		}
+	}
+}
+
+// tap returns conn, the client's side of the tunnel, with the server's
+// flight written to it followed for the negotiated ALPN and certificate.
+func (c *coalescableTunnel) tap(conn net.Conn) net.Conn {
+	if c == nil {
+		return conn
+	}
+	return coalescingTap{conn, c}
+}
+
+type coalescingTap struct {
+	net.Conn
+	tunnel *coalescableTunnel
+}
+
+func (t coalescingTap) Write(b []byte) (int, error) {
+	t.tunnel.observe(b)
+	return t.Conn.Write(b)
+}
+
+// observe feeds bytes from the server until what coalescing depends on is
+// known. Writes to the client come from one goroutine, so only what the
+// tracker reads is locked.
+func (c *coalescableTunnel) observe(b []byte) {
+	if c.tapped >= maxTappedHandshake {
+		return
+	}
+	c.tapped += len(b)
+	if c.handshake.FromServer(b) != nil {
+		c.tapped = maxTappedHandshake
+		return
+	}
+
+	hello := c.handshake.ServerHello()
+	if hello == nil || hello.HelloRetryRequest {
+		return
+	}
+	certificates := c.handshake.Certificates()
+	notH2 := hello.ALPNKnown && hello.ALPN != "h2"
+	if hello.ALPNKnown && !notH2 && len(certificates) == 0 {
+		return // TLS 1.2 with h2: the Certificate message follows
+	}
+	c.tapped = maxTappedHandshake
+
+	var leaf *x509.Certificate
+	if len(certificates) > 0 {
+		leaf, _ = x509.ParseCertificate(certificates[0])
+	}
+	c.tracker.mu.Lock()
+	c.notH2 = notH2
+	c.leaf = leaf
+	c.tracker.mu.Unlock()
+}
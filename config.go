@@ -2,20 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"os"
 )
 
-// OOBChannelConfig is defined in oob.go
-
-// Config represents the application configuration
-type Config struct {
-	LocalProxyAddr   string             `json:"local_proxy_addr"`
-	RelayPort        int                `json:"relay_port"`
-	CoverSNI         string             `json:"cover_sni,omitempty"`
-	OOBChannels      []OOBChannelConfig `json:"oob_channels"` // Changed from []OOBChannel
-	PrioritizeSNI    bool               `json:"prioritize_sni_concealment"`
-	HandshakeTimeout int                `json:"handshake_timeout,omitempty"`
-}
+// configPath is the configuration file the proxy runs with, in the working
+// directory.
+const configPath = "config.json"
 
 // LoadConfig reads the configuration from the specified file.
 func LoadConfig(configPath string) (*Config, error) {
@@ -28,6 +21,12 @@ func LoadConfig(configPath string) (*Config, error) {
 	if err := json.Unmarshal(data, &config); err != nil {
 		return nil, err
 	}
+	// Keys and channels that would be ignored are worth knowing about
+	for _, issue := range lintConfig(data) {
+		if issue.Level == lintWarning {
+			log.Printf("⚠️ %s: %s (see sultry config lint)", configPath, issue)
+		}
+	}
 
 	return &config, nil
 }
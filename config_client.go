@@ -0,0 +1,88 @@
+//go:build !relay
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// OOBChannelConfig is defined in oob.go
+
+// Config represents the application configuration
+type Config struct {
+	LocalProxyAddr      string                      `json:"local_proxy_addr"`
+	Listeners           []ListenerConfig            `json:"listeners,omitempty"` // More addresses to accept HTTP, SOCKS5 or transparent connections on, each with its own options
+	RelayPort           int                         `json:"relay_port"`
+	CoverSNI            string                      `json:"cover_sni,omitempty"`
+	CoverCheck          CoverCheckConfig            `json:"cover_check,omitempty"` // Periodic validation of cover_sni
+	OOBChannels         []OOBChannelConfig          `json:"oob_channels"`          // Changed from []OOBChannel
+	PrioritizeSNI       bool                        `json:"prioritize_sni_concealment"`
+	HandshakeTimeout    int                         `json:"handshake_timeout,omitempty"`
+	IdleTimeout         int                         `json:"idle_timeout,omitempty"` // Milliseconds a relay may carry nothing after its handshake before it is closed (default: never)
+	LoadBalancing       LoadBalancerConfig          `json:"load_balancing,omitempty"`
+	Fragment            FragmentConfig              `json:"fragment,omitempty"`
+	OOBTLS              OOBTLSConfig                `json:"oob_tls,omitempty"`
+	Desync              DesyncConfig                `json:"desync,omitempty"`
+	Shaping             ShapingConfig               `json:"shaping,omitempty"`
+	Auth                AuthConfig                  `json:"auth,omitempty"`
+	OOBFraming          string                      `json:"oob_framing,omitempty"`      // "json" (default) or "binary"
+	OOBMux              bool                        `json:"oob_mux,omitempty"`          // Multiplex all OOB requests to a peer over one connection
+	OOBTransport        OOBTransportConfig          `json:"oob_transport,omitempty"`    // Connection reuse and timeouts for OOB requests
+	OOBRetry            RetryConfig                 `json:"oob_retry,omitempty"`        // Retries with backoff for transient OOB request failures
+	OOBUserAgent        string                      `json:"oob_user_agent,omitempty"`   // User-Agent of OOB requests (default: Sultry/<version> (OOB protocol <n>))
+	Decoy               DecoyConfig                 `json:"decoy,omitempty"`            // Static site served to visitors that are not sultry clients
+	Heartbeat           HeartbeatConfig             `json:"heartbeat,omitempty"`        // Background liveness checks of OOB peers
+	Status              StatusConfig                `json:"status,omitempty"`           // JSON health endpoints
+	HandshakeLimits     HandshakeLimitsConfig       `json:"handshake_limits,omitempty"` // Ceilings on relayed handshakes (server)
+	VerifyTarget        TargetVerifyConfig          `json:"verify_target,omitempty"`    // Certificate checks of relayed targets (server)
+	Strategies          []string                    `json:"strategies,omitempty"`       // Connection strategies in the order they're tried
+	KillSwitch          bool                        `json:"kill_switch,omitempty"`      // Refuse tunnels concealment fails for, rather than fall back to strategies exposing their SNI
+	FailureDiary        FailureDiaryConfig          `json:"failure_diary,omitempty"`
+	ErrorBudget         ErrorBudgetConfig           `json:"error_budget,omitempty"`     // Disable strategies that fail too often everywhere
+	TicketCache         TicketCacheConfig           `json:"ticket_cache,omitempty"`     // Session tickets captured by relays, per host
+	Audit               AuditConfig                 `json:"audit,omitempty"`            // JSON-lines log of connection outcomes and fallbacks
+	DryRun              bool                        `json:"dry_run,omitempty"`          // Connect every tunnel directly and only log the strategy that would have been used
+	Transparent         TransparentConfig           `json:"transparent,omitempty"`      // Accept connections diverted by the firewall
+	H2Coalescing        CoalescingConfig            `json:"h2_coalescing,omitempty"`    // Watch for browsers coalescing h2 requests for several hosts onto one tunnel
+	HandshakeEvents     bool                        `json:"handshake_events,omitempty"` // Stream handshake responses over server-sent events
+	WebTransport        WebTransportConfig          `json:"webtransport,omitempty"`
+	SSH                 SSHConfig                   `json:"ssh,omitempty"`
+	Log                 LogConfig                   `json:"log,omitempty"`
+	ProxyProtocol       []ProxyProtocolRoute        `json:"proxy_protocol,omitempty"`   // PROXY protocol headers sent to matching targets
+	TunnelLifetimes     []TunnelLifetime            `json:"tunnel_lifetimes,omitempty"` // Rotate tunnels to matching destinations after a while
+	TunnelClasses       TunnelClassesConfig         `json:"tunnel_classes,omitempty"`   // WebSocket detection and idle timeouts by tunnel class
+	AcceptProxyProtocol ProxyProtocolListenerConfig `json:"accept_proxy_protocol,omitempty"`
+	MITM                MITMConfig                  `json:"mitm,omitempty"`             // Terminate TLS for chosen hosts with a local CA
+	KeyLogFile          string                      `json:"key_log_file,omitempty"`     // NSS key log of the TLS connections sultry makes, for Wireshark (default: $SSLKEYLOGFILE)
+	Strict              bool                        `json:"strict,omitempty"`           // Serve only the authenticated OOB API, without legacy endpoints (server)
+	DoH                 DoHConfig                   `json:"doh,omitempty"`              // DNS-over-HTTPS resolvers, tunneled only by concealing strategies
+	SOCKS               SOCKSConfig                 `json:"socks,omitempty"`            // SOCKS5 listener feeding the same tunnels as CONNECT requests
+	KeepAlive           []KeepAliveRoute            `json:"keepalive,omitempty"`        // TCP keep-alive probes of relay connections to matching addresses
+	Webhooks            WebhooksConfig              `json:"webhooks,omitempty"`         // Operator notifications of critical events
+	ProxyAuth           ProxyAuthConfig             `json:"proxy_auth,omitempty"`       // Basic authentication on the HTTP proxy listener
+	PAC                 PACConfig                   `json:"pac,omitempty"`              // Hosts the proxy.pac served by the HTTP proxy listener sends through sultry
+	LegacyTLS           string                      `json:"legacy_tls,omitempty"`       // TLS 1.0 and 1.1 handshakes: "allow", "warn" (default) or "deny"
+	UpstreamProxies     []UpstreamProxyRoute        `json:"upstream_proxies,omitempty"` // Proxies the client reaches matching targets and OOB peers through
+	Race                RaceConfig                  `json:"race,omitempty"`             // Race handshakes over several addresses of targets with many
+	Throttle            ThrottleConfig              `json:"throttle,omitempty"`         // Bandwidth limits per relayed connection and per client address
+	Transcripts         TranscriptConfig            `json:"transcripts,omitempty"`      // Record the OOB exchanges of tunnels, writing those of failed ones to files
+	SourcePorts         SourcePortConfig            `json:"source_ports,omitempty"`     // Local ports the relay connects to targets from
+	ConnectPorts        ConnectPortsConfig          `json:"connect_ports,omitempty"`    // Destination ports clients may open tunnels to with CONNECT or SOCKS5
+	HTTPSFallback       bool                        `json:"https_fallback,omitempty"`   // Fetch plain HTTP requests over HTTPS through a tunnel when the target refuses them or redirects to HTTPS
+	HTTPFetch           HTTPFetchConfig             `json:"http_fetch,omitempty"`       // Size and time limits of plain HTTP requests forwarded by the proxy
+	Rules               []RoutingRule               `json:"rules,omitempty"`            // How tunnels to matching hosts connect: direct, conceal, block or forward through a peer
+	RulesWatch          int                         `json:"rules_watch,omitempty"`      // Milliseconds between checks of config.json and the rule lists for changes, reloading the rules (default: 0, only on SIGHUP)
+	CoverRules          []CoverRule                 `json:"cover_rules,omitempty"`      // Cover SNIs of tunnels to matching hosts, in place of cover_sni
+	AddressCache        AddressCacheConfig          `json:"address_cache,omitempty"`    // Addresses relays resolved, which oob connects to while none answers
+	Tun                 TunConfig                   `json:"tun,omitempty"`              // Tun device whose flows the client terminates, as routed traffic rather than proxy clients
+}
+
+// coverPeers returns the OOB peers cover_sni is sent towards.
+func coverPeers(config *Config) []string {
+	var peers []string
+	for _, channel := range config.OOBChannels {
+		peers = append(peers, net.JoinHostPort(channel.Address, fmt.Sprint(channel.Port)))
+	}
+	return peers
+}
@@ -0,0 +1,32 @@
+//go:build relay
+
+package main
+
+// Config is the configuration of a relay-only build: the settings of the
+// server component, without any of the client's. Keys of the full schema
+// that only the client reads are reported by "sultry config lint" as
+// unknown, since this build ignores them.
+type Config struct {
+	RelayPort           int                         `json:"relay_port"`
+	CoverSNI            string                      `json:"cover_sni,omitempty"`
+	CoverCheck          CoverCheckConfig            `json:"cover_check,omitempty"` // Periodic validation of cover_sni
+	HandshakeTimeout    int                         `json:"handshake_timeout,omitempty"`
+	IdleTimeout         int                         `json:"idle_timeout,omitempty"` // Milliseconds a relay may carry nothing after its handshake before it is closed (default: never)
+	OOBTLS              OOBTLSConfig                `json:"oob_tls,omitempty"`
+	Auth                AuthConfig                  `json:"auth,omitempty"`
+	Decoy               DecoyConfig                 `json:"decoy,omitempty"`            // Static site served to visitors that are not sultry clients
+	Status              StatusConfig                `json:"status,omitempty"`           // JSON health endpoints
+	HandshakeLimits     HandshakeLimitsConfig       `json:"handshake_limits,omitempty"` // Ceilings on relayed handshakes
+	VerifyTarget        TargetVerifyConfig          `json:"verify_target,omitempty"`    // Certificate checks of relayed targets
+	Audit               AuditConfig                 `json:"audit,omitempty"`            // JSON-lines log of connection outcomes
+	WebTransport        WebTransportConfig          `json:"webtransport,omitempty"`
+	Log                 LogConfig                   `json:"log,omitempty"`
+	AcceptProxyProtocol ProxyProtocolListenerConfig `json:"accept_proxy_protocol,omitempty"`
+	KeyLogFile          string                      `json:"key_log_file,omitempty"` // NSS key log of the TLS connections sultry makes, for Wireshark (default: $SSLKEYLOGFILE)
+	Strict              bool                        `json:"strict,omitempty"`       // Serve only the authenticated OOB API, without legacy endpoints
+	KeepAlive           []KeepAliveRoute            `json:"keepalive,omitempty"`    // TCP keep-alive probes of relay connections to matching addresses
+	Webhooks            WebhooksConfig              `json:"webhooks,omitempty"`     // Operator notifications of critical events
+	LegacyTLS           string                      `json:"legacy_tls,omitempty"`   // TLS 1.0 and 1.1 handshakes: "allow", "warn" (default) or "deny"
+	Throttle            ThrottleConfig              `json:"throttle,omitempty"`     // Bandwidth limits per relayed connection and per client address
+	SourcePorts         SourcePortConfig            `json:"source_ports,omitempty"` // Local ports the relay connects to targets from
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Severity of a configuration issue.
+const (
+	lintError   = "error"   // The proxy refuses to start with it
+	lintWarning = "warning" // Accepted, but probably not what was meant
+	lintLegacy  = "legacy"  // Works, but "config migrate" rewrites it
+)
+
+// configIssue is a problem found in a configuration file.
+type configIssue struct {
+	Level   string
+	Path    string // Key the issue is about, e.g. oob_channels[2].type
+	Message string
+}
+
+func (i configIssue) String() string {
+	if i.Path == "" {
+		return fmt.Sprintf("%s: %s", i.Level, i.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", i.Level, i.Path, i.Message)
+}
+
+var listIndex = regexp.MustCompile(`\.(\d+)`)
+
+// lintConfig checks a configuration file against the Config schema: its
+// syntax, the types of its values, keys the decoder would silently ignore,
+// values the proxy ignores or rejects, and legacy settings.
+func lintConfig(data []byte) []configIssue {
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		message := err.Error()
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line := 1 + bytes.Count(data[:syntaxErr.Offset], []byte("\n"))
+			message = fmt.Sprintf("line %d: %v", line, err)
+		}
+		return []configIssue{{Level: lintError, Message: message}}
+	}
+
+	var issues []configIssue
+	unknownKeys(reflect.TypeOf(Config{}), raw, "", &issues)
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			// The decoder separates list indexes with dots too
+			path := listIndex.ReplaceAllString(typeErr.Field, "[$1]")
+			return append(issues, configIssue{Level: lintError, Path: path,
+				Message: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value)})
+		}
+		return append(issues, configIssue{Level: lintError, Message: err.Error()})
+	}
+	return append(issues, checkConfig(&config)...)
+}
+
+// checkConfig flags values that are ignored or rejected once decoded.
+func checkConfig(config *Config) []configIssue {
+	issues := checkClientConfig(config)
+	if config.Strict {
+		if err := checkStrict(config); err != nil {
+			issues = append(issues, configIssue{lintError, "strict", "the server refuses to start: " + err.Error()})
+		}
+	}
+	if f := config.Log.Format; f != "" && f != "text" && f != "json" {
+		issues = append(issues, configIssue{lintError, "log.format", fmt.Sprintf("unknown log format %q (use text or json)", f)})
+	}
+	if p := config.LegacyTLS; p != "" && p != legacyTLSAllow && p != legacyTLSWarn && p != legacyTLSDeny {
+		issues = append(issues, configIssue{lintError, "legacy_tls", fmt.Sprintf("unknown policy %q (use allow, warn or deny)", p)})
+	}
+	if t := config.Throttle; t.PerConnection < 0 || t.PerClient < 0 || t.Burst < 0 {
+		issues = append(issues, configIssue{lintError, "throttle", "limits can't be negative"})
+	}
+	if err := config.AcceptProxyProtocol.validate(); err != nil {
+		issues = append(issues, configIssue{lintError, "accept_proxy_protocol", err.Error()})
+	}
+	if err := config.SourcePorts.validate(); err != nil {
+		issues = append(issues, configIssue{lintError, "source_ports", err.Error()})
+	} else if s := config.SourcePorts; s.Range == "" && (s.Policy != "" || s.ReuseDelay != 0) {
+		issues = append(issues, configIssue{lintWarning, "source_ports", "no range is set, so the system picks source ports"})
+	}
+	return issues
+}
+
+// jsonField is a key of a struct's JSON encoding.
+type jsonField struct {
+	Name string
+	Type reflect.Type
+}
+
+// jsonFields lists the keys of t's JSON encoding in declaration order.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			fields = append(fields, jsonFields(f.Type)...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{Name: name, Type: f.Type})
+	}
+	return fields
+}
+
+// lookupField finds key among fields the way encoding/json does, preferring
+// an exact match over a case-insensitive one.
+func lookupField(fields []jsonField, key string) (jsonField, bool) {
+	for _, f := range fields {
+		if f.Name == key {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, key) {
+			return f, true
+		}
+	}
+	return jsonField{}, false
+}
+
+// unknownKeys reports the keys of value, decoded generically, that have no
+// field in t, recursing into nested objects and lists.
+func unknownKeys(t reflect.Type, value any, path string, issues *[]configIssue) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return
+		}
+		fields := jsonFields(t)
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if f, ok := lookupField(fields, key); ok {
+				unknownKeys(f.Type, obj[key], joinKey(path, key), issues)
+			} else {
+				*issues = append(*issues, configIssue{lintWarning, joinKey(path, key), "unknown key, ignored"})
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		list, _ := value.([]any)
+		for i, v := range list {
+			unknownKeys(t.Elem(), v, fmt.Sprintf("%s[%d]", path, i), issues)
+		}
+	case reflect.Map:
+		obj, _ := value.(map[string]any)
+		for key, v := range obj {
+			unknownKeys(t.Elem(), v, joinKey(path, key), issues)
+		}
+	}
+}
+
+func joinKey(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// migrateConfig rewrites a configuration in the current schema: unknown keys
+// and ignored channels are dropped, the strategy order the legacy flags
+// imply is written out, and empty sections are left out. It returns the new
+// file and a note per change.
+func migrateConfig(data []byte) ([]byte, []string, error) {
+	for _, issue := range lintConfig(data) {
+		if issue.Level == lintError {
+			return nil, nil, fmt.Errorf("fix the errors first: %s", issue)
+		}
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, nil, err
+	}
+
+	var notes []string
+	var raw any
+	json.Unmarshal(data, &raw)
+	var unknown []configIssue
+	unknownKeys(reflect.TypeOf(config), raw, "", &unknown)
+	for _, issue := range unknown {
+		notes = append(notes, fmt.Sprintf("dropped unknown key %s", issue.Path))
+	}
+	notes = append(notes, migrateClientConfig(&config)...)
+
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var generic any
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, nil, err
+	}
+	ordered, _ := orderLikeSchema(reflect.TypeOf(config), generic)
+	out, err := json.MarshalIndent(ordered, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(out, '\n'), notes, nil
+}
+
+// orderedObject is a JSON object that keeps its keys in order.
+type orderedObject []orderedMember
+
+type orderedMember struct {
+	Key   string
+	Value any
+}
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(m.Key)
+		value, err := json.Marshal(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// orderLikeSchema orders the keys of value as t declares them and drops
+// nulls, empty objects and empty lists. It reports whether anything is left.
+func orderLikeSchema(t reflect.Type, value any) (any, bool) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Interface {
+		return value, value != nil
+	}
+	switch v := value.(type) {
+	case nil:
+		return nil, false
+	case map[string]any:
+		var obj orderedObject
+		if t.Kind() == reflect.Struct {
+			for _, f := range jsonFields(t) {
+				// A missing key decodes to the zero value as well
+				if f.Type.Kind() != reflect.Pointer && isZeroJSON(v[f.Name]) {
+					continue
+				}
+				if member, ok := orderLikeSchema(f.Type, v[f.Name]); ok {
+					obj = append(obj, orderedMember{f.Name, member})
+				}
+			}
+		} else if t.Kind() == reflect.Map {
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if member, ok := orderLikeSchema(t.Elem(), v[key]); ok {
+					obj = append(obj, orderedMember{key, member})
+				}
+			}
+		}
+		return obj, len(obj) > 0
+	case []any:
+		list := make([]any, 0, len(v))
+		for _, item := range v {
+			// Keep list positions even for empty entries
+			member, _ := orderLikeSchema(t.Elem(), item)
+			list = append(list, member)
+		}
+		return list, len(list) > 0
+	}
+	return value, true
+}
+
+// isZeroJSON reports whether value is false, zero or an empty string.
+func isZeroJSON(value any) bool {
+	switch v := value.(type) {
+	case bool:
+		return !v
+	case string:
+		return v == ""
+	case json.Number:
+		f, err := v.Float64()
+		return err == nil && f == 0
+	}
+	return false
+}
+
+// configLint implements "sultry config lint".
+func configLint(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("config lint", flag.ContinueOnError)
+	path := flags.String("config", "config.json", "configuration file to check")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(*path)
+	if err != nil {
+		return err
+	}
+
+	issues := lintConfig(data)
+	errs := 0
+	for _, issue := range issues {
+		fmt.Fprintln(out, issue)
+		if issue.Level == lintError {
+			errs++
+		}
+	}
+	switch {
+	case errs > 0:
+		return fmt.Errorf("%s: %d error(s)", *path, errs)
+	case len(issues) == 0:
+		fmt.Fprintf(out, "✅ %s is valid\n", *path)
+	}
+	return nil
+}
+
+// configMigrate implements "sultry config migrate".
+func configMigrate(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("config migrate", flag.ContinueOnError)
+	path := flags.String("config", "config.json", "configuration file to migrate")
+	write := flags.Bool("w", false, "replace the file, keeping the original as <file>.bak, instead of printing the result")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(*path)
+	if err != nil {
+		return err
+	}
+
+	migrated, notes, err := migrateConfig(data)
+	if err != nil {
+		return err
+	}
+	for _, note := range notes {
+		fmt.Fprintf(os.Stderr, "🔹 %s\n", note)
+	}
+	if !*write {
+		_, err := out.Write(migrated)
+		return err
+	}
+	if err := os.WriteFile(*path+".bak", data, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*path, migrated, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "✅ Migrated %s (original kept as %s.bak)\n", *path, *path)
+	return nil
+}
@@ -0,0 +1,143 @@
+//go:build !relay
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// supportedChannelTypes are the oob_channels types a peer is created for;
+// channels of other types are skipped.
+var supportedChannelTypes = []string{"http", "https", "webtransport", "ssh", "loopback"}
+
+// checkClientConfig flags values of the client's settings that are ignored
+// or rejected once decoded.
+func checkClientConfig(config *Config) []configIssue {
+	var issues []configIssue
+	for i, channel := range config.OOBChannels {
+		path := fmt.Sprintf("oob_channels[%d]", i)
+		switch {
+		case !slices.Contains(supportedChannelTypes, channel.Type):
+			issues = append(issues, configIssue{lintWarning, path + ".type", fmt.Sprintf(
+				"type %q is not supported, the channel is ignored (use %s)", channel.Type, strings.Join(supportedChannelTypes, ", "))})
+		case channel.Type == "loopback":
+			// In-process, needs neither an address nor a port
+		case channel.Address == "":
+			issues = append(issues, configIssue{lintWarning, path + ".address", "missing, the channel is ignored"})
+		case channel.Port <= 0 || channel.Port > 65535:
+			issues = append(issues, configIssue{lintWarning, path + ".port", "missing or not a valid port"})
+		}
+	}
+
+	known := registeredStrategies()
+	for i, name := range config.Strategies {
+		if !slices.Contains(known, name) {
+			issues = append(issues, configIssue{lintError, fmt.Sprintf("strategies[%d]", i), fmt.Sprintf(
+				"unknown strategy %q (known: %s)", name, strings.Join(known, ", "))})
+		}
+	}
+	if len(config.Strategies) == 0 {
+		issues = append(issues, configIssue{lintLegacy, "strategies", fmt.Sprintf(
+			"not set, so the order %s is derived from prioritize_sni_concealment, cover_sni, desync.enabled and fragment.enabled",
+			strings.Join(legacyStrategies(config.PrioritizeSNI, config.CoverSNI, config.Desync.Enabled, config.Fragment.Enabled), " → "))})
+	}
+	names := config.Strategies
+	if len(names) == 0 {
+		names = legacyStrategies(config.PrioritizeSNI, config.CoverSNI, config.Desync.Enabled, config.Fragment.Enabled)
+	}
+	if config.KillSwitch && !slices.ContainsFunc(names, func(name string) bool { return sniHidingStrategies[name] }) {
+		issues = append(issues, configIssue{lintWarning, "kill_switch", "no strategy hiding the SNI (cover) is configured, so it has no effect"})
+	}
+	if err := checkKillSwitch(config); err != nil {
+		issues = append(issues, configIssue{lintError, "kill_switch", err.Error()})
+	}
+
+	checkEnum := func(path, value string, allowed ...string) {
+		if value != "" && !slices.Contains(allowed, value) {
+			issues = append(issues, configIssue{lintWarning, path, fmt.Sprintf(
+				"unknown value %q, the default is used (use %s)", value, strings.Join(allowed, ", "))})
+		}
+	}
+	checkEnum("oob_framing", config.OOBFraming, "json", "binary")
+	checkEnum("load_balancing.strategy", config.LoadBalancing.Strategy, "round_robin", "weighted", "latency")
+	if config.Race.Addresses > maxRacers {
+		issues = append(issues, configIssue{lintWarning, "race.addresses", fmt.Sprintf(
+			"%d addresses, but at most %d are raced", config.Race.Addresses, maxRacers)})
+	}
+	if t := config.Transcripts; t.Dir == "" && (t.All || t.MaxBody != 0) {
+		issues = append(issues, configIssue{lintWarning, "transcripts", "no dir is set, so nothing is recorded"})
+	} else if t.MaxBody < 0 {
+		issues = append(issues, configIssue{lintError, "transcripts.max_body", "can't be negative"})
+	}
+	peers := newPeerBalancer(config.OOBChannels, LoadBalancerConfig{}).Peers()
+	for i, rule := range config.Rules {
+		if err := rule.validate(peers); err != nil {
+			issues = append(issues, configIssue{lintError, fmt.Sprintf("rules[%d]", i), err.Error()})
+		}
+		for j, list := range rule.Lists {
+			if list.validate() != nil {
+				continue // Reported with the rule
+			}
+			if _, _, err := loadHostList(list); err != nil {
+				issues = append(issues, configIssue{lintError, fmt.Sprintf("rules[%d].lists[%d]", i, j), err.Error()})
+			}
+		}
+	}
+	for i, rule := range config.CoverRules {
+		if err := rule.validate(); err != nil {
+			issues = append(issues, configIssue{lintError, fmt.Sprintf("cover_rules[%d]", i), err.Error()})
+		}
+	}
+	for i, pattern := range config.DoH.Resolvers {
+		if err := validHostPattern(pattern); err != nil {
+			issues = append(issues, configIssue{lintError, fmt.Sprintf("doh.resolvers[%d]", i), err.Error()})
+		}
+	}
+	if config.HTTPFetch.validate() != nil {
+		issues = append(issues, configIssue{lintError, "http_fetch", "limits can't be negative, except read_timeout: -1"})
+	}
+	if err := config.ConnectPorts.validate(); err != nil {
+		issues = append(issues, configIssue{lintError, "connect_ports", err.Error()})
+	} else if c := config.ConnectPorts; c.Allow != nil && len(c.Allow) == 0 {
+		issues = append(issues, configIssue{lintWarning, "connect_ports.allow", "is empty, so every tunnel is refused"})
+	}
+	for i, inspector := range config.MITM.Inspectors {
+		if _, err := newInspector(inspector); err != nil {
+			issues = append(issues, configIssue{lintError, fmt.Sprintf("mitm.inspectors[%d]", i), err.Error()})
+		}
+	}
+	for i, listener := range config.Listeners {
+		if err := listener.validate(); err != nil {
+			issues = append(issues, configIssue{lintError, fmt.Sprintf("listeners[%d]", i), err.Error()})
+		}
+	}
+	for i, route := range config.UpstreamProxies {
+		if _, err := parseUpstreamProxy(route.Proxy); err != nil {
+			issues = append(issues, configIssue{lintError, fmt.Sprintf("upstream_proxies[%d].proxy", i), err.Error()})
+		}
+	}
+	return issues
+}
+
+// migrateClientConfig drops the channels the client ignores and writes out
+// the strategy order the legacy flags imply, returning a note per change.
+func migrateClientConfig(config *Config) []string {
+	var notes []string
+	channels := config.OOBChannels[:0]
+	for i, channel := range config.OOBChannels {
+		if !slices.Contains(supportedChannelTypes, channel.Type) || (channel.Address == "" && channel.Type != "loopback") {
+			notes = append(notes, fmt.Sprintf("dropped oob_channels[%d] (%s %s), which was ignored", i, channel.Type, channel.Address))
+			continue
+		}
+		channels = append(channels, channel)
+	}
+	config.OOBChannels = channels
+
+	if len(config.Strategies) == 0 {
+		config.Strategies = legacyStrategies(config.PrioritizeSNI, config.CoverSNI, config.Desync.Enabled, config.Fragment.Enabled)
+		notes = append(notes, fmt.Sprintf("set strategies to %q, the order implied by the legacy flags; it no longer follows them", config.Strategies))
+	}
+	return notes
+}
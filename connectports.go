@@ -0,0 +1,119 @@
+//go:build !relay
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Destination ports of tunnels
+//
+// A proxy that tunnels anywhere lets every program that can reach it
+// connect to any service through it, mail servers on port 25 included, and
+// the traffic leaves from the proxy's address. Tunnels clients ask for, with
+// CONNECT or SOCKS5, are only opened to allowed ports that aren't also
+// denied; by default those are the HTTPS ports 443 and 8443.
+
+// ConnectPortsConfig decides which destination ports clients may open
+// tunnels to.
+type ConnectPortsConfig struct {
+	Allow []string `json:"allow,omitempty"` // Ports or ranges tunnels may go to, e.g. "443", "8000-8999", or "*" for any (default: 443 and 8443)
+	Deny  []string `json:"deny,omitempty"`  // Ports or ranges refused even when allowed (default: 25; [] denies none)
+}
+
+var defaultConnectPorts = ConnectPortsConfig{Allow: []string{"443", "8443"}, Deny: []string{"25"}}
+
+// portRange is a range of ports, both ends included.
+type portRange struct {
+	low, high int
+}
+
+// portPolicy is a compiled ConnectPortsConfig.
+type portPolicy struct {
+	allow, deny []portRange
+}
+
+// connectPorts is the policy installed by setupConnectPorts.
+var connectPorts, _ = newPortPolicy(defaultConnectPorts)
+
+// withDefaults fills in the lists that aren't configured. An empty list is
+// configured: "deny": [] denies nothing.
+func (cfg ConnectPortsConfig) withDefaults() ConnectPortsConfig {
+	if cfg.Allow == nil {
+		cfg.Allow = defaultConnectPorts.Allow
+	}
+	if cfg.Deny == nil {
+		cfg.Deny = defaultConnectPorts.Deny
+	}
+	return cfg
+}
+
+// validate checks the ports of both lists.
+func (cfg ConnectPortsConfig) validate() error {
+	_, err := newPortPolicy(cfg)
+	return err
+}
+
+// newPortPolicy compiles the lists of cfg as they are, without defaults.
+func newPortPolicy(cfg ConnectPortsConfig) (*portPolicy, error) {
+	parse := func(key string, list []string) ([]portRange, error) {
+		var ranges []portRange
+		for _, entry := range list {
+			if strings.TrimSpace(entry) == "*" {
+				ranges = append(ranges, portRange{1, 65535})
+				continue
+			}
+			low, high, err := parsePortRange(entry)
+			if err != nil {
+				return nil, fmt.Errorf("connect_ports.%s: %w", key, err)
+			}
+			ranges = append(ranges, portRange{low, high})
+		}
+		return ranges, nil
+	}
+	allow, err := parse("allow", cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parse("deny", cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &portPolicy{allow: allow, deny: deny}, nil
+}
+
+// setupConnectPorts installs the destination ports tunnels may go to.
+func setupConnectPorts(cfg ConnectPortsConfig) error {
+	cfg = cfg.withDefaults()
+	policy, err := newPortPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	connectPorts = policy
+	denied := "none"
+	if len(cfg.Deny) > 0 {
+		denied = strings.Join(cfg.Deny, ", ")
+	}
+	log.Printf("🚪 Tunnels may go to ports %s, except %s", strings.Join(cfg.Allow, ", "), denied)
+	return nil
+}
+
+// allows reports whether tunnels may go to port.
+func (p *portPolicy) allows(port string) bool {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	contains := func(ranges []portRange) bool {
+		for _, r := range ranges {
+			if n >= r.low && n <= r.high {
+				return true
+			}
+		}
+		return false
+	}
+	return contains(p.allow) && !contains(p.deny)
+}
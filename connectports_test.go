@@ -0,0 +1,57 @@
+//go:build !relay
+
+package main
+
+import "testing"
+
+func TestPortPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ConnectPortsConfig
+		allowed []string
+		denied  []string
+	}{
+		{"defaults", ConnectPortsConfig{}, []string{"443", "8443"}, []string{"80", "25", "22", "0", "https", ""}},
+		{"range", ConnectPortsConfig{Allow: []string{"8000-8999"}}, []string{"8000", "8443", "8999"}, []string{"7999", "9000", "443"}},
+		{"any but mail", ConnectPortsConfig{Allow: []string{"*"}}, []string{"1", "80", "65535"}, []string{"25", "65536", "-1"}},
+		{"deny a range", ConnectPortsConfig{Allow: []string{"*"}, Deny: []string{"1-1023"}}, []string{"1024", "8443"}, []string{"1", "443"}},
+		{"deny none", ConnectPortsConfig{Allow: []string{"25", " 587 "}, Deny: []string{}}, []string{"25", "587"}, []string{"443"}},
+		{"deny wins", ConnectPortsConfig{Allow: []string{"443"}, Deny: []string{"443"}}, nil, []string{"443"}},
+	}
+	for _, tt := range tests {
+		policy, err := newPortPolicy(tt.cfg.withDefaults())
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		for _, port := range tt.allowed {
+			if !policy.allows(port) {
+				t.Errorf("%s: port %q refused", tt.name, port)
+			}
+		}
+		for _, port := range tt.denied {
+			if policy.allows(port) {
+				t.Errorf("%s: port %q allowed", tt.name, port)
+			}
+		}
+	}
+}
+
+func TestConnectPortsValidate(t *testing.T) {
+	tests := []struct {
+		cfg   ConnectPortsConfig
+		valid bool
+	}{
+		{ConnectPortsConfig{Allow: []string{"443", "8000-8999", "*"}, Deny: []string{"25"}}, true},
+		{ConnectPortsConfig{Allow: []string{"https"}}, false},
+		{ConnectPortsConfig{Allow: []string{"0"}}, false},
+		{ConnectPortsConfig{Allow: []string{"65536"}}, false},
+		{ConnectPortsConfig{Allow: []string{"9000-8000"}}, false},
+		{ConnectPortsConfig{Deny: []string{"25-"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validate(); (err == nil) != tt.valid {
+			t.Errorf("validate(%+v) = %v, want valid %v", tt.cfg, err, tt.valid)
+		}
+	}
+}
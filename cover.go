@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The cover strategy completes the dual-channel design: the real ClientHello
+// travels to the relay over the OOB channel, which opens the connection to
+// the target and forwards it, while the main channel to the relay only ever
+// shows the cover SNI. Once the relay has attached the main channel to the
+// target connection, the rest of the TLS session flows over it end to end.
+
+// coverRelayRequest asks the relay to connect to a target and send it the
+// real ClientHello, holding the connection for the main channel to attach.
+type coverRelayRequest struct {
+	SessionID   string `json:"session_id"`
+	Host        string `json:"host"`
+	Port        string `json:"port"`
+	ClientHello []byte `json:"client_hello,omitempty"`
+}
+
+// pendingCoverRelays holds target connections opened for /cover_open until
+// their main channel attaches.
+var pendingCoverRelays = struct {
+	conns map[string]net.Conn
+	mu    sync.Mutex
+}{conns: make(map[string]net.Conn)}
+
+// coverRelayTimeout is how long an opened target connection waits for its
+// main channel.
+const coverRelayTimeout = 30 * time.Second
+
+// handleCoverOpen connects to a target and sends it the client's real
+// ClientHello, then waits for the main channel at /cover_attach.
+func handleCoverOpen(w http.ResponseWriter, r *http.Request) {
+	var req coverRelayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" || req.Host == "" || len(req.ClientHello) == 0 {
+		http.Error(w, "session_id, host and client_hello are required", http.StatusBadRequest)
+		return
+	}
+	if req.Port == "" {
+		req.Port = "443"
+	}
+
+	target := net.JoinHostPort(req.Host, req.Port)
+	conn, err := dialTarget(r.Context(), connTuner.Dialer(&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}, target), target)
+	if err != nil {
+		log.Printf("❌ Cover relay %s failed to connect to %s: %v", req.SessionID, target, err)
+		http.Error(w, fmt.Sprintf("Failed to connect to target: %v", err), http.StatusBadGateway)
+		return
+	}
+	if _, err := conn.Write(req.ClientHello); err != nil {
+		conn.Close()
+		log.Printf("❌ Cover relay %s failed to send ClientHello to %s: %v", req.SessionID, target, err)
+		http.Error(w, fmt.Sprintf("Failed to send ClientHello: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	pendingCoverRelays.mu.Lock()
+	if _, exists := pendingCoverRelays.conns[req.SessionID]; exists {
+		pendingCoverRelays.mu.Unlock()
+		conn.Close()
+		http.Error(w, "Session already exists", http.StatusConflict)
+		return
+	}
+	pendingCoverRelays.conns[req.SessionID] = conn
+	pendingCoverRelays.mu.Unlock()
+	time.AfterFunc(coverRelayTimeout, func() {
+		if conn := takeCoverRelay(req.SessionID); conn != nil {
+			log.Printf("⚠️ Cover relay %s expired before its main channel attached", req.SessionID)
+			conn.Close()
+		}
+	})
+
+	log.Printf("🎭 Cover relay %s connected to %s, waiting for main channel", req.SessionID, target)
+	w.WriteHeader(http.StatusOK)
+}
+
+// takeCoverRelay removes and returns the pending target connection of
+// sessionID, or nil if there is none.
+func takeCoverRelay(sessionID string) net.Conn {
+	pendingCoverRelays.mu.Lock()
+	defer pendingCoverRelays.mu.Unlock()
+	conn := pendingCoverRelays.conns[sessionID]
+	delete(pendingCoverRelays.conns, sessionID)
+	return conn
+}
+
+// handleCoverAttach turns the requesting connection into the main channel of
+// a cover relay and relays it to the target connection until either ends.
+func handleCoverAttach(w http.ResponseWriter, r *http.Request) {
+	var req coverRelayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" {
+		http.Error(w, "session_id is required", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Cover relays are not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	target := takeCoverRelay(req.SessionID)
+	if target == nil {
+		http.Error(w, "Unknown or expired cover relay", http.StatusNotFound)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("❌ Failed to hijack main channel of cover relay %s: %v", req.SessionID, err)
+		target.Close()
+		return
+	}
+	rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		target.Close()
+		return
+	}
+
+	log.Printf("🎭 Cover relay %s attached from %s", req.SessionID, redacted(sensitiveClientIP, r.RemoteAddr))
+	clientToTarget := func() error {
+		_, err := io.Copy(target, rw.Reader)
+		return err
+	}
+	targetToClient := func() error {
+		_, err := io.Copy(conn, target)
+		return err
+	}
+	if err := relayPair(context.Background(), conn, target, clientToTarget, targetToClient); err != nil {
+		log.Printf("❌ Cover relay %s failed: %v", req.SessionID, err)
+		return
+	}
+	log.Printf("✅ Cover relay %s completed", req.SessionID)
+}
+
+// coverPrefaceListener lets plain HTTP relays accept main channels of cover
+// relays, which start with a TLS record carrying the cover ClientHello.
+type coverPrefaceListener struct {
+	net.Listener
+}
+
+func (l coverPrefaceListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &coverPrefaceConn{Conn: conn}, nil
+}
+
+// coverPrefaceConn skips a leading TLS handshake record on first read, so
+// the HTTP request behind it is parsed as usual. Connections that start
+// with anything else are passed through unchanged.
+type coverPrefaceConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	err    error
+}
+
+func (c *coverPrefaceConn) skipPreface() {
+	c.reader = bufio.NewReader(c.Conn)
+	header, err := c.reader.Peek(5)
+	if err != nil || header[0] != 0x16 {
+		return
+	}
+	_, c.err = c.reader.Discard(5 + int(binary.BigEndian.Uint16(header[3:5])))
+}
+
+func (c *coverPrefaceConn) Read(p []byte) (int, error) {
+	c.once.Do(c.skipPreface)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection for relays.
+func (c *coverPrefaceConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
@@ -0,0 +1,306 @@
+//go:build !relay
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The client side of the cover strategy: sending the ClientHello over OOB
+// and attaching the main channel under the cover SNI.
+
+// CoverRule gives tunnels to matching hosts a cover SNI of their own, in
+// place of cover_sni, for covers that pass better alongside particular
+// targets.
+type CoverRule struct {
+	Hosts []string `json:"hosts"` // "host", "*.example.com", "*", "keyword:..." or "regexp:..."
+	Cover string   `json:"cover"` // SNI the main channel shows for them
+}
+
+// validate checks that r has hosts and a cover.
+func (r CoverRule) validate() error {
+	if len(r.Hosts) == 0 {
+		return fmt.Errorf("no hosts")
+	}
+	for _, pattern := range r.Hosts {
+		if err := validHostPattern(pattern); err != nil {
+			return err
+		}
+	}
+	if r.Cover == "" {
+		return fmt.Errorf("no cover")
+	}
+	return nil
+}
+
+// compileCoverRules checks every rule and files their hosts in a matcher,
+// numbered by rule.
+func compileCoverRules(rules []CoverRule) (*hostMatcher, error) {
+	matcher := newHostMatcher()
+	for i, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("cover_rules[%d]: %w", i, err)
+		}
+		for _, pattern := range rule.Hosts {
+			matcher.add(pattern, i)
+		}
+	}
+	return matcher, nil
+}
+
+// coverFor returns the cover SNI of tunnels to dest: that of the first
+// cover rule matching it, or else cover_sni.
+func (p *TLSProxy) coverFor(dest Destination) string {
+	if i, ok := p.covers.match(dest.SNI, dest.Host); ok {
+		return p.CoverRules[i].Cover
+	}
+	return p.FakeSNI
+}
+
+func init() {
+	RegisterStrategy("cover", func(p *TLSProxy) ConnectionStrategy { return &coverStrategy{proxy: p} })
+}
+
+// coverStrategy sends the ClientHello through OOB and relays the session
+// over a main channel that carries the cover SNI.
+type coverStrategy struct {
+	proxy *TLSProxy
+}
+
+func (s *coverStrategy) Name() string { return "cover" }
+
+func (s *coverStrategy) Applicable(dest Destination) bool {
+	if s.proxy.OOB == nil || s.proxy.coverFor(dest) == "" {
+		return false
+	}
+	_, _, err := locateSNI(dest.ClientHello)
+	return err == nil
+}
+
+func (s *coverStrategy) Establish(ctx context.Context, clientConn net.Conn, dest Destination) (net.Conn, error) {
+	peer := s.proxy.OOB.PeerFor(dest)
+	if peer == "" {
+		return nil, fmt.Errorf("%w for cover SNI", errNoPeer)
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	sessionID := hex.EncodeToString(id)
+
+	cover := s.proxy.coverFor(dest)
+	logger := sessionLog(ctx).With("peer", peer)
+	logger.Printf("🎭 Sending ClientHello for %s via OOB, main channel covered as %s", dest.SNI, cover)
+	if err := s.proxy.OOB.OpenCoverRelay(ctx, peer, sessionID, dest); err != nil {
+		return nil, err
+	}
+	return s.proxy.OOB.AttachCoverRelay(ctx, peer, sessionID, cover, dest.ClientHello)
+}
+
+// OpenCoverRelay has peer connect to dest and send it dest's ClientHello.
+func (o *OOBModule) OpenCoverRelay(ctx context.Context, peer, sessionID string, dest Destination) error {
+	body, err := json.Marshal(coverRelayRequest{SessionID: sessionID, Host: dest.Host, Port: dest.Port, ClientHello: dest.ClientHello})
+	if err != nil {
+		return err
+	}
+	client := o.Client(o.Timeout(peer, 10*time.Second))
+	start := time.Now()
+	resp, err := o.withRetry(peer, "/cover_open", false, func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", o.URL(peer, "/cover_open"), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return client.Do(req)
+	})
+	if err == nil && resp.StatusCode >= 500 {
+		o.ReportPeerResult(peer, 0, fmt.Errorf("HTTP %d", resp.StatusCode))
+	} else {
+		o.ReportPeerResult(peer, time.Since(start), err)
+	}
+	if err != nil {
+		return &oobError{Peer: peer, Err: fmt.Errorf("failed to open cover relay: %w", err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return &oobError{Peer: peer, Status: resp.StatusCode,
+			Err: fmt.Errorf("relay failed to open cover relay: %s", bytes.TrimSpace(message))}
+	}
+	return nil
+}
+
+// AttachCoverRelay opens the main channel to peer and claims the target
+// connection opened for sessionID. To an observer the channel starts like a
+// TLS connection to cover: "https" peers are reached with cover as the SNI,
+// and on plain "http" peers clientHello is replayed first with its SNI
+// swapped for cover, which the relay skips.
+func (o *OOBModule) AttachCoverRelay(ctx context.Context, peer, sessionID, cover string, clientHello []byte) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch o.balancer.Scheme(peer) {
+	case "https":
+		conn, err = upstream.DialTLSContext(ctx, o.dialer, peer, coverTLSConfig(o.tlsConfig, peer, cover))
+	case "http":
+		var preface []byte
+		if preface, err = rewriteSNI(clientHello, cover); err != nil {
+			return nil, fmt.Errorf("failed to build cover ClientHello: %w", err)
+		}
+		if conn, err = upstream.DialContext(ctx, o.dialer, peer); err == nil {
+			if _, err = conn.Write(preface); err != nil {
+				conn.Close()
+			}
+		}
+	default:
+		return nil, fmt.Errorf("cover SNI needs an http or https OOB peer, %s is %s", peer, o.balancer.Scheme(peer))
+	}
+	if err != nil {
+		return nil, &oobError{Peer: peer, Err: fmt.Errorf("failed to open main channel: %w", err)}
+	}
+
+	// Bound the attach exchange by ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	body, _ := json.Marshal(coverRelayRequest{SessionID: sessionID})
+	req, _ := http.NewRequest("POST", "http://"+peer+"/cover_attach", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if o.authToken != "" {
+		req.Header.Set("Authorization", authorizationHeader(o.authToken))
+	}
+	reader := bufio.NewReader(conn)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to attach main channel to %s: %w", peer, err)
+	}
+	// The main channel doesn't go through the OOB client, so it's recorded here
+	attach := &transcriptExchange{Peer: peer, Method: req.Method, Path: req.URL.Path, ContentType: "application/json",
+		Request: body}
+	transcriptOf(ctx).record(attach)
+	start := time.Now()
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		attach.Error, attach.DurationMs = err.Error(), millisSince(start)
+		conn.Close()
+		return nil, fmt.Errorf("failed to read attach response from %s: %w", peer, err)
+	}
+	attach.Status, attach.DurationMs = resp.StatusCode, millisSince(start)
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		attach.Response = message
+		conn.Close()
+		return nil, &oobError{Peer: peer, Status: resp.StatusCode,
+			Err: fmt.Errorf("refused to attach main channel: %s", bytes.TrimSpace(message))}
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Target bytes may already sit behind the response headers
+	if reader.Buffered() > 0 {
+		peeked, _ := reader.Peek(reader.Buffered())
+		return &peekedConn{Conn: conn, peeked: append([]byte(nil), peeked...)}, nil
+	}
+	return conn, nil
+}
+
+// coverTLSConfig puts cover in the SNI of connections to peer while still
+// verifying the relay's certificate against the name it would be verified
+// against without a cover: oob_tls.server_name, or the peer's host.
+func coverTLSConfig(base *tls.Config, peer, cover string) *tls.Config {
+	cfg := base.Clone()
+	name := cfg.ServerName
+	if name == "" {
+		name, _, _ = net.SplitHostPort(peer)
+	}
+	cfg.ServerName = cover
+	if cfg.InsecureSkipVerify {
+		// Either no verification or pinning, which doesn't depend on the name
+		return cfg
+	}
+
+	pinned := cfg.VerifyConnection
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("OOB server presented no certificate")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       name,
+			Roots:         cfg.RootCAs,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return err
+		}
+		if pinned != nil {
+			return pinned(cs)
+		}
+		return nil
+	}
+	return cfg
+}
+
+// rewriteSNI returns a copy of clientHello whose server name is sni, with
+// the name, server_name list, extension, extensions block, handshake and
+// record lengths adjusted to match. Only the first record is rewritten, so
+// the SNI must lie within it.
+func rewriteSNI(clientHello []byte, sni string) ([]byte, error) {
+	start, end, err := locateSNI(clientHello)
+	if err != nil {
+		return nil, err
+	}
+	recordLen := int(binary.BigEndian.Uint16(clientHello[3:5]))
+	if 5+recordLen > len(clientHello) || end > 5+recordLen {
+		return nil, errors.New("server name lies outside the first record")
+	}
+	if len(sni) > 0xff00 {
+		return nil, errors.New("cover SNI too long")
+	}
+
+	// locateSNI has already checked these offsets
+	pos := 43
+	pos += 1 + int(clientHello[pos])
+	pos += 2 + int(binary.BigEndian.Uint16(clientHello[pos:]))
+	pos += 1 + int(clientHello[pos])
+	extensionsLenAt := pos
+
+	delta := len(sni) - (end - start)
+	out := make([]byte, 0, len(clientHello)+delta)
+	out = append(out, clientHello[:start]...)
+	out = append(out, sni...)
+	out = append(out, clientHello[end:]...)
+
+	adjust16 := func(at int) error {
+		value := int(binary.BigEndian.Uint16(out[at:])) + delta
+		if value < 0 || value > 0xffff {
+			return errors.New("rewritten ClientHello length out of range")
+		}
+		binary.BigEndian.PutUint16(out[at:], uint16(value))
+		return nil
+	}
+	// Host name, then server_name list, extension, extensions block and record
+	binary.BigEndian.PutUint16(out[start-2:], uint16(len(sni)))
+	for _, at := range []int{start - 5, start - 7, extensionsLenAt, 3} {
+		if err := adjust16(at); err != nil {
+			return nil, err
+		}
+	}
+	handshakeLen := int(out[6])<<16 | int(out[7])<<8 | int(out[8]) + delta
+	out[6], out[7], out[8] = byte(handshakeLen>>16), byte(handshakeLen>>8), byte(handshakeLen)
+	return out, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CoverCheckConfig controls the validation of cover_sni. Both components
+// check at startup, then periodically, that a TLS handshake with the cover
+// host succeeds from their network and that its addresses are plausible for
+// traffic to the relay, so a cover that stopped working is noticed before
+// connections start failing.
+type CoverCheckConfig struct {
+	Interval int `json:"interval,omitempty"` // Milliseconds between checks after the first (default: 3600000, -1 checks only at startup)
+	Timeout  int `json:"timeout,omitempty"`  // Milliseconds allowed for resolving and the handshake (default: 5000)
+}
+
+// coverCheckResult is the outcome of one cover SNI check, as reported on the
+// status endpoint.
+type coverCheckResult struct {
+	Host        string    `json:"host"`
+	Checked     time.Time `json:"checked"`
+	Addresses   []string  `json:"addresses,omitempty"`
+	TLSVersion  string    `json:"tls_version,omitempty"`
+	HandshakeMs int64     `json:"handshake_ms,omitempty"`
+	Problems    []string  `json:"problems,omitempty"`
+}
+
+// coverChecks holds the latest result. In dual mode both components share
+// one process and network, so only the first one to start checking does.
+var coverChecks struct {
+	once   sync.Once
+	latest *coverCheckResult
+	mu     sync.Mutex
+}
+
+// startCoverChecks validates config.CoverSNI in the background, at once and
+// then periodically. The cover should resolve near the OOB peers it's used
+// towards, since observers can compare the SNI with the address it's sent to.
+func startCoverChecks(config *Config) {
+	host, cfg := config.CoverSNI, config.CoverCheck
+	if host == "" {
+		return
+	}
+	peers := coverPeers(config)
+	coverChecks.once.Do(func() {
+		handleStatus("/cover", func() any {
+			coverChecks.mu.Lock()
+			defer coverChecks.mu.Unlock()
+			return coverChecks.latest
+		})
+
+		timeout := millis(cfg.Timeout, 5000)
+		go func() {
+			var healthy bool
+			for first := true; ; first = false {
+				result := checkCover(host, peers, timeout)
+				coverChecks.mu.Lock()
+				coverChecks.latest = result
+				coverChecks.mu.Unlock()
+
+				switch {
+				case len(result.Problems) > 0:
+					for _, problem := range result.Problems {
+						log.Printf("⚠️ Cover SNI %s: %s", host, problem)
+					}
+					healthy = false
+				case first || !healthy:
+					log.Printf("✅ Cover SNI %s validated: %s in %dms from %s",
+						host, result.TLSVersion, result.HandshakeMs, strings.Join(result.Addresses, ", "))
+					healthy = true
+				}
+
+				if cfg.Interval < 0 {
+					return
+				}
+				time.Sleep(millis(cfg.Interval, 3600000))
+			}
+		}()
+	})
+}
+
+// checkCover resolves host, completes a verified TLS handshake with it and
+// compares its addresses with those of peers.
+func checkCover(host string, peers []string, timeout time.Duration) *coverCheckResult {
+	result := &coverCheckResult{Host: host, Checked: time.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		result.Problems = append(result.Problems, fmt.Sprintf("failed to resolve: %v", err))
+		return result
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		result.Addresses = append(result.Addresses, addr.IP.String())
+		ips = append(ips, addr.IP)
+		// Sinkholed or poisoned answers often point at unroutable addresses
+		if !addr.IP.IsGlobalUnicast() || addr.IP.IsPrivate() {
+			result.Problems = append(result.Problems, fmt.Sprintf("resolves to non-public address %s, the name may be blocked or poisoned", addr.IP))
+		}
+	}
+
+	start := time.Now()
+	conn, err := (&tls.Dialer{Config: &tls.Config{ServerName: host, KeyLogWriter: keyLog}}).DialContext(ctx, "tcp", net.JoinHostPort(host, "443"))
+	if err != nil {
+		result.Problems = append(result.Problems, fmt.Sprintf("TLS handshake failed: %v", err))
+	} else {
+		result.HandshakeMs = time.Since(start).Milliseconds()
+		result.TLSVersion = tls.VersionName(conn.(*tls.Conn).ConnectionState().Version)
+		conn.Close()
+	}
+
+	for _, peer := range peers {
+		peerHost, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			peerHost = peer
+		}
+		peerIPs, err := net.DefaultResolver.LookupIP(ctx, "ip", peerHost)
+		if err != nil || len(peerIPs) == 0 {
+			continue
+		}
+		if !sharesNetwork(ips, peerIPs) {
+			result.Problems = append(result.Problems, fmt.Sprintf(
+				"relay %s is not in the cover's address space; observers that match the SNI against the destination address can tell them apart", peer))
+		}
+	}
+	return result
+}
+
+// sharesNetwork reports whether any address of a lies in the same /24
+// (IPv4) or /48 (IPv6) as any address of b, which is as close as addresses
+// of one provider or CDN usually get.
+func sharesNetwork(a, b []net.IP) bool {
+	for _, x := range a {
+		bits := 48
+		if v4 := x.To4(); v4 != nil {
+			x, bits = v4, 24
+		}
+		for _, y := range b {
+			network := net.IPNet{IP: x, Mask: net.CIDRMask(bits, 8*len(x))}
+			if network.Contains(y) {
+				return true
+			}
+		}
+	}
+	return false
+}
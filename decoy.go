@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DecoyConfig serves a static website from the relay port to anyone who
+// isn't a sultry client: browsers, crawlers and active probes see an
+// ordinary site instead of an API answering 401 or 404.
+type DecoyConfig struct {
+	Root     string            `json:"root,omitempty"`      // Directory holding the site
+	Index    string            `json:"index,omitempty"`     // File served for directory paths (default: "index.html")
+	NotFound string            `json:"not_found,omitempty"` // Page served with status 404, relative to root (default: plain "Not Found")
+	MaxAge   int               `json:"max_age,omitempty"`   // Seconds clients may cache files, sent as Cache-Control (default: 3600)
+	Headers  map[string]string `json:"headers,omitempty"`   // Extra headers on every response, e.g. "Server"
+}
+
+// decoyHandler serves the files under cfg.Root with content types from
+// their extensions and Last-Modified validation. Directory listings
+// and dotfiles are never served.
+type decoyHandler struct {
+	root     string
+	index    string
+	notFound string
+	maxAge   int
+	headers  map[string]string
+}
+
+func newDecoyHandler(cfg DecoyConfig) (*decoyHandler, error) {
+	info, err := os.Stat(cfg.Root)
+	if err != nil {
+		return nil, fmt.Errorf("decoy root: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("decoy root %s is not a directory", cfg.Root)
+	}
+	h := &decoyHandler{
+		root:     cfg.Root,
+		index:    cfg.Index,
+		notFound: cfg.NotFound,
+		maxAge:   orDefault(cfg.MaxAge, 3600),
+		headers:  cfg.Headers,
+	}
+	if h.index == "" {
+		h.index = "index.html"
+	}
+	return h, nil
+}
+
+func (h *decoyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for name, value := range h.headers {
+		w.Header().Set(name, value)
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, h.index)
+	}
+	if !h.serveFile(w, r, name, http.StatusOK) {
+		// A directory requested without its trailing slash gets its index
+		if info, err := os.Stat(h.path(name)); err == nil && info.IsDir() {
+			http.Redirect(w, r, path.Base(name)+"/", http.StatusMovedPermanently)
+			return
+		}
+		if h.notFound == "" || !h.serveFile(w, r, path.Clean("/"+h.notFound), http.StatusNotFound) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+		}
+	}
+}
+
+// path maps a cleaned URL path to a file under the root.
+func (h *decoyHandler) path(name string) string {
+	return filepath.Join(h.root, filepath.FromSlash(name))
+}
+
+// serveFile writes the file at name with the given status, and reports
+// false without writing anything if there is no such regular file.
+func (h *decoyHandler) serveFile(w http.ResponseWriter, r *http.Request, name string, status int) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	file, err := os.Open(h.path(name))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("⚠️ Decoy site failed to open %s: %v", name, err)
+		}
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+
+	if status != http.StatusOK {
+		// ServeContent only writes 200s and conditional responses, so error
+		// pages are written directly
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = "text/html; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			io.Copy(w, file)
+		}
+		return true
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", h.maxAge))
+	http.ServeContent(w, r, name, info.ModTime(), file)
+	return true
+}
+
+// withDecoy routes requests reaching the catch-all route: POSTs to "/" are
+// the legacy API endpoint, and everything else is a visitor for the decoy
+// site. Without a decoy, everything goes to legacy as before.
+func withDecoy(decoy http.Handler, legacy http.HandlerFunc) http.Handler {
+	if decoy == nil {
+		return legacy
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/" {
+			legacy(w, r)
+			return
+		}
+		decoy.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,74 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// DesyncConfig controls TCP-level desync: before the real ClientHello, fake
+// segments carrying a decoy ClientHello are injected with a TTL too low to
+// reach the target. DPI boxes closer than the target see the decoy SNI, while
+// the target only ever receives the real handshake. Requires Linux and
+// CAP_NET_RAW; elsewhere the strategy fails and the next one is tried.
+type DesyncConfig struct {
+	Enabled bool   `json:"enabled"`
+	TTL     int    `json:"ttl,omitempty"`      // IP TTL of fake segments, must expire before the target (default: 3)
+	FakeSNI string `json:"fake_sni,omitempty"` // SNI in the decoy ClientHello (default: cover_sni)
+	Repeats int    `json:"repeats,omitempty"`  // Number of fake segments to send (default: 1)
+}
+
+// errDesyncUnavailable means raw sockets can't be used on this host.
+var errDesyncUnavailable = errors.New("desync unavailable")
+
+func init() {
+	RegisterStrategy("desync", func(p *TLSProxy) ConnectionStrategy { return &desyncStrategy{proxy: p} })
+}
+
+// desyncStrategy injects fake low-TTL segments carrying a decoy ClientHello
+// before sending the real one.
+type desyncStrategy struct {
+	proxy *TLSProxy
+}
+
+func (s *desyncStrategy) Name() string { return "desync" }
+
+// Applicable leaves out destinations behind an upstream proxy, whose
+// connections the injected segments would never reach.
+func (s *desyncStrategy) Applicable(dest Destination) bool {
+	return s.fakeSNI() != "" && !upstream.Proxies(dest.Addr())
+}
+
+func (s *desyncStrategy) fakeSNI() string {
+	if s.proxy.Desync.FakeSNI != "" {
+		return s.proxy.Desync.FakeSNI
+	}
+	return s.proxy.FakeSNI
+}
+
+func (s *desyncStrategy) Establish(ctx context.Context, clientConn net.Conn, dest Destination) (net.Conn, error) {
+	cfg := s.proxy.Desync
+	if cfg.TTL <= 0 {
+		cfg.TTL = 3
+	}
+	if cfg.Repeats <= 0 {
+		cfg.Repeats = 1
+	}
+
+	timeout := 10 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	conn, err := dialDesync(sessionLog(ctx), dest.Addr(), timeout, cfg, buildClientHello(s.fakeSNI()))
+	if err != nil {
+		return nil, err
+	}
+	if err := sendClientHello(ctx, conn, dest, s.proxy.writeClientHello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
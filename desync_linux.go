@@ -0,0 +1,157 @@
+//go:build linux && !relay
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// dialDesync dials addr and, before returning, injects cfg.Repeats copies of
+// fakeHello with a low TTL at the sequence number the real ClientHello will use.
+//
+// The sequence numbers are learned by capturing the SYN-ACK on a raw socket
+// opened before the dial, so only CAP_NET_RAW is needed (no TCP_REPAIR).
+func dialDesync(logger *sessionLogger, addr string, timeout time.Duration, cfg DesyncConfig, fakeHello []byte) (net.Conn, error) {
+	recvFD, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errDesyncUnavailable, err)
+	}
+	defer syscall.Close(recvFD)
+
+	sendFD, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errDesyncUnavailable, err)
+	}
+	defer syscall.Close(sendFD)
+
+	conn, err := connTuner.Dialer(&net.Dialer{Timeout: timeout}, addr).Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+	if local.IP.To4() == nil || remote.IP.To4() == nil {
+		logger.Printf("⚠️ Desync only supports IPv4, sending %s without fake segments", remote)
+		return conn, nil
+	}
+
+	seq, ack, err := captureSynAck(recvFD, local, remote, time.Second)
+	if err != nil {
+		logger.Printf("⚠️ Desync could not learn sequence numbers (%v), sending without fake segments", err)
+		return conn, nil
+	}
+
+	segment := buildTCPSegment(local, remote, seq, ack, cfg.TTL, fakeHello)
+	dest := &syscall.SockaddrInet4{}
+	copy(dest.Addr[:], remote.IP.To4())
+	for i := 0; i < cfg.Repeats; i++ {
+		if err := syscall.Sendto(sendFD, segment, 0, dest); err != nil {
+			logger.Printf("⚠️ Desync failed to send fake segment: %v", err)
+			break
+		}
+	}
+	logger.Printf("🎭 Desync: injected %d fake segment(s) with TTL %d to %s", cfg.Repeats, cfg.TTL, remote)
+
+	return conn, nil
+}
+
+// captureSynAck reads packets from a raw TCP socket until it sees the SYN-ACK
+// for the local/remote pair, returning the next sequence and acknowledgment
+// numbers for our side of the connection.
+func captureSynAck(fd int, local, remote *net.TCPAddr, timeout time.Duration) (uint32, uint32, error) {
+	tv := syscall.NsecToTimeval((100 * time.Millisecond).Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return 0, 0, err
+	}
+
+	buf := make([]byte, 65535)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			return 0, 0, err
+		}
+		if n < 20 || buf[9] != syscall.IPPROTO_TCP {
+			continue
+		}
+		ihl := int(buf[0]&0x0f) * 4
+		if n < ihl+20 || !net.IP(buf[12:16]).Equal(remote.IP) {
+			continue
+		}
+
+		tcp := buf[ihl:n]
+		srcPort := int(binary.BigEndian.Uint16(tcp[0:2]))
+		dstPort := int(binary.BigEndian.Uint16(tcp[2:4]))
+		flags := tcp[13]
+		if srcPort != remote.Port || dstPort != local.Port || flags&0x12 != 0x12 { // SYN+ACK
+			continue
+		}
+
+		theirSeq := binary.BigEndian.Uint32(tcp[4:8])
+		ourNext := binary.BigEndian.Uint32(tcp[8:12])
+		return ourNext, theirSeq + 1, nil
+	}
+
+	return 0, 0, errors.New("timed out waiting for SYN-ACK")
+}
+
+// buildTCPSegment assembles an IPv4 packet carrying a PSH/ACK segment.
+func buildTCPSegment(local, remote *net.TCPAddr, seq, ack uint32, ttl int, payload []byte) []byte {
+	src := local.IP.To4()
+	dst := remote.IP.To4()
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:2], uint16(local.Port))
+	binary.BigEndian.PutUint16(tcp[2:4], uint16(remote.Port))
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = 5 << 4 // Data offset: 5 words, no options
+	tcp[13] = 0x18   // PSH+ACK
+	binary.BigEndian.PutUint16(tcp[14:16], 502)
+	copy(tcp[20:], payload)
+
+	pseudo := make([]byte, 12, 12+len(tcp))
+	copy(pseudo[0:4], src)
+	copy(pseudo[4:8], dst)
+	pseudo[9] = syscall.IPPROTO_TCP
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:18], internetChecksum(append(pseudo, tcp...)))
+
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0] = 0x45 // IPv4, 5-word header
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(tcp)))
+	binary.BigEndian.PutUint16(ip[4:6], uint16(rand.Intn(65536)))
+	binary.BigEndian.PutUint16(ip[6:8], 0x4000) // Don't fragment
+	ip[8] = byte(ttl)
+	ip[9] = syscall.IPPROTO_TCP
+	copy(ip[12:16], src)
+	copy(ip[16:20], dst)
+	binary.BigEndian.PutUint16(ip[10:12], internetChecksum(ip))
+
+	return append(ip, tcp...)
+}
+
+// internetChecksum computes the RFC 1071 ones' complement checksum.
+func internetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
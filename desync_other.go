@@ -0,0 +1,14 @@
+//go:build !linux && !relay
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// dialDesync is only implemented on Linux.
+func dialDesync(logger *sessionLogger, addr string, timeout time.Duration, cfg DesyncConfig, fakeHello []byte) (net.Conn, error) {
+	return nil, fmt.Errorf("%w: raw socket injection requires Linux", errDesyncUnavailable)
+}
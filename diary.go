@@ -0,0 +1,248 @@
+//go:build !relay
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FailureDiaryConfig controls the record of strategy failures per
+// destination. Observations decay, so a destination that was blocked
+// yesterday is retried with its preferred strategy eventually.
+type FailureDiaryConfig struct {
+	Path       string `json:"path,omitempty"`        // JSON file the diary persists to; empty keeps it in memory
+	HalfLife   int    `json:"half_life,omitempty"`   // Minutes after which a failure counts half as much (default: 360)
+	MaxEntries int    `json:"max_entries,omitempty"` // Oldest observations are dropped beyond this (default: 10000)
+}
+
+// FailureObservation is a single failed connection attempt.
+type FailureObservation struct {
+	Time        time.Time `json:"time"`
+	Destination string    `json:"destination"` // host:port
+	Strategy    string    `json:"strategy"`
+	ErrorClass  string    `json:"error_class"` // See classifyError
+	Network     string    `json:"network"`     // Identity of the local network the attempt was made from
+}
+
+// failureDiary stores failure observations and turns them into a decayed
+// per-strategy score for a destination on the current network.
+type failureDiary struct {
+	path       string
+	halfLife   time.Duration
+	maxEntries int
+
+	entries []FailureObservation
+	mu      sync.Mutex
+
+	network        string
+	networkChecked time.Time
+}
+
+// newFailureDiary loads the diary from cfg.Path if it exists.
+func newFailureDiary(cfg FailureDiaryConfig) *failureDiary {
+	d := &failureDiary{
+		path:       cfg.Path,
+		halfLife:   time.Duration(cfg.HalfLife) * time.Minute,
+		maxEntries: cfg.MaxEntries,
+	}
+	if d.halfLife <= 0 {
+		d.halfLife = 6 * time.Hour
+	}
+	if d.maxEntries <= 0 {
+		d.maxEntries = 10000
+	}
+
+	if d.path == "" {
+		return d
+	}
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("⚠️ Failed to read failure diary %s: %v", d.path, err)
+		}
+		return d
+	}
+	if err := json.Unmarshal(data, &d.entries); err != nil {
+		log.Printf("⚠️ Ignoring corrupt failure diary %s: %v", d.path, err)
+		d.entries = nil
+		return d
+	}
+	d.prune(time.Now())
+	log.Printf("🔹 Loaded %d failure observations from %s", len(d.entries), d.path)
+	return d
+}
+
+// Record adds a failure of strategy against dest.
+func (d *failureDiary) Record(dest, strategy string, err error) {
+	obs := FailureObservation{
+		Time:        time.Now(),
+		Destination: dest,
+		Strategy:    strategy,
+		ErrorClass:  classifyError(err),
+		Network:     d.currentNetwork(),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = append(d.entries, obs)
+	d.prune(obs.Time)
+	d.save()
+}
+
+// Forget drops the failures of strategy against dest on the current network
+// after it succeeded there again.
+func (d *failureDiary) Forget(dest, strategy string) {
+	network := d.currentNetwork()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	kept := d.entries[:0]
+	for _, obs := range d.entries {
+		if obs.Destination != dest || obs.Strategy != strategy || obs.Network != network {
+			kept = append(kept, obs)
+		}
+	}
+	if len(kept) != len(d.entries) {
+		d.entries = kept
+		d.save()
+	}
+}
+
+// Score returns the decayed failure weight of strategy against dest on the
+// current network: each failure counts 1 when fresh and halves every half-life.
+func (d *failureDiary) Score(dest, strategy string) float64 {
+	network := d.currentNetwork()
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	score := 0.0
+	for _, obs := range d.entries {
+		if obs.Destination == dest && obs.Strategy == strategy && obs.Network == network {
+			score += d.weight(obs, now)
+		}
+	}
+	return score
+}
+
+// Observations returns the observations for dest, oldest first, or all of
+// them when dest is empty.
+func (d *failureDiary) Observations(dest string) []FailureObservation {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var result []FailureObservation
+	for _, obs := range d.entries {
+		if dest == "" || obs.Destination == dest {
+			result = append(result, obs)
+		}
+	}
+	return result
+}
+
+func (d *failureDiary) weight(obs FailureObservation, now time.Time) float64 {
+	return math.Pow(0.5, float64(now.Sub(obs.Time))/float64(d.halfLife))
+}
+
+// prune drops observations that have decayed to almost nothing and caps the
+// diary's size. Callers must hold d.mu.
+func (d *failureDiary) prune(now time.Time) {
+	kept := d.entries[:0]
+	for _, obs := range d.entries {
+		if d.weight(obs, now) >= 0.01 {
+			kept = append(kept, obs)
+		}
+	}
+	d.entries = kept
+	if len(d.entries) > d.maxEntries {
+		d.entries = d.entries[len(d.entries)-d.maxEntries:]
+	}
+}
+
+// save writes the diary atomically. Callers must hold d.mu.
+func (d *failureDiary) save() {
+	if d.path == "" {
+		return
+	}
+	data, err := json.Marshal(d.entries)
+	if err != nil {
+		log.Printf("⚠️ Failed to encode failure diary: %v", err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), ".diary-*")
+	if err != nil {
+		log.Printf("⚠️ Failed to save failure diary: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("⚠️ Failed to save failure diary: %v", err)
+	}
+}
+
+// currentNetwork identifies the network we're on by the local address of
+// the default route, so observations from home and office networks don't
+// mix. It's refreshed at most once a minute.
+func (d *failureDiary) currentNetwork() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if time.Since(d.networkChecked) < time.Minute {
+		return d.network
+	}
+
+	d.network = "unknown"
+	d.networkChecked = time.Now()
+	// UDP "dial" only selects a route, no packet is sent
+	conn, err := net.Dial("udp", "192.0.2.1:9")
+	if err == nil {
+		d.network = conn.LocalAddr().(*net.UDPAddr).IP.String()
+		conn.Close()
+	}
+	return d.network
+}
+
+// classifyError maps an error to a coarse class that's stable enough to
+// compare across observations.
+func classifyError(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case strings.Contains(err.Error(), "tls:"):
+		return "tls"
+	case strings.Contains(err.Error(), "OOB"):
+		return "oob"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,63 @@
+//go:build !relay
+
+package main
+
+import "fmt"
+
+// DNS-over-HTTPS
+//
+// Blocking the well-known DoH resolvers is a cheap way to push browsers back
+// to plaintext DNS, which is then easy to poison. Tunnels to those resolvers
+// are therefore only connected by the strategies that conceal the SNI (see
+// concealingStrategies), whatever the configured order or the failure diary
+// says, and fail rather than reach the resolver in the clear. Resolvers are
+// recognized by the CONNECT host or the SNI, since the /dns-query path is
+// encrypted.
+
+// defaultDoHResolvers are the host patterns of public DoH resolvers,
+// including the addresses browsers connect to without a name.
+var defaultDoHResolvers = []string{
+	"dns.google", "dns.google.com", "8.8.8.8", "8.8.4.4",
+	"cloudflare-dns.com", "*.cloudflare-dns.com", "one.one.one.one", "1.1.1.1", "1.0.0.1",
+	"dns.quad9.net", "dns9.quad9.net", "dns10.quad9.net", "dns11.quad9.net", "9.9.9.9", "149.112.112.112",
+	"doh.opendns.com", "doh.familyshield.opendns.com",
+	"dns.adguard-dns.com", "*.dns.adguard-dns.com", "dns.adguard.com",
+	"dns.nextdns.io", "*.dns.nextdns.io",
+	"doh.cleanbrowsing.org", "dns.controld.com", "freedns.controld.com",
+	"doh.dns.sb", "dns.alidns.com", "doh.pub", "dns.mullvad.net",
+}
+
+// DoHConfig changes which tunnels are treated as DNS-over-HTTPS.
+type DoHConfig struct {
+	Resolvers []string `json:"resolvers,omitempty"` // More resolver host patterns, e.g. a self-hosted one or "keyword:doh"
+	Direct    bool     `json:"direct,omitempty"`    // Route resolvers like other hosts
+}
+
+// dohResolvers recognizes tunnels to DoH resolvers.
+type dohResolvers struct {
+	patterns *hostMatcher
+}
+
+// newDoHResolvers returns the resolvers cfg describes, or nil if they are
+// routed like other hosts.
+func newDoHResolvers(cfg DoHConfig) (*dohResolvers, error) {
+	if cfg.Direct {
+		return nil, nil
+	}
+	patterns := newHostMatcher()
+	for i, pattern := range append(append([]string(nil), defaultDoHResolvers...), cfg.Resolvers...) {
+		if err := patterns.add(pattern, i); err != nil {
+			return nil, fmt.Errorf("doh.resolvers: %w", err)
+		}
+	}
+	return &dohResolvers{patterns: patterns}, nil
+}
+
+// matches reports whether a tunnel to host with sni reaches a resolver.
+func (r *dohResolvers) matches(host, sni string) bool {
+	if r == nil {
+		return false
+	}
+	_, ok := r.patterns.match(host, sni)
+	return ok
+}
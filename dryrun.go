@@ -0,0 +1,149 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dry runs
+//
+// With dry_run set, every tunnel is connected directly, whatever the
+// configured strategies say, and only the strategy that would have been
+// tried first is logged. The direct attempt then doubles as a probe: a
+// reset, a silent close, a timeout or a retryable TLS alert are what
+// censorship usually looks like, so they mark concealment as likely needed
+// for the destination. That lets a policy be evaluated on a network before
+// it is enforced, without any traffic going through the OOB peers.
+
+// Concealment verdicts of a dry run.
+const (
+	concealmentNotNeeded    = "not_needed"    // The direct connection worked
+	concealmentLikelyNeeded = "likely_needed" // The direct connection failed the way interference does
+	concealmentUnknown      = "unknown"       // The direct connection failed for reasons concealment doesn't fix
+)
+
+// maxDryRunDestinations bounds the destinations listed on the status
+// endpoint as likely needing concealment.
+const maxDryRunDestinations = 256
+
+// dryRunStats summarizes the dry run so far, as served at /dry_run.
+type dryRunStats struct {
+	Connections int               `json:"connections"`
+	Planned     map[string]int    `json:"planned"`          // Connections by the strategy that would have been tried first
+	Verdicts    map[string]int    `json:"verdicts"`         // Connections by concealment verdict
+	Needed      map[string]string `json:"needed,omitempty"` // Destinations likely needing concealment, with the direct attempt's failure cause
+}
+
+// dryRunObserver connects directly on the orchestrator's behalf.
+type dryRunObserver struct {
+	direct ConnectionStrategy
+	stats  dryRunStats
+	mu     sync.Mutex
+}
+
+func newDryRunObserver(p *TLSProxy) *dryRunObserver {
+	return &dryRunObserver{
+		direct: &directStrategy{proxy: p},
+		stats:  dryRunStats{Planned: make(map[string]int), Verdicts: make(map[string]int), Needed: make(map[string]string)},
+	}
+}
+
+// Stats returns a snapshot of the dry run's outcomes.
+func (d *dryRunObserver) Stats() dryRunStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	snapshot := d.stats
+	snapshot.Planned = maps.Clone(d.stats.Planned)
+	snapshot.Verdicts = maps.Clone(d.stats.Verdicts)
+	snapshot.Needed = maps.Clone(d.stats.Needed)
+	return snapshot
+}
+
+func (d *dryRunObserver) record(dest, planned, verdict string, cause FallbackCause) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stats.Connections++
+	d.stats.Planned[planned]++
+	d.stats.Verdicts[verdict]++
+	if verdict == concealmentLikelyNeeded && (len(d.stats.Needed) < maxDryRunDestinations || d.stats.Needed[dest] != "") {
+		d.stats.Needed[dest] = string(cause)
+	} else if verdict == concealmentNotNeeded {
+		delete(d.stats.Needed, dest)
+	}
+}
+
+// Observe connects to dest directly and logs which strategy Establish would
+// have tried first and whether concealment appears necessary. A failed
+// direct attempt is not retried with another strategy.
+func (o *strategyOrchestrator) Observe(ctx context.Context, clientConn net.Conn, dest Destination) (net.Conn, error) {
+	candidates, _ := o.candidates(dest)
+	names := make([]string, len(candidates))
+	for i, s := range candidates {
+		names[i] = s.Name()
+	}
+	planned, order := "none", strings.Join(names, " → ")
+	if len(names) > 0 {
+		planned = names[0]
+	} else {
+		order = planned
+	}
+
+	direct := o.dryRun.direct
+	logger := sessionLog(ctx).With("strategy", direct.Name(), "planned", planned)
+	attemptCtx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+	attemptCtx = withSessionLogger(attemptCtx, logger)
+	start := time.Now()
+
+	conn, err := direct.Establish(attemptCtx, clientConn, dest)
+	probeErr := err
+	if err == nil {
+		// The alert is relayed either way, there's nothing to fall back to
+		conn, probeErr = awaitServerResponse(attemptCtx, conn, dest)
+		var alert *tlsAlertError
+		if errors.As(probeErr, &alert) {
+			if !alert.Retryable() {
+				probeErr = nil
+			}
+		} else if probeErr != nil {
+			conn.Close()
+			conn, err = nil, probeErr
+		}
+	}
+	o.record(direct.Name(), time.Since(start), probeErr)
+	if probeErr != nil {
+		o.diary.Record(dest.Addr(), direct.Name(), probeErr)
+	} else {
+		o.diary.Forget(dest.Addr(), direct.Name())
+	}
+
+	verdict, cause := concealmentNotNeeded, FallbackCause("")
+	if probeErr != nil {
+		cause = fallbackCause(probeErr)
+		verdict = concealmentUnknown
+		if cause.suggestsInterference() {
+			verdict = concealmentLikelyNeeded
+		}
+	}
+	o.dryRun.record(dest.Addr(), planned, verdict, cause)
+
+	event := auditEvent{Event: "dry_run", Session: sessionLog(ctx).ID(), Dest: dest.Addr(), SNI: dest.SNI, Strategy: direct.Name(),
+		Planned: planned, Concealment: verdict, Cause: cause, LatencyMs: time.Since(start).Milliseconds()}
+	if probeErr != nil {
+		event.Error = probeErr.Error()
+		logger.With("cause", cause).Printf("🔍 DRY RUN: %s would use %s; direct connection failed, concealment %s: %v",
+			dest.Addr(), order, strings.ReplaceAll(verdict, "_", " "), probeErr)
+	} else {
+		logger.Printf("🔍 DRY RUN: %s would use %s; direct connection worked in %s, concealment not needed",
+			dest.Addr(), order, time.Since(start).Truncate(time.Millisecond))
+	}
+	audit(event)
+	return conn, err
+}
@@ -0,0 +1,106 @@
+//go:build !relay
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrorBudgetConfig disables a strategy for everyone once too many of its
+// attempts fail, so a misbehaving relay or a newly blocked technique stops
+// costing every tunnel a timeout before the next strategy is tried. The
+// failure diary does the same per destination; this covers strategies that
+// fail everywhere.
+type ErrorBudgetConfig struct {
+	MaxFailureRate float64 `json:"max_failure_rate,omitempty"` // Fraction of attempts that may fail, e.g. 0.5; 0 disables the budget
+	Window         int     `json:"window,omitempty"`           // Milliseconds of attempts the rate is computed over (default: 60000)
+	MinAttempts    int     `json:"min_attempts,omitempty"`     // Attempts in the window before the rate counts (default: 10)
+	Cooldown       int     `json:"cooldown,omitempty"`         // Milliseconds a strategy stays disabled (default: 300000)
+}
+
+// errorBudget tracks recent attempts per strategy and which strategies are
+// disabled.
+type errorBudget struct {
+	cfg ErrorBudgetConfig
+
+	mu       sync.Mutex
+	attempts map[string][]budgetAttempt
+	disabled map[string]time.Time // Strategy to the end of its cooldown
+}
+
+type budgetAttempt struct {
+	at     time.Time
+	failed bool
+}
+
+func newErrorBudget(cfg ErrorBudgetConfig) *errorBudget {
+	if cfg.MaxFailureRate <= 0 {
+		return nil
+	}
+	log.Printf("🔹 Strategies failing more than %.0f%% of their attempts are disabled for %dms", cfg.MaxFailureRate*100,
+		orDefault(cfg.Cooldown, 300000))
+	return &errorBudget{cfg: cfg, attempts: make(map[string][]budgetAttempt), disabled: make(map[string]time.Time)}
+}
+
+// record accounts for an attempt of strategy and disables it if the budget
+// is spent. Failures that say something about the destination rather than
+// the strategy, like a name that doesn't resolve, don't count.
+func (b *errorBudget) record(strategy string, err error) {
+	if b == nil {
+		return
+	}
+	if err != nil {
+		switch fallbackCause(err) {
+		case causeDNS, causeTargetRefused:
+			return
+		}
+	}
+
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.disabled[strategy]; ok {
+		return // Attempts made before it was disabled
+	}
+
+	window := millis(b.cfg.Window, 60000)
+	attempts := b.attempts[strategy]
+	for len(attempts) > 0 && now.Sub(attempts[0].at) > window {
+		attempts = attempts[1:]
+	}
+	attempts = append(attempts, budgetAttempt{at: now, failed: err != nil})
+	b.attempts[strategy] = attempts
+
+	failures := 0
+	for _, attempt := range attempts {
+		if attempt.failed {
+			failures++
+		}
+	}
+	if len(attempts) < orDefault(b.cfg.MinAttempts, 10) || float64(failures) <= b.cfg.MaxFailureRate*float64(len(attempts)) {
+		return
+	}
+	cooldown := millis(b.cfg.Cooldown, 300000)
+	b.disabled[strategy] = now.Add(cooldown)
+	delete(b.attempts, strategy)
+	log.Printf("🚫 Strategy %s disabled for %s: %d of its last %d attempts failed", strategy, cooldown, failures, len(attempts))
+}
+
+// disabledUntil returns when strategy's cooldown ends, or the zero time if
+// it's enabled. Strategies whose cooldown is over start with a fresh budget.
+func (b *errorBudget) disabledUntil(strategy string) time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.disabled[strategy]
+	if ok && time.Now().After(until) {
+		delete(b.disabled, strategy)
+		log.Printf("✅ Strategy %s enabled again after its cooldown", strategy)
+		return time.Time{}
+	}
+	return until
+}
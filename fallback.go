@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// FallbackCause says why a connection strategy failed and the next one was
+// tried. Causes are recorded in the strategy stats, the session's log lines
+// and the audit log, so fallbacks can be counted and compared.
+type FallbackCause string
+
+const (
+	causeTimeout           FallbackCause = "timeout"            // The attempt ran out of time
+	causeOOBServerError    FallbackCause = "oob_5xx"            // The OOB peer answered with a server error
+	causeOOBRejected       FallbackCause = "oob_rejected"       // The OOB peer refused the request (4xx)
+	causePeerUnreachable   FallbackCause = "peer_unreachable"   // No connection to the OOB peer
+	causeOOBError          FallbackCause = "oob_error"          // The OOB request failed otherwise
+	causeDNS               FallbackCause = "dns"                // The target's name didn't resolve
+	causeTargetRefused     FallbackCause = "target_refused"     // The target refused the connection
+	causeTargetReset       FallbackCause = "target_reset"       // The target (or a middlebox) reset the connection
+	causeTargetUnreachable FallbackCause = "target_unreachable" // No route to the target
+	causeTargetClosed      FallbackCause = "target_closed"      // The target closed without answering
+	causeTLSAlert          FallbackCause = "tls_alert"          // The target answered with a TLS alert
+	causeTargetCertificate FallbackCause = "target_certificate" // The OOB peer found the target's certificate invalid
+	causeOther             FallbackCause = "other"
+)
+
+// suggestsInterference reports whether failures with this cause look like
+// censorship (a reset, a silent close, a timeout, a poisoned lookup or an
+// alert about the SNI) rather than a target that's down, which concealment
+// wouldn't fix.
+func (c FallbackCause) suggestsInterference() bool {
+	switch c {
+	case causeTimeout, causeTargetReset, causeTargetClosed, causeTLSAlert, causeDNS:
+		return true
+	}
+	return false
+}
+
+// Fallback is one failed strategy attempt of a connection.
+type Fallback struct {
+	Strategy string        `json:"strategy"`
+	Cause    FallbackCause `json:"cause"`
+	Error    string        `json:"error"`
+}
+
+// errNoPeer is returned when every OOB peer is down or skipped.
+var errNoPeer = errors.New("no available OOB server")
+
+// oobError marks a failure in talking to an OOB peer, as opposed to the
+// peer failing to reach the target, so the two get different causes.
+type oobError struct {
+	Peer   string
+	Status int    // HTTP status of the peer's answer, or 0 if there was none
+	Code   string // Code of a structured error answer, such as "target_certificate"
+	Err    error
+}
+
+// readOOBError turns a peer's error answer into an oobError, keeping the
+// code of structured ones.
+func readOOBError(peer string, resp *http.Response) *oobError {
+	body, _ := io.ReadAll(resp.Body)
+	var structured oobErrorBody
+	if json.Unmarshal(body, &structured) == nil && structured.Code != "" {
+		return &oobError{Peer: peer, Status: resp.StatusCode, Code: structured.Code, Err: errors.New(structured.Error)}
+	}
+	return &oobError{Peer: peer, Status: resp.StatusCode, Err: errors.New(strings.TrimSpace(string(body)))}
+}
+
+func (e *oobError) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("OOB peer %s answered HTTP %d: %v", e.Peer, e.Status, e.Err)
+	}
+	return fmt.Sprintf("OOB peer %s: %v", e.Peer, e.Err)
+}
+
+func (e *oobError) Unwrap() error { return e.Err }
+
+// fallbackCause classifies the error of a failed strategy attempt.
+func fallbackCause(err error) FallbackCause {
+	var oobErr *oobError
+	var alert *tlsAlertError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	timedOut := errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+
+	switch {
+	case errors.Is(err, errNoPeer):
+		return causePeerUnreachable
+	case errors.As(err, &oobErr):
+		switch {
+		case oobErr.Code == oobErrorTargetCertificate:
+			return causeTargetCertificate
+		case oobErr.Status >= 500:
+			return causeOOBServerError
+		case oobErr.Status != 0:
+			return causeOOBRejected
+		case isDialError(err):
+			return causePeerUnreachable
+		case timedOut:
+			return causeTimeout
+		}
+		return causeOOBError
+	case errors.As(err, &alert):
+		return causeTLSAlert
+	case timedOut:
+		return causeTimeout
+	case errors.As(err, &dnsErr):
+		return causeDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return causeTargetRefused
+	case errors.Is(err, syscall.ECONNRESET):
+		return causeTargetReset
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return causeTargetUnreachable
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return causeTargetClosed
+	}
+	return causeOther
+}
+
+// fallbackSummary formats fallbacks for a log field, e.g.
+// "cover:oob_5xx,oob:target_refused".
+func fallbackSummary(fallbacks []Fallback) string {
+	parts := make([]string, len(fallbacks))
+	for i, f := range fallbacks {
+		parts[i] = f.Strategy + ":" + string(f.Cause)
+	}
+	return strings.Join(parts, ",")
+}
+
+// isDialError reports whether err comes from failing to connect, meaning
+// the request was never sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,178 @@
+//go:build !relay
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// FragmentConfig controls ClientHello splitting, a lightweight DPI evasion
+// technique that works without any relay server. Middleboxes that only
+// inspect the first segment (or don't reassemble TLS records) never see a
+// complete SNI.
+type FragmentConfig struct {
+	Enabled     bool  `json:"enabled"`
+	SplitPoints []int `json:"split_points,omitempty"` // Byte offsets into the ClientHello record where it is cut
+	Sizes       []int `json:"sizes,omitempty"`        // Lengths of the first pieces, counted from the payload with tls_records; the rest is one piece
+	SplitSNI    bool  `json:"split_sni,omitempty"`    // Also cut in the middle of the SNI hostname
+	TLSRecords  bool  `json:"tls_records,omitempty"`  // Re-frame each piece as its own TLS record
+	Coalesce    bool  `json:"coalesce,omitempty"`     // With tls_records, send all records in one TCP segment
+	Delay       int   `json:"delay,omitempty"`        // Milliseconds to wait between pieces
+}
+
+// fragmentClientHello splits a ClientHello into the pieces that are written
+// as separate TCP segments. Without TLSRecords the bytes are only cut at the
+// TCP level; with it, the handshake payload is spread over several records,
+// which is legal TLS and survives middleboxes that coalesce segments. The
+// record contents are never changed, only how they are framed and written.
+func fragmentClientHello(clientHello []byte, cfg FragmentConfig) [][]byte {
+	points := append([]int(nil), cfg.SplitPoints...)
+	base := 0
+	if cfg.TLSRecords {
+		base = 5 // Sizes apply to the payload, which is what gets re-framed
+	}
+	offset := 0
+	for _, size := range cfg.Sizes {
+		if size > 0 {
+			offset += size
+			points = append(points, base+offset)
+		}
+	}
+	if cfg.SplitSNI {
+		if start, end, err := locateSNI(clientHello); err == nil {
+			points = append(points, start+(end-start)/2)
+		}
+	}
+	if len(points) == 0 {
+		// Split off the first byte by default: of the record, or of its
+		// payload when re-framing, as cuts in the header re-frame nothing
+		points = []int{base + 1}
+	}
+	sort.Ints(points)
+
+	if !cfg.TLSRecords || len(clientHello) < 5 {
+		return splitAt(clientHello, points)
+	}
+
+	// Only the first record is re-framed; anything after it is sent as-is
+	recordLen := int(clientHello[3])<<8 | int(clientHello[4])
+	if 5+recordLen > len(clientHello) {
+		return splitAt(clientHello, points)
+	}
+	payload := clientHello[5 : 5+recordLen]
+	rest := clientHello[5+recordLen:]
+
+	// Points are offsets into the whole record; shift them into the payload
+	var payloadPoints []int
+	for _, point := range points {
+		if point > 5 {
+			payloadPoints = append(payloadPoints, point-5)
+		}
+	}
+
+	var pieces [][]byte
+	for _, fragment := range splitAt(payload, payloadPoints) {
+		record := make([]byte, 5+len(fragment))
+		copy(record, clientHello[:3]) // Content type and record version
+		record[3] = byte(len(fragment) >> 8)
+		record[4] = byte(len(fragment))
+		copy(record[5:], fragment)
+		pieces = append(pieces, record)
+	}
+	if len(rest) > 0 {
+		pieces = append(pieces, rest)
+	}
+	if cfg.Coalesce {
+		return [][]byte{bytes.Join(pieces, nil)}
+	}
+	return pieces
+}
+
+// splitAt cuts data at the given sorted offsets, ignoring out-of-range and
+// duplicate points.
+func splitAt(data []byte, points []int) [][]byte {
+	var pieces [][]byte
+	last := 0
+	for _, point := range points {
+		if point <= last || point >= len(data) {
+			continue
+		}
+		pieces = append(pieces, data[last:point])
+		last = point
+	}
+	return append(pieces, data[last:])
+}
+
+// writeFragmented writes each piece as its own TCP segment, pausing between
+// them if a delay is configured.
+func writeFragmented(conn net.Conn, pieces [][]byte, delay time.Duration) error {
+	// Nagle's algorithm would coalesce the pieces back into one segment
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(true)
+	}
+
+	for i, piece := range pieces {
+		if i > 0 && delay > 0 {
+			time.Sleep(delay)
+		}
+		if _, err := conn.Write(piece); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeClientHello sends the ClientHello to the target, shaping the first
+// flight when configured.
+func (p *TLSProxy) writeClientHello(targetConn net.Conn, clientHello []byte) error {
+	if p.Shaping.Enabled {
+		pieces := splitAt(clientHello, randomSplitPoints(len(clientHello), p.Shaping))
+		log.Printf("🎲 Sending ClientHello in %d randomly sized segments", len(pieces))
+		return writeFragmented(targetConn, pieces, 0)
+	}
+	_, err := targetConn.Write(clientHello)
+	return err
+}
+
+func init() {
+	RegisterStrategy("fragment", func(p *TLSProxy) ConnectionStrategy { return &fragmentStrategy{cfg: p.Fragment} })
+}
+
+// fragmentStrategy dials the target directly and sends the ClientHello in
+// fragments.
+type fragmentStrategy struct {
+	cfg FragmentConfig
+}
+
+func (s *fragmentStrategy) Name() string { return "fragment" }
+
+func (s *fragmentStrategy) Applicable(dest Destination) bool { return true }
+
+func (s *fragmentStrategy) Prepare(ctx context.Context, dest Destination) (net.Conn, error) {
+	return dialDestination(ctx, dest)
+}
+
+func (s *fragmentStrategy) Establish(ctx context.Context, clientConn net.Conn, dest Destination) (net.Conn, error) {
+	conn, err := dest.takePrepared(ctx, s.Name())
+	if conn == nil && err == nil {
+		conn, err = dialDestination(ctx, dest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = sendClientHello(ctx, conn, dest, func(conn net.Conn, clientHello []byte) error {
+		pieces := fragmentClientHello(clientHello, s.cfg)
+		sessionLog(ctx).Printf("✂️ Sending ClientHello in %d fragments (tls_records=%t, coalesce=%t)", len(pieces), s.cfg.TLSRecords, s.cfg.Coalesce)
+		return writeFragmented(conn, pieces, time.Duration(s.cfg.Delay)*time.Millisecond)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
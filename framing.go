@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// frameContentType marks a request or response body as a binary OOB frame.
+// Anything else is decoded as the original JSON messages, so old clients and
+// servers keep working.
+const frameContentType = "application/x-sultry-frame"
+
+// maxFramePayload bounds the payload a peer can make us allocate.
+const maxFramePayload = 16 << 20
+
+type frameType byte
+
+const (
+	frameHandshake frameType = 1 // /handshake: client handshake message (SNI set on the first one)
+	frameAppData   frameType = 2 // /appdata: application data after the handshake
+	frameSendData  frameType = 3 // /send_data: client data during the handshake
+	frameResponse  frameType = 4 // /get_response: queued server response
+	framePing      frameType = 5 // /ping: RTT probe carrying the client's smoothed RTT
+)
+
+// frameFlagHandshakeComplete is set on responses once the handshake finished.
+const frameFlagHandshakeComplete byte = 0x01
+
+// oobFrame is the compact binary form of an OOB message, avoiding the
+// base64 overhead JSON adds to every relayed TLS record:
+//
+//	type (1) | flags (1) | session ID length (1) | session ID |
+//	SNI length (1) | SNI | payload length (4) | payload
+type oobFrame struct {
+	Type      frameType
+	Flags     byte
+	SessionID string
+	SNI       string
+	Payload   []byte
+}
+
+// MarshalBinary encodes the frame.
+func (f *oobFrame) MarshalBinary() ([]byte, error) {
+	if len(f.SessionID) > 255 || len(f.SNI) > 255 {
+		return nil, errors.New("session ID and SNI must be at most 255 bytes")
+	}
+	buf := make([]byte, 0, 9+len(f.SessionID)+len(f.SNI)+len(f.Payload))
+	buf = append(buf, byte(f.Type), f.Flags, byte(len(f.SessionID)))
+	buf = append(buf, f.SessionID...)
+	buf = append(buf, byte(len(f.SNI)))
+	buf = append(buf, f.SNI...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(f.Payload)))
+	return append(buf, f.Payload...), nil
+}
+
+// readFrame decodes a single frame from r.
+func readFrame(r io.Reader) (*oobFrame, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read frame header: %w", err)
+	}
+	f := &oobFrame{Type: frameType(header[0]), Flags: header[1]}
+
+	sessionID := make([]byte, header[2])
+	if _, err := io.ReadFull(r, sessionID); err != nil {
+		return nil, fmt.Errorf("failed to read session ID: %w", err)
+	}
+	f.SessionID = string(sessionID)
+
+	var sniLen [1]byte
+	if _, err := io.ReadFull(r, sniLen[:]); err != nil {
+		return nil, fmt.Errorf("failed to read SNI length: %w", err)
+	}
+	sni := make([]byte, sniLen[0])
+	if _, err := io.ReadFull(r, sni); err != nil {
+		return nil, fmt.Errorf("failed to read SNI: %w", err)
+	}
+	f.SNI = string(sni)
+
+	var payloadLen [4]byte
+	if _, err := io.ReadFull(r, payloadLen[:]); err != nil {
+		return nil, fmt.Errorf("failed to read payload length: %w", err)
+	}
+	n := binary.BigEndian.Uint32(payloadLen[:])
+	if n > maxFramePayload {
+		return nil, fmt.Errorf("frame payload too large (%d bytes)", n)
+	}
+	f.Payload = make([]byte, n)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return nil, fmt.Errorf("failed to read payload: %w", err)
+	}
+	return f, nil
+}
+
+// oobMessage is the union of the fields carried by the JSON OOB requests.
+type oobMessage struct {
+	SessionID string `json:"session_id"`
+	SNI       string `json:"sni,omitempty"`
+	Action    string `json:"action,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+}
+
+// isFramed reports whether the request body is a binary frame.
+func isFramed(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), frameContentType)
+}
+
+// decodeOOBMessage reads an OOB request in either wire format.
+func decodeOOBMessage(r *http.Request) (oobMessage, error) {
+	if !isFramed(r) {
+		var msg oobMessage
+		err := json.NewDecoder(r.Body).Decode(&msg)
+		return msg, err
+	}
+	f, err := readFrame(r.Body)
+	if err != nil {
+		return oobMessage{}, err
+	}
+	return oobMessage{SessionID: f.SessionID, SNI: f.SNI, Data: f.Payload}, nil
+}
+
+// encodeOOBMessage serializes msg for the requested wire format and returns
+// the body together with its content type.
+func encodeOOBMessage(t frameType, msg oobMessage, framed bool) ([]byte, string, error) {
+	if !framed {
+		body, err := json.Marshal(msg)
+		return body, "application/json", err
+	}
+	f := &oobFrame{Type: t, SessionID: msg.SessionID, SNI: msg.SNI, Payload: msg.Data}
+	body, err := f.MarshalBinary()
+	return body, frameContentType, err
+}
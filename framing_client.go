@@ -0,0 +1,43 @@
+//go:build !relay
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// postOOBMessage sends msg to peer, binary-framed when configured. A peer
+// that rejects frames (servers predating them answer 400) is retried with
+// JSON and remembered, so mixed deployments keep working.
+func (o *OOBModule) postOOBMessage(client *http.Client, peer, path string, t frameType, msg oobMessage) (*http.Response, error) {
+	o.mu.Lock()
+	framed := o.binaryFraming && !o.jsonOnlyPeers[peer]
+	o.mu.Unlock()
+	framed = framed && o.Supports(peer, capBinaryFraming)
+
+	body, contentType, err := encodeOOBMessage(t, msg, framed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s message: %w", path, err)
+	}
+	resp, err := client.Post(o.URL(peer, path), contentType, bytes.NewReader(body))
+	if err != nil || !framed || (resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusUnsupportedMediaType) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	body, contentType, err = encodeOOBMessage(t, msg, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s message: %w", path, err)
+	}
+	resp, err = client.Post(o.URL(peer, path), contentType, bytes.NewReader(body))
+	if err == nil && resp.StatusCode == http.StatusOK {
+		o.mu.Lock()
+		o.jsonOnlyPeers[peer] = true
+		o.mu.Unlock()
+		log.Printf("⚠️ OOB peer %s doesn't accept binary frames, using JSON", peer)
+	}
+	return resp, err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadFrame(t *testing.T) {
+	frame := func(f oobFrame) string {
+		raw, err := f.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(raw)
+	}
+	handshake := oobFrame{Type: frameHandshake, SessionID: "abc", SNI: "example.com", Payload: []byte("hello")}
+	full := frame(handshake)
+
+	tests := []struct {
+		name  string
+		input string
+		want  *oobFrame
+		err   string // Substring of the expected error
+	}{
+		{name: "handshake", input: full, want: &handshake},
+		{name: "empty fields", input: frame(oobFrame{Type: frameResponse, Flags: frameFlagHandshakeComplete}), want: &oobFrame{Type: frameResponse, Flags: frameFlagHandshakeComplete, Payload: []byte{}}},
+		{name: "longest fields", input: frame(oobFrame{Type: frameAppData, SessionID: strings.Repeat("s", 255), SNI: strings.Repeat("h", 255)}), want: &oobFrame{Type: frameAppData, SessionID: strings.Repeat("s", 255), SNI: strings.Repeat("h", 255), Payload: []byte{}}},
+		{name: "trailing bytes", input: full + "next", want: &handshake},
+		{name: "empty", input: "", err: "frame header"},
+		{name: "short header", input: full[:2], err: "frame header"},
+		{name: "truncated session ID", input: full[:5], err: "session ID"},
+		{name: "no SNI length", input: full[:6], err: "SNI length"},
+		{name: "truncated SNI", input: full[:10], err: "failed to read SNI"},
+		{name: "truncated payload length", input: full[:20], err: "payload length"},
+		{name: "truncated payload", input: full[:len(full)-1], err: "failed to read payload"},
+		{name: "oversized payload", input: "\x01\x00\x00\x00\x01\x00\x00\x01", err: "too large"},
+		{name: "largest payload length", input: "\x01\x00\x00\x00\xff\xff\xff\xff", err: "too large"},
+	}
+	for _, tt := range tests {
+		got, err := readFrame(strings.NewReader(tt.input))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got.Type != tt.want.Type || got.Flags != tt.want.Flags || got.SessionID != tt.want.SessionID ||
+			got.SNI != tt.want.SNI || !bytes.Equal(got.Payload, tt.want.Payload) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFrameMarshalRejectsLongFields(t *testing.T) {
+	for _, f := range []oobFrame{
+		{SessionID: strings.Repeat("s", 256)},
+		{SNI: strings.Repeat("h", 256)},
+	} {
+		if _, err := f.MarshalBinary(); err == nil {
+			t.Errorf("frame with %d-byte session ID and %d-byte SNI encoded", len(f.SessionID), len(f.SNI))
+		}
+	}
+}
+
+func TestDecodeOOBMessage(t *testing.T) {
+	msg := oobMessage{SessionID: "abc", SNI: "example.com", Data: []byte("hello")}
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		err         bool
+	}{
+		{name: "json", body: `{"session_id":"abc","sni":"example.com","data":"aGVsbG8="}`, contentType: "application/json"},
+		{name: "json without content type", body: `{"session_id":"abc","sni":"example.com","data":"aGVsbG8="}`},
+		{name: "frame", contentType: frameContentType},
+		{name: "frame with parameters", contentType: frameContentType + "; v=1"},
+		{name: "truncated frame", body: "\x01\x00\x03ab", contentType: frameContentType, err: true},
+		{name: "frame sent as json", contentType: "application/json", err: true},
+		{name: "malformed json", body: `{"session_id":`, contentType: "application/json", err: true},
+	}
+	for _, tt := range tests {
+		body := tt.body
+		if body == "" {
+			raw, _, err := encodeOOBMessage(frameHandshake, msg, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = string(raw)
+		}
+		r := httptest.NewRequest("POST", "/handshake", strings.NewReader(body))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		got, err := decodeOOBMessage(r)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: decoded %+v", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got.SessionID != msg.SessionID || got.SNI != msg.SNI || !bytes.Equal(got.Data, msg.Data) {
+			t.Errorf("%s: got %+v, %v", tt.name, got, err)
+		}
+	}
+}
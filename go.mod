@@ -1,3 +1,24 @@
 module sultry
 
 go 1.23.6
+
+require (
+	github.com/hashicorp/yamux v0.1.2
+	github.com/quic-go/quic-go v0.54.0
+	github.com/quic-go/webtransport-go v0.9.0
+	golang.org/x/crypto v0.26.0
+	golang.org/x/sync v0.8.0
+	gvisor.dev/gvisor v0.0.0-20240722211153-64c016c92987
+)
+
+require (
+	github.com/google/btree v1.1.2 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/time v0.5.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// HandshakeLimitsConfig bounds how much a relayed handshake may exchange
+// before it completes, so a broken or malicious endpoint can't keep a
+// session in handshake state, and its target connection open, forever.
+type HandshakeLimitsConfig struct {
+	MaxMessages int `json:"max_messages,omitempty"` // Messages relayed in either direction (default: 64)
+	MaxBytes    int `json:"max_bytes,omitempty"`    // Bytes relayed in either direction (default: 262144)
+	MaxDuration int `json:"max_duration,omitempty"` // Milliseconds from the ClientHello (default: 60000)
+}
+
+// handshakeLimits is set from the configuration when the server starts.
+var handshakeLimits HandshakeLimitsConfig
+
+// countHandshakeMessage accounts for a message of n bytes relayed for a
+// session whose handshake is still in progress. Once a limit is exceeded
+// the session is aborted and an error returned.
+func countHandshakeMessage(sessionID string, session *SessionState, n int) error {
+	session.mu.Lock()
+	if session.HandshakeComplete || session.Adopted {
+		session.mu.Unlock()
+		return nil
+	}
+	session.handshakeMessages++
+	session.handshakeBytes += n
+
+	var exceeded string
+	switch {
+	case session.handshakeMessages > orDefault(handshakeLimits.MaxMessages, 64):
+		exceeded = fmt.Sprintf("%d messages", session.handshakeMessages)
+	case session.handshakeBytes > orDefault(handshakeLimits.MaxBytes, 262144):
+		exceeded = fmt.Sprintf("%d bytes", session.handshakeBytes)
+	case !session.handshakeStarted.IsZero() && time.Since(session.handshakeStarted) > millis(handshakeLimits.MaxDuration, 60000):
+		exceeded = fmt.Sprintf("%v", time.Since(session.handshakeStarted).Truncate(time.Millisecond))
+	}
+	session.mu.Unlock()
+	if exceeded == "" {
+		return nil
+	}
+	return abortHandshake(sessionID, session, exceeded)
+}
+
+// handshakeDeadline returns when the session's handshake has to be done by:
+// max_duration after the ClientHello.
+func (s *SessionState) handshakeDeadline() time.Time {
+	return s.handshakeStarted.Add(millis(handshakeLimits.MaxDuration, 60000))
+}
+
+// abortHandshake ends a session whose handshake exceeded a limit, closing
+// its target connection.
+func abortHandshake(sessionID string, session *SessionState, exceeded string) error {
+	log.Printf("🛑 Aborting session %s: handshake still incomplete after %s", sessionID, exceeded)
+	sessionsMu.Lock()
+	if sessions[sessionID] == session {
+		delete(sessions, sessionID)
+		session.unredact()
+	}
+	sessionsMu.Unlock()
+	if session.TargetConn != nil {
+		session.TargetConn.Close()
+	}
+	return fmt.Errorf("handshake limit exceeded after %s", exceeded)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// handleHeartbeat answers heartbeats from clients predating pings.
+func handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePing answers client pings and records the RTT they report.
+func handlePing(w http.ResponseWriter, r *http.Request) {
+	msg, err := decodeOOBMessage(r)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(msg.Data) >= 4 {
+		rtt := time.Duration(binary.BigEndian.Uint32(msg.Data)) * time.Microsecond
+		clientLatency.record(r.RemoteAddr, rtt)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clientRTT is a client's latency as reported by its pings.
+type clientRTT struct {
+	Client   string    `json:"client"`
+	RTT      float64   `json:"rtt_ms"` // 0 until the client has measured one
+	Pings    int       `json:"pings"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// clientLatencyTracker keeps the RTT reported by each client address.
+type clientLatencyTracker struct {
+	clients map[string]*clientRTT
+	mu      sync.Mutex
+}
+
+var clientLatency = &clientLatencyTracker{clients: make(map[string]*clientRTT)}
+
+func (t *clientLatencyTracker) record(remoteAddr string, rtt time.Duration) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.clients[host]
+	if !ok {
+		// Clients that stopped pinging make room for new ones
+		if len(t.clients) >= maxTrackedPaths {
+			for addr, c := range t.clients {
+				if time.Since(c.LastSeen) > 10*time.Minute {
+					delete(t.clients, addr)
+				}
+			}
+			if len(t.clients) >= maxTrackedPaths {
+				return
+			}
+		}
+		entry = &clientRTT{Client: host}
+		t.clients[host] = entry
+	}
+	entry.Pings++
+	entry.LastSeen = time.Now()
+	if rtt > 0 {
+		entry.RTT = float64(rtt) / float64(time.Millisecond)
+	}
+}
+
+// Snapshot returns the latency of every client seen, sorted by address.
+func (t *clientLatencyTracker) Snapshot() []clientRTT {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make([]clientRTT, 0, len(t.clients))
+	for _, entry := range t.clients {
+		snapshot = append(snapshot, *entry)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Client < snapshot[j].Client })
+	return snapshot
+}
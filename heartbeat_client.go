@@ -0,0 +1,76 @@
+//go:build !relay
+
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"math"
+	"time"
+)
+
+// HeartbeatConfig has the client check every OOB peer in the background,
+// so a dead server is taken out of rotation before a user connection is
+// sent its way, and put back as soon as it answers again.
+type HeartbeatConfig struct {
+	Interval  int `json:"interval,omitempty"`   // Milliseconds between heartbeats to each peer; 0 disables them
+	Timeout   int `json:"timeout,omitempty"`    // Milliseconds before a heartbeat counts as missed (default: 3000)
+	MaxMissed int `json:"max_missed,omitempty"` // Consecutive missed heartbeats before a peer is marked down (default: 2)
+}
+
+// startHeartbeats runs a heartbeat loop for every peer.
+func (o *OOBModule) startHeartbeats(cfg HeartbeatConfig) {
+	if cfg.Interval <= 0 {
+		return
+	}
+	interval := time.Duration(cfg.Interval) * time.Millisecond
+	timeout := millis(cfg.Timeout, 3000)
+	maxMissed := orDefault(cfg.MaxMissed, 2)
+	log.Printf("💓 Sending heartbeats to OOB peers every %v", interval)
+
+	for _, peer := range o.balancer.Peers() {
+		go func() {
+			missed := 0
+			for range time.Tick(interval) {
+				rtt, err := o.heartbeat(peer, timeout)
+				if err == nil {
+					if missed >= maxMissed {
+						// It may have come back as a different version
+						o.negotiate(peer)
+					}
+					missed = 0
+					o.balancer.MarkUp(peer, rtt)
+					continue
+				}
+				// Keep quiet once the peer is down, until it comes back
+				missed++
+				if missed <= maxMissed {
+					log.Printf("⚠️ Missed heartbeat from OOB peer %s (%d/%d): %v", peer, missed, maxMissed, err)
+				}
+				if missed == maxMissed {
+					o.balancer.MarkDown(peer)
+				}
+			}
+		}()
+	}
+}
+
+// heartbeat sends one ping to peer and returns the round-trip time. The
+// ping tells the server the RTT measured so far, so both ends know the
+// latency of the path. Any HTTP response counts, since it shows the peer is
+// reachable and serving, even if it predates the ping endpoint.
+func (o *OOBModule) heartbeat(peer string, timeout time.Duration) (time.Duration, error) {
+	micros := o.balancer.SRTT(peer).Microseconds()
+	if micros > math.MaxUint32 {
+		micros = math.MaxUint32
+	}
+	payload := binary.BigEndian.AppendUint32(nil, uint32(micros))
+
+	start := time.Now()
+	resp, err := o.postOOBMessage(o.Client(timeout), peer, "/ping", framePing, oobMessage{Action: "ping", Data: payload})
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return time.Since(start), nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"time"
+
+	sultrytls "sultry/pkg/tls"
+)
+
+// maxClientHelloLen bounds how much of a client's first flight is buffered
+// while waiting for its ClientHello to complete.
+const maxClientHelloLen = 65535
+
+// readClientHello reads a client's first flight within timeout. A TLS
+// ClientHello is buffered until it's complete, even when it arrives in
+// several TCP segments or spans several records, as large hellos with
+// post-quantum key shares or many extensions do. Anything that's not a
+// ClientHello is returned as first read. Bytes read past the ClientHello,
+// such as early data, are returned after it.
+func readClientHello(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var records sultrytls.Reassembler
+	var hello, message []byte // Whole records read so far, and the handshake message they carry
+	buffer := make([]byte, 16384)
+	for {
+		n, err := conn.Read(buffer)
+		if n > 0 && len(hello) == 0 && records.Buffered() == 0 && buffer[0] != sultrytls.RecordHandshake {
+			return append([]byte(nil), buffer[:n]...), nil
+		}
+		if n > 0 {
+			complete, parseErr := records.Feed(buffer[:n])
+			for _, record := range complete {
+				hello = append(hello, record.Raw...)
+				if record.Type == sultrytls.RecordHandshake && !handshakeMessageComplete(message) {
+					message = append(message, record.Payload...)
+				}
+			}
+			if parseErr != nil || handshakeMessageComplete(message) {
+				return append(hello, records.Rest()...), nil
+			}
+			if len(hello)+records.Buffered() > maxClientHelloLen {
+				return nil, fmt.Errorf("ClientHello exceeds %d bytes", maxClientHelloLen)
+			}
+		}
+		if err != nil {
+			if len(hello)+records.Buffered() > 0 {
+				return nil, fmt.Errorf("incomplete ClientHello after %d bytes: %w", len(hello)+records.Buffered(), err)
+			}
+			return nil, err
+		}
+	}
+}
+
+// handshakeMessageComplete reports whether message holds at least one whole
+// handshake message.
+func handshakeMessageComplete(message []byte) bool {
+	if len(message) < 4 {
+		return false
+	}
+	length := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+	return len(message) >= 4+length
+}
+
+// singleRecordHello returns hello with its handshake message in a single
+// record, for parsers that expect the ClientHello in the first record. A
+// hello that already fits one record is returned as it is; the result is
+// only for inspection, the client's original records are what get relayed.
+func singleRecordHello(hello []byte) []byte {
+	var records sultrytls.Reassembler
+	complete, _ := records.Feed(hello)
+	if len(complete) < 2 || complete[0].Type != sultrytls.RecordHandshake || handshakeMessageComplete(complete[0].Payload) {
+		return hello
+	}
+	var message []byte
+	for _, record := range complete {
+		if record.Type != sultrytls.RecordHandshake || handshakeMessageComplete(message) {
+			break
+		}
+		message = append(message, record.Payload...)
+	}
+	joined := []byte{sultrytls.RecordHandshake, hello[1], hello[2]}
+	joined = binary.BigEndian.AppendUint16(joined, uint16(len(message)))
+	return append(joined, message...)
+}
+
+// buildClientHello generates a plausible TLS 1.3 ClientHello record for sni.
+// It's used for proxy-originated hellos that are never completed, such as the
+// fake segments sent by the desync strategy, so only its wire shape matters.
+// Like current browsers, every hello carries fresh GREASE values (RFC 8701)
+// and its own extension order, so generated hellos don't share a stable
+// fingerprint.
+func buildClientHello(sni string) []byte {
+	random := make([]byte, 32)
+	rand.Read(random)
+	sessionID := make([]byte, 32)
+	rand.Read(sessionID)
+	keyShare := make([]byte, 32)
+	rand.Read(keyShare)
+	grease := greaseValues(5)
+
+	cipherSuites := []uint16{
+		grease[0],
+		0x1301, 0x1302, 0x1303, // TLS 1.3 AES-128-GCM, AES-256-GCM, ChaCha20
+		0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, // ECDHE AEAD suites
+		0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+	}
+
+	extensions := []helloExtension{
+		{0x0000, serverNameExtension(sni)},
+		{0x0017, nil},                                        // extended_master_secret
+		{0xff01, []byte{0x00}},                               // renegotiation_info
+		{0x000a, u16List(grease[1], 0x001d, 0x0017, 0x0018)}, // supported_groups
+		{0x000b, []byte{0x01, 0x00}},                         // ec_point_formats
+		{0x0023, nil},                                        // session_ticket
+		{0x0010, alpnExtension("h2", "http/1.1")},
+		{0x0005, []byte{0x01, 0x00, 0x00, 0x00, 0x00}}, // status_request
+		{0x000d, u16List(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)},
+		{0x0033, keyShareExtension(keyShareEntry{grease[1], []byte{0x00}}, keyShareEntry{0x001d, keyShare})},
+		{0x002d, []byte{0x01, 0x01}},                // psk_key_exchange_modes: psk_dhe_ke
+		{0x002b, u8List(grease[2], 0x0304, 0x0303)}, // supported_versions: 1.3, 1.2
+	}
+	mrand.Shuffle(len(extensions), func(i, j int) {
+		extensions[i], extensions[j] = extensions[j], extensions[i]
+	})
+	// GREASE extensions go first and last, where browsers put them
+	extensions = append([]helloExtension{{grease[3], nil}}, extensions...)
+	extensions = append(extensions, helloExtension{grease[4], []byte{0x00}})
+
+	var extensionBytes []byte
+	for _, ext := range extensions {
+		extensionBytes = appendExtension(extensionBytes, ext.Type, ext.Data)
+	}
+
+	var body []byte
+	body = append(body, 0x03, 0x03) // legacy_version TLS 1.2
+	body = append(body, random...)
+	body = append(body, byte(len(sessionID)))
+	body = append(body, sessionID...)
+	suites := u16List(cipherSuites...)
+	body = append(body, suites...)
+	body = append(body, 0x01, 0x00) // compression_methods: null
+	body = binary.BigEndian.AppendUint16(body, uint16(len(extensionBytes)))
+	body = append(body, extensionBytes...)
+
+	handshake := []byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	handshake = append(handshake, body...)
+
+	record := []byte{0x16, 0x03, 0x01, byte(len(handshake) >> 8), byte(len(handshake))}
+	return append(record, handshake...)
+}
+
+// helloExtension is a ClientHello extension before encoding.
+type helloExtension struct {
+	Type uint16
+	Data []byte
+}
+
+// greaseValues returns n distinct random GREASE values, which have the
+// form 0x?a?a and must be ignored by servers.
+func greaseValues(n int) []uint16 {
+	values := make([]uint16, 0, n)
+	for _, i := range mrand.Perm(16)[:n] {
+		values = append(values, 0x0a0a+uint16(i)*0x1010)
+	}
+	return values
+}
+
+// appendExtension appends a type/length/value encoded extension.
+func appendExtension(b []byte, extType uint16, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, extType)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+// u16List encodes a 2-byte length-prefixed list of uint16 values.
+func u16List(values ...uint16) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(values)*2))
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+// u8List encodes a 1-byte length-prefixed list of uint16 values.
+func u8List(values ...uint16) []byte {
+	b := []byte{byte(len(values) * 2)}
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+func serverNameExtension(sni string) []byte {
+	entry := []byte{0x00} // host_name
+	entry = binary.BigEndian.AppendUint16(entry, uint16(len(sni)))
+	entry = append(entry, sni...)
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(entry)))
+	return append(b, entry...)
+}
+
+func alpnExtension(protocols ...string) []byte {
+	var list []byte
+	for _, proto := range protocols {
+		list = append(list, byte(len(proto)))
+		list = append(list, proto...)
+	}
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(list)))
+	return append(b, list...)
+}
+
+// keyShareEntry is one group's key in the key_share extension.
+type keyShareEntry struct {
+	Group uint16
+	Key   []byte
+}
+
+func keyShareExtension(shares ...keyShareEntry) []byte {
+	var entries []byte
+	for _, share := range shares {
+		entries = binary.BigEndian.AppendUint16(entries, share.Group)
+		entries = binary.BigEndian.AppendUint16(entries, uint16(len(share.Key)))
+		entries = append(entries, share.Key...)
+	}
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(entries)))
+	return append(b, entries...)
+}
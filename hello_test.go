@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	sultrytls "sultry/pkg/tls"
+)
+
+// splitRecords moves the handshake message of a single-record hello into
+// records of at most size bytes each.
+func splitRecords(hello []byte, size int) []byte {
+	message := hello[sultrytls.HeaderLen:]
+	var split []byte
+	for len(message) > 0 {
+		n := min(size, len(message))
+		split = append(split, sultrytls.RecordHandshake, hello[1], hello[2])
+		split = binary.BigEndian.AppendUint16(split, uint16(n))
+		split = append(split, message[:n]...)
+		message = message[n:]
+	}
+	return split
+}
+
+func TestReadClientHello(t *testing.T) {
+	hello := buildClientHello("example.com")
+	spanning := splitRecords(hello, 100)
+	earlyData := []byte{sultrytls.RecordApplicationData, 3, 3, 0, 2, 'h', 'i'}
+
+	tests := []struct {
+		name   string
+		writes [][]byte
+		want   []byte
+		err    bool
+	}{
+		{"one segment", [][]byte{hello}, hello, false},
+		{"several segments", [][]byte{hello[:3], hello[3:50], hello[50:]}, hello, false},
+		{"spanning records", [][]byte{spanning[:150], spanning[150:]}, spanning, false},
+		{"with early data", [][]byte{append(append([]byte{}, hello...), earlyData...)}, append(append([]byte{}, hello...), earlyData...), false},
+		{"not TLS", [][]byte{[]byte("GET / HTTP/1.1\r\n")}, []byte("GET / HTTP/1.1\r\n"), false},
+		{"cut short", [][]byte{hello[:len(hello)-10]}, nil, true},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			for _, w := range tt.writes {
+				client.Write(w)
+			}
+			client.Close()
+		}()
+		got, err := readClientHello(server, time.Second)
+		server.Close()
+		if (err != nil) != tt.err || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: read %d bytes, %v, want %d", tt.name, len(got), err, len(tt.want))
+		}
+	}
+}
+
+func TestSingleRecordHello(t *testing.T) {
+	hello := buildClientHello("example.com")
+	if got := singleRecordHello(hello); !bytes.Equal(got, hello) {
+		t.Error("single-record hello changed")
+	}
+	joined := singleRecordHello(splitRecords(hello, 64))
+	if !bytes.Equal(joined, hello) {
+		t.Errorf("joined hello differs from the original: %d bytes, want %d", len(joined), len(hello))
+	}
+	var records sultrytls.Reassembler
+	if complete, err := records.Feed(joined); len(complete) != 1 || err != nil {
+		t.Errorf("joined hello is %d records, %v", len(complete), err)
+	}
+}
+
+func TestBuildClientHello(t *testing.T) {
+	for _, sni := range []string{"example.com", "a.very.long.subdomain.example.org"} {
+		a, b := buildClientHello(sni), buildClientHello(sni)
+		hello, err := sultrytls.ParseClientHello(a)
+		if err != nil {
+			t.Fatalf("%s: %v", sni, err)
+		}
+		if hello.ServerName != sni || hello.MaxVersion() != sultrytls.VersionTLS13 {
+			t.Errorf("%s: server name %q, max version %#04x", sni, hello.ServerName, hello.MaxVersion())
+		}
+		if bytes.Equal(a, b) {
+			t.Errorf("%s: two hellos are identical", sni)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+//go:build !relay
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Host list files
+//
+// Communities maintain lists of the domains blocked in their country, in
+// the formats of the tools they were written for: gfwlist's base64-encoded
+// AutoProxy rules, dnsmasq configurations that send those domains to another
+// resolver, or plain lists of names; blocklists of ads and trackers come as
+// hosts files or Adblock filters. Rules can reference such files instead
+// of copying thousands of hosts into the configuration; their entries are
+// turned into host patterns when the rules are compiled.
+//
+// Only the host of each entry is kept. Entries that can't be reduced to a
+// host, like URL regular expressions, paths and filters applying only to
+// some requests, are skipped, as are exceptions, so a list matches somewhat
+// more hosts than the tool it was written for would, and blocks somewhat
+// fewer requests.
+
+// HostList is a file of hosts a rule matches.
+type HostList struct {
+	Path   string `json:"path"`
+	Format string `json:"format,omitempty"` // "gfwlist", "dnsmasq", "hosts", "adblock" or "plain" (default: detected from the contents)
+}
+
+// Host list formats.
+const (
+	listGFWList = "gfwlist" // AutoProxy rules, usually base64-encoded
+	listDnsmasq = "dnsmasq" // server=/domain/..., ipset=/domain/... and similar lines
+	listHosts   = "hosts"   // "0.0.0.0 host ..." lines, as in /etc/hosts
+	listAdblock = "adblock" // Adblock Plus filters, of which "||domain^" ones are used
+	listPlain   = "plain"   // One host pattern per line; bare names match their subdomains too
+)
+
+// validate checks that list names a file and a format loadHostList knows.
+func (list HostList) validate() error {
+	if list.Path == "" {
+		return fmt.Errorf("no path")
+	}
+	switch list.Format {
+	case "", listGFWList, listDnsmasq, listHosts, listAdblock, listPlain:
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q (use gfwlist, dnsmasq, hosts, adblock or plain)", list.Format)
+	}
+}
+
+// loadHostList reads list and returns its hosts as patterns for a
+// hostMatcher, along with the number of entries skipped.
+func loadHostList(list HostList) ([]string, int, error) {
+	data, err := os.ReadFile(list.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	format := list.Format
+	if format == "" {
+		format = detectListFormat(data)
+	}
+	switch format {
+	case listGFWList:
+		return parseGFWList(data)
+	case listDnsmasq:
+		patterns, skipped := parseDnsmasqList(data)
+		return patterns, skipped, nil
+	case listHosts:
+		patterns, skipped := parseHostsList(data)
+		return patterns, skipped, nil
+	case listAdblock:
+		patterns, skipped := parseAdblockList(data)
+		return patterns, skipped, nil
+	case listPlain:
+		return parsePlainList(data)
+	default:
+		return nil, 0, fmt.Errorf("unknown format %q (use gfwlist, dnsmasq, hosts, adblock or plain)", format)
+	}
+}
+
+// detectListFormat guesses the format of a list from its contents.
+func detectListFormat(data []byte) string {
+	if decoded, ok := decodeBase64List(data); ok && bytes.HasPrefix(bytes.TrimSpace(decoded), []byte("[AutoProxy")) {
+		return listGFWList
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[AutoProxy")) {
+		return listGFWList
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[Adblock")) {
+		return listAdblock
+	}
+	for _, line := range listLines(data) {
+		if key, _, ok := strings.Cut(line, "=/"); ok && dnsmasqDomainKeys[key] {
+			return listDnsmasq
+		}
+		if strings.HasPrefix(line, "||") && strings.Contains(line, "^") {
+			return listAdblock
+		}
+		if _, ok := hostsLine(line); ok {
+			return listHosts
+		}
+	}
+	return listPlain
+}
+
+// decodeBase64List decodes a base64-encoded list, which may be wrapped
+// over many lines.
+func decodeBase64List(data []byte) ([]byte, bool) {
+	compact := bytes.Join(bytes.Fields(data), nil)
+	decoded, err := base64.StdEncoding.DecodeString(string(compact))
+	if err != nil {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// listLines returns the lines of data with surrounding space removed,
+// leaving out empty ones.
+func listLines(data []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// parseGFWList turns AutoProxy rules into host patterns: "||domain" and
+// ".domain" match the domain and its subdomains, "|http://host/..." the
+// host, and a bare "domain/path" the domain and its subdomains. Comments,
+// exceptions ("@@") and regular expressions are skipped.
+func parseGFWList(data []byte) ([]string, int, error) {
+	if decoded, ok := decodeBase64List(data); ok {
+		data = decoded
+	}
+	var patterns []string
+	skipped := 0
+	for _, line := range listLines(data) {
+		switch {
+		case strings.HasPrefix(line, "!"), strings.HasPrefix(line, "["):
+			continue
+		case strings.HasPrefix(line, "@@"), strings.HasPrefix(line, "/"):
+			skipped++
+			continue
+		}
+
+		host, wildcard := line, true
+		switch {
+		case strings.HasPrefix(line, "||"):
+			host = line[2:]
+		case strings.HasPrefix(line, "|"):
+			u, err := url.Parse(line[1:])
+			if err != nil || u.Hostname() == "" {
+				skipped++
+				continue
+			}
+			host, wildcard = u.Hostname(), false
+		default:
+			host = strings.TrimPrefix(line, ".")
+			host = strings.TrimPrefix(strings.TrimPrefix(host, "http://"), "https://")
+		}
+		host, _, _ = strings.Cut(host, "/")
+		host = strings.TrimRight(host, "^")
+		if !listHost(host) {
+			skipped++
+			continue
+		}
+		if wildcard {
+			host = "*." + host
+		}
+		patterns = append(patterns, host)
+	}
+	return patterns, skipped, nil
+}
+
+// dnsmasqDomainKeys are the dnsmasq options that apply to /domains/.
+var dnsmasqDomainKeys = map[string]bool{
+	"server": true, "local": true, "address": true, "ipset": true, "nftset": true, "rebind-domain-ok": true,
+}
+
+// parseDnsmasqList takes the domains of dnsmasq options like
+// "server=/example.com/example.net/1.2.3.4", each of which matches the
+// domain and its subdomains. Other lines are skipped.
+func parseDnsmasqList(data []byte) ([]string, int) {
+	var patterns []string
+	skipped := 0
+	for _, line := range listLines(data) {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, rest, ok := strings.Cut(line, "=/")
+		if !ok || !dnsmasqDomainKeys[key] {
+			skipped++
+			continue
+		}
+		fields := strings.Split(rest, "/")
+		// The last field is the option's value, not a domain
+		for _, domain := range fields[:len(fields)-1] {
+			if domain = strings.TrimPrefix(domain, "."); listHost(domain) {
+				patterns = append(patterns, "*."+domain)
+			}
+		}
+	}
+	return patterns, skipped
+}
+
+// parseHostsList takes the names of hosts file lines like
+// "0.0.0.0 ads.example.com tracker.example.com", each matching only itself,
+// as hosts files do. The names every system's hosts file has, like
+// localhost, are left out; other lines are skipped.
+func parseHostsList(data []byte) ([]string, int) {
+	var patterns []string
+	skipped := 0
+	for _, line := range listLines(data) {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		names, ok := hostsLine(line)
+		if !ok {
+			skipped++
+			continue
+		}
+		patterns = append(patterns, names...)
+	}
+	return patterns, skipped
+}
+
+// hostsLine returns the names a hosts file line maps to an address, if it
+// is one.
+func hostsLine(line string) ([]string, bool) {
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil, false
+	}
+	var names []string
+	for _, name := range fields[1:] {
+		if !localHostsName(name) && listHost(name) {
+			names = append(names, name)
+		}
+	}
+	return names, true
+}
+
+// localHostsName reports whether name is one of those hosts files map to
+// the machine itself, which blocklists repeat from the system's own.
+func localHostsName(name string) bool {
+	switch strings.ToLower(name) {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost", "0.0.0.0":
+		return true
+	}
+	return strings.HasPrefix(strings.ToLower(name), "ip6-")
+}
+
+// adblockHostOptions are the Adblock filter options that still apply to
+// every request to a host, so a filter having only these blocks the host.
+var adblockHostOptions = map[string]bool{
+	"important": true, "all": true, "document": true, "doc": true,
+}
+
+// parseAdblockList takes the hosts of Adblock filters blocking whole
+// hosts: "||domain^" matches the domain and its subdomains,
+// "|https://host^" the host, and a bare domain the domain and its
+// subdomains, as do hosts file lines, which blocklists for DNS filters mix
+// in. Comments and element hiding rules are left out; exceptions ("@@"),
+// filters with a path and filters limited by options like $third-party are
+// skipped.
+func parseAdblockList(data []byte) ([]string, int) {
+	var patterns []string
+	skipped := 0
+	for _, line := range listLines(data) {
+		if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") || strings.HasPrefix(line, "#") ||
+			strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") || strings.Contains(line, "#$#") {
+			continue
+		}
+		if names, ok := hostsLine(line); ok {
+			patterns = append(patterns, names...)
+			continue
+		}
+		if strings.HasPrefix(line, "@@") {
+			skipped++
+			continue
+		}
+
+		filter, options, _ := strings.Cut(line, "$")
+		hostWide := true
+		if options != "" {
+			for _, option := range strings.Split(options, ",") {
+				hostWide = hostWide && adblockHostOptions[option]
+			}
+		}
+		host, wildcard := filter, true
+		switch {
+		case strings.HasPrefix(filter, "||"):
+			host = filter[2:]
+		case strings.HasPrefix(filter, "|http://"), strings.HasPrefix(filter, "|https://"):
+			_, host, _ = strings.Cut(filter, "://")
+			wildcard = false
+		}
+		host = strings.TrimSuffix(strings.TrimSuffix(host, "|"), "^")
+		if !hostWide || !listHost(host) {
+			skipped++
+			continue
+		}
+		if wildcard {
+			host = "*." + host
+		}
+		patterns = append(patterns, host)
+	}
+	return patterns, skipped
+}
+
+// parsePlainList takes one host pattern per line, with "#" starting a
+// comment. Bare names match their subdomains too, as lists of blocked
+// domains mean them to; "full:" matches only the name itself, and
+// "domain:", "keyword:" and "regexp:" patterns are taken as they are.
+func parsePlainList(data []byte) ([]string, int, error) {
+	var patterns []string
+	for _, line := range listLines(data) {
+		if line, _, _ = strings.Cut(line, "#"); strings.TrimSpace(line) == "" {
+			continue
+		}
+		line = strings.TrimSpace(line)
+		var pattern string
+		switch {
+		case strings.HasPrefix(line, "full:"):
+			pattern = strings.TrimPrefix(line, "full:")
+		case strings.HasPrefix(line, "domain:"):
+			pattern = "*." + strings.TrimPrefix(line, "domain:")
+		case strings.HasPrefix(line, keywordPrefix), strings.HasPrefix(line, regexpPrefix),
+			strings.HasPrefix(line, "*"), net.ParseIP(line) != nil:
+			pattern = line
+		default:
+			pattern = "*." + line
+		}
+		if err := validHostPattern(pattern); err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", line, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, 0, nil
+}
+
+// listHost reports whether s looks like a host name or address that a
+// list entry can be reduced to.
+func listHost(s string) bool {
+	if net.ParseIP(s) != nil {
+		return true
+	}
+	if !strings.Contains(s, ".") || strings.HasPrefix(s, ".") || strings.HasSuffix(s, ".") {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Host pattern sets
+//
+// Lists of host patterns like routing rules and DoH resolvers can run to
+// thousands of entries, and are consulted for every tunnel. Rather than
+// trying each pattern in turn, a hostMatcher files names and "*.suffix"
+// patterns in a trie of domain labels, walked from the top-level domain
+// down, so a lookup costs one step per label of the host whatever the size
+// of the list. Only "keyword:" and "regexp:" patterns, which can match
+// anywhere in a name, are tried one by one.
+//
+// Patterns are numbered by the entry they belong to, and a lookup returns
+// the lowest number matching, so the first matching entry wins just as if
+// the list were tried in order.
+
+// Prefixes of patterns that aren't host names.
+const (
+	keywordPrefix = "keyword:" // Hosts containing the rest, e.g. "keyword:tracker"
+	regexpPrefix  = "regexp:"  // Hosts matching the rest as a regular expression, e.g. `regexp:^ads?\.`
+)
+
+// hostMatcher finds the first of a set of numbered host patterns matching a
+// host. The zero value matches nothing.
+type hostMatcher struct {
+	root     *suffixNode
+	any      int // Number of the first "*" pattern, or -1
+	keywords []keywordPattern
+	regexps  []regexpPattern
+}
+
+// suffixNode is a domain in the trie, its children keyed by the label
+// before it. Pattern numbers are -1 where no pattern ends.
+type suffixNode struct {
+	children map[string]*suffixNode
+	exact    int // First pattern naming the domain itself
+	wildcard int // First "*." pattern of the domain, matching it and its subdomains
+}
+
+type keywordPattern struct {
+	keyword string
+	n       int
+}
+
+type regexpPattern struct {
+	re *regexp.Regexp
+	n  int
+}
+
+func newSuffixNode() *suffixNode {
+	return &suffixNode{exact: -1, wildcard: -1}
+}
+
+// newHostMatcher returns an empty matcher to add patterns to.
+func newHostMatcher() *hostMatcher {
+	return &hostMatcher{root: newSuffixNode(), any: -1}
+}
+
+// validHostPattern checks that pattern can be added to a hostMatcher.
+func validHostPattern(pattern string) error {
+	return newHostMatcher().add(pattern, 0)
+}
+
+// add files pattern under n: an exact name, "*", "*.suffix", which matches
+// the suffix itself and any subdomain, "keyword:" or "regexp:". Names are
+// compared without case and trailing dots; regular expressions are matched
+// against the lower-case name. Patterns must be added in increasing order
+// of n.
+func (m *hostMatcher) add(pattern string, n int) error {
+	switch {
+	case strings.HasPrefix(pattern, keywordPrefix):
+		keyword := strings.ToLower(strings.TrimPrefix(pattern, keywordPrefix))
+		if keyword == "" {
+			return fmt.Errorf("empty keyword in %q", pattern)
+		}
+		m.keywords = append(m.keywords, keywordPattern{keyword, n})
+		return nil
+	case strings.HasPrefix(pattern, regexpPrefix):
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, regexpPrefix))
+		if err != nil {
+			return fmt.Errorf("invalid %q: %w", pattern, err)
+		}
+		m.regexps = append(m.regexps, regexpPattern{re, n})
+		return nil
+	}
+
+	pattern = normalizeHost(pattern)
+	if pattern == "" {
+		return fmt.Errorf("empty host pattern")
+	}
+	if pattern == "*" {
+		if m.any < 0 {
+			m.any = n
+		}
+		return nil
+	}
+	wildcard := strings.HasPrefix(pattern, "*.")
+	if wildcard {
+		pattern = pattern[2:]
+	}
+	node := m.root
+	labels := strings.Split(pattern, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child := node.children[labels[i]]
+		if child == nil {
+			child = newSuffixNode()
+			if node.children == nil {
+				node.children = make(map[string]*suffixNode)
+			}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	if wildcard && node.wildcard < 0 {
+		node.wildcard = n
+	} else if !wildcard && node.exact < 0 {
+		node.exact = n
+	}
+	return nil
+}
+
+// match returns the number of the first pattern matching any of hosts.
+// Empty hosts match nothing.
+func (m *hostMatcher) match(hosts ...string) (int, bool) {
+	best := -1
+	better := func(n int) bool { return n >= 0 && (best < 0 || n < best) }
+	if m == nil || m.root == nil {
+		return best, false
+	}
+	for _, host := range hosts {
+		host = normalizeHost(host)
+		if host == "" {
+			continue
+		}
+		if better(m.any) {
+			best = m.any
+		}
+
+		node := m.root
+		labels := strings.Split(host, ".")
+		for i := len(labels) - 1; i >= 0 && node != nil; i-- {
+			if node = node.children[labels[i]]; node == nil {
+				break
+			}
+			if better(node.wildcard) {
+				best = node.wildcard
+			}
+			if i == 0 && better(node.exact) {
+				best = node.exact
+			}
+		}
+
+		// Both lists are in pattern order, so the rest can't do better
+		for _, k := range m.keywords {
+			if !better(k.n) {
+				break
+			}
+			if strings.Contains(host, k.keyword) {
+				best = k.n
+				break
+			}
+		}
+		for _, r := range m.regexps {
+			if !better(r.n) {
+				break
+			}
+			if r.re.MatchString(host) {
+				best = r.n
+				break
+			}
+		}
+	}
+	return best, best >= 0
+}
+
+// normalizeHost returns host as patterns are matched against it: in lower
+// case, without a trailing dot.
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
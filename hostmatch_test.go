@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHostMatcher(t *testing.T) {
+	patterns := []string{
+		"example.com",           // 0
+		"*.ads.example",         // 1
+		"keyword:tracker",       // 2
+		`regexp:^cdn\d+\.`,      // 3
+		"*.example.com",         // 4
+		"Mixed.Case.Example.",   // 5
+		"exact.ads.example",     // 6, shadowed by 1
+		"*.tracker.example.net", // 7, shadowed by 2
+	}
+	m := newHostMatcher()
+	for n, pattern := range patterns {
+		if err := m.add(pattern, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		hosts []string
+		n     int
+		ok    bool
+	}{
+		{[]string{"example.com"}, 0, true},
+		{[]string{"EXAMPLE.com."}, 0, true},
+		{[]string{"www.example.com"}, 4, true},
+		{[]string{"notexample.com"}, 0, false},
+		{[]string{"ads.example"}, 1, true},
+		{[]string{"exact.ads.example"}, 1, true},
+		{[]string{"deep.sub.ads.example"}, 1, true},
+		{[]string{"mytracker.example.org"}, 2, true},
+		{[]string{"x.tracker.example.net"}, 2, true},
+		{[]string{"cdn42.example.org"}, 3, true},
+		{[]string{"cdn.example.org"}, 0, false},
+		{[]string{"mixed.case.example"}, 5, true},
+		{[]string{"other.example"}, 0, false},
+		{[]string{""}, 0, false},
+		{nil, 0, false},
+		{[]string{"www.example.com", "example.com"}, 0, true}, // The first entry wins across hosts
+		{[]string{"other.example", "cdn1.example.org"}, 3, true},
+	}
+	for _, tt := range tests {
+		n, ok := m.match(tt.hosts...)
+		if ok != tt.ok || (ok && n != tt.n) {
+			t.Errorf("match(%q) = %d, %v, want %d, %v", tt.hosts, n, ok, tt.n, tt.ok)
+		}
+	}
+}
+
+func TestHostMatcherAny(t *testing.T) {
+	m := newHostMatcher()
+	for n, pattern := range []string{"keyword:ads", "*", "example.com"} {
+		if err := m.add(pattern, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for host, want := range map[string]int{"ads.example": 0, "example.com": 1, "anything": 1} {
+		if n, ok := m.match(host); !ok || n != want {
+			t.Errorf("match(%q) = %d, %v, want %d", host, n, ok, want)
+		}
+	}
+	if _, ok := m.match(""); ok {
+		t.Error(`"*" matched an empty host`)
+	}
+
+	var zero *hostMatcher
+	if _, ok := zero.match("example.com"); ok {
+		t.Error("nil matcher matched")
+	}
+	if _, ok := (&hostMatcher{}).match("example.com"); ok {
+		t.Error("zero matcher matched")
+	}
+}
+
+func TestValidHostPattern(t *testing.T) {
+	for pattern, valid := range map[string]bool{
+		"example.com":      true,
+		"*.example.com":    true,
+		"*":                true,
+		"keyword:ads":      true,
+		`regexp:^ads?\.`:   true,
+		"":                 false,
+		".":                false,
+		"keyword:":         false,
+		"regexp:(unclosed": false,
+	} {
+		if err := validHostPattern(pattern); (err == nil) != valid {
+			t.Errorf("validHostPattern(%q) = %v, want valid %v", pattern, err, valid)
+		}
+	}
+}
+
+func BenchmarkHostMatcher(b *testing.B) {
+	m := newHostMatcher()
+	for n := 0; n < 10000; n++ {
+		m.add(fmt.Sprintf("*.host%d.example", n), n)
+	}
+	m.add("keyword:tracker", 10000)
+	hosts := []string{"www.host5000.example", "cdn.tracker.example.net", "unlisted.example.org"}
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.match(hosts[i%len(hosts)])
+	}
+}
@@ -0,0 +1,105 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Limits of the plain HTTP fetch path
+//
+// Responses are streamed to the client as they arrive, so none is held in
+// memory whole, but an origin that answers slowly, or never stops answering,
+// still holds a goroutine and a connection for as long as it likes. These
+// limits bound how long a request waits for the origin and how much of its
+// response is relayed; a response cut short ends the client's connection
+// without completing the response, so the client sees it as failed.
+
+// HTTPFetchConfig limits plain HTTP requests forwarded by the proxy.
+type HTTPFetchConfig struct {
+	MaxResponse    int64 `json:"max_response,omitempty"`    // Bytes of response body relayed before the response is cut off (default: unlimited)
+	Timeout        int   `json:"timeout,omitempty"`         // Milliseconds from sending a request to the end of its response (default: none)
+	ReadTimeout    int   `json:"read_timeout,omitempty"`    // Milliseconds to wait for the response headers and for each read of the body (default: 300000; -1: none)
+	ConnectTimeout int   `json:"connect_timeout,omitempty"` // Milliseconds allowed to connect to the target (default: 10000)
+}
+
+var errResponseTooLarge = errors.New("response exceeds http_fetch.max_response")
+
+// validate checks that no limit is negative, except for read_timeout, where
+// -1 turns it off.
+func (cfg HTTPFetchConfig) validate() error {
+	if cfg.MaxResponse < 0 || cfg.Timeout < 0 || cfg.ConnectTimeout < 0 || cfg.ReadTimeout < -1 {
+		return fmt.Errorf("http_fetch limits can't be negative")
+	}
+	return nil
+}
+
+// readTimeout is how long a fetch waits for the target to send something,
+// or 0 for as long as it takes.
+func (cfg HTTPFetchConfig) readTimeout() time.Duration {
+	if cfg.ReadTimeout < 0 {
+		return 0
+	}
+	return millis(cfg.ReadTimeout, 300000)
+}
+
+// context bounds a request and its response by timeout, if configured.
+func (cfg HTTPFetchConfig) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cfg.Timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(cfg.Timeout)*time.Millisecond)
+	}
+	return context.WithCancel(ctx)
+}
+
+// fetchBody is a response body held to the limits of the fetch path. Reads
+// that wait longer than the read timeout for the target cancel the request,
+// and reads past the maximum size fail.
+type fetchBody struct {
+	io.ReadCloser
+	max   int64 // 0 is unlimited
+	read  int64
+	idle  time.Duration
+	timer *time.Timer // Cancels the request when a read waits too long; nil without a read timeout
+}
+
+// limitBody wraps body in the limits of cfg; cancel ends its request.
+func (cfg HTTPFetchConfig) limitBody(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	b := &fetchBody{ReadCloser: body, max: cfg.MaxResponse, idle: cfg.readTimeout()}
+	if b.idle > 0 {
+		b.timer = time.AfterFunc(b.idle, cancel)
+		b.timer.Stop()
+	}
+	return b
+}
+
+func (b *fetchBody) Read(p []byte) (int, error) {
+	if b.max > 0 && int64(len(p)) > b.max-b.read+1 {
+		// One byte more than allowed tells a body that ends at the limit
+		// from one that goes on
+		p = p[:b.max-b.read+1]
+	}
+	// Only the wait for the target counts, not the client reading slowly
+	if b.timer != nil {
+		b.timer.Reset(b.idle)
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.timer != nil && !b.timer.Stop() && err != nil {
+		err = fmt.Errorf("no data from the target within %v: %w", b.idle, err)
+	}
+	b.read += int64(n)
+	if b.max > 0 && b.read > b.max {
+		return n - int(b.read-b.max), errResponseTooLarge
+	}
+	return n, err
+}
+
+func (b *fetchBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,102 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// HTTPS fallback of plain HTTP requests
+//
+// Many sites only serve HTTPS: port 80 refuses connections, or answers every
+// request with a redirect to https://. A user typing an http:// URL then
+// gets a 502 from the proxy, or a redirect their browser follows with a
+// CONNECT of its own. With https_fallback, the proxy fetches such requests
+// over HTTPS itself, through a tunnel like a browser's that gets the
+// configured strategies and connect_ports, and answers the original request
+// with the response.
+
+// newHTTPSFallbackClient returns the client fetching plain HTTP requests
+// over HTTPS. Like the direct one, it follows no redirects and relays
+// responses as the target encoded them.
+func newHTTPSFallbackClient(p *TLSProxy) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(ctx, millis(p.HTTPFetch.ConnectTimeout, 10000))
+				defer cancel()
+				return p.dialTLSTunnel(ctx, addr, "https_fallback")
+			},
+			DisableCompression:    true,
+			MaxIdleConnsPerHost:   4,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: p.HTTPFetch.readTimeout(),
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// httpsFallbackURL returns the HTTPS URL to fetch in place of target when
+// its plain HTTP fetch, which answered resp or failed with err, shows the
+// target only serves HTTPS, or nil. Only requests without a body are
+// fetched again, since the body of the first attempt can't be sent twice.
+func (p *TLSProxy) httpsFallbackURL(in *http.Request, target *url.URL, resp *http.Response, err error) *url.URL {
+	if p.httpsFallback == nil || in.ContentLength != 0 {
+		return nil
+	}
+	if port := target.Port(); port != "" && port != "80" {
+		return nil
+	}
+	if err != nil {
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil
+		}
+		secure := *target
+		secure.Scheme, secure.Host = "https", strings.TrimSuffix(target.Host, ":80")
+		return &secure
+	}
+
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect:
+	default:
+		return nil
+	}
+	location, err := resp.Location()
+	if err != nil || location.Scheme != "https" || !strings.EqualFold(location.Hostname(), target.Hostname()) {
+		return nil
+	}
+	if port := location.Port(); port != "" && port != "443" {
+		return nil
+	}
+	return location
+}
+
+// fetchOverHTTPS sends a request like in, with header, to target through a
+// tunnel, if connect_ports allows tunnels to its port.
+func (p *TLSProxy) fetchOverHTTPS(ctx context.Context, in *http.Request, header http.Header,
+	target *url.URL) (*http.Response, error) {
+	port := target.Port()
+	if port == "" {
+		port = "443"
+	}
+	if !connectPorts.allows(port) {
+		return nil, fmt.Errorf("connect_ports doesn't allow tunnels to port %s", port)
+	}
+	req, err := http.NewRequestWithContext(ctx, in.Method, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+	return p.httpsFallback.Do(req)
+}
@@ -0,0 +1,256 @@
+//go:build !relay
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Content inspection
+//
+// Intercepted requests and responses can be passed through inspectors,
+// which content filters or malware scanners implement to see, change or
+// block traffic without the MITM proxy knowing about them. An inspector
+// sees each request's headers before it is sent on, and each response's
+// body one chunk at a time as it streams to the client, so nothing has to
+// be held in memory whole. The first chunk is inspected before the
+// response's headers are sent, so blocking it still answers 403 Forbidden;
+// a response blocked later is cut short, since its status has already been
+// sent.
+
+// Inspector inspects the traffic of intercepted hosts. Inspectors are
+// configured in order, and each sees what the previous one let through.
+type Inspector interface {
+	Name() string
+
+	// OnRequestHeaders is called before r is sent on, or answered from the
+	// cache. It may change r's headers and URL; an error blocks the request.
+	OnRequestHeaders(r *http.Request) error
+
+	// OnResponseChunk is called with each chunk of a response body and
+	// returns what to send in its place: the chunk itself, a changed one, or
+	// nothing, holding it back for later. The last call has s.EOF set and
+	// may have an empty chunk. An error blocks the response.
+	OnResponseChunk(s *InspectedStream, chunk []byte) ([]byte, error)
+}
+
+// InspectedStream is one inspector's view of one response.
+type InspectedStream struct {
+	Response *http.Response
+	EOF      bool // This is the last chunk
+	State    any  // Kept between the chunks of the response, for the inspector's own use
+}
+
+// InspectorFactory builds an inspector from the options of its config
+// entry, which may be empty.
+type InspectorFactory func(options json.RawMessage) (Inspector, error)
+
+// InspectorConfig enables a registered inspector.
+type InspectorConfig struct {
+	Name    string          `json:"name"`              // Name the inspector is registered under
+	Options json.RawMessage `json:"options,omitempty"` // Passed to the inspector as they are
+}
+
+var (
+	inspectorFactories   = make(map[string]InspectorFactory)
+	inspectorFactoriesMu sync.Mutex
+)
+
+// RegisterInspector makes an inspector available under name for the
+// "mitm.inspectors" config option. Like strategies, built-ins register
+// themselves from init, and files added to the package can register more.
+func RegisterInspector(name string, factory InspectorFactory) {
+	inspectorFactoriesMu.Lock()
+	defer inspectorFactoriesMu.Unlock()
+
+	if _, exists := inspectorFactories[name]; exists {
+		panic("sultry: inspector registered twice: " + name)
+	}
+	inspectorFactories[name] = factory
+}
+
+// registeredInspectors returns the names of all registered inspectors.
+func registeredInspectors() []string {
+	inspectorFactoriesMu.Lock()
+	defer inspectorFactoriesMu.Unlock()
+
+	names := make([]string, 0, len(inspectorFactories))
+	for name := range inspectorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newInspector builds the inspector of a config entry.
+func newInspector(cfg InspectorConfig) (Inspector, error) {
+	inspectorFactoriesMu.Lock()
+	factory, ok := inspectorFactories[cfg.Name]
+	inspectorFactoriesMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown inspector %q (registered: %v)", cfg.Name, registeredInspectors())
+	}
+	inspector, err := factory(cfg.Options)
+	if err != nil {
+		return nil, fmt.Errorf("inspector %s: %w", cfg.Name, err)
+	}
+	return inspector, nil
+}
+
+// inspectionBlock is the error of traffic an inspector blocked.
+type inspectionBlock struct {
+	inspector string
+	err       error
+}
+
+func (b *inspectionBlock) Error() string {
+	return fmt.Sprintf("blocked by inspector %s: %v", b.inspector, b.err)
+}
+
+func (b *inspectionBlock) Unwrap() error { return b.err }
+
+// inspectRequest passes r through the inspectors.
+func (m *mitmProxy) inspectRequest(r *http.Request) error {
+	for _, inspector := range m.inspectors {
+		if err := inspector.OnRequestHeaders(r); err != nil {
+			return &inspectionBlock{inspector: inspector.Name(), err: err}
+		}
+	}
+	return nil
+}
+
+// inspectResponse has resp's body pass through the inspectors as it is
+// read, inspecting the first chunk right away. Its length isn't known any
+// more once inspectors may change it. cutShort is called if a later chunk
+// is blocked.
+func (m *mitmProxy) inspectResponse(resp *http.Response, cutShort func(error)) error {
+	if len(m.inspectors) == 0 {
+		return nil
+	}
+	body := &inspectedBody{body: resp.Body, inspectors: m.inspectors, buf: make([]byte, 32*1024)}
+	for range m.inspectors {
+		body.streams = append(body.streams, &InspectedStream{Response: resp})
+	}
+	resp.Body = body
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	if err := body.next(); err != nil {
+		return err
+	}
+	body.cutShort = cutShort
+	return nil
+}
+
+// inspectedBody is a response body read through inspectors.
+type inspectedBody struct {
+	body       io.ReadCloser
+	inspectors []Inspector
+	streams    []*InspectedStream // One per inspector
+	buf        []byte
+	pending    []byte // Inspected, not yet read
+	eof        bool
+	err        error // Sticky, once reading or an inspector failed
+	cutShort   func(error)
+}
+
+func (b *inspectedBody) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		if b.eof {
+			return 0, io.EOF
+		}
+		if err := b.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+// next reads the next chunk of the body and inspects it.
+func (b *inspectedBody) next() error {
+	if b.err != nil {
+		return b.err
+	}
+	n, err := b.body.Read(b.buf)
+	if err != nil && !errors.Is(err, io.EOF) {
+		b.err = err
+		return err
+	}
+	chunk, eof := b.buf[:n], err != nil
+	for i, inspector := range b.inspectors {
+		b.streams[i].EOF = eof
+		if chunk, err = inspector.OnResponseChunk(b.streams[i], chunk); err != nil {
+			b.err = &inspectionBlock{inspector: inspector.Name(), err: err}
+			if b.cutShort != nil {
+				b.cutShort(b.err)
+			}
+			return b.err
+		}
+	}
+	b.pending = append(b.pending, chunk...)
+	b.eof = eof
+	return nil
+}
+
+func (b *inspectedBody) Close() error {
+	return b.body.Close()
+}
+
+func init() {
+	RegisterInspector("signatures", newSignatureInspector)
+}
+
+// signatureInspector blocks responses whose body contains any of a set of
+// byte patterns, such as the EICAR test string, wherever chunks split them.
+type signatureInspector struct {
+	patterns [][]byte
+	longest  int
+}
+
+func newSignatureInspector(options json.RawMessage) (Inspector, error) {
+	var opts struct {
+		Patterns []string `json:"patterns"`
+	}
+	if len(options) > 0 {
+		if err := json.Unmarshal(options, &opts); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.Patterns) == 0 {
+		return nil, errors.New("no patterns to look for")
+	}
+	s := &signatureInspector{}
+	for _, pattern := range opts.Patterns {
+		if pattern == "" {
+			return nil, errors.New("empty pattern")
+		}
+		s.patterns = append(s.patterns, []byte(pattern))
+		s.longest = max(s.longest, len(pattern))
+	}
+	return s, nil
+}
+
+func (s *signatureInspector) Name() string { return "signatures" }
+
+func (s *signatureInspector) OnRequestHeaders(r *http.Request) error { return nil }
+
+func (s *signatureInspector) OnResponseChunk(stream *InspectedStream, chunk []byte) ([]byte, error) {
+	// The end of the previous chunk is kept to find patterns split between two
+	tail, _ := stream.State.([]byte)
+	window := append(tail, chunk...)
+	for _, pattern := range s.patterns {
+		if bytes.Contains(window, pattern) {
+			return nil, fmt.Errorf("response contains %q", pattern)
+		}
+	}
+	stream.State = bytes.Clone(window[max(0, len(window)-s.longest+1):])
+	return chunk, nil
+}
@@ -0,0 +1,237 @@
+//go:build !relay
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Differential integrity checks
+//
+// Each strategy relays the same TLS stream differently: fragmented, split
+// at a desync point, or message by message through the OOB server. A relay
+// that drops, reorders or duplicates bytes usually ends the connection with
+// a bad_record_mac alert, but not always where it's easy to tell which path
+// did it. "check integrity" fetches one resource through every strategy on
+// its own and compares what arrived, so a corrupting path stands out.
+
+// defaultIntegrityHeaders are the response headers compared between
+// strategies. Others, like Date, differ between any two requests.
+const defaultIntegrityHeaders = "Content-Type,Content-Length,Content-Encoding,ETag,Last-Modified"
+
+// integrityResult is what one strategy fetched.
+type integrityResult struct {
+	Strategy string
+	Status   int
+	Header   http.Header
+	Body     []byte
+	Sum      string // Hex SHA-256 of Body
+	Elapsed  time.Duration
+	Err      error
+}
+
+// checkIntegrity fetches a URL through each strategy and reports whether
+// they all returned the same status, headers and body.
+func checkIntegrity(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("check integrity", flag.ContinueOnError)
+	path := flags.String("config", "config.json", "configuration file")
+	names := flags.String("strategies", "", "comma-separated strategies to compare (default: the configured order)")
+	headers := flags.String("headers", defaultIntegrityHeaders, "comma-separated response headers to compare")
+	timeout := flags.Duration("timeout", 30*time.Second, "time allowed for each fetch")
+	insecure := flags.Bool("insecure", false, "skip certificate verification, for test servers")
+	verbose := flags.Bool("v", false, "print the proxy's logs")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: sultry check integrity [flags] https://host/resource")
+	}
+	target, err := url.Parse(flags.Arg(0))
+	if err != nil || target.Scheme != "https" || target.Hostname() == "" {
+		return fmt.Errorf("%q is not an https URL: only TLS tunnels go through strategies", flags.Arg(0))
+	}
+
+	config, err := LoadConfig(*path)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if !*verbose {
+		defer log.SetOutput(log.Writer())
+		log.SetOutput(io.Discard)
+	}
+	if err := setupUpstreamProxies(config.UpstreamProxies); err != nil {
+		return err
+	}
+	setupUserAgent(config.OOBUserAgent)
+	proxy, err := newClientProxy(config)
+	if err != nil {
+		return err
+	}
+	proxy.DryRun = false // Dry runs connect directly whatever the strategy
+	proxy.doh = nil      // Resolvers would otherwise only be reached by concealing strategies
+	strategies := proxy.strategies.Names()
+	if *names != "" {
+		strategies = splitList(*names)
+	}
+
+	var results []*integrityResult
+	for _, name := range strategies {
+		// Only the strategy being checked may connect, with no fallback to another
+		orchestrator, err := newStrategyOrchestrator(proxy, []string{name}, newFailureDiary(FailureDiaryConfig{}))
+		if err != nil {
+			return err
+		}
+		proxy.strategies = orchestrator
+		results = append(results, fetchThrough(proxy, name, target, *timeout, *insecure))
+	}
+
+	mismatches := compareIntegrity(out, results, splitList(*headers))
+	if mismatches > 0 {
+		return fmt.Errorf("%d strategies failed or returned something different", mismatches)
+	}
+	return nil
+}
+
+// fetchThrough requests target over a tunnel established by proxy's
+// strategies, reading the whole body.
+func fetchThrough(proxy *TLSProxy, strategy string, target *url.URL, timeout time.Duration,
+	insecure bool) *integrityResult {
+	result := &integrityResult{Strategy: strategy}
+	transport := &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			tunnelCtx := withSessionLogger(context.Background(),
+				newSessionLogger().Redacting(sensitiveSNI, host).With("check", strategy, "dest", destHash(host)))
+			tlsConn := tls.Client(proxy.pipeTunnel(tunnelCtx, host, port),
+				&tls.Config{ServerName: host, NextProtos: []string{"http/1.1"}, InsecureSkipVerify: insecure,
+					KeyLogWriter: keyLog})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				tlsConn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+		DisableKeepAlives:  true,
+		DisableCompression: true, // Compare the bytes as sent
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: timeout}
+
+	start := time.Now()
+	resp, err := client.Get(target.String())
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+	result.Status = resp.StatusCode
+	result.Header = resp.Header
+	result.Body, result.Err = io.ReadAll(resp.Body)
+	result.Elapsed = time.Since(start)
+	sum := sha256.Sum256(result.Body)
+	result.Sum = hex.EncodeToString(sum[:])
+	return result
+}
+
+// compareIntegrity prints each result and how it differs from the first
+// that succeeded, returning how many differ.
+func compareIntegrity(out io.Writer, results []*integrityResult, headers []string) int {
+	var reference *integrityResult
+	for _, r := range results {
+		if r.Err == nil {
+			reference = r
+			break
+		}
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STRATEGY\tSTATUS\tBYTES\tSHA-256\tTIME\tRESULT")
+	var details []string
+	mismatches := 0
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(tw, "%s\t-\t%d\t-\t-\t❌ %v\n", r.Strategy, len(r.Body), r.Err)
+			if r != reference {
+				mismatches++
+			}
+			continue
+		}
+		verdict := "reference"
+		if r != reference {
+			diffs := integrityDiffs(reference, r, headers)
+			if len(diffs) == 0 {
+				verdict = "✅ identical"
+			} else {
+				verdict = "❌ differs"
+				mismatches++
+				for _, d := range diffs {
+					details = append(details, fmt.Sprintf("%s: %s", r.Strategy, d))
+				}
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\n", r.Strategy, r.Status, len(r.Body), r.Sum[:16],
+			r.Elapsed.Round(time.Millisecond), verdict)
+	}
+	tw.Flush()
+
+	if reference != nil && len(details) > 0 {
+		fmt.Fprintf(out, "\nCompared with %s:\n", reference.Strategy)
+		for _, d := range details {
+			fmt.Fprintf(out, "  %s\n", d)
+		}
+	}
+	return mismatches
+}
+
+// integrityDiffs describes how r differs from reference.
+func integrityDiffs(reference, r *integrityResult, headers []string) []string {
+	var diffs []string
+	if r.Status != reference.Status {
+		diffs = append(diffs, fmt.Sprintf("status %d, not %d", r.Status, reference.Status))
+	}
+	for _, name := range headers {
+		want, got := reference.Header.Values(name), r.Header.Values(name)
+		if strings.Join(want, ", ") != strings.Join(got, ", ") {
+			diffs = append(diffs, fmt.Sprintf("%s %q, not %q", http.CanonicalHeaderKey(name),
+				strings.Join(got, ", "), strings.Join(want, ", ")))
+		}
+	}
+	if !bytes.Equal(r.Body, reference.Body) {
+		offset := 0
+		for offset < len(r.Body) && offset < len(reference.Body) && r.Body[offset] == reference.Body[offset] {
+			offset++
+		}
+		diffs = append(diffs, fmt.Sprintf("body differs from byte %d (%d bytes, not %d)", offset, len(r.Body),
+			len(reference.Body)))
+	}
+	return diffs
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
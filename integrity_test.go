@@ -0,0 +1,59 @@
+//go:build !relay
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fetched returns what a strategy fetched without error.
+func fetched(strategy string, status int, contentType, body string) *integrityResult {
+	sum := sha256.Sum256([]byte(body))
+	return &integrityResult{Strategy: strategy, Status: status, Header: http.Header{"Content-Type": {contentType}},
+		Body: []byte(body), Sum: hex.EncodeToString(sum[:])}
+}
+
+func TestCompareIntegrity(t *testing.T) {
+	headers := splitList(defaultIntegrityHeaders)
+	failed := &integrityResult{Strategy: "oob", Err: errors.New("bad_record_mac")}
+
+	tests := []struct {
+		name       string
+		results    []*integrityResult
+		mismatches int
+		details    []string
+	}{
+		{"identical", []*integrityResult{fetched("direct", 200, "text/html", "page"), fetched("fragment", 200, "text/html", "page")}, 0, nil},
+		{"body corrupted", []*integrityResult{fetched("direct", 200, "text/html", "page one"), fetched("desync", 200, "text/html", "page 0ne")},
+			1, []string{"desync: body differs from byte 5 (8 bytes, not 8)"}},
+		{"body truncated", []*integrityResult{fetched("direct", 200, "text/html", "page"), fetched("fragment", 200, "text/html", "pa")},
+			1, []string{"fragment: body differs from byte 2 (2 bytes, not 4)"}},
+		{"status and header", []*integrityResult{fetched("direct", 200, "text/html", "page"), fetched("sni", 404, "text/plain", "page")},
+			1, []string{"sni: status 404, not 200", `sni: Content-Type "text/plain", not "text/html"`}},
+		{"failure", []*integrityResult{fetched("direct", 200, "text/html", "page"), failed}, 1, nil},
+		{"first failed", []*integrityResult{failed, fetched("direct", 200, "text/html", "page"), fetched("fragment", 200, "text/html", "page")},
+			1, []string{"✅ identical"}}, // Compared with the first that succeeded
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		if got := compareIntegrity(&out, tt.results, headers); got != tt.mismatches {
+			t.Errorf("%s: %d mismatches, want %d\n%s", tt.name, got, tt.mismatches, out.String())
+		}
+		for _, detail := range tt.details {
+			if !strings.Contains(out.String(), detail) {
+				t.Errorf("%s: report lacks %q\n%s", tt.name, detail, out.String())
+			}
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	if got := strings.Join(splitList(" direct, ,fragment,oob "), "|"); got != "direct|fragment|oob" {
+		t.Errorf("splitList = %q", got)
+	}
+}
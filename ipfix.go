@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IPFIXConfig exports a flow record for every tunnel to an IPFIX (RFC 7011)
+// collector, for enterprise monitoring that already speaks NetFlow/IPFIX.
+type IPFIXConfig struct {
+	Collector         string `json:"collector,omitempty"`          // host:port of the collector, sent to over UDP; empty disables the exporter
+	ObservationDomain uint32 `json:"observation_domain,omitempty"` // Observation Domain ID identifying this client to the collector
+	EnterpriseNumber  uint32 `json:"enterprise_number,omitempty"`  // Private Enterprise Number of the fields with no standard element (default: 32473)
+}
+
+// defaultIPFIXEnterprise is the Private Enterprise Number reserved for
+// documentation (RFC 5612), used until one is configured.
+const defaultIPFIXEnterprise = 32473
+
+// Template IDs, one per address family of the client.
+const (
+	ipfixTemplateIPv4 = 256
+	ipfixTemplateIPv6 = 257
+)
+
+// ipfixVarLen marks a variable-length field in a template.
+const ipfixVarLen = 0xffff
+
+// ipfixField is an information element in a template. Enterprise fields
+// are ours, numbered under the configured enterprise number.
+type ipfixField struct {
+	ID         uint16
+	Length     uint16
+	Enterprise bool
+}
+
+// Standard information elements (IANA IPFIX registry) and ours.
+var (
+	ipfixSourceIPv4       = ipfixField{ID: 8, Length: 4}
+	ipfixSourceIPv6       = ipfixField{ID: 27, Length: 16}
+	ipfixSourcePort       = ipfixField{ID: 7, Length: 2}
+	ipfixDestinationPort  = ipfixField{ID: 11, Length: 2}
+	ipfixInitiatorOctets  = ipfixField{ID: 231, Length: 8}
+	ipfixResponderOctets  = ipfixField{ID: 232, Length: 8}
+	ipfixFlowStartMillis  = ipfixField{ID: 152, Length: 8}
+	ipfixFlowEndMillis    = ipfixField{ID: 153, Length: 8}
+	ipfixDestinationHash  = ipfixField{ID: 1, Length: ipfixVarLen, Enterprise: true}
+	ipfixStrategy         = ipfixField{ID: 2, Length: ipfixVarLen, Enterprise: true}
+	ipfixConnectLatencyMs = ipfixField{ID: 3, Length: 4, Enterprise: true}
+)
+
+// ipfixTemplate lists the fields of a flow record, the client's address
+// first.
+func ipfixTemplate(source ipfixField) []ipfixField {
+	return []ipfixField{source, ipfixSourcePort, ipfixDestinationPort, ipfixInitiatorOctets, ipfixResponderOctets,
+		ipfixFlowStartMillis, ipfixFlowEndMillis, ipfixDestinationHash, ipfixStrategy, ipfixConnectLatencyMs}
+}
+
+// ipfixExporter sends the "close" audit events as flow records. Templates
+// go along with every message, so a collector that restarts or loses a
+// datagram never waits for them.
+type ipfixExporter struct {
+	conn       net.Conn
+	domain     uint32
+	enterprise uint32
+	mu         sync.Mutex
+	sequence   uint32 // Data records sent so far
+}
+
+func init() {
+	registerAuditExporter("ipfix", newIPFIXExporter)
+}
+
+func newIPFIXExporter(cfg AuditConfig) (auditExporter, error) {
+	if cfg.IPFIX.Collector == "" {
+		return nil, nil
+	}
+	conn, err := net.Dial("udp", cfg.IPFIX.Collector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up IPFIX export: %w", err)
+	}
+	enterprise := cfg.IPFIX.EnterpriseNumber
+	if enterprise == 0 {
+		enterprise = defaultIPFIXEnterprise
+	}
+	log.Printf("📒 Flow records exported over IPFIX to %s", cfg.IPFIX.Collector)
+	return &ipfixExporter{conn: conn, domain: cfg.IPFIX.ObservationDomain, enterprise: enterprise}, nil
+}
+
+func (e *ipfixExporter) Export(event auditEvent) {
+	if event.Event != "close" {
+		return
+	}
+	client, err := netip.ParseAddrPort(event.Client)
+	if err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	message := e.message(event, client)
+	e.sequence++
+	if _, err := e.conn.Write(message); err != nil {
+		log.Printf("⚠️ Failed to export IPFIX flow record: %v", err)
+	}
+}
+
+// message builds an IPFIX message carrying both templates and event's flow
+// record.
+func (e *ipfixExporter) message(event auditEvent, client netip.AddrPort) []byte {
+	templateID := uint16(ipfixTemplateIPv6)
+	addr := client.Addr().Unmap()
+	if addr.Is4() {
+		templateID = ipfixTemplateIPv4
+	}
+
+	host, port, _ := net.SplitHostPort(event.Dest)
+	destPort, _ := strconv.ParseUint(port, 10, 16)
+	start := event.Time.Add(-time.Duration(event.DurationMs) * time.Millisecond)
+
+	var record []byte
+	record = append(record, addr.AsSlice()...)
+	record = binary.BigEndian.AppendUint16(record, client.Port())
+	record = binary.BigEndian.AppendUint16(record, uint16(destPort))
+	record = binary.BigEndian.AppendUint64(record, uint64(event.BytesUp))
+	record = binary.BigEndian.AppendUint64(record, uint64(event.BytesDown))
+	record = binary.BigEndian.AppendUint64(record, uint64(start.UnixMilli()))
+	record = binary.BigEndian.AppendUint64(record, uint64(event.Time.UnixMilli()))
+	record = appendIPFIXString(record, destHash(host))
+	record = appendIPFIXString(record, event.Strategy)
+	record = binary.BigEndian.AppendUint32(record, uint32(event.LatencyMs))
+
+	var templates []byte
+	templates = e.appendTemplate(templates, ipfixTemplateIPv4, ipfixTemplate(ipfixSourceIPv4))
+	templates = e.appendTemplate(templates, ipfixTemplateIPv6, ipfixTemplate(ipfixSourceIPv6))
+
+	message := make([]byte, 16, 16+4+len(templates)+4+len(record))
+	message = appendIPFIXSet(message, 2, templates) // Set ID 2: templates
+	message = appendIPFIXSet(message, templateID, record)
+	binary.BigEndian.PutUint16(message[0:2], 10) // Version
+	binary.BigEndian.PutUint16(message[2:4], uint16(len(message)))
+	binary.BigEndian.PutUint32(message[4:8], uint32(event.Time.Unix()))
+	binary.BigEndian.PutUint32(message[8:12], e.sequence)
+	binary.BigEndian.PutUint32(message[12:16], e.domain)
+	return message
+}
+
+// appendTemplate appends a template record: ID, field count and the field
+// specifiers, with the enterprise number after our own fields.
+func (e *ipfixExporter) appendTemplate(b []byte, id uint16, fields []ipfixField) []byte {
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+	for _, f := range fields {
+		if f.Enterprise {
+			b = binary.BigEndian.AppendUint16(b, f.ID|0x8000)
+			b = binary.BigEndian.AppendUint16(b, f.Length)
+			b = binary.BigEndian.AppendUint32(b, e.enterprise)
+			continue
+		}
+		b = binary.BigEndian.AppendUint16(b, f.ID)
+		b = binary.BigEndian.AppendUint16(b, f.Length)
+	}
+	return b
+}
+
+// appendIPFIXSet appends a set header and its records.
+func appendIPFIXSet(b []byte, id uint16, records []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = binary.BigEndian.AppendUint16(b, uint16(4+len(records)))
+	return append(b, records...)
+}
+
+// appendIPFIXString appends a variable-length string field.
+func appendIPFIXString(b []byte, s string) []byte {
+	if len(s) < 255 {
+		b = append(b, byte(len(s)))
+	} else {
+		b = append(b, 255)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	}
+	return append(b, s...)
+}
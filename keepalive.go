@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// KeepAliveRoute tunes TCP keep-alive on connections to matching addresses.
+// With the OS defaults, a relay that vanished without closing the
+// connection, as when a phone switches networks, is only noticed after
+// minutes of silence; short probes notice it in seconds.
+type KeepAliveRoute struct {
+	Match    string `json:"match"`              // "host", "*.example.com" or "*", optionally with ":port"
+	Idle     int    `json:"idle,omitempty"`     // Milliseconds without traffic before the first probe (default: 30000)
+	Interval int    `json:"interval,omitempty"` // Milliseconds between unanswered probes (default: 30000)
+	Count    int    `json:"count,omitempty"`    // Unanswered probes after which the connection is dead (default: the OS's)
+	Disable  bool   `json:"disable,omitempty"`  // Send no probes
+}
+
+// defaultKeepAlive is what relay connections use without a matching route.
+var defaultKeepAlive = net.KeepAliveConfig{Enable: true, Idle: 30 * time.Second, Interval: 30 * time.Second, Count: -1}
+
+// ConnTuner applies the socket options of their route to the connections
+// relays make and accept. One is shared by every component of the process.
+type ConnTuner struct {
+	routes []KeepAliveRoute
+}
+
+// connTuner tunes every relay connection, with the routes of the config.
+var connTuner = newConnTuner(nil)
+
+func newConnTuner(routes []KeepAliveRoute) *ConnTuner {
+	return &ConnTuner{routes: routes}
+}
+
+// keepAlive returns the keep-alive of the first route matching address, a
+// host:port, reporting false when none does.
+func (t *ConnTuner) keepAlive(address string) (net.KeepAliveConfig, bool) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, ""
+	}
+	for _, route := range t.routes {
+		if !matchRoute(route.Match, host, port) {
+			continue
+		}
+		if route.Disable {
+			return net.KeepAliveConfig{}, true
+		}
+		return net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     millis(route.Idle, 30000),
+			Interval: millis(route.Interval, 30000),
+			Count:    orDefault(route.Count, -1),
+		}, true
+	}
+	return net.KeepAliveConfig{}, false
+}
+
+// Dialer returns dialer, or a copy of it whose connections get the
+// keep-alive of address's route if one matches.
+func (t *ConnTuner) Dialer(dialer *net.Dialer, address string) *net.Dialer {
+	config, ok := t.keepAlive(address)
+	if !ok {
+		return dialer
+	}
+	tuned := *dialer
+	tuned.KeepAliveConfig = config
+	if !config.Enable {
+		tuned.KeepAlive = -1
+	}
+	return &tuned
+}
+
+// Tune disables Nagle's algorithm on conn and sets the keep-alive of
+// address's route, or the default one, if conn is a TCP connection.
+func (t *ConnTuner) Tune(conn net.Conn, address string) {
+	tcpConn, ok := tcpConnOf(conn)
+	if !ok {
+		return
+	}
+	config, ok := t.keepAlive(address)
+	if !ok {
+		config = defaultKeepAlive
+	}
+	tcpConn.SetNoDelay(true)
+	tcpConn.SetKeepAliveConfig(config)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// keyLog receives the secrets of the TLS connections sultry itself makes
+// (OOB TLS, cover connections, MITM and certificate checks) in NSS key log
+// format, so Wireshark can decrypt them; nil unless configured.
+var keyLog io.Writer
+
+// setupKeyLog opens the key log file at path, or at $SSLKEYLOGFILE if path
+// is empty. Lines are appended, so browsers can share the file.
+func setupKeyLog(path string) error {
+	if path == "" {
+		path = os.Getenv("SSLKEYLOGFILE")
+	}
+	if path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open key log file: %w", err)
+	}
+	keyLog = file
+	log.Printf("⚠️ Writing TLS secrets to %s: anyone who can read it can decrypt sultry's TLS traffic", path)
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	sultrytls "sultry/pkg/tls"
+)
+
+// Legacy TLS versions
+//
+// TLS 1.0 and 1.1 are deprecated (RFC 8996) and current browsers no longer
+// offer them, so a handshake using one comes from an old client or target,
+// or from something downgrading the connection. Sultry relays handshakes
+// rather than terminating them and can't upgrade one, but legacy_tls
+// decides what it does about them: relay them quietly, relay them with a
+// warning, or refuse them. The same policy applies to the version a
+// ClientHello offers at most and to the one a ServerHello negotiates,
+// whichever strategy carries the tunnel: the client checks ClientHellos
+// and the ServerHellos of tunnels it connects itself, the relay those of
+// the handshakes it relays.
+
+// legacy_tls policies.
+const (
+	legacyTLSAllow = "allow"
+	legacyTLSWarn  = "warn"
+	legacyTLSDeny  = "deny"
+)
+
+// errLegacyTLS is returned for handshakes the policy refuses.
+var errLegacyTLS = errors.New("legacy TLS version refused")
+
+// legacyTLS is the policy installed by setupLegacyTLS.
+var legacyTLS = legacyTLSWarn
+
+// alertProtocolVersion is the record a peer using a refused version gets
+// instead of a handshake: a fatal protocol_version alert, in a record any
+// TLS version can read.
+var alertProtocolVersion = []byte{sultrytls.RecordAlert, 0x03, 0x01, 0x00, 0x02, 2, sultrytls.AlertProtocolVersion}
+
+// setupLegacyTLS installs the configured policy.
+func setupLegacyTLS(policy string) error {
+	switch policy {
+	case "":
+		legacyTLS = legacyTLSWarn
+	case legacyTLSAllow, legacyTLSWarn, legacyTLSDeny:
+		legacyTLS = policy
+	default:
+		return fmt.Errorf("unknown legacy_tls policy %q (use allow, warn or deny)", policy)
+	}
+	if legacyTLS == legacyTLSDeny {
+		log.Printf("🔒 Handshakes using TLS 1.0 or 1.1 are refused")
+	}
+	return nil
+}
+
+// legacyTLSVersion reports whether version predates TLS 1.2. 0, a version
+// that isn't known yet, doesn't.
+func legacyTLSVersion(version uint16) bool {
+	return version != 0 && version < sultrytls.VersionTLS12
+}
+
+// checkLegacyTLS applies the policy to version, logging with logf. what
+// says who uses it, e.g. "Client offers at most".
+func checkLegacyTLS(logf func(format string, args ...any), what string, version uint16) error {
+	if !legacyTLSVersion(version) || legacyTLS == legacyTLSAllow {
+		return nil
+	}
+	if legacyTLS == legacyTLSDeny {
+		logf("🛑 %s %s, a legacy TLS version: refusing the handshake", what, versionName(version))
+		return fmt.Errorf("%w: %s", errLegacyTLS, versionName(version))
+	}
+	logf("⚠️ %s %s, a legacy TLS version", what, versionName(version))
+	return nil
+}
+
+// checkLegacyClientHello applies the policy to the highest version the
+// ClientHello at the start of data offers. ClientHellos that don't parse
+// are left to the rest of the handshake.
+func checkLegacyClientHello(logf func(format string, args ...any), data []byte) error {
+	hello, err := sultrytls.ParseClientHello(data)
+	if err != nil {
+		return nil
+	}
+	return checkLegacyTLS(logf, "Client offers at most", hello.MaxVersion())
+}
+
+// legacyTLSTap checks the ServerHello in the first write to the client's
+// side of a tunnel, which relayData makes whole records. A refused one
+// isn't forwarded: the client gets a protocol_version alert instead, and
+// the write fails, ending the relay.
+type legacyTLSTap struct {
+	net.Conn
+	logger *sessionLogger
+	once   sync.Once
+	err    error
+}
+
+// tapLegacyTLS returns conn with the ServerHello written to it checked, or
+// conn itself if the policy allows every version.
+func tapLegacyTLS(logger *sessionLogger, conn net.Conn) net.Conn {
+	if legacyTLS == legacyTLSAllow {
+		return conn
+	}
+	return &legacyTLSTap{Conn: conn, logger: logger}
+}
+
+func (t *legacyTLSTap) Write(b []byte) (int, error) {
+	t.once.Do(func() {
+		hello, err := sultrytls.ParseServerHello(b)
+		if err != nil || hello.HelloRetryRequest {
+			return
+		}
+		if t.err = checkLegacyTLS(t.logger.Printf, "Target negotiated", hello.Version); t.err != nil {
+			t.Conn.Write(alertProtocolVersion)
+		}
+	})
+	if t.err != nil {
+		return 0, t.err
+	}
+	return t.Conn.Write(b)
+}
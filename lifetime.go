@@ -0,0 +1,83 @@
+//go:build !relay
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TunnelLifetime bounds how long tunnels to matching destinations live, so
+// no single long-lived flow is around long enough to be fingerprinted or
+// throttled. A tunnel carries the browser's own TLS session, which can't be
+// moved to another connection, so rotating it means closing it between
+// requests: the browser opens a new tunnel for its next one.
+type TunnelLifetime struct {
+	Match       string `json:"match"`           // "host", "*.example.com" or "*", optionally with ":port"
+	MaxLifetime int    `json:"max_lifetime"`    // Milliseconds after which the tunnel is rotated
+	Idle        int    `json:"idle,omitempty"`  // Milliseconds without traffic that count as between requests (default: 1000)
+	Drain       int    `json:"drain,omitempty"` // Milliseconds to wait for such a pause before closing anyway (default: 30000)
+}
+
+// tunnelLifetime returns the first lifetime matching host:port, or nil.
+func tunnelLifetime(lifetimes []TunnelLifetime, host, port string) *TunnelLifetime {
+	for i, lifetime := range lifetimes {
+		if lifetime.MaxLifetime > 0 && matchRoute(lifetime.Match, host, port) {
+			return &lifetimes[i]
+		}
+	}
+	return nil
+}
+
+// scheduleRotation calls rotate once the tunnel has lived out lifetime and
+// its traffic, counted by up and down, pauses, or the drain period ends.
+// Tunnels found to carry a WebSocket by then are left open, since closing
+// one ends the application's session rather than a request. The returned
+// function cancels it when the tunnel ends first.
+func scheduleRotation(logger *sessionLogger, lifetime *TunnelLifetime, class *tunnelClass, up, down *atomic.Int64,
+	rotate func()) (stop func()) {
+	if lifetime == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-time.After(time.Duration(lifetime.MaxLifetime) * time.Millisecond):
+		case <-done:
+			return
+		}
+		if class.WebSocket() {
+			logger.Printf("♻️ ROTATE: Tunnel reached its lifetime of %dms but carries a WebSocket, leaving it open",
+				lifetime.MaxLifetime)
+			return
+		}
+		logger.Printf("♻️ ROTATE: Tunnel reached its lifetime of %dms, draining", lifetime.MaxLifetime)
+
+		idle := millis(lifetime.Idle, 1000)
+		deadline := time.After(millis(lifetime.Drain, 30000))
+		check := time.NewTicker(idle / 4)
+		defer check.Stop()
+		last, quietSince := up.Load()+down.Load(), time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-deadline:
+				logger.Printf("♻️ ROTATE: No pause in traffic while draining, closing the tunnel")
+				rotate()
+				return
+			case now := <-check.C:
+				if total := up.Load() + down.Load(); total != last {
+					last, quietSince = total, now
+					continue
+				}
+				if now.Sub(quietSince) >= idle {
+					logger.Printf("♻️ ROTATE: Closing the tunnel between requests")
+					rotate()
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
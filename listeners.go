@@ -0,0 +1,152 @@
+//go:build !relay
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ListenerConfig is an address the client accepts connections on, with the
+// options of its kind. One process serves any number of them, all feeding
+// the same strategies.
+type ListenerConfig struct {
+	Type   string            `json:"type,omitempty"`                // "http" (default), "socks" or "transparent"
+	Listen string            `json:"listen"`                        // Address to accept connections on, or "unix:" and a socket path
+	Mode   string            `json:"mode,omitempty"`                // Octal permissions of a unix socket, e.g. "0660" (default: per umask)
+	Users  map[string]string `json:"users,omitempty" secret:"true"` // Passwords by username: Basic proxy authentication for http, RFC 1929 for socks; empty accepts anyone
+	Realm  string            `json:"realm,omitempty"`               // Shown by browsers asking for credentials, for http (default: "sultry")
+}
+
+// Listener types.
+const (
+	listenerHTTP        = "http"
+	listenerSOCKS       = "socks"
+	listenerTransparent = "transparent"
+)
+
+// unixListenerPrefix starts listen addresses that are unix socket paths.
+const unixListenerPrefix = "unix:"
+
+// clientListeners returns every listener of the config: the ones of
+// local_proxy_addr, socks and transparent, then those in listeners.
+func (c *Config) clientListeners() []ListenerConfig {
+	var listeners []ListenerConfig
+	if c.LocalProxyAddr != "" {
+		listeners = append(listeners, ListenerConfig{Type: listenerHTTP, Listen: c.LocalProxyAddr,
+			Users: c.ProxyAuth.Users, Realm: c.ProxyAuth.Realm})
+	}
+	if c.SOCKS.Listen != "" {
+		listeners = append(listeners, ListenerConfig{Type: listenerSOCKS, Listen: c.SOCKS.Listen, Users: c.SOCKS.Users})
+	}
+	if c.Transparent.Listen != "" {
+		listeners = append(listeners, ListenerConfig{Type: listenerTransparent, Listen: c.Transparent.Listen})
+	}
+	return append(listeners, c.Listeners...)
+}
+
+// validate rejects listeners that can't be served.
+func (l ListenerConfig) validate() error {
+	kind := l.Type
+	switch kind {
+	case "":
+		kind = listenerHTTP
+	case listenerHTTP, listenerSOCKS, listenerTransparent:
+	default:
+		return fmt.Errorf("unknown listener type %q (use http, socks or transparent)", l.Type)
+	}
+	if l.Listen == "" {
+		return fmt.Errorf("%s listener without a listen address", kind)
+	}
+	path, unix := strings.CutPrefix(l.Listen, unixListenerPrefix)
+	switch {
+	case unix && kind == listenerTransparent:
+		return errors.New("transparent listeners can't be unix sockets: diverted connections arrive over TCP")
+	case unix && path == "":
+		return fmt.Errorf("%s listener without a socket path", kind)
+	case l.Mode != "" && !unix:
+		return fmt.Errorf("mode %s is only for unix sockets, not %s", l.Mode, l.Listen)
+	}
+	if _, err := l.socketMode(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// socketMode returns the permissions of the listener's unix socket, or 0 to
+// leave them to the umask.
+func (l ListenerConfig) socketMode() (fs.FileMode, error) {
+	if l.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(l.Mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid socket mode %q (use octal permissions such as 0660)", l.Mode)
+	}
+	return fs.FileMode(mode), nil
+}
+
+// listen opens the listener's TCP address or unix socket. A socket left
+// behind by a process that didn't close it is replaced, but nothing else
+// at the path is.
+func (l ListenerConfig) listen() (net.Listener, error) {
+	path, unix := strings.CutPrefix(l.Listen, unixListenerPrefix)
+	if !unix {
+		return net.Listen("tcp", l.Listen)
+	}
+	mode, err := l.socketMode()
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set permissions of %s: %w", path, err)
+		}
+	}
+	return listener, nil
+}
+
+// serveListeners starts every listener and serves them until the process
+// ends. A listener that can't be opened is fatal, like a single one was.
+func (p *TLSProxy) serveListeners(listeners []ListenerConfig) {
+	if len(listeners) == 0 {
+		log.Fatalf("❌ No listeners configured (set local_proxy_addr or listeners)")
+	}
+	for _, l := range listeners {
+		if err := l.validate(); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+	}
+	for _, l := range listeners {
+		switch l.Type {
+		case listenerSOCKS:
+			go p.StartSOCKS(l)
+		case listenerTransparent:
+			go p.StartTransparent(TransparentConfig{Listen: l.Listen})
+		default:
+			go p.Start(l)
+		}
+	}
+	select {}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogConfig selects how log lines are written.
+type LogConfig struct {
+	Format string       `json:"format,omitempty"` // "text" (default) or "json"
+	Redact RedactConfig `json:"redact,omitempty"` // How hostnames, client addresses and URLs appear, also in the audit log
+	Debug  bool         `json:"debug,omitempty"`  // Also log every record and chunk relays pass on
+}
+
+// logHandler receives the lines of every session logger. It is replaced by
+// setupLogging before any connection is handled.
+var logHandler slog.Handler = &textHandler{}
+
+// debugLogging reports whether relays log the details of what they pass on.
+var debugLogging bool
+
+// setupLogging installs the configured formatter. With JSON, lines from the
+// standard log package are converted too, so the output stays parseable.
+func setupLogging(cfg LogConfig) error {
+	if err := cfg.Redact.validate(); err != nil {
+		return err
+	}
+	redaction = cfg.Redact
+	debugLogging = cfg.Debug
+
+	// Values of requests and sessions in progress are scrubbed from every
+	// line, however it was logged
+	output := scrubbingWriter{os.Stderr}
+	switch cfg.Format {
+	case "", "text":
+		logHandler = &textHandler{}
+		log.SetOutput(output)
+	case "json":
+		logHandler = slog.NewJSONHandler(output, &slog.HandlerOptions{AddSource: true, Level: slog.LevelDebug})
+		slog.SetDefault(slog.New(logHandler))
+	default:
+		return fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	return nil
+}
+
+// sessionLogger is a structured logger scoped to one proxied connection.
+// Every line carries the fields attached with With (session ID, strategy,
+// destination hash, OOB peer), so the lines of concurrent connections can
+// be told apart. Sensitive values the logger has been given with Redacting
+// are rewritten in every line as the redaction configuration requires.
+type sessionLogger struct {
+	handler slog.Handler
+	id      string // Session ID, also in the fields
+	redact  redactions
+}
+
+// newSessionLogger returns a logger for a new connection with a fresh
+// session ID.
+func newSessionLogger() *sessionLogger {
+	id := make([]byte, 4)
+	rand.Read(id)
+	logger := &sessionLogger{handler: logHandler, id: hex.EncodeToString(id)}
+	return logger.With("session", logger.id)
+}
+
+// With returns a logger that adds the given key-value pairs to every line.
+func (l *sessionLogger) With(args ...any) *sessionLogger {
+	if len(l.redact) > 0 {
+		args = slices.Clone(args)
+		for i := 1; i < len(args); i += 2 {
+			if value, ok := args[i].(string); ok {
+				args[i] = l.redact.scrub(value)
+			}
+		}
+	}
+	return &sessionLogger{handler: slog.New(l.handler).With(args...).Handler(), id: l.id, redact: l.redact}
+}
+
+// Redacting returns a logger that rewrites value, a sensitive field of the
+// given kind, wherever it appears in later lines and fields.
+func (l *sessionLogger) Redacting(kind sensitiveKind, value string) *sessionLogger {
+	redact := l.redact.with(kind, value)
+	if len(redact) == len(l.redact) {
+		return l
+	}
+	return &sessionLogger{handler: l.handler, id: l.id, redact: redact}
+}
+
+// ID returns the session ID, or "" for loggers outside a session.
+func (l *sessionLogger) ID() string {
+	return l.id
+}
+
+// Printf logs a message in the style of log.Printf. The level is derived
+// from the message's emoji prefix.
+func (l *sessionLogger) Printf(format string, args ...any) {
+	msg := l.redact.scrub(fmt.Sprintf(format, args...))
+	level := slog.LevelInfo
+	switch {
+	case strings.HasPrefix(msg, "❌"):
+		level = slog.LevelError
+	case strings.HasPrefix(msg, "⚠️"):
+		level = slog.LevelWarn
+	case strings.HasPrefix(msg, "DEBUG"):
+		level = slog.LevelDebug
+	}
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+	record := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	l.handler.Handle(context.Background(), record)
+}
+
+type sessionLoggerKey struct{}
+
+// withSessionLogger returns a context carrying logger.
+func withSessionLogger(ctx context.Context, logger *sessionLogger) context.Context {
+	return context.WithValue(ctx, sessionLoggerKey{}, logger)
+}
+
+// sessionLog returns the logger carried by ctx, or one without session
+// fields if there is none.
+func sessionLog(ctx context.Context) *sessionLogger {
+	if logger, ok := ctx.Value(sessionLoggerKey{}).(*sessionLogger); ok {
+		return logger
+	}
+	return &sessionLogger{handler: logHandler}
+}
+
+// destHash identifies a destination in log fields without naming it, so
+// structured logs can be correlated and shared without leaking hostnames.
+func destHash(host string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(host)))
+	return hex.EncodeToString(sum[:4])
+}
+
+// textHandler writes lines in the standard log format, honoring the flags
+// of the log package, followed by the logger's fields as key=value pairs.
+type textHandler struct {
+	attrs []slog.Attr
+	group string
+}
+
+var textHandlerMu sync.Mutex
+
+func (h *textHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	flags := log.Flags()
+	if flags&log.Ldate != 0 {
+		b.WriteString(r.Time.Format("2006/01/02 "))
+	}
+	if flags&(log.Ltime|log.Lmicroseconds) != 0 {
+		if flags&log.Lmicroseconds != 0 {
+			b.WriteString(r.Time.Format("15:04:05.000000 "))
+		} else {
+			b.WriteString(r.Time.Format("15:04:05 "))
+		}
+	}
+	if flags&(log.Lshortfile|log.Llongfile) != 0 && r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		file := frame.File
+		if flags&log.Lshortfile != 0 {
+			file = filepath.Base(file)
+		}
+		fmt.Fprintf(&b, "%s:%d: ", file, frame.Line)
+	}
+	b.WriteString(r.Message)
+
+	writeAttr := func(a slog.Attr) {
+		key := a.Key
+		if h.group != "" {
+			key = h.group + "." + key
+		}
+		fmt.Fprintf(&b, " %s=%v", key, a.Value)
+	}
+	for _, a := range h.attrs {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(a)
+		return true
+	})
+	b.WriteByte('\n')
+
+	textHandlerMu.Lock()
+	defer textHandlerMu.Unlock()
+	_, err := log.Writer().Write([]byte(b.String()))
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := &textHandler{group: h.group, attrs: append([]slog.Attr(nil), h.attrs...)}
+	for _, a := range attrs {
+		if h.group != "" {
+			a.Key = h.group + "." + a.Key
+		}
+		next.attrs = append(next.attrs, a)
+	}
+	return next
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	group := name
+	if h.group != "" {
+		group = h.group + "." + name
+	}
+	return &textHandler{group: group, attrs: h.attrs}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// The loopback transport connects a client and a server running in the same
+// process ("dual" mode) over in-memory pipes instead of sockets, so the whole
+// OOB protocol, from the first handshake message to connection adoption, can
+// be exercised without a network. Clients reach it with a "loopback" channel;
+// the server always accepts on it.
+
+// loopbackAddr is the address of both ends of loopback connections.
+type loopbackAddr struct{}
+
+func (loopbackAddr) Network() string { return "pipe" }
+func (loopbackAddr) String() string  { return "loopback" }
+
+// loopbackListener hands the server ends of loopback connections to the
+// server's OOB API.
+var loopbackListener = newStreamListener(loopbackAddr{})
+
+// dialLoopback opens a connection to the in-process server, waiting for it
+// to start accepting if needed.
+func dialLoopback(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case loopbackListener.conns <- server:
+		return client, nil
+	case <-loopbackListener.done:
+		client.Close()
+		server.Close()
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,261 @@
+//go:build !relay
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// loopbackFault decides what happens to a write of the relay to a loopback
+// connection: it is delayed by delay, or dropped, which closes the connection
+// as if the relay had gone away mid-response.
+type loopbackFault func(b []byte) (delay time.Duration, drop bool)
+
+// loopbackRelay is the in-process relay of tests. It dials the targets tests
+// name to local servers instead, and fails its writes as the test's fault
+// says.
+type loopbackRelay struct {
+	targets sync.Map // Local addresses dialed in place of targets
+	fault   atomic.Pointer[loopbackFault]
+}
+
+var (
+	testRelay     loopbackRelay
+	testRelayOnce sync.Once
+)
+
+// serveLoopback serves the OOB API on the loopback listener for the rest of
+// the test binary; it can't be reopened once closed.
+func serveLoopback(t testing.TB) *loopbackRelay {
+	testRelayOnce.Do(func() {
+		api := http.NewServeMux()
+		api.HandleFunc("/handshake", handleHandshake)
+		api.HandleFunc("/complete_handshake", handleCompleteHandshake)
+		api.HandleFunc("/get_target_info", handleGetTargetInfo)
+		api.HandleFunc("/adopt_connection", handleAdoptConnection)
+		api.HandleFunc("/release_connection", handleReleaseConnection)
+		api.HandleFunc("/create_connection", handleCreateConnection)
+		relay := newRelayServer(&http.Server{Handler: api}, faultyListener{loopbackListener, &testRelay})
+		relay.dial = testRelay.dial
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go relay.Serve(listener)
+	})
+	t.Cleanup(func() {
+		sessionsMu.Lock()
+		for id, session := range sessions {
+			session.TargetConn.Close()
+			session.unredact()
+			delete(sessions, id)
+		}
+		sessionsMu.Unlock()
+	})
+	return &testRelay
+}
+
+// redirect has the relay dial addr in place of target until the test ends.
+func (r *loopbackRelay) redirect(t testing.TB, target, addr string) {
+	r.targets.Store(target, addr)
+	t.Cleanup(func() { r.targets.Delete(target) })
+}
+
+func (r *loopbackRelay) dial(dialer *net.Dialer, address string) (net.Conn, error) {
+	if addr, ok := r.targets.Load(address); ok {
+		address = addr.(string)
+	}
+	return dialer.Dial("tcp", address)
+}
+
+// inject fails the relay's writes as fault says until the test ends.
+func (r *loopbackRelay) inject(t testing.TB, fault loopbackFault) {
+	if fault != nil {
+		r.fault.Store(&fault)
+		t.Cleanup(func() { r.fault.Store(nil) })
+	}
+}
+
+// faultyListener hands out the relay ends of loopback connections, failing
+// their writes as the relay's fault says.
+type faultyListener struct {
+	net.Listener
+	relay *loopbackRelay
+}
+
+func (l faultyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return faultyConn{conn, l.relay}, nil
+}
+
+type faultyConn struct {
+	net.Conn
+	relay *loopbackRelay
+}
+
+func (c faultyConn) Write(b []byte) (int, error) {
+	if fault := c.relay.fault.Load(); fault != nil {
+		delay, drop := (*fault)(b)
+		if drop {
+			c.Conn.Close()
+			return 0, net.ErrClosed
+		}
+		time.Sleep(delay)
+	}
+	return c.Conn.Write(b)
+}
+
+// newLoopbackTestProxy returns a proxy whose OOB peer is the in-process
+// relay, connecting tunnels with strategies.
+func newLoopbackTestProxy(t testing.TB, strategies ...string) *TLSProxy {
+	proxy, err := newClientProxy(&Config{
+		OOBChannels: []OOBChannelConfig{{Type: "loopback"}},
+		OOBRetry:    RetryConfig{InitialBackoff: 10, MaxBackoff: 50},
+		Strategies:  strategies,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+// fetchConcealed fetches / from example.com over a TLS connection whose
+// handshake the proxy relays, adopting the relay's connection afterwards.
+func fetchConcealed(proxy *TLSProxy, roots *x509.CertPool) (string, error) {
+	client, server := net.Pipe()
+	go proxy.handleProxyConnection(server, bufio.NewReader(server), false)
+	return fetchExample(client, roots)
+}
+
+// fetchTunneled fetches / from example.com through a tunnel the proxy's
+// strategies connect.
+func fetchTunneled(proxy *TLSProxy, roots *x509.CertPool) (string, error) {
+	client, tunnelEnd := net.Pipe()
+	go func() {
+		defer tunnelEnd.Close()
+		clientHello, err := readClientHello(tunnelEnd, 5*time.Second)
+		if err != nil {
+			return
+		}
+		ctx := context.Background()
+		pipeline := proxy.startPipeline(ctx, "example.com", "443")
+		defer pipeline.Close()
+		proxy.tunnel(ctx, tunnelEnd, pipeline, "example.com", "443", "example.com", clientHello)
+	}()
+	return fetchExample(client, roots)
+}
+
+// fetchExample fetches / from example.com over conn.
+func fetchExample(raw net.Conn, roots *x509.CertPool) (string, error) {
+	conn := tls.Client(raw, &tls.Config{ServerName: "example.com", RootCAs: roots})
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"); err != nil {
+		return "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// newExampleTarget returns a server standing in for example.com:443, and
+// the roots its certificate is verified with.
+func newExampleTarget(t testing.TB, relay *loopbackRelay) *x509.CertPool {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello from "+r.Host)
+	}))
+	t.Cleanup(target.Close)
+	relay.redirect(t, "example.com:443", target.Listener.Addr().String())
+	roots := x509.NewCertPool()
+	roots.AddCert(target.Certificate())
+	return roots
+}
+
+func TestLoopbackHandshakeAndAdoption(t *testing.T) {
+	relay := serveLoopback(t)
+	roots := newExampleTarget(t, relay)
+	proxy := newLoopbackTestProxy(t)
+
+	tests := []struct {
+		name  string
+		fault loopbackFault
+		err   bool
+	}{
+		{"no faults", nil, false},
+		{"slow responses", func([]byte) (time.Duration, bool) { return 20 * time.Millisecond, false }, false},
+		{"handshake responses lost", func(b []byte) (time.Duration, bool) {
+			return 0, !strings.Contains(string(b), "target_host")
+		}, true},
+		{"server gone", func([]byte) (time.Duration, bool) { return 0, true }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay.inject(t, tt.fault)
+			body, err := fetchConcealed(proxy, roots)
+			if tt.err {
+				if err == nil {
+					t.Errorf("fetch succeeded with %q", body)
+				}
+				return
+			}
+			if err != nil || body != "hello from example.com" {
+				t.Errorf("fetch = %q, %v", body, err)
+			}
+		})
+	}
+}
+
+func TestLoopbackTunnel(t *testing.T) {
+	relay := serveLoopback(t)
+	roots := newExampleTarget(t, relay)
+	proxy := newLoopbackTestProxy(t, "oob")
+
+	tests := []struct {
+		name  string
+		fault loopbackFault
+		err   bool
+	}{
+		{"no faults", nil, false},
+		{"slow responses", func([]byte) (time.Duration, bool) { return 20 * time.Millisecond, false }, false},
+		{"resolution lost", func(b []byte) (time.Duration, bool) {
+			return 0, strings.Contains(string(b), `"address"`)
+		}, true},
+		{"server gone", func([]byte) (time.Duration, bool) { return 0, true }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay.inject(t, tt.fault)
+			body, err := fetchTunneled(proxy, roots)
+			if tt.err {
+				if err == nil {
+					t.Errorf("fetch succeeded with %q", body)
+				}
+				return
+			}
+			if err != nil || body != "hello from example.com" {
+				t.Errorf("fetch = %q, %v", body, err)
+			}
+		})
+	}
+}
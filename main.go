@@ -26,20 +26,93 @@ and reliability based on the specific requirements of each connection.
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"os"
 )
 
+// runCommand runs the subcommand named by args instead of the proxy.
+func runCommand(args []string) error {
+	sub := ""
+	if len(args) >= 2 {
+		sub = args[1]
+	}
+	switch args[0] + " " + sub {
+	case "report sni":
+		return reportSNI(args[2:], os.Stdout)
+	case "config lint":
+		return configLint(args[2:], os.Stdout)
+	case "config migrate":
+		return configMigrate(args[2:], os.Stdout)
+	case "check integrity":
+		return checkIntegrity(args[2:], os.Stdout)
+	case "bench handshake":
+		return benchHandshake(args[2:], os.Stdout)
+	case "transcript replay":
+		return replayTranscript(args[2:], os.Stdout)
+	}
+	switch args[0] {
+	case "report":
+		return errors.New("usage: sultry report sni [flags]")
+	case "config":
+		return errors.New("usage: sultry config lint|migrate [flags]")
+	case "check":
+		return errors.New("usage: sultry check integrity [flags] URL")
+	case "bench":
+		return errors.New("usage: sultry bench handshake [flags] host[:port]...")
+	case "transcript":
+		return errors.New("usage: sultry transcript replay [flags] transcript.json")
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
 func main() {
-	// three modes: client(default)/server/dual
-	var mode = flag.String("mode", "client", "proxy mode: client/server/dual")
+	// three modes: client(default, server in relay-only builds)/server/dual
+	var mode = flag.String("mode", defaultMode, "proxy mode: client/server/dual")
 	flag.Parse()
 
+	// Subcommands such as "report sni" run instead of the proxy
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatalf("❌ %v", err)
+		}
+		return
+	}
+
 	// Load configuration
-	config, err := LoadConfig("config.json")
+	config, err := LoadConfig(configPath)
 	if err != nil {
 		log.Fatalf("❌ Failed to load config: %v", err)
 	}
+	if err := setupLogging(config.Log); err != nil {
+		log.Fatalf("❌ Invalid log configuration: %v", err)
+	}
+	if err := setupAudit(config.Audit); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if err := setupKeyLog(config.KeyLogFile); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	connTuner = newConnTuner(config.KeepAlive)
+	setupTimeouts(config.HandshakeTimeout, config.IdleTimeout)
+	if err := setupLegacyTLS(config.LegacyTLS); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if err := setupClient(config); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if err := setupThrottling(config.Throttle); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if err := setupSourcePorts(config.SourcePorts); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if err := setupWebhooks(config.Webhooks); err != nil {
+		log.Fatalf("❌ Invalid webhooks: %v", err)
+	}
+	serveStatus(config.Status)
 
 	switch *mode {
 	case "client":
@@ -0,0 +1,32 @@
+//go:build !relay
+
+package main
+
+import "errors"
+
+// defaultMode is the mode sultry runs in without -mode.
+const defaultMode = "client"
+
+// setupClient installs the settings only the client component reads.
+func setupClient(config *Config) error {
+	if err := checkKillSwitch(config); err != nil {
+		return err
+	}
+	if err := setupUpstreamProxies(config.UpstreamProxies); err != nil {
+		return err
+	}
+	setupUserAgent(config.OOBUserAgent)
+	if err := setupTranscripts(config.Transcripts); err != nil {
+		return err
+	}
+	return setupConnectPorts(config.ConnectPorts)
+}
+
+// checkKillSwitch rejects a kill switch that can't hold: a dry run connects
+// every tunnel directly, whatever the strategies.
+func checkKillSwitch(config *Config) error {
+	if config.KillSwitch && config.DryRun {
+		return errors.New("kill_switch can't be combined with dry_run, which connects every tunnel directly")
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+//go:build !relay
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MITMConfig has the client terminate TLS for chosen hosts with certificates
+// issued by a local CA the user installed in their browser, like mitmproxy,
+// so their requests can be filtered, rewritten and cached. Tunnels to every
+// other host are passed through untouched, as always.
+type MITMConfig struct {
+	CACert        string            `json:"ca_cert,omitempty"`                      // PEM file with the CA certificate browsers trust
+	CAKey         string            `json:"ca_key,omitempty"`                       // PEM file with its private key
+	Hosts         []string          `json:"hosts,omitempty"`                        // Hosts to intercept: "host", "*.example.com" or "*", optionally with ":port"
+	InjectHeaders map[string]string `json:"inject_headers,omitempty" secret:"true"` // Headers set on intercepted requests
+	Block         []string          `json:"block,omitempty"`                        // Requests answered with 403 Forbidden: "host" or "host/path-prefix", host patterns as in hosts
+	CacheEntries  int               `json:"cache_entries,omitempty"`                // Cacheable responses kept in memory (default: 0, no caching)
+	Inspectors    []InspectorConfig `json:"inspectors,omitempty"`                   // Registered inspectors intercepted traffic passes through, in order
+}
+
+// mitmCertLifetime is how long the certificates issued for intercepted
+// hosts are valid; they're issued again after a restart anyway.
+const mitmCertLifetime = 7 * 24 * time.Hour
+
+// maxCachedBody bounds the responses the MITM cache keeps.
+const maxCachedBody = 1 << 20
+
+// mitmProxy terminates TLS for intercepted hosts and forwards their
+// requests to the real targets over tunnels of its own, which use the
+// configured strategies like any other.
+type mitmProxy struct {
+	cfg        MITMConfig
+	proxy      *TLSProxy
+	ca         *x509.Certificate
+	caKey      any
+	key        *ecdsa.PrivateKey // Shared by all issued certificates
+	transport  *http.Transport
+	cache      *responseCache
+	inspectors []Inspector
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate // By host
+}
+
+// newMITMProxy loads the CA of cfg. It returns nil if interception isn't
+// configured.
+func newMITMProxy(cfg MITMConfig, proxy *TLSProxy) (*mitmProxy, error) {
+	if len(cfg.Hosts) == 0 {
+		return nil, nil
+	}
+	if cfg.CACert == "" || cfg.CAKey == "" {
+		return nil, fmt.Errorf("mitm.hosts requires mitm.ca_cert and mitm.ca_key")
+	}
+	pair, err := tls.LoadX509KeyPair(cfg.CACert, cfg.CAKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load MITM CA: %w", err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse MITM CA: %w", err)
+	}
+	if !ca.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", cfg.CACert)
+	}
+	watchCertExpiry("MITM CA", ca.Raw)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mitmProxy{
+		cfg:   cfg,
+		proxy: proxy,
+		ca:    ca,
+		caKey: pair.PrivateKey,
+		key:   key,
+		cache: newResponseCache(cfg.CacheEntries),
+		certs: make(map[string]*tls.Certificate),
+	}
+	for _, c := range cfg.Inspectors {
+		inspector, err := newInspector(c)
+		if err != nil {
+			return nil, err
+		}
+		m.inspectors = append(m.inspectors, inspector)
+		log.Printf("🔍 MITM: Inspecting intercepted traffic with %s", inspector.Name())
+	}
+	m.transport = &http.Transport{
+		DialTLSContext:      m.dialTarget,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	log.Printf("🔓 MITM: Terminating TLS for %s with certificates issued by %s", strings.Join(cfg.Hosts, ", "),
+		ca.Subject.CommonName)
+	return m, nil
+}
+
+// intercepts reports whether tunnels to host:port are terminated locally.
+func (m *mitmProxy) intercepts(host, port string) bool {
+	if m == nil {
+		return false
+	}
+	for _, match := range m.cfg.Hosts {
+		if matchRoute(match, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// serve terminates the TLS connection the client opens in its tunnel to
+// host:port and answers its requests until it closes.
+func (m *mitmProxy) serve(ctx context.Context, clientConn net.Conn, host, port string) {
+	logger := sessionLog(ctx)
+	cert, err := m.certificate(host)
+	if err != nil {
+		logger.Printf("❌ MITM: Failed to issue a certificate for %s: %v", host, err)
+		return
+	}
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"http/1.1"}, // Requests are proxied one at a time
+		KeyLogWriter: keyLog,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		logger.Printf("❌ MITM: TLS handshake with the client failed (is the CA installed?): %v", err)
+		return
+	}
+	logger.Printf("🔓 MITM: Intercepting %s", net.JoinHostPort(host, port))
+
+	upstream := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "https"
+			r.Out.URL.Host = net.JoinHostPort(host, port)
+			r.Out.Host = r.In.Host
+			for name, value := range m.cfg.InjectHeaders {
+				r.Out.Header.Set(name, value)
+			}
+		},
+		Transport: m.transport,
+		ModifyResponse: func(resp *http.Response) error {
+			cutShort := func(err error) {
+				logger.Printf("🚫 MITM: Response to %s %s%s cut short, %v", resp.Request.Method, host,
+					resp.Request.URL.Path, err)
+			}
+			if err := m.inspectResponse(resp, cutShort); err != nil {
+				return err
+			}
+			return m.cache.store(resp)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var block *inspectionBlock
+			if errors.As(err, &block) {
+				logger.Printf("🚫 MITM: Response to %s %s%s %v", r.Method, host, r.URL.Path, err)
+				http.Error(w, "Blocked by proxy", http.StatusForbidden)
+				return
+			}
+			logger.Printf("❌ MITM: %s %s failed: %v", r.Method, r.URL.Path, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.blocks(host, r.URL.Path) {
+			logger.Printf("🚫 MITM: Blocked %s %s%s", r.Method, host, r.URL.Path)
+			http.Error(w, "Blocked by proxy", http.StatusForbidden)
+			return
+		}
+		if err := m.inspectRequest(r); err != nil {
+			logger.Printf("🚫 MITM: %s %s%s %v", r.Method, host, r.URL.Path, err)
+			http.Error(w, "Blocked by proxy", http.StatusForbidden)
+			return
+		}
+		if m.cache.serve(w, r) {
+			logger.Printf("🔹 MITM: Served %s%s from the cache", host, r.URL.Path)
+			return
+		}
+		upstream.ServeHTTP(w, r)
+	})
+
+	// Serve the one connection, until the client closes it
+	listener := newStreamListener(clientConn.LocalAddr())
+	closed := make(chan struct{})
+	var once sync.Once
+	srv := &http.Server{
+		Handler: handler,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				once.Do(func() { close(closed) })
+			}
+		},
+	}
+	go srv.Serve(listener)
+	defer listener.Close()
+	if !listener.deliver(tlsConn) {
+		return
+	}
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		tlsConn.Close()
+	}
+}
+
+// blocks reports whether requests for path on host are blocked.
+func (m *mitmProxy) blocks(host, path string) bool {
+	for _, rule := range m.cfg.Block {
+		pattern, prefix, _ := strings.Cut(rule, "/")
+		if matchHostPattern(pattern, host) && strings.HasPrefix(path, "/"+prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialTarget connects to a target for intercepted requests through a tunnel
+// like a browser's, so requests still get the configured strategies.
+func (m *mitmProxy) dialTarget(ctx context.Context, network, addr string) (net.Conn, error) {
+	return m.proxy.dialTLSTunnel(ctx, addr, "mitm")
+}
+
+// certificate returns the certificate presented to clients for host,
+// issuing it on first use.
+func (m *mitmProxy) certificate(host string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cert, ok := m.certs[host]; ok && time.Now().Before(cert.Leaf.NotAfter.Add(-time.Hour)) {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(mitmCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, m.ca, &m.key.PublicKey, m.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, m.ca.Raw}, PrivateKey: m.key, Leaf: leaf}
+	m.certs[host] = cert
+	return cert, nil
+}
+
+// responseCache keeps responses to intercepted GET requests for as long as
+// their Cache-Control allows. It's shared by all clients, so responses
+// that are private to one aren't kept.
+type responseCache struct {
+	max int
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse // By URL
+}
+
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func newResponseCache(max int) *responseCache {
+	if max <= 0 {
+		return nil
+	}
+	return &responseCache{max: max, entries: make(map[string]*cachedResponse)}
+}
+
+// serve answers r from the cache, if it holds a fresh response for it.
+func (c *responseCache) serve(w http.ResponseWriter, r *http.Request) bool {
+	if c == nil || r.Method != http.MethodGet || r.Header.Get("Authorization") != "" {
+		return false
+	}
+	key := r.Host + r.URL.RequestURI()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+	return true
+}
+
+// store keeps resp if it may be cached by a shared cache. Bodies of
+// unknown length, such as inspected ones, are kept if they turn out small
+// enough.
+func (c *responseCache) store(resp *http.Response) error {
+	r := resp.Request
+	if c == nil || r.Method != http.MethodGet || r.Header.Get("Authorization") != "" ||
+		resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" ||
+		resp.ContentLength > maxCachedBody {
+		return nil
+	}
+	maxAge := sharedMaxAge(resp.Header.Get("Cache-Control"))
+	if maxAge <= 0 {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCachedBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+	if len(body) > maxCachedBody {
+		// Too large after all: send what was read, then the rest
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.max {
+		for key, entry := range c.entries {
+			if time.Now().After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= c.max {
+			return nil
+		}
+	}
+	c.entries[r.Host+r.URL.RequestURI()] = &cachedResponse{status: resp.StatusCode, header: resp.Header.Clone(), body: body,
+		stored: time.Now(), expires: time.Now().Add(maxAge)}
+	return nil
+}
+
+// sharedMaxAge returns how long a response with the Cache-Control header
+// value may be kept by a shared cache, or 0 if it may not.
+func sharedMaxAge(cacheControl string) time.Duration {
+	var maxAge, sMaxAge = -1, -1
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0
+		case "max-age":
+			maxAge, _ = strconv.Atoi(value)
+		case "s-maxage":
+			sMaxAge, _ = strconv.Atoi(value)
+		}
+	}
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	return time.Duration(max(maxAge, 0)) * time.Second
+}
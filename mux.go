@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/yamux"
+)
+
+// muxProtocol is the Upgrade token that turns an OOB connection into a
+// yamux session. Every stream of the session is then served like a separate
+// connection to the OOB API, so clients far from the server only pay for
+// the TCP and TLS handshakes once.
+const muxProtocol = "sultry-mux"
+
+func muxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = nil
+	cfg.Logger = log.Default()
+	return cfg
+}
+
+// bufferedConn is a connection whose first bytes were already buffered
+// while reading the upgrade exchange.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.reader.Read(p) }
+
+// NetConn returns the connection underneath, for its socket options.
+func (c *bufferedConn) NetConn() net.Conn { return c.Conn }
+
+// muxUpgradeHandler upgrades requests to /mux into yamux sessions whose
+// streams are handed to listener.
+func muxUpgradeHandler(listener *streamListener) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), muxProtocol) {
+			http.Error(w, "Upgrade to "+muxProtocol+" required", http.StatusUpgradeRequired)
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Multiplexing not supported on this connection", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			log.Printf("❌ Failed to hijack connection for multiplexing: %v", err)
+			return
+		}
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + muxProtocol + "\r\n\r\n")
+		if err := rw.Flush(); err != nil {
+			conn.Close()
+			return
+		}
+
+		session, err := yamux.Server(&bufferedConn{Conn: conn, reader: rw.Reader}, muxConfig())
+		if err != nil {
+			log.Printf("❌ Failed to start multiplexed session: %v", err)
+			conn.Close()
+			return
+		}
+		log.Printf("🔹 Multiplexed OOB session established from %s", redacted(sensitiveClientIP, r.RemoteAddr))
+		go func() {
+			for {
+				stream, err := session.Accept()
+				if err != nil {
+					log.Printf("🔹 Multiplexed OOB session from %s ended: %v", redacted(sensitiveClientIP, r.RemoteAddr), err)
+					return
+				}
+				if !listener.deliver(stream) {
+					session.Close()
+					return
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,147 @@
+//go:build !relay
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// muxReconnectTimeout bounds each attempt to re-establish a dropped
+// multiplexed session.
+const muxReconnectTimeout = 10 * time.Second
+
+// muxDialer keeps one multiplexed session per OOB peer and opens a new
+// stream on it for every connection. A session that drops is re-established
+// with backoff, and the handshake sessions on its peer re-synchronized once
+// it's back, see sessionsync.go.
+type muxDialer struct {
+	tlsConfig   *tls.Config
+	dialer      *net.Dialer
+	scheme      func(peer string) string // "http" or "https" for the underlying connection
+	authToken   string
+	retry       retryPolicy       // Attempts and backoff for reconnecting
+	onReconnect func(peer string) // Re-synchronizes the sessions on peer
+	sessions    map[string]*yamux.Session
+	dropped     map[string]bool // Peers whose session dropped and whose next one needs a re-sync
+	mu          sync.Mutex
+}
+
+// DialContext opens a stream to peer, establishing a session if needed.
+func (d *muxDialer) DialContext(ctx context.Context, peer string) (net.Conn, error) {
+	session, err := d.session(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open multiplexed stream to %s: %w", peer, err)
+	}
+	return stream, nil
+}
+
+// session returns the live session to peer, connecting and upgrading a new
+// connection if the previous session ended.
+func (d *muxDialer) session(ctx context.Context, peer string) (*yamux.Session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if session, ok := d.sessions[peer]; ok && !session.IsClosed() {
+		return session, nil
+	}
+
+	var conn net.Conn
+	var err error
+	if d.scheme(peer) == "https" {
+		conn, err = upstream.DialTLSContext(ctx, d.dialer, peer, d.tlsConfig)
+	} else {
+		conn, err = upstream.DialContext(ctx, d.dialer, peer)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", peer, err)
+	}
+
+	// Bound the upgrade exchange by ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req, _ := http.NewRequest("GET", "http://"+peer+"/mux", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", muxProtocol)
+	req.Header.Set("User-Agent", oobUserAgent)
+	if d.authToken != "" {
+		req.Header.Set("Authorization", authorizationHeader(d.authToken))
+	}
+	reader := bufio.NewReader(conn)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to request multiplexing from %s: %w", peer, err)
+	}
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read upgrade response from %s: %w", peer, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("%s refused multiplexing: HTTP %d", peer, resp.StatusCode)
+	}
+	conn.SetDeadline(time.Time{})
+
+	session, err := yamux.Client(&bufferedConn{Conn: conn, reader: reader}, muxConfig())
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start multiplexed session with %s: %w", peer, err)
+	}
+	log.Printf("🔹 Multiplexed OOB session established to %s", peer)
+	d.sessions[peer] = session
+	go d.watch(peer, session)
+	if d.dropped[peer] {
+		// The re-sync's own request goes over the new session, so it can't
+		// wait for the lock
+		delete(d.dropped, peer)
+		if d.onReconnect != nil {
+			go d.onReconnect(peer)
+		}
+	}
+	return session, nil
+}
+
+// watch waits for session to end and, unless another has replaced it
+// already, reconnects to peer, so the next OOB request doesn't wait for a
+// new session and the handshake sessions on peer are re-synchronized right
+// away. Once the attempts oob_retry allows are used up, the next request
+// to peer reconnects, and re-syncs, instead.
+func (d *muxDialer) watch(peer string, session *yamux.Session) {
+	<-session.CloseChan()
+	d.mu.Lock()
+	if d.sessions[peer] != session {
+		d.mu.Unlock()
+		return
+	}
+	d.dropped[peer] = true
+	d.mu.Unlock()
+	log.Printf("⚠️ Multiplexed OOB session to %s dropped, reconnecting", peer)
+
+	for attempt := 1; attempt <= d.retry.maxAttempts; attempt++ {
+		time.Sleep(d.retry.backoff(attempt))
+		ctx, cancel := context.WithTimeout(context.Background(), muxReconnectTimeout)
+		_, err := d.session(ctx, peer)
+		cancel()
+		if err == nil {
+			return
+		}
+		log.Printf("⚠️ Reconnecting to %s failed (attempt %d/%d): %v", peer, attempt, d.retry.maxAttempts, err)
+	}
+	log.Printf("⚠️ Gave up reconnecting to %s; its next OOB request will", peer)
+}
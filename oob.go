@@ -1,3 +1,5 @@
+//go:build !relay
+
 // OOB (Out-of-Band) Module for the Sultry proxy system.
 //
 // This module is central to the SNI concealment strategy, providing:
@@ -14,15 +16,23 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/hashicorp/yamux"
 )
 
 // OOBChannel interface defines the methods for out-of-band communication.
@@ -49,15 +59,31 @@ type OOBChannel interface {
 type OOBChannelConfig struct {
 	Type    string `json:"type"`
 	Address string `json:"address,omitempty"`
-	Port    int16  `json:"port,omitempty"`
+	Port    int    `json:"port,omitempty"`
+	Weight  int    `json:"weight,omitempty"` // Relative share of sessions with the weighted strategy
 }
 
 // OOBModule implements the OOBChannel interface for HTTP-based out-of-band communication.
 type OOBModule struct {
 	Channels     []OOBChannelConfig
-	activePeer   string
-	sessionStore map[string]*SessionData
-	mu           sync.Mutex
+	balancer     *peerBalancer
+	tlsConfig    *tls.Config     // Used to reach "https" peers
+	transport    *http.Transport // Shared by all OOB HTTP requests
+	dialer       *net.Dialer     // Connects to plain TCP peers, with the configured timeouts
+	webTransport *webTransportDialer
+	ssh          *sshDialer // nil unless a channel uses SSH
+	mux          *muxDialer // Multiplexes HTTP(S) peers over one connection, if enabled
+	authToken    string     // Bearer token sent to peers, if any
+	retry        retryPolicy
+	failover     int // Standby peers tried when a session's peer fails mid-setup
+	// Binary framing for handshake and app data messages, with JSON kept for
+	// peers that reject it
+	binaryFraming bool
+	jsonOnlyPeers map[string]bool
+	peerCaps      map[string]*capabilitySet // Capabilities of peers that sent theirs
+	sessionStore  map[string]*SessionData
+	abandoned     map[string][]string // Sessions given up on, by peer, for the server to close at the next re-sync
+	mu            sync.Mutex
 }
 
 // HandshakeResponse represents a response from the server during handshake
@@ -69,6 +95,8 @@ type HandshakeResponse struct {
 // SessionData stores session-related information.
 type SessionData struct {
 	SNI               string
+	Peer              string   // OOB peer holding this session's server-side state
+	FailedPeers       []string // Peers this session was moved away from
 	HandshakeComplete bool
 	ServerMessages    [][]byte
 	ClientMessages    [][]byte
@@ -77,101 +105,197 @@ type SessionData struct {
 	ResponseQueue     chan struct{}
 }
 
-// ClientHelloRequest represents the payload for an SNI request.
-type ClientHelloRequest struct {
-	SNI  string `json:"sni"`
-	Data []byte `json:"client_hello"`
-}
-
-// HandshakeMessageRequest represents the payload for a handshake message.
-type HandshakeMessageRequest struct {
-	SessionID string `json:"session_id"`
-	SNI       string `json:"sni"`
-	Data      []byte `json:"data"`
-}
-
-// AppDataRequest represents the payload for application data.
-type AppDataRequest struct {
-	SessionID string `json:"session_id"`
-	Data      []byte `json:"data"`
-}
-
 // NewOOBModule initializes the OOB module.
-func NewOOBModule(channels []OOBChannelConfig) *OOBModule {
+func NewOOBModule(config *Config) *OOBModule {
+	tlsConfig, err := clientTLSConfig(config.OOBTLS)
+	if err != nil {
+		log.Fatalf("❌ Failed to configure OOB TLS: %v", err)
+	}
+	transport, dialer := newOOBTransport(config.OOBTransport, tlsConfig)
+	sshDialer, err := newSSHDialer(config)
+	if err != nil {
+		log.Fatalf("❌ Failed to configure SSH OOB transport: %v", err)
+	}
+
 	oob := &OOBModule{
-		Channels:     channels,
-		sessionStore: make(map[string]*SessionData),
+		Channels:      config.OOBChannels,
+		balancer:      newPeerBalancer(config.OOBChannels, config.LoadBalancing),
+		tlsConfig:     tlsConfig,
+		transport:     transport,
+		dialer:        dialer,
+		webTransport:  newWebTransportDialer(config.WebTransport, tlsConfig, config.Auth.Token),
+		ssh:           sshDialer,
+		authToken:     config.Auth.Token,
+		retry:         newRetryPolicy(config.OOBRetry),
+		failover:      orDefault(config.LoadBalancing.Failover, 1),
+		binaryFraming: config.OOBFraming == "binary",
+		jsonOnlyPeers: make(map[string]bool),
+		peerCaps:      make(map[string]*capabilitySet),
+		sessionStore:  make(map[string]*SessionData),
+		abandoned:     make(map[string][]string),
+	}
+	if config.OOBMux {
+		oob.mux = &muxDialer{
+			tlsConfig:   tlsConfig,
+			dialer:      dialer,
+			scheme:      oob.balancer.Scheme,
+			authToken:   config.Auth.Token,
+			retry:       oob.retry,
+			onReconnect: oob.resyncSessions,
+			sessions:    make(map[string]*yamux.Session),
+			dropped:     make(map[string]bool),
+		}
 	}
-	
-	// Initialize an active peer from the available channels
-	for _, channel := range channels {
-		if channel.Type == "http" && len(channel.Address) > 0 {
-			peer := fmt.Sprintf("%s:%d", channel.Address, channel.Port)
-			log.Printf("🔹 Checking OOB peer %s...", peer)
-			if oob.CanConnect(peer) {
-				oob.activePeer = peer
-				log.Printf("✅ Set active OOB peer to %s", peer)
-				break
-			}
+
+	// Requests to WebTransport and SSH peers, and to HTTP(S) peers when
+	// multiplexing, are carried over streams or channels of a shared session
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch oob.balancer.Scheme(addr) {
+		case "webtransport":
+			return oob.webTransport.DialContext(ctx, addr)
+		case "ssh":
+			return oob.ssh.DialContext(ctx, addr)
+		case "loopback":
+			return dialLoopback(ctx)
+		}
+		if oob.mux != nil && oob.Supports(addr, capMux) {
+			return oob.mux.DialContext(ctx, addr)
+		}
+		return upstream.DialContext(ctx, dialer, addr)
+	}
+
+	// Probe every peer up front so unreachable ones start with an open circuit
+	peers := oob.balancer.Peers()
+	healthy := 0
+	for _, peer := range peers {
+		log.Printf("🔹 Checking OOB peer %s...", peer)
+		if oob.CanConnect(peer) {
+			oob.negotiate(peer)
+			healthy++
+		} else {
+			oob.balancer.Trip(peer)
 		}
 	}
-	
-	if oob.activePeer == "" {
+
+	if healthy == 0 {
 		log.Printf("⚠️ WARNING: No active OOB peer found during initialization!")
 	} else {
-		log.Printf("🔹 OOB Module initialized with active peer: %s", oob.activePeer)
+		log.Printf("🔹 OOB Module initialized with active peers: %d/%d (%s balancing)",
+			healthy, len(peers), oob.balancer.strategy)
 	}
-	
+
+	oob.startHeartbeats(config.Heartbeat)
+	handleStatus("/peers", func() any { return oob.balancer.Status() })
+
 	return oob
 }
 
 // InitiateHandshake initializes a new handshake session.
 func (o *OOBModule) InitiateHandshake(sessionID string, clientHello []byte, sni string) error {
-	log.Printf("🔹 Initiating handshake for session %s with SNI %s", sessionID, sni)
+	log.Printf("🔹 Initiating handshake for session %s with SNI %s", sessionID, redacted(sensitiveSNI, sni))
 
-	o.mu.Lock()
-	defer o.mu.Unlock()
+	// Pick a peer for this session; all later requests must go to the same one
+	peer, err := o.balancer.Pick()
+	if err != nil {
+		return err
+	}
 
 	// Create a new session
+	o.mu.Lock()
 	o.sessionStore[sessionID] = &SessionData{
 		SNI:               sni,
+		Peer:              peer,
 		HandshakeComplete: false,
 		ServerMessages:    make([][]byte, 0),
 		ClientMessages:    [][]byte{clientHello}, // Store initial ClientHello
 		ServerMsgIndex:    0,
 		ApplicationData:   make(chan []byte, 100),
 	}
+	o.mu.Unlock()
 
-	// Find an active peer for this session
-	if o.activePeer == "" {
-		// Try connecting to available OOB peers
-		for _, channel := range o.Channels {
-			if channel.Type == "http" && len(channel.Address) > 0 {
-				peer := fmt.Sprintf("%s:%d", channel.Address, channel.Port)
-				if o.CanConnect(peer) {
-					o.activePeer = peer
-					break
-				}
-			}
-		}
-	}
-
-	if o.activePeer == "" {
-		return fmt.Errorf("no available OOB peers")
-	}
-
-	// Send the initial ClientHello to the OOB peer
-	serverHello, err := o.sendOOBHandshakeMessage(sessionID, clientHello, sni)
+	// Send the initial ClientHello to the OOB peer; the lock isn't held
+	// meanwhile, since sending needs it too
+	serverHello, err := o.sendOOBHandshakeMessage(peer, sessionID, clientHello, sni)
 	if err != nil {
 		return fmt.Errorf("failed to send initial ClientHello: %w", err)
 	}
 
 	// Store the ServerHello response
-	o.sessionStore[sessionID].ServerMessages = append(o.sessionStore[sessionID].ServerMessages, serverHello)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	session, exists := o.sessionStore[sessionID]
+	if !exists {
+		return fmt.Errorf("session %s was closed", sessionID)
+	}
+	session.ServerMessages = append(session.ServerMessages, serverHello)
 
 	return nil
 }
 
+// Failover moves a session whose peer failed before any server message
+// reached the client to a standby peer, and returns its new session ID. The
+// buffered client flights are sent again, which starts a fresh handshake
+// with the target; once server messages have been forwarded the client is
+// committed to the old one, so callers must only fail over before that.
+func (o *OOBModule) Failover(sessionID string) (string, error) {
+	o.mu.Lock()
+	session, exists := o.sessionStore[sessionID]
+	if !exists {
+		o.mu.Unlock()
+		return "", fmt.Errorf("session %s not found", sessionID)
+	}
+	delete(o.sessionStore, sessionID)
+	o.abandon(session.Peer, sessionID)
+	o.mu.Unlock()
+
+	failed := append(session.FailedPeers, session.Peer)
+	for attempt := 1; attempt <= o.failover; attempt++ {
+		peer, err := o.balancer.PickStandby(failed)
+		if err != nil {
+			return "", err
+		}
+		newID := fmt.Sprintf("%d", time.Now().UnixNano())
+		log.Printf("🔁 Failing over session %s from %s to standby %s as session %s",
+			sessionID, failed[len(failed)-1], peer, newID)
+
+		standby := &SessionData{
+			SNI:             session.SNI,
+			Peer:            peer,
+			FailedPeers:     failed,
+			ClientMessages:  session.ClientMessages,
+			ApplicationData: make(chan []byte, 100),
+		}
+		o.mu.Lock()
+		o.sessionStore[newID] = standby
+		o.mu.Unlock()
+
+		err = func() error {
+			for _, message := range session.ClientMessages {
+				response, err := o.sendOOBHandshakeMessage(peer, newID, message, session.SNI)
+				if err != nil {
+					return err
+				}
+				if len(response) > 0 {
+					o.mu.Lock()
+					standby.ServerMessages = append(standby.ServerMessages, response)
+					o.mu.Unlock()
+				}
+			}
+			return nil
+		}()
+		if err == nil {
+			return newID, nil
+		}
+		log.Printf("❌ Standby %s failed for session %s: %v", peer, newID, err)
+		o.mu.Lock()
+		delete(o.sessionStore, newID)
+		o.abandon(peer, newID)
+		o.mu.Unlock()
+		failed = append(failed, peer)
+	}
+	return "", fmt.Errorf("session %s failed on %d peer(s)", sessionID, len(failed))
+}
+
 // GetNextServerMessage gets the next message from the server during handshake.
 func (o *OOBModule) GetNextServerMessage(sessionID string) ([]byte, bool, error) {
 	o.mu.Lock()
@@ -212,7 +336,7 @@ func (o *OOBModule) SendClientMessage(sessionID string, message []byte) (bool, e
 	o.mu.Unlock()
 
 	// Send the message to the OOB peer
-	serverResponse, err := o.sendOOBHandshakeMessage(sessionID, message, session.SNI)
+	serverResponse, err := o.sendOOBHandshakeMessage(session.Peer, sessionID, message, session.SNI)
 	if err != nil {
 		return false, fmt.Errorf("failed to send client message: %w", err)
 	}
@@ -253,19 +377,11 @@ func (o *OOBModule) SendApplicationData(sessionID string, data []byte) error {
 		return fmt.Errorf("handshake not complete for session %s", sessionID)
 	}
 
-	// Create app data request
-	reqPayload := AppDataRequest{
+	// Send the app data to the OOB peer
+	resp, err := o.postOOBMessage(o.Client(0), session.Peer, "/appdata", frameAppData, oobMessage{
 		SessionID: sessionID,
 		Data:      data,
-	}
-
-	reqBody, err := json.Marshal(reqPayload)
-	if err != nil {
-		return fmt.Errorf("failed to marshal app data request: %w", err)
-	}
-
-	// Send the app data to the OOB peer
-	resp, err := http.Post(fmt.Sprintf("http://%s/appdata", o.activePeer), "application/json", bytes.NewBuffer(reqBody))
+	})
 	if err != nil {
 		return fmt.Errorf("failed to send app data: %w", err)
 	}
@@ -357,35 +473,35 @@ func (o *OOBModule) RelayTLSHandshake(reqID string, clientHelloData []byte, real
 
 // sendOOBHandshakeMessage sends a handshake message over the OOB channel.
 // sendOOBHandshakeMessage uses shorter timeouts to avoid long hangs when using direct fetch
-func (o *OOBModule) sendOOBHandshakeMessage(sessionID string, data []byte, sni string) ([]byte, error) {
-	if o.activePeer == "" {
+func (o *OOBModule) sendOOBHandshakeMessage(peer string, sessionID string, data []byte, sni string) ([]byte, error) {
+	if peer == "" {
 		return nil, fmt.Errorf("no active OOB peer")
 	}
 
-	// Create the request payload
-	reqPayload := HandshakeMessageRequest{
-		SessionID: sessionID,
-		SNI:       sni,
-		Data:      data,
-	}
-
-	reqBody, err := json.Marshal(reqPayload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal handshake message: %w", err)
-	}
-
 	// Send the request to the OOB peer with a shorter timeout
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Post(fmt.Sprintf("http://%s/handshake", o.activePeer), "application/json", bytes.NewBuffer(reqBody))
+	client := o.Client(o.Timeout(peer, 5*time.Second))
+	start := time.Now()
+	resp, err := o.withRetry(peer, "/handshake", false, func() (*http.Response, error) {
+		return o.postOOBMessage(client, peer, "/handshake", frameHandshake, oobMessage{
+			SessionID: sessionID,
+			SNI:       sni,
+			Data:      data,
+		})
+	})
 	if err != nil {
+		o.balancer.ReportFailure(peer)
 		return nil, fmt.Errorf("OOB request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("OOB request failed: %s", string(body))
+		oobErr := readOOBError(peer, resp)
+		if resp.StatusCode >= 500 && oobErr.Code == "" {
+			o.balancer.ReportFailure(peer)
+		}
+		return nil, fmt.Errorf("OOB request failed: %w", oobErr)
 	}
+	o.balancer.ReportSuccess(peer, time.Since(start))
 
 	// Read the response
 	serverResponse, err := io.ReadAll(resp.Body)
@@ -403,12 +519,42 @@ func (o *OOBModule) sendOOBHandshakeMessage(sessionID string, data []byte, sni s
 
 // CanConnect checks if a connection to the peer can be established.
 func (o *OOBModule) CanConnect(peer string) bool {
-	conn, err := net.DialTimeout("tcp", peer, 2*time.Second)
+	// Tunneled peers are probed by setting up the shared session or connection
+	var err error
+	switch o.balancer.Scheme(peer) {
+	case "webtransport":
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = o.webTransport.session(ctx, peer)
+	case "ssh":
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err = o.ssh.client(ctx, peer)
+	case "loopback":
+		var conn net.Conn
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if conn, err = dialLoopback(ctx); err == nil {
+			conn.Close()
+		}
+	default:
+		if o.mux != nil && o.Supports(peer, capMux) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_, err = o.mux.session(ctx, peer)
+			break
+		}
+		var conn net.Conn
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if conn, err = upstream.DialContext(ctx, &net.Dialer{}, peer); err == nil {
+			conn.Close()
+		}
+	}
 	if err != nil {
 		log.Printf("⚠️ Failed to connect to OOB peer %s: %v", peer, err)
 		return false
 	}
-	conn.Close()
 	log.Printf("🔹 Successfully connected to OOB peer %s", peer)
 	return true
 }
@@ -444,7 +590,7 @@ func (o *OOBModule) AdoptConnection(sessionID string) (net.Conn, error) {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	resp, err := http.Post(fmt.Sprintf("http://%s/adopt_connection", o.activePeer),
+	resp, err := o.Client(0).Post(o.URL(session.Peer, "/adopt_connection"),
 		"application/json", bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to contact OOB server: %w", err)
@@ -532,12 +678,119 @@ func (c *oobConn) RemoteAddr() net.Addr {
 	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
 }
 
-// GetServerAddress returns the address of the active OOB server
+// URL builds the endpoint URL for a request to peer.
+func (o *OOBModule) URL(peer string, path string) string {
+	scheme := o.balancer.Scheme(peer)
+	switch scheme {
+	case "webtransport", "loopback":
+		// Plain HTTP inside the already encrypted stream, or in memory
+		scheme = "http"
+	case "ssh":
+		scheme = "http"
+		if o.ssh.tls {
+			scheme = "https"
+		}
+	case "https":
+		if o.mux != nil && o.Supports(peer, capMux) {
+			// TLS already wraps the multiplexed session
+			scheme = "http"
+		}
+	}
+	return scheme + "://" + peer + path
+}
+
+// Client returns an HTTP client for OOB requests; a zero timeout means none.
+func (o *OOBModule) Client(timeout time.Duration) *http.Client {
+	var transport http.RoundTripper = userAgentTransport{base: o.transport}
+	if o.authToken != "" {
+		transport = &authTransport{base: transport, token: o.authToken}
+	}
+	return &http.Client{Transport: transcripts.transport(transport), Timeout: timeout}
+}
+
+// Timeout stretches a request timeout by the measured round-trip time to
+// peer, so requests over slow links aren't cut off by timeouts sized for
+// fast ones. Two RTOs leave room for setting up a new connection.
+func (o *OOBModule) Timeout(peer string, base time.Duration) time.Duration {
+	return base + 2*o.balancer.RTO(peer)
+}
+
+// AuthHeader returns the Authorization header line for hand-written requests
+// on raw OOB connections, or "" when no token is configured.
+func (o *OOBModule) AuthHeader() string {
+	if o.authToken == "" {
+		return ""
+	}
+	return "Authorization: " + authorizationHeader(o.authToken)
+}
+
+// Dial opens a raw connection to peer, wrapped in TLS for "https" peers.
+func (o *OOBModule) Dial(peer string) (net.Conn, error) {
+	scheme := o.balancer.Scheme(peer)
+	if o.mux != nil && (scheme == "http" || scheme == "https") && o.Supports(peer, capMux) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return o.mux.DialContext(ctx, peer)
+	}
+	switch scheme {
+	case "https":
+		ctx, cancel := context.WithTimeout(context.Background(), o.dialer.Timeout)
+		defer cancel()
+		return upstream.DialTLSContext(ctx, o.dialer, peer, o.tlsConfig)
+	case "webtransport":
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return o.webTransport.DialContext(ctx, peer)
+	case "ssh":
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		conn, err := o.ssh.DialContext(ctx, peer)
+		if err != nil || !o.ssh.tls {
+			return conn, err
+		}
+		return tls.Client(conn, o.tlsConfig), nil
+	case "loopback":
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return dialLoopback(ctx)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.dialer.Timeout)
+	defer cancel()
+	return upstream.DialContext(ctx, o.dialer, peer)
+}
+
+// GetServerAddress returns the address of the OOB server to use for a
+// request that isn't bound to an existing session, or "" if none is available.
 func (o *OOBModule) GetServerAddress() string {
+	peer, err := o.balancer.Pick()
+	if err != nil {
+		log.Printf("⚠️ %v", err)
+		return ""
+	}
+	return peer
+}
+
+// PeerForSession returns the OOB server holding the given session's state,
+// falling back to a freshly picked peer for unknown sessions.
+func (o *OOBModule) PeerForSession(sessionID string) string {
 	o.mu.Lock()
-	defer o.mu.Unlock()
+	session, exists := o.sessionStore[sessionID]
+	o.mu.Unlock()
+
+	if exists && session.Peer != "" {
+		return session.Peer
+	}
+	return o.GetServerAddress()
+}
 
-	return o.activePeer
+// ReportPeerResult feeds the outcome of a request made outside the module
+// into the peer's circuit breaker.
+func (o *OOBModule) ReportPeerResult(peer string, latency time.Duration, err error) {
+	if err != nil {
+		o.balancer.ReportFailure(peer)
+		return
+	}
+	o.balancer.ReportSuccess(peer, latency)
 }
 
 // GetHandshakeResponse gets the next handshake response from the server
@@ -577,6 +830,96 @@ func (o *OOBModule) GetHandshakeResponse(sessionID string) (*HandshakeResponse,
 	}, nil
 }
 
+// StreamHandshakeResponses subscribes to the session's /events stream on its
+// OOB peer. Server responses are delivered in order as they arrive; a final
+// response with HandshakeComplete set marks the end of the handshake. The
+// channel is closed when the stream ends or ctx is cancelled.
+func (o *OOBModule) StreamHandshakeResponses(ctx context.Context, sessionID string) (<-chan HandshakeResponse, error) {
+	peer := o.PeerForSession(sessionID)
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		o.URL(peer, "/events?session_id="+url.QueryEscape(sessionID)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := o.Client(0).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event stream: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("event stream failed: %s", strings.TrimSpace(string(body)))
+	}
+
+	responses := make(chan HandshakeResponse)
+	go func() {
+		defer resp.Body.Close()
+		defer close(responses)
+
+		var event string
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 4*maxFramePayload/3+64)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data:"):
+				var response HandshakeResponse
+				switch event {
+				case "response":
+					data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+					if err != nil {
+						log.Printf("❌ Invalid event data for session %s: %v", sessionID, err)
+						return
+					}
+					response.Data = data
+				case "error":
+					var structured oobErrorBody
+					json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &structured)
+					log.Printf("❌ OOB peer %s ended session %s: %s (%s)", peer, sessionID, structured.Error, structured.Code)
+					return
+				case "complete", "closed":
+					response.HandshakeComplete = true
+				default:
+					continue
+				}
+				select {
+				case responses <- response:
+				case <-ctx.Done():
+					return
+				}
+				if response.HandshakeComplete {
+					return
+				}
+			}
+		}
+	}()
+	return responses, nil
+}
+
+// SendData forwards client handshake data without waiting for the server's
+// reply, which arrives on the event stream instead.
+func (o *OOBModule) SendData(sessionID string, data []byte) error {
+	peer := o.PeerForSession(sessionID)
+	resp, err := o.postOOBMessage(o.Client(o.Timeout(peer, 10*time.Second)), peer, "/send_data", frameSendData, oobMessage{
+		SessionID: sessionID,
+		Action:    "send_data",
+		Data:      data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send data: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("send_data failed: %s", strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
 // SendHandshakeData sends client handshake data to the server
 func (o *OOBModule) SendHandshakeData(sessionID string, data []byte) error {
 	_, err := o.SendClientMessage(sessionID, data)
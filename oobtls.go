@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// OOBTLSConfig enables HTTPS on the OOB channel so handshake payloads (and the
+// concealed SNI inside them) are encrypted between client and server components.
+// Clients use TLS for every oob_channels entry of type "https".
+type OOBTLSConfig struct {
+	CertFile           string `json:"cert_file,omitempty"`            // Server: certificate (PEM)
+	KeyFile            string `json:"key_file,omitempty"`             // Server: private key (PEM)
+	SelfSigned         bool   `json:"self_signed,omitempty"`          // Server: generate a certificate, persisted to cert/key files if set
+	ServerName         string `json:"server_name,omitempty"`          // Name in the generated certificate, or expected by the client
+	CAFile             string `json:"ca_file,omitempty"`              // Client: CA bundle used to verify the server
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"` // Client: accept any server certificate
+
+	// Mutual TLS: the server only serves clients with a certificate signed by
+	// ClientCAFile, and the client only talks to servers whose certificate matches a pin.
+	ClientCAFile   string   `json:"client_ca_file,omitempty"`   // Server: CA that must have signed client certificates
+	ClientCertFile string   `json:"client_cert_file,omitempty"` // Client: certificate presented to the server (PEM)
+	ClientKeyFile  string   `json:"client_key_file,omitempty"`  // Client: private key for client_cert_file (PEM)
+	PinnedSHA256   []string `json:"pinned_sha256,omitempty"`    // Client: accepted SHA-256 fingerprints of the server certificate
+
+	// Server: obtain the certificate from an ACME CA instead of cert_file/key_file
+	ACME *ACMEConfig `json:"acme,omitempty"`
+}
+
+// serverTLSConfig returns the TLS configuration for the OOB listener, or nil
+// when the OOB API should be served over plain HTTP.
+func serverTLSConfig(cfg OOBTLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" && !cfg.SelfSigned && cfg.ACME == nil {
+		return nil, nil
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.ACME != nil {
+		var err error
+		if tlsConfig, err = acmeTLSConfig(*cfg.ACME); err != nil {
+			return nil, err
+		}
+	} else {
+		cert, err := loadServerCert(cfg)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("🔒 OOB certificate SHA-256 fingerprint: %s", certFingerprint(cert.Certificate[0]))
+		watchCertExpiry("OOB server", cert.Certificate[0])
+
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+			// Connection adoption hijacks the underlying connection, which HTTP/2 doesn't allow
+			NextProtos: []string{"http/1.1"},
+		}
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		log.Printf("🔒 OOB API requires client certificates signed by %s", cfg.ClientCAFile)
+	}
+	tlsConfig.KeyLogWriter = keyLog
+
+	return tlsConfig, nil
+}
+
+// loadServerCert loads the configured certificate, generating a
+// self-signed one if requested.
+func loadServerCert(cfg OOBTLSConfig) (tls.Certificate, error) {
+	switch {
+	case cfg.SelfSigned && !fileExists(cfg.CertFile):
+		return generateSelfSignedCert(cfg)
+	case cfg.CertFile == "" || cfg.KeyFile == "":
+		return tls.Certificate{}, errors.New("both cert_file and key_file are required for OOB TLS")
+	default:
+		return tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	}
+}
+
+// clientTLSConfig returns the TLS configuration used to reach "https" OOB peers.
+func clientTLSConfig(cfg OOBTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+		NextProtos:         []string{"http/1.1"},
+		KeyLogWriter:       keyLog, // Inherited by cover connections
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCertFile != "" || cfg.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load OOB client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+		watchCertExpiry("OOB client", cert.Certificate[0])
+	}
+
+	if len(cfg.PinnedSHA256) > 0 {
+		pins := make(map[string]bool, len(cfg.PinnedSHA256))
+		for _, pin := range cfg.PinnedSHA256 {
+			pins[strings.ToLower(strings.ReplaceAll(pin, ":", ""))] = true
+		}
+		// A pin is sufficient on its own, so self-signed servers work without a CA file
+		if cfg.CAFile == "" {
+			tlsConfig.InsecureSkipVerify = true
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("OOB server presented no certificate")
+			}
+			fingerprint := certFingerprint(cs.PeerCertificates[0].Raw)
+			if !pins[fingerprint] {
+				return fmt.Errorf("OOB server certificate %s does not match any pinned fingerprint", fingerprint)
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCertPool reads a PEM bundle into a certificate pool.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pemData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// certFingerprint returns the hex SHA-256 of a DER certificate, the format
+// used by pinned_sha256.
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// generateSelfSignedCert creates a bootstrap certificate for the OOB listener.
+// When cert/key paths are configured the result is written there so the
+// fingerprint stays stable across restarts.
+func generateSelfSignedCert(cfg OOBTLSConfig) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate serial: %w", err)
+	}
+
+	name := cfg.ServerName
+	if name == "" {
+		name = "localhost"
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to marshal key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		if err := os.WriteFile(cfg.CertFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to write certificate: %w", err)
+		}
+		if err := os.WriteFile(cfg.KeyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to write key: %w", err)
+		}
+		log.Printf("🔒 Wrote self-signed OOB certificate to %s", cfg.CertFile)
+	} else {
+		log.Printf("🔒 Generated in-memory self-signed OOB certificate for %s", name)
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func fileExists(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,47 @@
+//go:build !relay
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// OOBTransportConfig tunes the HTTP transport shared by every OOB request.
+// A handshake makes several requests to the same peer, so idle connections
+// are kept around long enough to be reused instead of opening a new TCP (and
+// TLS) connection for each of them.
+type OOBTransportConfig struct {
+	MaxIdleConns        int `json:"max_idle_conns,omitempty"`          // Idle connections kept across all peers (default: 64)
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"` // Idle connections kept per peer (default: 16)
+	MaxConnsPerHost     int `json:"max_conns_per_host,omitempty"`      // Connections per peer, including active ones (default: unlimited)
+	IdleConnTimeout     int `json:"idle_conn_timeout,omitempty"`       // Milliseconds an idle connection is kept (default: 90000)
+	KeepAlive           int `json:"keep_alive,omitempty"`              // Milliseconds between TCP keep-alive probes, -1 to disable (default: 30000)
+	ConnectTimeout      int `json:"connect_timeout,omitempty"`         // Milliseconds allowed for the TCP connect and the TLS handshake (default: 10000)
+	ReadTimeout         int `json:"read_timeout,omitempty"`            // Milliseconds to wait for response headers (default: none)
+}
+
+// newOOBTransport builds the shared transport described by cfg along with
+// the dialer it connects through. The caller installs a DialContext that
+// uses the dialer for plain TCP peers.
+func newOOBTransport(cfg OOBTransportConfig, tlsConfig *tls.Config) (*http.Transport, *net.Dialer) {
+	dialer := &net.Dialer{
+		Timeout:   millis(cfg.ConnectTimeout, 10000),
+		KeepAlive: millis(cfg.KeepAlive, 30000),
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = upstream.EnvironmentProxy
+	transport.MaxIdleConns = orDefault(cfg.MaxIdleConns, 64)
+	// The default of 2 idle connections per host is what made concurrent
+	// handshakes to the same peer keep opening new connections
+	transport.MaxIdleConnsPerHost = orDefault(cfg.MaxIdleConnsPerHost, 16)
+	transport.MaxConnsPerHost = cfg.MaxConnsPerHost
+	transport.IdleConnTimeout = millis(cfg.IdleConnTimeout, 90000)
+	transport.TLSHandshakeTimeout = dialer.Timeout
+	transport.ResponseHeaderTimeout = time.Duration(cfg.ReadTimeout) * time.Millisecond
+	return transport, dialer
+}
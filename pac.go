@@ -0,0 +1,79 @@
+//go:build !relay
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// PACConfig decides what the proxy auto-config file served at /proxy.pac
+// on the HTTP proxy listener sends through sultry, so a browser can be set
+// up with that one URL. Local names and addresses always go direct.
+type PACConfig struct {
+	Proxy     []string `json:"proxy,omitempty"`      // Hosts sent through sultry, as "example.com" or "*.example.com" (default: all)
+	Direct    []string `json:"direct,omitempty"`     // Hosts browsers connect to themselves, checked before proxy
+	ProxyAddr string   `json:"proxy_addr,omitempty"` // host:port browsers reach the proxy at (default: the address the PAC was fetched from)
+}
+
+// pacPath is where the PAC file is served.
+const pacPath = "/proxy.pac"
+
+// pacScript returns the PAC file for cfg, sending proxied hosts to proxyAddr.
+// Patterns match like matchHostPattern, so the file agrees with the rest of
+// the configuration.
+func pacScript(cfg PACConfig, proxyAddr string) string {
+	list := func(patterns []string) string {
+		lowered := make([]string, 0, len(patterns))
+		for _, pattern := range patterns {
+			lowered = append(lowered, strings.ToLower(strings.TrimSuffix(pattern, ".")))
+		}
+		encoded, _ := json.Marshal(lowered)
+		return string(encoded)
+	}
+	proxy, _ := json.Marshal("PROXY " + proxyAddr)
+
+	return fmt.Sprintf(`// Generated by sultry
+var direct = %s;
+var proxied = %s;
+
+function matches(host, patterns) {
+  for (var i = 0; i < patterns.length; i++) {
+    var p = patterns[i];
+    if (p == "*" || host == p) return true;
+    if (p.substring(0, 2) == "*." && (host == p.substring(2) || dnsDomainIs(host, p.substring(1)))) return true;
+  }
+  return false;
+}
+
+function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  if (isPlainHostName(host) || host == "localhost" || dnsDomainIs(host, ".local") ||
+      /^127\.\d+\.\d+\.\d+$/.test(host) || host == "::1" || host == "[::1]") {
+    return "DIRECT";
+  }
+  if (matches(host, direct)) return "DIRECT";
+  if (proxied.length == 0 || matches(host, proxied)) return %s;
+  return "DIRECT";
+}
+`, list(cfg.Direct), list(cfg.Proxy), proxy)
+}
+
+// servePAC answers a request for the PAC file on the proxy listener, whose
+// head has been read. Proxied hosts are sent to the address the browser
+// fetched it from unless another is configured.
+func (p *TLSProxy) servePAC(logger *sessionLogger, clientConn net.Conn, head []byte) {
+	proxyAddr := p.PAC.ProxyAddr
+	if proxyAddr == "" {
+		proxyAddr, _ = requestHeader(head, "Host")
+	}
+	if proxyAddr == "" {
+		proxyAddr = clientConn.LocalAddr().String()
+	}
+	script := pacScript(p.PAC, proxyAddr)
+	fmt.Fprintf(clientConn, "HTTP/1.1 200 OK\r\nContent-Type: application/x-ns-proxy-autoconfig\r\n"+
+		"Content-Length: %d\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n%s", len(script), script)
+	logger.Printf("📜 Served %s to %s (proxy %s)", pacPath, clientConn.RemoteAddr(), proxyAddr)
+}
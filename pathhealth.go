@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxTrackedPaths bounds the number of destinations kept in pathHealth;
+// the least recently dialed one is forgotten first.
+const maxTrackedPaths = 1024
+
+// pathStats is the relay's view of the network path to one destination.
+type pathStats struct {
+	Dest          string         `json:"dest"`
+	Dials         int            `json:"dials"`
+	Failures      int            `json:"failures"`
+	Latency       float64        `json:"latency_ms"`      // Moving average of successful dial times
+	LastLatency   float64        `json:"last_latency_ms"` // Most recent successful dial time
+	FailureTypes  map[string]int `json:"failure_types,omitempty"`
+	LastError     string         `json:"last_error,omitempty"`
+	LastFailureAt *time.Time     `json:"last_failure_at,omitempty"`
+	LastSuccessAt *time.Time     `json:"last_success_at,omitempty"`
+	Open          int            `json:"open"`      // Connections to the destination open now
+	PeakOpen      int            `json:"peak_open"` // Most connections open at once
+	lastDialAt    time.Time
+}
+
+// pathHealthTracker records how dials from the relay to each destination
+// go, so a destination the relay can't reach ("relay→target broken") can
+// be told apart from a client that can't reach the relay.
+type pathHealthTracker struct {
+	paths map[string]*pathStats
+	mu    sync.Mutex
+}
+
+var pathHealth = &pathHealthTracker{paths: make(map[string]*pathStats)}
+
+// targetDialer connects the relay to a target with dialer. A RelayServer
+// built with one hands it to its handlers in the request context, in place
+// of dialing from source_ports.
+type targetDialer func(dialer *net.Dialer, address string) (net.Conn, error)
+
+type targetDialerKey struct{}
+
+// withTargetDialer returns ctx carrying dial for dialTarget.
+func withTargetDialer(ctx context.Context, dial targetDialer) context.Context {
+	return context.WithValue(ctx, targetDialerKey{}, dial)
+}
+
+// dialTarget connects to a destination with dialer, from a source port of
+// source_ports if configured or with the targetDialer ctx carries, and
+// records the result. The connection is counted as open to the destination
+// until it is closed.
+func dialTarget(ctx context.Context, dialer *net.Dialer, address string) (net.Conn, error) {
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	release := func() {}
+	if dial, ok := ctx.Value(targetDialerKey{}).(targetDialer); ok {
+		conn, err = dial(dialer, address)
+	} else {
+		conn, release, err = sourcePorts.dial(dialer, address)
+	}
+	stats := pathHealth.record(address, time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	return &trackedConn{Conn: conn, closed: func() {
+		release()
+		pathHealth.closed(stats)
+	}}, nil
+}
+
+// trackedConn is a relay connection to a target that reports its closing.
+type trackedConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.closed)
+	return err
+}
+
+// CloseWrite half-closes the connection, for relays.
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// NetConn returns the underlying connection, for socket options.
+func (c *trackedConn) NetConn() net.Conn { return c.Conn }
+
+// tcpConnOf returns the TCP connection under conn, looking through wrappers
+// that expose it with NetConn.
+func tcpConnOf(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			return tcpConn, true
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil, false
+		}
+		conn = wrapper.NetConn()
+	}
+}
+
+// record counts a dial to dest and returns its stats, with the connection
+// counted as open if it succeeded.
+func (t *pathHealthTracker) record(dest string, elapsed time.Duration, err error) *pathStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.paths[dest]
+	if !ok {
+		if len(t.paths) >= maxTrackedPaths {
+			t.evictOldest()
+		}
+		stats = &pathStats{Dest: dest}
+		t.paths[dest] = stats
+	}
+	now := time.Now()
+	stats.Dials++
+	stats.lastDialAt = now
+	if err != nil {
+		if stats.FailureTypes == nil {
+			stats.FailureTypes = make(map[string]int)
+		}
+		stats.Failures++
+		stats.FailureTypes[classifyDialError(err)]++
+		stats.LastError = err.Error()
+		stats.LastFailureAt = &now
+		return stats
+	}
+	ms := float64(elapsed) / float64(time.Millisecond)
+	if stats.Latency == 0 {
+		stats.Latency = ms
+	} else {
+		stats.Latency = (stats.Latency*7 + ms) / 8
+	}
+	stats.LastLatency = ms
+	stats.LastSuccessAt = &now
+	stats.Open++
+	stats.PeakOpen = max(stats.PeakOpen, stats.Open)
+	return stats
+}
+
+// closed counts a connection whose dial was recorded in stats as closed.
+func (t *pathHealthTracker) closed(stats *pathStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats.Open--
+}
+
+func (t *pathHealthTracker) evictOldest() {
+	var oldest *pathStats
+	for _, stats := range t.paths {
+		switch {
+		case oldest == nil:
+			oldest = stats
+		case (stats.Open == 0) != (oldest.Open == 0):
+			// Destinations with open connections are kept while others remain
+			if stats.Open == 0 {
+				oldest = stats
+			}
+		case stats.lastDialAt.Before(oldest.lastDialAt):
+			oldest = stats
+		}
+	}
+	delete(t.paths, oldest.Dest)
+}
+
+// Snapshot returns a copy of the stats of every tracked destination,
+// sorted by destination.
+func (t *pathHealthTracker) Snapshot() []pathStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make([]pathStats, 0, len(t.paths))
+	for _, stats := range t.paths {
+		s := *stats
+		if stats.FailureTypes != nil {
+			s.FailureTypes = make(map[string]int, len(stats.FailureTypes))
+			for k, v := range stats.FailureTypes {
+				s.FailureTypes[k] = v
+			}
+		}
+		snapshot = append(snapshot, s)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Dest < snapshot[j].Dest })
+	return snapshot
+}
+
+// classifyDialError names the way a dial failed: "dns", "timeout",
+// "refused", "reset", "unreachable" or "other".
+func classifyDialError(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "other"
+}
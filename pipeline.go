@@ -0,0 +1,243 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// PreparableStrategy is implemented by strategies that can start connecting
+// from the CONNECT target alone, before the ClientHello has been read.
+// Prepare must not send anything; Establish later picks the connection up
+// with Destination.takePrepared.
+type PreparableStrategy interface {
+	Prepare(ctx context.Context, dest Destination) (net.Conn, error)
+}
+
+// dnsStage resolves the target host once, concurrently with the rest of the
+// setup, and shares the result with every strategy that dials directly.
+type dnsStage struct {
+	done chan struct{}
+	ips  []net.IPAddr
+	err  error
+}
+
+func startDNSStage(ctx context.Context, host string) *dnsStage {
+	stage := &dnsStage{done: make(chan struct{})}
+	go func() {
+		defer close(stage.done)
+		if ip := net.ParseIP(host); ip != nil {
+			stage.ips = []net.IPAddr{{IP: ip}}
+			return
+		}
+		start := time.Now()
+		stage.ips, stage.err = net.DefaultResolver.LookupIPAddr(ctx, host)
+		if stage.err == nil {
+			sessionLog(ctx).Printf("🔹 Resolved %s to %d address(es) in %s", host, len(stage.ips), time.Since(start).Truncate(time.Millisecond))
+		}
+	}()
+	return stage
+}
+
+// wait returns the resolved addresses, or ctx's error if it ends first.
+func (s *dnsStage) wait(ctx context.Context) ([]net.IPAddr, error) {
+	select {
+	case <-s.done:
+		return s.ips, s.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// preparedConn is a connection a strategy started speculatively.
+type preparedConn struct {
+	strategy string
+	dest     Destination
+	done     chan struct{}
+	conn     net.Conn
+	err      error
+
+	mu    sync.Mutex
+	taken bool
+}
+
+// take hands the prepared connection to its strategy, at most once.
+func (p *preparedConn) take(ctx context.Context) (net.Conn, error) {
+	p.mu.Lock()
+	if p.taken {
+		p.mu.Unlock()
+		return nil, nil
+	}
+	p.taken = true
+	p.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return p.conn, p.err
+	case <-ctx.Done():
+		go p.closeWhenDone()
+		return nil, ctx.Err()
+	}
+}
+
+// discard releases the connection if nobody took it.
+func (p *preparedConn) discard() {
+	p.mu.Lock()
+	taken := p.taken
+	p.taken = true
+	p.mu.Unlock()
+	if !taken {
+		go p.closeWhenDone()
+	}
+}
+
+func (p *preparedConn) closeWhenDone() {
+	<-p.done
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
+
+// connectPipeline runs the setup stages of a tunnel concurrently: as soon as
+// the CONNECT target is known, DNS resolution and the first preparable
+// strategy's connection start, overlapping with reading the ClientHello.
+type connectPipeline struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	dns        *dnsStage
+	prepared   *preparedConn
+	transcript *sessionTranscript // nil unless transcripts are on
+}
+
+// startPipeline kicks off the stages that only need the CONNECT target. The
+// stages log with the session logger carried by parent, and record their
+// OOB exchanges in the tunnel's transcript.
+func (p *TLSProxy) startPipeline(parent context.Context, host, port string) *connectPipeline {
+	transcript := transcripts.start(sessionLog(parent).ID(), net.JoinHostPort(host, port))
+	ctx, cancel := context.WithCancel(withTranscript(parent, transcript))
+	pipeline := &connectPipeline{ctx: ctx, cancel: cancel, dns: startDNSStage(ctx, host), transcript: transcript}
+
+	// Until the ClientHello arrives, the CONNECT host is our best guess at the SNI
+	dest := p.routed(ctx, Destination{Host: host, Port: port, SNI: host, resolver: pipeline.dns})
+	pipeline.prepared = p.strategies.Prepare(ctx, dest)
+	return pipeline
+}
+
+// Destination completes dest with the pipeline's shared stages.
+func (c *connectPipeline) Destination(dest Destination) Destination {
+	dest.resolver = c.dns
+	dest.prepared = c.prepared
+	return dest
+}
+
+// Close cancels outstanding stages and releases unused connections, and
+// writes the tunnel's transcript if it's kept.
+func (c *connectPipeline) Close() {
+	c.cancel()
+	if c.prepared != nil {
+		c.prepared.discard()
+	}
+	c.transcript.finish()
+}
+
+// takePrepared returns the connection strategy prepared for d, or nil when
+// none was prepared or it was prepared for a different target or SNI.
+func (d Destination) takePrepared(ctx context.Context, strategy string) (net.Conn, error) {
+	p := d.prepared
+	if p == nil || p.strategy != strategy || p.dest.Addr() != d.Addr() || p.dest.SNI != d.SNI {
+		return nil, nil
+	}
+	conn, err := p.take(ctx)
+	if conn != nil && d.Affinity != "" && conn.RemoteAddr().String() != d.Affinity {
+		// Resuming the session needs the address that issued it
+		conn.Close()
+		return nil, nil
+	}
+	if conn != nil {
+		sessionLog(ctx).Printf("🔹 Using connection prepared by %s while the ClientHello was read", strategy)
+	}
+	return conn, err
+}
+
+// dialDestination dials d over TCP, using the pipeline's DNS result when
+// available and trying each resolved address in turn, d.Affinity first.
+// Destinations behind an upstream proxy are dialed by name, which the
+// proxy resolves.
+func dialDestination(ctx context.Context, d Destination) (net.Conn, error) {
+	if upstream.Proxies(d.Addr()) {
+		return upstream.DialContext(ctx, &net.Dialer{}, d.Addr())
+	}
+	dialer := connTuner.Dialer(&net.Dialer{}, d.Addr())
+	if d.pinned != nil {
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.pinned.String(), d.Port))
+	}
+	if d.Affinity != "" {
+		conn, err := dialer.DialContext(ctx, "tcp", d.Affinity)
+		if err == nil {
+			sessionLog(ctx).Printf("🔹 Dialed %s, which issued the session the ClientHello resumes", d.Affinity)
+			return conn, nil
+		}
+	}
+	if d.resolver == nil {
+		return dialer.DialContext(ctx, "tcp", d.Addr())
+	}
+	ips, err := d.resolver.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), d.Port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no addresses", Name: d.Host, IsNotFound: true}
+	}
+	return nil, lastErr
+}
+
+// pipeTunnel returns the client end of an in-memory pipe whose other end
+// goes through a tunnel to host:port like a browser's, for connections the
+// proxy makes itself. The tunnel starts with the first ClientHello written
+// to the pipe and logs to ctx's session logger.
+func (p *TLSProxy) pipeTunnel(ctx context.Context, host, port string) net.Conn {
+	conn, tunnelEnd := net.Pipe()
+	go func() {
+		defer tunnelEnd.Close()
+		clientHello, err := readClientHello(tunnelEnd, timeouts.handshake)
+		if err != nil {
+			return
+		}
+		pipeline := p.startPipeline(ctx, host, port)
+		defer pipeline.Close()
+		p.tunnel(ctx, tunnelEnd, pipeline, host, port, host, clientHello)
+	}()
+	return conn
+}
+
+// dialTLSTunnel connects to addr over TLS through a tunnel like a browser's,
+// for requests the proxy makes itself, which still get the configured
+// strategies. The tunnel logs with kind naming its purpose.
+func (p *TLSProxy) dialTLSTunnel(ctx context.Context, addr, kind string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := p.pipeTunnel(withSessionLogger(context.Background(),
+		newSessionLogger().Redacting(sensitiveSNI, host).With(kind, host, "dest", destHash(host))), host, port)
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host, NextProtos: []string{"http/1.1"}, KeyLogWriter: keyLog})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
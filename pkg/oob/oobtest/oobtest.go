@@ -0,0 +1,287 @@
+// Package oobtest runs a fake sultry relay for integration tests of
+// programs that talk to one, so they can be tested without building and
+// configuring the real server, or reaching real targets through it.
+//
+// The fake speaks the parts of the OOB protocol a client needs to get
+// started and to conceal a SNI with the oob strategy: it exchanges
+// capabilities, answers pings and heartbeats, and resolves hosts for
+// /create_connection from a script instead of connecting to them. Every
+// endpoint can be made slow, fail with a status or a structured error, or
+// drop the connection, and the requests it got can be inspected afterwards:
+//
+//	relay := oobtest.NewServer()
+//	defer relay.Close()
+//	relay.Resolve("example.com", "127.0.0.1", "8443")
+//	relay.Script("/create_connection", oobtest.Response{Delay: 2 * time.Second, Drop: true})
+//
+//	// Point the client's oob_channels at relay.Host and relay.Port, then
+//	// check what it sent:
+//	for _, req := range relay.Requests() { ... }
+//
+// Capabilities it doesn't implement, like the handshake relay, mux and
+// cover, aren't announced, so clients don't try them.
+package oobtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProtocolVersion is the version of the OOB protocol the fake announces.
+const ProtocolVersion = 2
+
+// Response is a scripted answer to one request.
+type Response struct {
+	Status int           // HTTP status (default: 200)
+	Body   string        // Sent as it is, unless Code is set
+	Code   string        // Answers with a structured error of this code and Body as its message, e.g. "target_certificate"
+	Delay  time.Duration // Waited before answering, on top of the server's latency
+	Drop   bool          // Close the connection without answering
+}
+
+// Request is a request the fake received.
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+	Time   time.Time
+}
+
+// Server is a fake relay listening on a local port.
+type Server struct {
+	URL  string // Base URL of the OOB API, e.g. http://127.0.0.1:40123
+	Host string // Address and port to put in oob_channels
+	Port int
+
+	srv *httptest.Server
+
+	mu           sync.Mutex
+	capabilities []string
+	token        string
+	latency      time.Duration
+	resolutions  map[string]resolution // By host, "*" for any
+	scripts      map[string][]Response // By path, used up in order
+	requests     []Request
+}
+
+// resolution is where a host resolves to.
+type resolution struct {
+	address, port string
+}
+
+// NewServer starts a fake relay announcing the structured_errors
+// capability and resolving no hosts. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		capabilities: []string{"structured_errors"},
+		resolutions:  make(map[string]resolution),
+		scripts:      make(map[string][]Response),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/capabilities", s.handleCapabilities)
+	mux.HandleFunc("/ping", s.handleNoContent)
+	mux.HandleFunc("/heartbeat", s.handleNoContent)
+	mux.HandleFunc("/create_connection", s.handleCreateConnection)
+	s.srv = httptest.NewServer(s.wrap(mux))
+
+	addr := s.srv.Listener.Addr().(*net.TCPAddr)
+	s.URL, s.Host, s.Port = s.srv.URL, addr.IP.String(), addr.Port
+	return s
+}
+
+// Close shuts the server down, dropping connections still open.
+func (s *Server) Close() {
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+}
+
+// Addr returns the host:port of the server.
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// SetCapabilities replaces the capabilities the server announces.
+func (s *Server) SetCapabilities(capabilities ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capabilities = capabilities
+}
+
+// RequireToken has the server refuse requests without the bearer token,
+// as a relay with auth.tokens does. An empty token accepts any request.
+func (s *Server) RequireToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+}
+
+// SetLatency delays every answer by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Resolve has /create_connection answer requests for host with address and
+// port, as if the relay had connected to the target there. A port of ""
+// answers with the port asked for; host "*" resolves any host without a
+// resolution of its own. Hosts that don't resolve get a 500, as targets
+// the relay can't connect to do.
+func (s *Server) Resolve(host, address, port string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resolutions[strings.ToLower(host)] = resolution{address, port}
+}
+
+// Script queues responses for the next requests to path, one per request.
+// Once they are used up, path is answered as usual again.
+func (s *Server) Script(path string, responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[path] = append(s.scripts[path], responses...)
+}
+
+// Requests returns the requests received so far, in order.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// RequestsTo returns the requests to path received so far, in order.
+func (s *Server) RequestsTo(path string) []Request {
+	var matching []Request
+	for _, req := range s.Requests() {
+		if req.Path == path {
+			matching = append(matching, req)
+		}
+	}
+	return matching
+}
+
+// wrap records every request, checks its token and applies the latency
+// and any scripted response before next answers it.
+func (s *Server) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		s.mu.Lock()
+		s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: body, Time: time.Now()})
+		token, latency := s.token, s.latency
+		var scripted *Response
+		if queue := s.scripts[r.URL.Path]; len(queue) > 0 {
+			scripted = &queue[0]
+			s.scripts[r.URL.Path] = queue[1:]
+		}
+		s.mu.Unlock()
+
+		time.Sleep(latency)
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sultry"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if scripted != nil {
+			s.respond(w, *scripted)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// respond answers with a scripted response.
+func (s *Server) respond(w http.ResponseWriter, resp Response) {
+	time.Sleep(resp.Delay)
+	if resp.Drop {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if resp.Code != "" {
+		writeJSON(w, status, struct {
+			Code  string `json:"code"`
+			Error string `json:"error"`
+		}{resp.Code, resp.Body})
+		return
+	}
+	w.WriteHeader(status)
+	fmt.Fprint(w, resp.Body)
+}
+
+func (s *Server) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	capabilities := append([]string{}, s.capabilities...)
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, struct {
+		Protocol     int      `json:"protocol"`
+		Version      string   `json:"version"`
+		Capabilities []string `json:"capabilities"`
+	}{ProtocolVersion, "oobtest", capabilities})
+}
+
+func (s *Server) handleNoContent(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleCreateConnection(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SessionID string `json:"session_id"`
+		SNI       string `json:"sni"`
+		Port      string `json:"port"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.SessionID == "" || req.SNI == "" {
+		http.Error(w, "Session ID and SNI are required", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	res, ok := s.resolutions[strings.ToLower(req.SNI)]
+	if !ok {
+		res, ok = s.resolutions["*"]
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("Failed to connect to target: no resolution for %s", req.SNI), http.StatusInternalServerError)
+		return
+	}
+	port := res.port
+	if port == "" {
+		if port = req.Port; port == "" {
+			port = "443"
+		}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Status  string `json:"status"`
+		Address string `json:"address"`
+		Port    string `json:"port"`
+	}{"ok", res.address, port})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
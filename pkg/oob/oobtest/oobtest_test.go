@@ -0,0 +1,199 @@
+package oobtest_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"sultry/pkg/oob/oobtest"
+)
+
+// post sends body to path on relay, returning the status and body of the
+// answer.
+func post(t *testing.T, relay *oobtest.Server, path, body string, header http.Header) (int, string, error) {
+	t.Helper()
+	req, err := http.NewRequest("POST", relay.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, strings.TrimSpace(string(answer)), nil
+}
+
+func TestResolve(t *testing.T) {
+	relay := oobtest.NewServer()
+	defer relay.Close()
+	relay.Resolve("Example.com", "127.0.0.1", "8443")
+	relay.Resolve("any.port", "127.0.0.2", "")
+
+	tests := []struct {
+		name    string
+		request string
+		status  int
+		address string
+		port    string
+	}{
+		{"resolved", `{"session_id":"1","sni":"example.com"}`, 200, "127.0.0.1", "8443"},
+		{"case-insensitive", `{"session_id":"2","sni":"EXAMPLE.COM","port":"443"}`, 200, "127.0.0.1", "8443"},
+		{"port asked for", `{"session_id":"3","sni":"any.port","port":"8080"}`, 200, "127.0.0.2", "8080"},
+		{"default port", `{"session_id":"4","sni":"any.port"}`, 200, "127.0.0.2", "443"},
+		{"unresolved", `{"session_id":"5","sni":"example.org"}`, 500, "", ""},
+		{"without session", `{"sni":"example.com"}`, 400, "", ""},
+		{"malformed", `{`, 400, "", ""},
+	}
+	for _, tt := range tests {
+		status, body, err := post(t, relay, "/create_connection", tt.request, nil)
+		if err != nil || status != tt.status {
+			t.Errorf("%s: status = %d, %v, want %d", tt.name, status, err, tt.status)
+			continue
+		}
+		if status != 200 {
+			continue
+		}
+		var resp struct{ Address, Port string }
+		if err := json.Unmarshal([]byte(body), &resp); err != nil || resp.Address != tt.address || resp.Port != tt.port {
+			t.Errorf("%s: resolved to %s:%s (%v), want %s:%s", tt.name, resp.Address, resp.Port, err, tt.address, tt.port)
+		}
+	}
+
+	relay.Resolve("*", "127.0.0.3", "")
+	if _, body, _ := post(t, relay, "/create_connection", `{"session_id":"6","sni":"example.org"}`, nil); !strings.Contains(body, "127.0.0.3") {
+		t.Errorf("host without a resolution of its own: %s, want the wildcard's address", body)
+	}
+	if got := len(relay.RequestsTo("/create_connection")); got != len(tests)+1 {
+		t.Errorf("recorded %d requests to /create_connection, want %d", got, len(tests)+1)
+	}
+}
+
+func TestScript(t *testing.T) {
+	relay := oobtest.NewServer()
+	defer relay.Close()
+	relay.Resolve("*", "127.0.0.1", "")
+	relay.Script("/create_connection",
+		oobtest.Response{Status: http.StatusBadGateway, Body: "upstream down"},
+		oobtest.Response{Status: http.StatusBadGateway, Code: "target_certificate", Body: "pin mismatch"},
+		oobtest.Response{Drop: true},
+		oobtest.Response{Delay: 50 * time.Millisecond, Body: "late"},
+	)
+
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		err    bool
+	}{
+		{"status", 502, "upstream down", false},
+		{"structured error", 502, `{"code":"target_certificate","error":"pin mismatch"}`, false},
+		{"dropped", 0, "", true},
+		{"delayed", 200, "late", false},
+		{"used up", 200, `{"status":"ok","address":"127.0.0.1","port":"443"}`, false},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		status, body, err := post(t, relay, "/create_connection", `{"session_id":"1","sni":"example.com"}`, nil)
+		if (err != nil) != tt.err || status != tt.status || body != tt.body {
+			t.Errorf("%s: got %d %q, %v", tt.name, status, body, err)
+		}
+		if tt.name == "delayed" && time.Since(start) < 50*time.Millisecond {
+			t.Errorf("delayed: answered after %v", time.Since(start))
+		}
+	}
+
+	// Scripts only apply to their path
+	relay.Script("/ping", oobtest.Response{Status: http.StatusServiceUnavailable})
+	if status, _, _ := post(t, relay, "/heartbeat", "", nil); status != http.StatusNoContent {
+		t.Errorf("/heartbeat = %d with a script for /ping", status)
+	}
+	if status, _, _ := post(t, relay, "/ping", "", nil); status != http.StatusServiceUnavailable {
+		t.Errorf("/ping = %d, want the scripted 503", status)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	relay := oobtest.NewServer()
+	defer relay.Close()
+	relay.RequireToken("secret")
+
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"without token", nil, http.StatusUnauthorized},
+		{"wrong token", http.Header{"Authorization": {"Bearer guess"}}, http.StatusUnauthorized},
+		{"token", http.Header{"Authorization": {"Bearer secret"}}, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if status, _, err := post(t, relay, "/ping", "", tt.header); err != nil || status != tt.status {
+			t.Errorf("%s: status = %d, %v, want %d", tt.name, status, err, tt.status)
+		}
+	}
+
+	// Refused requests are recorded too, and no token accepts anything again
+	if got := len(relay.Requests()); got != len(tests) {
+		t.Errorf("recorded %d requests, want %d", got, len(tests))
+	}
+	relay.RequireToken("")
+	if status, _, _ := post(t, relay, "/ping", "", nil); status != http.StatusNoContent {
+		t.Errorf("without a required token: status = %d", status)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	relay := oobtest.NewServer()
+	defer relay.Close()
+	relay.SetCapabilities("structured_errors", "events")
+
+	resp, err := http.Get(relay.URL + "/capabilities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var caps struct {
+		Protocol     int
+		Capabilities []string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&caps); err != nil {
+		t.Fatal(err)
+	}
+	if caps.Protocol != oobtest.ProtocolVersion || fmt.Sprint(caps.Capabilities) != "[structured_errors events]" {
+		t.Errorf("capabilities = %+v", caps)
+	}
+}
+
+func Example() {
+	relay := oobtest.NewServer()
+	defer relay.Close()
+	relay.Resolve("example.com", "127.0.0.1", "8443")
+	relay.Script("/create_connection", oobtest.Response{Status: http.StatusInternalServerError, Body: "busy"})
+
+	// A client's first attempt fails, its retry resolves the host
+	for range 2 {
+		resp, err := http.Post(relay.URL+"/create_connection", "application/json",
+			strings.NewReader(`{"session_id":"1","sni":"example.com"}`))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		fmt.Println(resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	fmt.Println(len(relay.RequestsTo("/create_connection")), "requests")
+	// Output:
+	// 500 busy
+	// 200 {"status":"ok","address":"127.0.0.1","port":"8443"}
+	// 2 requests
+}
@@ -0,0 +1,118 @@
+package tls
+
+import "fmt"
+
+// Alert levels.
+const (
+	AlertLevelWarning uint8 = 1
+	AlertLevelFatal   uint8 = 2
+)
+
+// Alert descriptions (RFC 8446 section 6).
+const (
+	AlertCloseNotify                  uint8 = 0
+	AlertUnexpectedMessage            uint8 = 10
+	AlertBadRecordMAC                 uint8 = 20
+	AlertRecordOverflow               uint8 = 22
+	AlertHandshakeFailure             uint8 = 40
+	AlertBadCertificate               uint8 = 42
+	AlertUnsupportedCertificate       uint8 = 43
+	AlertCertificateRevoked           uint8 = 44
+	AlertCertificateExpired           uint8 = 45
+	AlertCertificateUnknown           uint8 = 46
+	AlertIllegalParameter             uint8 = 47
+	AlertUnknownCA                    uint8 = 48
+	AlertAccessDenied                 uint8 = 49
+	AlertDecodeError                  uint8 = 50
+	AlertDecryptError                 uint8 = 51
+	AlertProtocolVersion              uint8 = 70
+	AlertInsufficientSecurity         uint8 = 71
+	AlertInternalError                uint8 = 80
+	AlertInappropriateFallback        uint8 = 86
+	AlertUserCanceled                 uint8 = 90
+	AlertNoRenegotiation              uint8 = 100
+	AlertMissingExtension             uint8 = 109
+	AlertUnsupportedExtension         uint8 = 110
+	AlertUnrecognizedName             uint8 = 112
+	AlertBadCertificateStatusResponse uint8 = 113
+	AlertUnknownPSKIdentity           uint8 = 115
+	AlertCertificateRequired          uint8 = 116
+	AlertNoApplicationProtocol        uint8 = 120
+)
+
+var alertNames = map[uint8]string{
+	AlertCloseNotify:                  "close_notify",
+	AlertUnexpectedMessage:            "unexpected_message",
+	AlertBadRecordMAC:                 "bad_record_mac",
+	AlertRecordOverflow:               "record_overflow",
+	AlertHandshakeFailure:             "handshake_failure",
+	AlertBadCertificate:               "bad_certificate",
+	AlertUnsupportedCertificate:       "unsupported_certificate",
+	AlertCertificateRevoked:           "certificate_revoked",
+	AlertCertificateExpired:           "certificate_expired",
+	AlertCertificateUnknown:           "certificate_unknown",
+	AlertIllegalParameter:             "illegal_parameter",
+	AlertUnknownCA:                    "unknown_ca",
+	AlertAccessDenied:                 "access_denied",
+	AlertDecodeError:                  "decode_error",
+	AlertDecryptError:                 "decrypt_error",
+	AlertProtocolVersion:              "protocol_version",
+	AlertInsufficientSecurity:         "insufficient_security",
+	AlertInternalError:                "internal_error",
+	AlertInappropriateFallback:        "inappropriate_fallback",
+	AlertUserCanceled:                 "user_canceled",
+	AlertNoRenegotiation:              "no_renegotiation",
+	AlertMissingExtension:             "missing_extension",
+	AlertUnsupportedExtension:         "unsupported_extension",
+	AlertUnrecognizedName:             "unrecognized_name",
+	AlertBadCertificateStatusResponse: "bad_certificate_status_response",
+	AlertUnknownPSKIdentity:           "unknown_psk_identity",
+	AlertCertificateRequired:          "certificate_required",
+	AlertNoApplicationProtocol:        "no_application_protocol",
+}
+
+// Alert is a TLS alert sent in the clear, before the handshake has
+// established keys. Later alerts are encrypted like any other record.
+type Alert struct {
+	Level       uint8
+	Description uint8
+}
+
+// Name returns the name of the alert's description, e.g. "unrecognized_name".
+func (a Alert) Name() string {
+	if name, ok := alertNames[a.Description]; ok {
+		return name
+	}
+	return fmt.Sprintf("alert %d", a.Description)
+}
+
+// Fatal reports whether the alert ends the connection with an error.
+func (a Alert) Fatal() bool {
+	return a.Level != AlertLevelWarning
+}
+
+func (a Alert) String() string {
+	level := "fatal"
+	if a.Level == AlertLevelWarning {
+		level = "warning"
+	}
+	return level + " alert " + a.Name()
+}
+
+// ParseAlert decodes the first record of data if it's an alert sent in the
+// clear, reporting false otherwise.
+func ParseAlert(data []byte) (Alert, bool) {
+	if len(data) < HeaderLen+2 || data[0] != RecordAlert || data[1] != 3 {
+		return Alert{}, false
+	}
+	if length := int(data[3])<<8 | int(data[4]); length != 2 {
+		return Alert{}, false // Encrypted
+	}
+	return Alert{Level: data[5], Description: data[6]}, true
+}
+
+// Alert returns the alert r carries if it's an alert record sent in the
+// clear, reporting false otherwise.
+func (r Record) Alert() (Alert, bool) {
+	return ParseAlert(r.Raw)
+}
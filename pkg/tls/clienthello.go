@@ -0,0 +1,122 @@
+package tls
+
+import (
+	"errors"
+	"fmt"
+)
+
+// extensionServerName is the server_name extension of client hellos.
+const extensionServerName uint16 = 0
+
+// errTruncatedClientHello is returned for ClientHellos shorter than their
+// lengths say.
+var errTruncatedClientHello = errors.New("truncated ClientHello")
+
+// ErrUnexpectedClientHello is returned for a ClientHello the handshake
+// doesn't allow: one that doesn't answer a HelloRetryRequest, or an answer
+// naming another server than the first ClientHello.
+var ErrUnexpectedClientHello = errors.New("unexpected ClientHello")
+
+// ClientHello is what a relay needs from a client's hello.
+type ClientHello struct {
+	LegacyVersion     uint16 // client_version, the highest version offered before TLS 1.3
+	SessionID         []byte
+	ServerName        string   // From server_name, "" without one
+	ALPN              []string // Offered application protocols, nil without the extension
+	SupportedVersions []uint16 // From supported_versions, nil without the extension
+}
+
+// MaxVersion returns the highest version the client offers: the highest in
+// supported_versions, GREASE values aside, or client_version without it.
+func (h *ClientHello) MaxVersion() uint16 {
+	if h.SupportedVersions == nil {
+		return h.LegacyVersion
+	}
+	var max uint16
+	for _, v := range h.SupportedVersions {
+		if v&0x0f0f != 0x0a0a && v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// ParseClientHello parses the ClientHello at the start of data, the records
+// a client sent first. The message may span several handshake records.
+func ParseClientHello(data []byte) (*ClientHello, error) {
+	message := firstHandshakeMessage(data)
+	if len(message) < 4 {
+		return nil, errTruncatedClientHello
+	}
+	if message[0] != HandshakeClientHello {
+		return nil, fmt.Errorf("handshake message type %d is not a ClientHello", message[0])
+	}
+	return parseClientHelloBody(message[4:])
+}
+
+func parseClientHelloBody(body []byte) (*ClientHello, error) {
+	s := reader(body)
+	version, ok := s.uint16()
+	_, ok1 := s.bytes(32) // Random
+	sessionID, ok2 := s.vector8()
+	_, ok3 := s.vector16() // Cipher suites
+	_, ok4 := s.vector8()  // Compression methods
+	if !(ok && ok1 && ok2 && ok3 && ok4) {
+		return nil, errTruncatedClientHello
+	}
+	hello := &ClientHello{LegacyVersion: version, SessionID: sessionID}
+	if len(s) == 0 {
+		return hello, nil // No extensions
+	}
+
+	extensions, ok := s.vector16()
+	if !ok {
+		return nil, errTruncatedClientHello
+	}
+	for len(extensions) > 0 {
+		extType, ok := extensions.uint16()
+		data, ok2 := extensions.vector16()
+		if !(ok && ok2) {
+			return nil, errTruncatedClientHello
+		}
+		switch extType {
+		case extensionServerName:
+			list, ok := data.vector16()
+			for ok && len(list) > 0 {
+				nameType, ok2 := list.bytes(1)
+				name, ok3 := list.vector16()
+				if !(ok2 && ok3) {
+					return nil, errors.New("malformed server_name extension in ClientHello")
+				}
+				if nameType[0] == 0 { // host_name
+					hello.ServerName = string(name)
+					break
+				}
+			}
+		case extensionALPN:
+			list, ok := data.vector16()
+			if !ok {
+				return nil, errors.New("malformed ALPN extension in ClientHello")
+			}
+			hello.ALPN = []string{}
+			for len(list) > 0 {
+				protocol, ok := list.vector8()
+				if !ok {
+					return nil, errors.New("malformed ALPN extension in ClientHello")
+				}
+				hello.ALPN = append(hello.ALPN, string(protocol))
+			}
+		case extensionSupportedVersions:
+			list, ok := data.vector8()
+			if !ok || len(list)%2 != 0 {
+				return nil, errors.New("malformed supported_versions extension in ClientHello")
+			}
+			hello.SupportedVersions = []uint16{}
+			for len(list) > 0 {
+				v, _ := list.uint16()
+				hello.SupportedVersions = append(hello.SupportedVersions, v)
+			}
+		}
+	}
+	return hello, nil
+}
@@ -0,0 +1,136 @@
+package tls
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// captureClientHello returns the first flight crypto/tls sends with config.
+func captureClientHello(t testing.TB, config *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+	var records Reassembler
+	var hello []byte
+	buffer := make([]byte, 4096)
+	for {
+		n, err := server.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		complete, _ := records.Feed(buffer[:n])
+		for _, record := range complete {
+			hello = append(hello, record.Raw...)
+		}
+		if len(complete) > 0 {
+			return hello
+		}
+	}
+}
+
+// splitHello moves the handshake message of a single-record hello into
+// records of at most size bytes each.
+func splitHello(hello []byte, size int) []byte {
+	message := hello[HeaderLen:]
+	var split []byte
+	for len(message) > 0 {
+		n := min(size, len(message))
+		split = append(split, RecordHandshake, hello[1], hello[2])
+		split = binary.BigEndian.AppendUint16(split, uint16(n))
+		split = append(split, message[:n]...)
+		message = message[n:]
+	}
+	return split
+}
+
+func TestParseClientHello(t *testing.T) {
+	modern := captureClientHello(t, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+	tls12 := captureClientHello(t, &tls.Config{ServerName: "Example.ORG", MaxVersion: tls.VersionTLS12})
+	noSNI := captureClientHello(t, &tls.Config{InsecureSkipVerify: true})
+
+	tests := []struct {
+		name       string
+		data       []byte
+		serverName string
+		alpn       []string
+		maxVersion uint16
+		err        bool
+	}{
+		{"TLS 1.3 with ALPN", modern, "example.com", []string{"h2", "http/1.1"}, VersionTLS13, false},
+		{"TLS 1.2 only", tls12, "Example.ORG", nil, VersionTLS12, false},
+		{"without server_name", noSNI, "", nil, VersionTLS13, false},
+		{"spanning records", splitHello(modern, 64), "example.com", []string{"h2", "http/1.1"}, VersionTLS13, false},
+		{"truncated", modern[:60], "", nil, 0, true},
+		{"truncated in extensions", modern[:len(modern)-20], "", nil, 0, true},
+		{"not a ClientHello", []byte{RecordHandshake, 3, 3, 0, 4, HandshakeServerHello, 0, 0, 0}, "", nil, 0, true},
+		{"empty", nil, "", nil, 0, true},
+	}
+	for _, tt := range tests {
+		hello, err := ParseClientHello(tt.data)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: parsed %+v", tt.name, hello)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if hello.ServerName != tt.serverName || fmt.Sprint(hello.ALPN) != fmt.Sprint(tt.alpn) ||
+			hello.MaxVersion() != tt.maxVersion {
+			t.Errorf("%s: server name %q, ALPN %q, max version %#04x", tt.name, hello.ServerName, hello.ALPN,
+				hello.MaxVersion())
+		}
+	}
+}
+
+func TestClientHelloMaxVersion(t *testing.T) {
+	tests := []struct {
+		hello ClientHello
+		want  uint16
+	}{
+		{ClientHello{LegacyVersion: VersionTLS12}, VersionTLS12},
+		{ClientHello{LegacyVersion: VersionTLS12, SupportedVersions: []uint16{VersionTLS13, VersionTLS12}}, VersionTLS13},
+		{ClientHello{LegacyVersion: VersionTLS12, SupportedVersions: []uint16{0x7a7a, VersionTLS12}}, VersionTLS12}, // GREASE
+		{ClientHello{LegacyVersion: VersionTLS12, SupportedVersions: []uint16{}}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.hello.MaxVersion(); got != tt.want {
+			t.Errorf("MaxVersion of %v = %#04x, want %#04x", tt.hello.SupportedVersions, got, tt.want)
+		}
+	}
+}
+
+func TestHandshakeRejectsSecondClientHello(t *testing.T) {
+	hello := captureClientHello(t, &tls.Config{ServerName: "example.com"})
+	var h Handshake
+	if err := h.FromClient(hello); err != nil {
+		t.Fatal(err)
+	}
+	if h.ClientHello().ServerName != "example.com" || h.State() != StateClientHello {
+		t.Fatalf("after the ClientHello: %s, %+v", h.State(), h.ClientHello())
+	}
+	if err := h.FromClient(hello); !errors.Is(err, ErrUnexpectedClientHello) || h.State() != StateFailed {
+		t.Errorf("second ClientHello: %v, state %s", err, h.State())
+	}
+}
+
+func BenchmarkParseClientHello(b *testing.B) {
+	hello := captureClientHello(b, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+	b.SetBytes(int64(len(hello)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseClientHello(hello); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package tls
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// HandshakeState is how far a handshake has got, as far as a relay can
+// tell from the records passing through it.
+type HandshakeState int
+
+const (
+	StateStart          HandshakeState = iota // Nothing sent yet
+	StateClientHello                          // ClientHello sent, waiting for the ServerHello
+	StateServerHello                          // ServerHello received, the server's flight is on its way
+	StateClientFinished                       // TLS 1.2 client sent its Finished, the server's is outstanding
+	StateComplete                             // Both sides are done, what follows is application data
+	StateFailed                               // An alert or a malformed stream ended the handshake
+)
+
+func (s HandshakeState) String() string {
+	switch s {
+	case StateStart:
+		return "start"
+	case StateClientHello:
+		return "client_hello"
+	case StateServerHello:
+		return "server_hello"
+	case StateClientFinished:
+		return "client_finished"
+	case StateComplete:
+		return "complete"
+	case StateFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("HandshakeState(%d)", int(s))
+}
+
+// maxHandshakeMessageLen bounds a plaintext handshake message, which a
+// certificate chain can make larger than a record.
+const maxHandshakeMessageLen = 1 << 20
+
+// Handshake follows a TLS 1.2 or 1.3 handshake from the records of both
+// directions and tells when it's complete. The zero value is ready to use.
+//
+// A relay can't decrypt anything, so the encrypted parts are recognized by
+// where they are:
+//
+//   - TLS 1.3 encrypts everything after the ServerHello: EncryptedExtensions
+//     through the server's Finished arrive as application data records, and
+//     the client's first application data record after the ServerHello is
+//     its Finished (or the certificate preceding it), which completes the
+//     handshake. Compatibility-mode ChangeCipherSpec records mean nothing.
+//   - TLS 1.2 sends everything in the clear up to each side's
+//     ChangeCipherSpec; the handshake record following it is that side's
+//     Finished. The handshake is complete once both have been sent, in
+//     either order: resumed sessions have the server finish first.
+//
+// A HelloRetryRequest returns the handshake to waiting for a ServerHello,
+// and the ClientHello answering it replaces the first, which it must name
+// the same server as. A second ClientHello without a HelloRetryRequest to
+// answer, or a second HelloRetryRequest, fails the handshake.
+type Handshake struct {
+	client, server direction
+	state          HandshakeState
+	clientHello    *ClientHello
+	awaitingRetry  bool // A HelloRetryRequest was sent, its ClientHello wasn't
+	hello          *ServerHello
+	certificates   [][]byte
+	clientFinished bool
+	serverFinished bool
+	resumed        bool
+	retried        bool
+	err            error
+}
+
+// direction is one side's part of the record stream.
+type direction struct {
+	records Reassembler
+	message []byte // Plaintext handshake bytes not yet parsed into messages
+	ccs     bool   // TLS 1.2 ChangeCipherSpec sent, records are encrypted from here on
+}
+
+// FromClient feeds bytes the client sent, in any chunks.
+func (h *Handshake) FromClient(data []byte) error {
+	return h.feed(&h.client, data, h.clientRecord)
+}
+
+// FromServer feeds bytes the server sent, in any chunks.
+func (h *Handshake) FromServer(data []byte) error {
+	return h.feed(&h.server, data, h.serverRecord)
+}
+
+func (h *Handshake) feed(d *direction, data []byte, handle func(Record) error) error {
+	if h.err != nil || h.state == StateComplete {
+		return h.err
+	}
+	records, err := d.records.Feed(data)
+	for _, record := range records {
+		if h.state == StateComplete || h.state == StateFailed {
+			break
+		}
+		if err := handle(record); err != nil {
+			return h.fail(err)
+		}
+	}
+	if err != nil && h.state != StateComplete {
+		return h.fail(err)
+	}
+	return h.err
+}
+
+func (h *Handshake) fail(err error) error {
+	h.state, h.err = StateFailed, err
+	return err
+}
+
+// negotiated returns the version the ServerHello settled on, or 0 before
+// it or after a HelloRetryRequest.
+func (h *Handshake) negotiated() uint16 {
+	if h.hello == nil || h.hello.HelloRetryRequest {
+		return 0
+	}
+	return h.hello.Version
+}
+
+func (h *Handshake) tls12() bool {
+	return h.negotiated() != 0 && h.negotiated() < VersionTLS13
+}
+
+func (h *Handshake) tls13() bool {
+	return h.negotiated() >= VersionTLS13
+}
+
+func (h *Handshake) clientRecord(r Record) error {
+	switch r.Type {
+	case RecordAlert:
+		if !h.client.warning(r) {
+			return errors.New("client sent an alert during the handshake")
+		}
+	case RecordChangeCipherSpec:
+		if h.tls12() {
+			h.client.ccs = true
+		}
+	case RecordApplicationData:
+		if h.tls13() {
+			h.state = StateComplete
+		}
+	case RecordHandshake:
+		if h.client.ccs {
+			h.clientFinished = true
+			h.state = StateClientFinished
+			h.checkComplete()
+			return nil
+		}
+		return h.client.messages(r.Payload, func(msgType uint8, body []byte) error {
+			if msgType != HandshakeClientHello {
+				return nil
+			}
+			hello, err := parseClientHelloBody(body)
+			if err != nil {
+				return err
+			}
+			if h.clientHello != nil {
+				if !h.awaitingRetry {
+					return fmt.Errorf("%w: no HelloRetryRequest to answer", ErrUnexpectedClientHello)
+				}
+				if hello.ServerName != h.clientHello.ServerName {
+					return fmt.Errorf("%w: names %q after a HelloRetryRequest, not %q", ErrUnexpectedClientHello,
+						hello.ServerName, h.clientHello.ServerName)
+				}
+			}
+			h.clientHello, h.awaitingRetry = hello, false
+			h.state = StateClientHello
+			return nil
+		})
+	}
+	return nil
+}
+
+func (h *Handshake) serverRecord(r Record) error {
+	switch r.Type {
+	case RecordAlert:
+		if !h.server.warning(r) {
+			return errors.New("server sent an alert during the handshake")
+		}
+	case RecordChangeCipherSpec:
+		if h.tls12() {
+			h.server.ccs = true
+		}
+	case RecordHandshake:
+		if h.server.ccs {
+			h.serverFinished = true
+			h.resumed = !h.clientFinished
+			h.checkComplete()
+			return nil
+		}
+		return h.server.messages(r.Payload, func(msgType uint8, body []byte) error {
+			if msgType == HandshakeCertificate {
+				certificates, err := parseCertificateBody(body)
+				h.certificates = certificates
+				return err
+			}
+			if msgType != HandshakeServerHello {
+				return nil
+			}
+			hello, err := parseServerHelloBody(body)
+			if err != nil {
+				return err
+			}
+			if hello.HelloRetryRequest && h.retried {
+				return errors.New("second HelloRetryRequest")
+			}
+			h.hello = hello
+			if hello.HelloRetryRequest {
+				h.retried, h.awaitingRetry = true, true
+				h.state = StateClientHello
+			} else {
+				h.state = StateServerHello
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+func (h *Handshake) checkComplete() {
+	if h.clientFinished && h.serverFinished {
+		h.state = StateComplete
+	}
+}
+
+// warning reports whether r is a plaintext warning alert other than
+// close_notify, such as the unrecognized_name warning TLS 1.2 servers send
+// before carrying on.
+func (d *direction) warning(r Record) bool {
+	return !d.ccs && len(r.Payload) == 2 && r.Payload[0] == 1 && r.Payload[1] != 0
+}
+
+// messages appends a plaintext handshake record's payload and calls handle
+// for every message it completes.
+func (d *direction) messages(payload []byte, handle func(msgType uint8, body []byte) error) error {
+	d.message = append(d.message, payload...)
+	for len(d.message) >= 4 {
+		length := int(d.message[1])<<16 | int(binary.BigEndian.Uint16(d.message[2:4]))
+		if length > maxHandshakeMessageLen {
+			return fmt.Errorf("handshake message of %d bytes", length)
+		}
+		if len(d.message) < 4+length {
+			break
+		}
+		if err := handle(d.message[0], d.message[4:4+length]); err != nil {
+			return err
+		}
+		d.message = d.message[4+length:]
+	}
+	return nil
+}
+
+// State returns how far the handshake has got.
+func (h *Handshake) State() HandshakeState {
+	return h.state
+}
+
+// Complete reports whether both sides finished the handshake.
+func (h *Handshake) Complete() bool {
+	return h.state == StateComplete
+}
+
+// Version returns the negotiated protocol version, or 0 before the
+// ServerHello.
+func (h *Handshake) Version() uint16 {
+	return h.negotiated()
+}
+
+// ClientHello returns the client's ClientHello, the one answering the
+// HelloRetryRequest if there was one, or nil before it was sent.
+func (h *Handshake) ClientHello() *ClientHello {
+	return h.clientHello
+}
+
+// ServerHello returns the server's ServerHello, or nil before it arrived.
+func (h *Handshake) ServerHello() *ServerHello {
+	return h.hello
+}
+
+// Certificates returns the DER certificate chain the server sent, leaf
+// first. Only TLS 1.2 and earlier send it in the clear, so it's nil for TLS
+// 1.3, resumed sessions, and before the Certificate message arrived.
+func (h *Handshake) Certificates() [][]byte {
+	return h.certificates
+}
+
+// Resumed reports whether a TLS 1.2 session was resumed, which is when the
+// server finishes first.
+func (h *Handshake) Resumed() bool {
+	return h.resumed
+}
+
+// Retried reports whether the server sent a HelloRetryRequest.
+func (h *Handshake) Retried() bool {
+	return h.retried
+}
+
+// Err returns why the handshake failed, if it did.
+func (h *Handshake) Err() error {
+	return h.err
+}
+
+// parseCertificateBody parses a TLS 1.2 Certificate message: a list of DER
+// certificates, each with a 24-bit length.
+func parseCertificateBody(body []byte) ([][]byte, error) {
+	s := reader(body)
+	list, ok := s.vector24()
+	if !ok {
+		return nil, errors.New("truncated Certificate message")
+	}
+	var certificates [][]byte
+	for len(list) > 0 {
+		certificate, ok := list.vector24()
+		if !ok {
+			return nil, errors.New("truncated certificate in Certificate message")
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
@@ -0,0 +1,126 @@
+// Package tls parses the TLS record layer for relays, which pass records
+// through unmodified but must never split or merge them on their way.
+package tls
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Record content types.
+const (
+	RecordChangeCipherSpec uint8 = 20
+	RecordAlert            uint8 = 21
+	RecordHandshake        uint8 = 22
+	RecordApplicationData  uint8 = 23
+	RecordHeartbeat        uint8 = 24
+)
+
+const (
+	// HeaderLen is the length of a record header: type, version, length.
+	HeaderLen = 5
+
+	// MaxRecordLen is the longest payload a record may carry: 2^14 bytes of
+	// plaintext plus the 2048 bytes TLS 1.2 allows for encryption overhead.
+	MaxRecordLen = 16384 + 2048
+)
+
+// ErrNotTLS is returned once the stream stops looking like TLS records.
+var ErrNotTLS = errors.New("not a TLS record stream")
+
+// Record is one whole TLS record.
+type Record struct {
+	Type    uint8
+	Version uint16
+	Payload []byte
+	Raw     []byte // Header and payload, as they were read
+}
+
+// Reassembler turns the chunks a connection is read in into whole records.
+// The zero value is ready to use.
+type Reassembler struct {
+	buf []byte
+	err error
+}
+
+// Feed appends data, which the Reassembler copies, and returns the records
+// completed by it. Records belong to the caller and stay valid after later
+// calls. A partial record stays buffered until the rest of it is fed.
+//
+// When the stream turns out not to be TLS, the records before the offending
+// header are returned along with an error wrapping ErrNotTLS; the bytes from
+// that header on are available from Rest, and every later call fails with
+// the same error.
+func (r *Reassembler) Feed(data []byte) ([]Record, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	r.buf = append(r.buf, data...)
+
+	var ends []int
+	n := 0
+	for len(r.buf)-n >= HeaderLen {
+		header := r.buf[n : n+HeaderLen]
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		if err := checkHeader(header, length); err != nil {
+			r.err = err
+			break
+		}
+		if len(r.buf)-n < HeaderLen+length {
+			break
+		}
+		n += HeaderLen + length
+		ends = append(ends, n)
+	}
+	if n == 0 {
+		return nil, r.err
+	}
+
+	// One allocation for all complete records, the rest moves to the front
+	whole := make([]byte, n)
+	copy(whole, r.buf[:n])
+	r.buf = append(r.buf[:0], r.buf[n:]...)
+
+	records := make([]Record, len(ends))
+	start := 0
+	for i, end := range ends {
+		raw := whole[start:end]
+		records[i] = Record{
+			Type:    raw[0],
+			Version: binary.BigEndian.Uint16(raw[1:3]),
+			Payload: raw[HeaderLen:],
+			Raw:     raw,
+		}
+		start = end
+	}
+	return records, r.err
+}
+
+// Buffered returns the number of bytes held back as part of an incomplete
+// record.
+func (r *Reassembler) Buffered() int {
+	return len(r.buf)
+}
+
+// Rest returns the buffered bytes and empties the buffer, for passing them
+// on when the stream ends or turns out not to be TLS.
+func (r *Reassembler) Rest() []byte {
+	rest := r.buf
+	r.buf = nil
+	return rest
+}
+
+// checkHeader rejects headers that can't start a TLS record.
+func checkHeader(header []byte, length int) error {
+	if header[0] < RecordChangeCipherSpec || header[0] > RecordHeartbeat {
+		return fmt.Errorf("%w: content type %d", ErrNotTLS, header[0])
+	}
+	if header[1] != 3 {
+		return fmt.Errorf("%w: version 0x%02x%02x", ErrNotTLS, header[1], header[2])
+	}
+	if length > MaxRecordLen {
+		return fmt.Errorf("%w: record length %d exceeds %d", ErrNotTLS, length, MaxRecordLen)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package tls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// record returns a record of type typ carrying payload.
+func record(typ uint8, payload []byte) []byte {
+	raw := []byte{typ, 3, 3}
+	raw = binary.BigEndian.AppendUint16(raw, uint16(len(payload)))
+	return append(raw, payload...)
+}
+
+// chunks splits data at the offsets given, in increasing order.
+func chunks(data []byte, offsets ...int) [][]byte {
+	var split [][]byte
+	start := 0
+	for _, offset := range offsets {
+		split = append(split, data[start:offset])
+		start = offset
+	}
+	return append(split, data[start:])
+}
+
+func TestReassembler(t *testing.T) {
+	hello := record(RecordHandshake, bytes.Repeat([]byte{1}, 300))
+	data := record(RecordApplicationData, bytes.Repeat([]byte{2}, 40))
+	alert := record(RecordAlert, []byte{2, 40})
+	stream := bytes.Join([][]byte{hello, data, alert}, nil)
+	byteByByte := make([]int, len(stream)-1)
+	for i := range byteByByte {
+		byteByByte[i] = i + 1
+	}
+
+	tests := []struct {
+		name    string
+		chunks  [][]byte
+		records [][]byte // Completed after each chunk, joined
+		err     error
+	}{
+		{"one record", [][]byte{hello}, [][]byte{hello}, nil},
+		{"several in one chunk", [][]byte{stream}, [][]byte{stream}, nil},
+		{"header split", chunks(hello, 2), [][]byte{nil, hello}, nil},
+		{"payload split", chunks(stream, 100, len(hello)+10), [][]byte{nil, hello, append(data, alert...)}, nil},
+		{"record and a half", chunks(stream, len(hello)+3), [][]byte{hello, append(data, alert...)}, nil},
+		{"byte by byte", chunks(stream, byteByByte...), nil, nil},
+		{"empty record", [][]byte{record(RecordHandshake, nil)}, [][]byte{record(RecordHandshake, nil)}, nil},
+		{"not TLS", [][]byte{append(hello, "GET / HTTP/1.1\r\n"...)}, [][]byte{hello}, ErrNotTLS},
+		{"SSLv2 version", [][]byte{{RecordHandshake, 2, 0, 0, 1, 0}}, [][]byte{nil}, ErrNotTLS},
+		{"oversized", [][]byte{{RecordApplicationData, 3, 3, 0x48, 0x01}}, [][]byte{nil}, ErrNotTLS},
+	}
+	for _, tt := range tests {
+		var r Reassembler
+		var all []byte
+		var err error
+		for i, chunk := range tt.chunks {
+			var records []Record
+			records, err = r.Feed(chunk)
+			var got []byte
+			for _, record := range records {
+				got = append(got, record.Raw...)
+				if !bytes.Equal(record.Raw[HeaderLen:], record.Payload) || record.Type != record.Raw[0] {
+					t.Errorf("%s: record %x has payload %x, type %d", tt.name, record.Raw, record.Payload, record.Type)
+				}
+			}
+			if tt.records != nil && !bytes.Equal(got, tt.records[i]) {
+				t.Errorf("%s: chunk %d completed %d bytes, want %d", tt.name, i, len(got), len(tt.records[i]))
+			}
+			all = append(all, got...)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+		if tt.err != nil {
+			if _, again := r.Feed(record(RecordHandshake, nil)); again != err {
+				t.Errorf("%s: Feed after the error = %v, want the same error", tt.name, again)
+			}
+			continue
+		}
+		if want := bytes.Join(tt.chunks, nil); !bytes.Equal(all, want) || r.Buffered() != 0 {
+			t.Errorf("%s: reassembled %d bytes, %d buffered, want %d", tt.name, len(all), r.Buffered(), len(want))
+		}
+	}
+}
+
+func TestReassemblerRest(t *testing.T) {
+	hello := record(RecordHandshake, []byte("hello"))
+	var r Reassembler
+	records, err := r.Feed(append(hello, "SSH-2.0-OpenSSH\r\n"...))
+	if len(records) != 1 || !errors.Is(err, ErrNotTLS) {
+		t.Fatalf("Feed = %d records, %v", len(records), err)
+	}
+	if rest := string(r.Rest()); rest != "SSH-2.0-OpenSSH\r\n" || r.Buffered() != 0 {
+		t.Errorf("Rest = %q, %d still buffered", rest, r.Buffered())
+	}
+
+	// An incomplete record is left for Rest when the stream ends
+	r = Reassembler{}
+	r.Feed(hello[:7])
+	if r.Buffered() != 7 || !bytes.Equal(r.Rest(), hello[:7]) {
+		t.Error("partial record not returned by Rest")
+	}
+}
+
+func TestReassemblerRecordsStayValid(t *testing.T) {
+	var r Reassembler
+	second := record(RecordApplicationData, []byte("second"))
+	chunk := append(record(RecordApplicationData, []byte("first")), second[:len(second)-3]...)
+	records, _ := r.Feed(chunk)
+	copy(chunk, make([]byte, len(chunk)))
+	r.Feed(second[len(second)-3:])
+	if len(records) != 1 || string(records[0].Payload) != "first" {
+		t.Errorf("records changed by later calls: %q", records)
+	}
+}
+
+func BenchmarkReassembler(b *testing.B) {
+	var stream []byte
+	for i := 0; i < 8; i++ {
+		stream = append(stream, record(RecordApplicationData, bytes.Repeat([]byte{byte(i)}, 16384))...)
+	}
+	for _, size := range []int{1500, 16384, 32768} {
+		b.Run(fmt.Sprintf("reads of %d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(stream)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var r Reassembler
+				for rest := stream; len(rest) > 0; {
+					n := min(size, len(rest))
+					if _, err := r.Feed(rest[:n]); err != nil {
+						b.Fatal(err)
+					}
+					rest = rest[n:]
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package tls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Handshake message types.
+const (
+	HandshakeClientHello uint8 = 1
+	HandshakeServerHello uint8 = 2
+	HandshakeCertificate uint8 = 11
+)
+
+// Protocol versions.
+const (
+	VersionTLS10 uint16 = 0x0301
+	VersionTLS11 uint16 = 0x0302
+	VersionTLS12 uint16 = 0x0303
+	VersionTLS13 uint16 = 0x0304
+)
+
+// Extension types read from hellos.
+const (
+	extensionALPN              uint16 = 16
+	extensionSupportedVersions uint16 = 43
+)
+
+// helloRetryRequestRandom is the random of a ServerHello that is really a
+// HelloRetryRequest (RFC 8446, section 4.1.3).
+var helloRetryRequestRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// errTruncated is returned for messages shorter than their lengths say.
+var errTruncated = errors.New("truncated ServerHello")
+
+// ServerHello is what a relay can learn from a server's first message.
+type ServerHello struct {
+	Version           uint16 // Negotiated version, from supported_versions in TLS 1.3
+	CipherSuite       uint16
+	SessionID         []byte
+	HelloRetryRequest bool
+
+	// ALPN is the negotiated application protocol. TLS 1.3 servers send it
+	// in EncryptedExtensions, out of a relay's sight, so it's only known for
+	// earlier versions; ALPNKnown tells an empty ALPN that was negotiated
+	// away from one that couldn't be seen.
+	ALPN      string
+	ALPNKnown bool
+}
+
+// ParseServerHello parses the ServerHello at the start of data, the records
+// a server sent first. The message may span several handshake records.
+func ParseServerHello(data []byte) (*ServerHello, error) {
+	message := firstHandshakeMessage(data)
+	if len(message) < 4 {
+		return nil, errTruncated
+	}
+	if message[0] != HandshakeServerHello {
+		return nil, fmt.Errorf("handshake message type %d is not a ServerHello", message[0])
+	}
+	return parseServerHelloBody(message[4:])
+}
+
+// firstHandshakeMessage reassembles the handshake message at the start of
+// data from its records, returning what there is of it.
+func firstHandshakeMessage(data []byte) []byte {
+	var message []byte
+	for len(data) >= HeaderLen && data[0] == RecordHandshake {
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < HeaderLen+length {
+			break
+		}
+		message = append(message, data[HeaderLen:HeaderLen+length]...)
+		data = data[HeaderLen+length:]
+		if len(message) >= 4 && len(message) >= 4+(int(message[1])<<16|int(message[2])<<8|int(message[3])) {
+			break
+		}
+	}
+	return message
+}
+
+func parseServerHelloBody(body []byte) (*ServerHello, error) {
+	s := reader(body)
+	version, ok := s.uint16()
+	random, ok2 := s.bytes(32)
+	sessionID, ok3 := s.vector8()
+	suite, ok4 := s.uint16()
+	_, ok5 := s.bytes(1) // Compression method
+	if !(ok && ok2 && ok3 && ok4 && ok5) {
+		return nil, errTruncated
+	}
+	hello := &ServerHello{
+		Version:           version,
+		CipherSuite:       suite,
+		SessionID:         sessionID,
+		HelloRetryRequest: bytes.Equal(random, helloRetryRequestRandom),
+	}
+	if len(s) == 0 {
+		hello.ALPNKnown = version < VersionTLS13
+		return hello, nil // No extensions
+	}
+
+	extensions, ok := s.vector16()
+	if !ok {
+		return nil, errTruncated
+	}
+	for len(extensions) > 0 {
+		extType, ok := extensions.uint16()
+		data, ok2 := extensions.vector16()
+		if !(ok && ok2) {
+			return nil, errTruncated
+		}
+		switch extType {
+		case extensionSupportedVersions:
+			if v, ok := data.uint16(); ok {
+				hello.Version = v
+			}
+		case extensionALPN:
+			list, ok := data.vector16()
+			protocol, ok2 := list.vector8()
+			if !(ok && ok2) || len(protocol) == 0 {
+				return nil, errors.New("malformed ALPN extension in ServerHello")
+			}
+			hello.ALPN = string(protocol)
+		}
+	}
+	hello.ALPNKnown = hello.Version < VersionTLS13
+	return hello, nil
+}
+
+// reader consumes a handshake message from the front.
+type reader []byte
+
+func (r *reader) bytes(n int) ([]byte, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	b := (*r)[:n]
+	*r = (*r)[n:]
+	return b, true
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	b, ok := r.bytes(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b), true
+}
+
+func (r *reader) vector8() (reader, bool) {
+	n, ok := r.bytes(1)
+	if !ok {
+		return nil, false
+	}
+	b, ok := r.bytes(int(n[0]))
+	return reader(b), ok
+}
+
+func (r *reader) vector16() (reader, bool) {
+	n, ok := r.uint16()
+	if !ok {
+		return nil, false
+	}
+	b, ok := r.bytes(int(n))
+	return reader(b), ok
+}
+
+func (r *reader) vector24() (reader, bool) {
+	n, ok := r.bytes(3)
+	if !ok {
+		return nil, false
+	}
+	b, ok := r.bytes(int(n[0])<<16 | int(n[1])<<8 | int(n[2]))
+	return reader(b), ok
+}
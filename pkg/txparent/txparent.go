@@ -0,0 +1,48 @@
+// Package txparent accepts connections that the operating system diverted
+// to the proxy instead of applications being configured to use it, and
+// recovers where each of them was headed.
+//
+// Diverting is left to the platform's firewall, which is set up outside the
+// proxy: iptables or nftables REDIRECT rules on Linux, pf rdr rules on
+// macOS. The listener only asks the firewall's connection tracking for the
+// original destination of every accepted connection.
+package txparent
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// ErrUnsupported is returned by Listen on platforms without an
+// implementation.
+var ErrUnsupported = errors.New("transparent interception is not supported on this platform")
+
+// Listener accepts diverted connections.
+type Listener interface {
+	net.Listener
+
+	// OriginalDestination returns the address conn, accepted by this
+	// listener, was sent to before it was diverted.
+	OriginalDestination(conn net.Conn) (netip.AddrPort, error)
+}
+
+// Listen opens a listener on addr for connections the firewall diverts to
+// it.
+func Listen(addr string) (Listener, error) {
+	return listen(addr)
+}
+
+// diverted reports whether conn was diverted on its way to dest. One that
+// was sent to the listener directly has its own local address as the
+// original destination, and relaying it would only loop back.
+func diverted(conn net.Conn, dest netip.AddrPort) bool {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	return local.AddrPort().Addr().Unmap() != dest.Addr().Unmap() || local.AddrPort().Port() != dest.Port()
+}
+
+// errNotDiverted is returned for connections made to the listener directly.
+var errNotDiverted = errors.New("connection was sent to the listener directly, not diverted by the firewall")
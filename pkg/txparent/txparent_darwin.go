@@ -0,0 +1,77 @@
+//go:build darwin
+
+package txparent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// pfListener looks up original destinations in pf's state table, for
+// connections diverted by rdr rules such as
+//
+//	rdr pass on en0 inet proto tcp to any port 443 -> 127.0.0.1 port 8443
+//
+// pf only exposes the table through /dev/pf, so this needs the same
+// privileges as pfctl. Connections originating on the Mac itself aren't
+// subject to rdr and have to be routed through lo0 with route-to first.
+type pfListener struct {
+	net.Listener
+}
+
+func listen(addr string) (Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pfListener{l}, nil
+}
+
+func (l pfListener) OriginalDestination(conn net.Conn) (netip.AddrPort, error) {
+	client, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("not a TCP connection: %T", conn)
+	}
+	out, err := exec.Command("pfctl", "-s", "state").Output()
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed to read pf states: %w", err)
+	}
+	dest, err := lookupState(out, client.AddrPort())
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if !diverted(conn, dest) {
+		return netip.AddrPort{}, errNotDiverted
+	}
+	return dest, nil
+}
+
+// lookupState finds the original destination of client's connection in
+// pfctl's state listing, where rdr states read
+//
+//	ALL tcp 127.0.0.1:8443 <- 93.184.216.34:443 <- 192.168.1.2:52000  ESTABLISHED:ESTABLISHED
+func lookupState(states []byte, client netip.AddrPort) (netip.AddrPort, error) {
+	want := netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+	scanner := bufio.NewScanner(bytes.NewReader(states))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 || fields[1] != "tcp" || fields[3] != "<-" || fields[5] != "<-" {
+			continue
+		}
+		source, err := netip.ParseAddrPort(fields[6])
+		if err != nil || source != want {
+			continue
+		}
+		dest, err := netip.ParseAddrPort(fields[4])
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("unexpected pf state %q: %w", scanner.Text(), err)
+		}
+		return dest, nil
+	}
+	return netip.AddrPort{}, fmt.Errorf("no pf state for %s", client)
+}
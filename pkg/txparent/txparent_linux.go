@@ -0,0 +1,85 @@
+//go:build linux
+
+package txparent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST for IPv4 and IP6T_SO_ORIGINAL_DST for
+// IPv6, answered by netfilter's connection tracking for REDIRECT and DNAT
+// targets.
+const soOriginalDst = 80
+
+// conntrackListener looks up original destinations with SO_ORIGINAL_DST.
+type conntrackListener struct {
+	net.Listener
+}
+
+func listen(addr string) (Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conntrackListener{l}, nil
+}
+
+func (l conntrackListener) OriginalDestination(conn net.Conn) (netip.AddrPort, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("not a TCP connection: %T", conn)
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	ipv6 := tcpConn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	var dest netip.AddrPort
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			dest, sockErr = originalDst6(int(fd))
+		} else {
+			dest, sockErr = originalDst4(int(fd))
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("SO_ORIGINAL_DST: %w", err)
+	}
+	if !diverted(conn, dest) {
+		return netip.AddrPort{}, errNotDiverted
+	}
+	return dest, nil
+}
+
+// originalDst4 reads the sockaddr_in SO_ORIGINAL_DST returns. The syscall
+// package has no getsockopt for it, but IPv6Mreq is large enough to hold
+// one: family and port, then the address.
+func originalDst4(fd int) (netip.AddrPort, error) {
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.SOL_IP, soOriginalDst)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	sa := mreq.Multiaddr
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte(sa[4:8])), binary.BigEndian.Uint16(sa[2:4])), nil
+}
+
+// originalDst6 reads the sockaddr_in6 IP6T_SO_ORIGINAL_DST returns, which
+// is where IPv6MTUInfo starts.
+func originalDst6(fd int) (netip.AddrPort, error) {
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.SOL_IPV6, soOriginalDst)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	sa := info.Addr
+	port := binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, sa.Port)) // Stored in network byte order
+	return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr).Unmap(), port), nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package txparent
+
+// listen has no implementation here. On Windows, diverting connections
+// takes a packet driver such as WinDivert; reflecting them to the listener
+// would also catch the proxy's own connections to the same ports, so it
+// needs socket-level filtering by process, which isn't implemented.
+func listen(addr string) (Listener, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,92 @@
+//go:build !relay
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ProxyAuthConfig requires clients of the HTTP proxy listener to log in
+// with Proxy-Authorization, so a client listening on a LAN address isn't an
+// open proxy for everyone on it. Only the Basic scheme is supported.
+type ProxyAuthConfig struct {
+	Users map[string]string `json:"users,omitempty" secret:"true"` // Passwords by username; empty leaves the listener open
+	Realm string            `json:"realm,omitempty"`               // Shown by browsers asking for credentials (default: "sultry")
+}
+
+// errNoProxyCredentials is returned for requests without credentials, which
+// browsers send before they've been challenged.
+var errNoProxyCredentials = errors.New("no Proxy-Authorization")
+
+// proxyAuthenticate checks the Basic credentials in the Proxy-Authorization
+// header of a request, returning the user they belong to.
+func proxyAuthenticate(users map[string]string, header http.Header) (string, error) {
+	credentials := header.Get("Proxy-Authorization")
+	if credentials == "" {
+		return "", errNoProxyCredentials
+	}
+
+	scheme, encoded, _ := strings.Cut(credentials, " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return "", fmt.Errorf("unsupported authentication scheme %q", scheme)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", errors.New("malformed Basic credentials")
+	}
+	user, password, _ := strings.Cut(string(decoded), ":")
+	want, ok := users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 {
+		return "", fmt.Errorf("authentication failed for user %q", user)
+	}
+	return user, nil
+}
+
+// authorizeProxyRequest checks the credentials of a request a client of the
+// proxy listener sent, returning the user. A client that hasn't logged in is
+// challenged, and false returned: the connection is done with.
+func authorizeProxyRequest(logger *sessionLogger, clientConn net.Conn, auth ProxyAuthConfig, header http.Header) (string, bool) {
+	user, err := proxyAuthenticate(auth.Users, header)
+	if err != nil {
+		if !errors.Is(err, errNoProxyCredentials) {
+			logger.Printf("❌ Proxy authentication for %s: %v", clientConn.RemoteAddr(), err)
+			recordAuthFailure(clientConn.RemoteAddr().String())
+		}
+		clientConn.Write(proxyAuthRequired(auth.Realm))
+		return "", false
+	}
+	return user, true
+}
+
+// requestHeader returns the value of the named header in the request head
+// read so far, reporting false if it isn't there.
+func requestHeader(head []byte, name string) (string, bool) {
+	if end := bytes.Index(head, []byte("\r\n\r\n")); end >= 0 {
+		head = head[:end]
+	}
+	for _, line := range strings.Split(string(head), "\r\n")[1:] {
+		key, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(key), name) {
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
+
+// proxyAuthRequired is the 407 response challenging a client to log in.
+func proxyAuthRequired(realm string) []byte {
+	if realm == "" {
+		realm = "sultry"
+	}
+	return []byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+		"Proxy-Authenticate: Basic realm=" + strconv.Quote(realm) + "\r\n" +
+		"Content-Length: 0\r\nConnection: close\r\n\r\n")
+}
@@ -0,0 +1,103 @@
+//go:build !relay
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyAuthenticate(t *testing.T) {
+	users := map[string]string{"alice": "secret"}
+	basic := func(credentials string) http.Header {
+		return http.Header{"Proxy-Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))}}
+	}
+	tests := []struct {
+		name   string
+		header http.Header
+		user   string
+		err    bool
+	}{
+		{"valid", basic("alice:secret"), "alice", false},
+		{"wrong password", basic("alice:guess"), "", true},
+		{"unknown user", basic("bob:secret"), "", true},
+		{"other scheme", http.Header{"Proxy-Authorization": {"Bearer abc"}}, "", true},
+		{"malformed", http.Header{"Proxy-Authorization": {"Basic !!!"}}, "", true},
+		{"missing", http.Header{}, "", true},
+	}
+	for _, tt := range tests {
+		user, err := proxyAuthenticate(users, tt.header)
+		if user != tt.user || (err != nil) != tt.err {
+			t.Errorf("%s: proxyAuthenticate = %q, %v", tt.name, user, err)
+		}
+	}
+	if _, err := proxyAuthenticate(users, http.Header{}); err != errNoProxyCredentials {
+		t.Errorf("without credentials: err = %v, want errNoProxyCredentials", err)
+	}
+}
+
+// proxyExchange sends requests to handleConnection one after the other on
+// a single connection and returns the status of each response, stopping
+// when the proxy closes the connection.
+func proxyExchange(proxy *TLSProxy, auth ProxyAuthConfig, requests ...string) []int {
+	client, server := net.Pipe()
+	defer client.Close()
+	go proxy.handleConnection(server, auth)
+
+	var statuses []int
+	responses := bufio.NewReader(client)
+	for _, request := range requests {
+		if _, err := client.Write([]byte(request)); err != nil {
+			break
+		}
+		resp, err := http.ReadResponse(responses, nil)
+		if err != nil {
+			break
+		}
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+	return statuses
+}
+
+func TestProxyAuthEveryRequest(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer target.Close()
+	host := strings.TrimPrefix(target.URL, "http://")
+
+	proxy, err := newClientProxy(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := ProxyAuthConfig{Users: map[string]string{"alice": "secret"}}
+	credentials := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")) + "\r\n"
+	get := "GET " + target.URL + "/ HTTP/1.1\r\nHost: " + host + "\r\n"
+
+	tests := []struct {
+		name     string
+		requests []string
+		want     []int
+	}{
+		{"without credentials", []string{get + "\r\n"}, []int{407}},
+		{"logged in throughout", []string{get + credentials + "\r\n", get + credentials + "\r\n"}, []int{200, 200}},
+		{"second without credentials", []string{get + credentials + "\r\n", get + "\r\n"}, []int{200, 407}},
+		{"tunnel without credentials", []string{get + credentials + "\r\n", "CONNECT " + host + " HTTP/1.1\r\n\r\n"}, []int{200, 407}},
+		{"credentials after a long head", []string{get + "X-Padding: " + strings.Repeat("a", 4096) + "\r\n" + credentials + "\r\n"}, []int{200}},
+		{"tunnel without credentials after a long head", []string{"CONNECT " + host + " HTTP/1.1\r\nX-Padding: " +
+			strings.Repeat("a", 4096) + "\r\n\r\n"}, []int{407}},
+	}
+	for _, tt := range tests {
+		got := proxyExchange(proxy, auth, tt.requests...)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: statuses = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocolRoute sends a PROXY protocol header ahead of the ClientHello
+// to matching targets, for targets (or load balancers in front of them)
+// that need the original client address.
+type ProxyProtocolRoute struct {
+	Match   string `json:"match"`   // "host", "*.example.com" or "*", optionally with ":port"
+	Version int    `json:"version"` // 1 (text) or 2 (binary)
+}
+
+// proxyProtocolV2Signature starts every version 2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyProtocolV2Payload bounds the addresses and TLVs of a version 2
+// header; load balancers send a few hundred bytes at most.
+const maxProxyProtocolV2Payload = 4096
+
+// proxyProtocolVersion returns the PROXY protocol version to use towards
+// host:port, or 0 if no route matches. The first matching route wins.
+func proxyProtocolVersion(routes []ProxyProtocolRoute, host, port string) int {
+	for _, route := range routes {
+		if matchRoute(route.Match, host, port) {
+			return route.Version
+		}
+	}
+	return 0
+}
+
+// matchRoute reports whether host:port matches a route's match: a host
+// pattern for matchHostPattern, optionally with ":port".
+func matchRoute(match, host, port string) bool {
+	pattern, routePort := match, ""
+	if h, p, err := net.SplitHostPort(match); err == nil {
+		pattern, routePort = h, p
+	}
+	if routePort != "" && routePort != port {
+		return false
+	}
+	return matchHostPattern(pattern, host)
+}
+
+// matchHostPattern reports whether host matches pattern: an exact name, "*"
+// or "*.suffix", which matches the suffix itself and any subdomain.
+func matchHostPattern(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		suffix := pattern[2:]
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	default:
+		return host == pattern
+	}
+}
+
+// proxyProtocolHeader builds a PROXY protocol header describing a TCP
+// connection from src to dst. Addresses that aren't TCP produce a header
+// that tells the receiver to use the connection's own addresses.
+func proxyProtocolHeader(version int, src, dst net.Addr) ([]byte, error) {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+
+	// Both addresses must be of the same family; mixed pairs are sent as IPv6
+	ipv4 := known && srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil
+
+	switch version {
+	case 1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family, srcIP, dstIP := "TCP4", srcTCP.IP.String(), dstTCP.IP.String()
+		if !ipv4 {
+			family, srcIP, dstIP = "TCP6", ipv6String(srcTCP.IP), ipv6String(dstTCP.IP)
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcTCP.Port, dstTCP.Port)), nil
+
+	case 2:
+		header := append([]byte(nil), proxyProtocolV2Signature...)
+		if !known {
+			// LOCAL command, unspecified family, no addresses
+			return append(header, 0x20, 0x00, 0x00, 0x00), nil
+		}
+		var addrs []byte
+		family := byte(0x21) // TCP over IPv6
+		if ipv4 {
+			family = 0x11 // TCP over IPv4
+			addrs = append(addrs, srcTCP.IP.To4()...)
+			addrs = append(addrs, dstTCP.IP.To4()...)
+		} else {
+			addrs = append(addrs, srcTCP.IP.To16()...)
+			addrs = append(addrs, dstTCP.IP.To16()...)
+		}
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcTCP.Port))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstTCP.Port))
+
+		header = append(header, 0x21, family) // Version 2, PROXY command
+		header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+		return append(header, addrs...), nil
+	}
+	return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+}
+
+// ipv6String formats ip in IPv6 notation, including IPv4-mapped addresses.
+func ipv6String(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+	return ip.String()
+}
+
+// ProxyProtocolListenerConfig lets the server sit behind a load balancer
+// such as HAProxy or an AWS NLB that prepends a PROXY protocol header, so
+// handlers, rate limits and logs see the real client address.
+type ProxyProtocolListenerConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Trusted  []string `json:"trusted,omitempty"`  // CIDRs of the load balancers whose headers are believed; required when enabled
+	Required bool     `json:"required,omitempty"` // Reject connections from trusted sources that carry no header
+}
+
+// proxyProtocolListener parses PROXY protocol headers on accepted
+// connections. Parsing happens on the connection's first use, in its own
+// goroutine, so a slow client can't stall Accept.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted  []*net.IPNet
+	required bool
+}
+
+// validate rejects invalid CIDRs, and an enabled listener trusting no
+// source: anyone able to connect could then claim any client address.
+func (cfg ProxyProtocolListenerConfig) validate() error {
+	if cfg.Enabled && len(cfg.Trusted) == 0 {
+		return errors.New("trusted must list the CIDRs of the load balancers sending PROXY protocol headers")
+	}
+	for _, cidr := range cfg.Trusted {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+	}
+	return nil
+}
+
+func newProxyProtocolListener(l net.Listener, cfg ProxyProtocolListenerConfig) (*proxyProtocolListener, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	pl := &proxyProtocolListener{Listener: l, required: cfg.Required}
+	for _, cidr := range cfg.Trusted {
+		_, network, _ := net.ParseCIDR(cidr)
+		pl.trusted = append(pl.trusted, network)
+	}
+	return pl, nil
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn), required: l.required}, nil
+}
+
+func (l *proxyProtocolListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConn reports the source address from its PROXY protocol
+// header as RemoteAddr.
+type proxyProtocolConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	required bool
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) parse() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		c.remote, c.err = readProxyProtocolHeader(c.reader)
+		if c.err == nil && c.remote == nil && c.required {
+			c.err = errors.New("missing PROXY protocol header")
+		}
+		if c.err != nil {
+			log.Printf("❌ Rejecting connection from %s: %v", redacted(sensitiveClientIP, c.Conn.RemoteAddr().String()), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.parse()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.parse()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader consumes a version 1 or 2 PROXY protocol header
+// from r and returns the source address it carries. It returns a nil
+// address without error if r doesn't start with a header, or if the header
+// says to use the connection's own addresses.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(6)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if string(start) == "PROXY " {
+		return readProxyProtocolV1(r)
+	}
+	if signature, err := r.Peek(len(proxyProtocolV2Signature)); err == nil && bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(r)
+	}
+	return nil, nil
+}
+
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	// A version 1 header is at most 107 bytes including CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("truncated PROXY header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY header too long")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY header source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("truncated PROXY header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	length := binary.BigEndian.Uint16(header[14:16])
+	if length > maxProxyProtocolV2Payload {
+		return nil, errors.New("PROXY header too long")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("truncated PROXY header: %w", err)
+	}
+
+	// LOCAL connections (health checks) carry no addresses to use
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("short IPv4 PROXY header")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("short IPv6 PROXY header")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// Other families (UDP, unix sockets) don't describe a usable client address
+	return nil, nil
+}
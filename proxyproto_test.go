@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// v2Header builds a version 2 header with the given command, family and
+// payload, the length field saying length.
+func v2Header(command, family byte, length int, payload []byte) []byte {
+	header := append([]byte(nil), proxyProtocolV2Signature...)
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(length))
+	return append(header, payload...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	src4 := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 51234}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 51234}
+	dst := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443}
+	header := func(version int, src net.Addr) string {
+		h, err := proxyProtocolHeader(version, src, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(h)
+	}
+	ipv4 := append(append(net.IPv4(192, 0, 2, 10).To4(), 198, 51, 100, 1), 0xc8, 0x22, 0x01, 0xbb)
+
+	tests := []struct {
+		name   string
+		input  string
+		source string // Empty when the connection's own address is used
+		err    string // Substring of the expected error
+	}{
+		{name: "no header", input: "GET / HTTP/1.1\r\n"},
+		{name: "empty", input: ""},
+		{name: "v1 IPv4", input: header(1, src4) + "rest", source: "192.0.2.10:51234"},
+		{name: "v1 IPv6", input: header(1, src6) + "rest", source: "[2001:db8::10]:51234"},
+		{name: "v1 unknown", input: "PROXY UNKNOWN\r\nrest"},
+		{name: "v1 truncated", input: "PROXY TCP4 192.0.2.10 198.51", err: "truncated"},
+		{name: "v1 without CRLF", input: "PROXY TCP4 192.0.2.10 198.51.100.1 51234 443\n", err: "too long"},
+		{name: "v1 oversized", input: "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", err: "too long"},
+		{name: "v1 unknown family", input: "PROXY UDP4 192.0.2.10 198.51.100.1 51234 443\r\n", err: "malformed"},
+		{name: "v1 missing fields", input: "PROXY TCP4 192.0.2.10 198.51.100.1 51234\r\n", err: "malformed"},
+		{name: "v1 bad address", input: "PROXY TCP4 192.0.2.300 198.51.100.1 51234 443\r\n", err: "malformed"},
+		{name: "v1 bad port", input: "PROXY TCP4 192.0.2.10 198.51.100.1 70000 443\r\n", err: "malformed"},
+		{name: "v2 IPv4", input: header(2, src4) + "rest", source: "192.0.2.10:51234"},
+		{name: "v2 IPv6", input: header(2, src6) + "rest", source: "[2001:db8::10]:51234"},
+		{name: "v2 local", input: header(2, nil) + "rest"},
+		{name: "v2 IPv4 with TLVs", input: string(v2Header(0x21, 0x11, 16, append(ipv4, 0x04, 0x00, 0x01, 'x'))), source: "192.0.2.10:51234"},
+		{name: "v2 UDP", input: string(v2Header(0x21, 0x12, 12, ipv4))},
+		{name: "v2 truncated header", input: string(proxyProtocolV2Signature) + "\x21", err: "truncated"},
+		{name: "v2 truncated payload", input: string(v2Header(0x21, 0x11, 12, ipv4[:6])), err: "truncated"},
+		{name: "v2 short IPv4", input: string(v2Header(0x21, 0x11, 6, ipv4[:6])), err: "short IPv4"},
+		{name: "v2 short IPv6", input: string(v2Header(0x21, 0x21, 12, ipv4)), err: "short IPv6"},
+		{name: "v2 oversized", input: string(v2Header(0x21, 0x11, maxProxyProtocolV2Payload+1, nil)), err: "too long"},
+		{name: "v2 wrong version", input: string(v2Header(0x11, 0x11, 12, ipv4)), err: "unsupported"},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(tt.input))
+		source, err := readProxyProtocolHeader(r)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := ""; source != nil {
+			if got = source.String(); got != tt.source {
+				t.Errorf("%s: source = %s, want %s", tt.name, got, tt.source)
+			}
+		} else if tt.source != "" {
+			t.Errorf("%s: no source, want %s", tt.name, tt.source)
+		}
+		// Whatever followed the header is left to read
+		if rest, _ := io.ReadAll(r); strings.HasSuffix(tt.input, "rest") && string(rest) != "rest" {
+			t.Errorf("%s: left %q to read", tt.name, rest)
+		}
+	}
+}
+
+func TestProxyProtocolListenerConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg   ProxyProtocolListenerConfig
+		valid bool
+	}{
+		{ProxyProtocolListenerConfig{}, true},
+		{ProxyProtocolListenerConfig{Enabled: true, Trusted: []string{"10.0.0.0/8", "2001:db8::/32"}}, true},
+		{ProxyProtocolListenerConfig{Enabled: true}, false},
+		{ProxyProtocolListenerConfig{Enabled: true, Trusted: []string{}}, false},
+		{ProxyProtocolListenerConfig{Enabled: true, Trusted: []string{"10.0.0.1"}}, false},
+		{ProxyProtocolListenerConfig{Trusted: []string{"not a network"}}, false},
+	}
+	for _, tt := range tests {
+		err := tt.cfg.validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("%+v: error = %v, want valid %v", tt.cfg, err, tt.valid)
+		}
+		if _, err := newProxyProtocolListener(nil, tt.cfg); tt.cfg.Enabled && (err == nil) != tt.valid {
+			t.Errorf("%+v: listener error = %v, want valid %v", tt.cfg, err, tt.valid)
+		}
+	}
+}
+
+func TestProxyProtocolListenerTrust(t *testing.T) {
+	header := "PROXY TCP4 192.0.2.10 198.51.100.1 51234 443\r\n"
+	tests := []struct {
+		name     string
+		trusted  []string
+		required bool
+		input    string
+		remote   string // Empty for the connection's own address
+		read     string
+	}{
+		{name: "trusted", trusted: []string{"127.0.0.0/8"}, input: header + "hello", remote: "192.0.2.10:51234", read: "hello"},
+		{name: "trusted without header", trusted: []string{"127.0.0.0/8"}, input: "hello", read: "hello"},
+		{name: "required", trusted: []string{"127.0.0.0/8"}, required: true, input: "hello"},
+		{name: "untrusted", trusted: []string{"10.0.0.0/8"}, input: header + "hello", read: header + "hello"},
+		{name: "untrusted, required", trusted: []string{"10.0.0.0/8"}, required: true, input: "hello", read: "hello"},
+	}
+	for _, tt := range tests {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := newProxyProtocolListener(inner, ProxyProtocolListenerConfig{Enabled: true, Trusted: tt.trusted, Required: tt.required})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte(tt.input))
+		client.(*net.TCPConn).CloseWrite()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		remote := conn.RemoteAddr().String()
+		if tt.remote == "" {
+			tt.remote = client.LocalAddr().String()
+		}
+		if remote != tt.remote {
+			t.Errorf("%s: remote = %s, want %s", tt.name, remote, tt.remote)
+		}
+		var read bytes.Buffer
+		io.Copy(&read, conn)
+		if read.String() != tt.read {
+			t.Errorf("%s: read %q, want %q", tt.name, read.String(), tt.read)
+		}
+		conn.Close()
+		client.Close()
+		listener.Close()
+	}
+}
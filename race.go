@@ -0,0 +1,139 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Handshake racing
+//
+// CDN hosts resolve to many addresses, and any one of them may be slow,
+// overloaded or throttled for the client. With racing on, strategies that
+// dial the target's addresses themselves send the ClientHello to the first
+// few addresses at once, and the tunnel keeps whichever answers first; the
+// other connections are closed as soon as there's a winner, before
+// anything but the ClientHello was sent on them. An address that answers
+// with a TLS alert doesn't win while another may still answer properly.
+
+// RaceConfig races the handshake of each tunnel over several of the
+// target's addresses.
+type RaceConfig struct {
+	Addresses int `json:"addresses,omitempty"` // Addresses raced at once, at most 3; 0 or 1 disables racing
+	Stagger   int `json:"stagger,omitempty"`   // Milliseconds between starting one racer and the next (default: 0)
+}
+
+// maxRacers bounds the connections one tunnel opens at once.
+const maxRacers = 3
+
+// racingStrategies dial the addresses of the destination themselves, through
+// dialDestination, so they can be raced by pinning each racer to one.
+var racingStrategies = map[string]bool{"direct": true, "fragment": true}
+
+// racer is the outcome of one racer.
+type racer struct {
+	addr string
+	conn net.Conn
+	err  error
+	keep func() bool // Stops conn being closed when the race ends, reporting false if it already was
+}
+
+// attempt establishes a connection to dest with s and waits for the
+// target's answer to the ClientHello, racing several of dest's addresses
+// if configured and possible. Like awaitServerResponse, it returns the
+// connection along with a TLS alert the target answered with.
+func (o *strategyOrchestrator) attempt(ctx context.Context, s ConnectionStrategy, clientConn net.Conn, dest Destination) (net.Conn, error) {
+	ips := o.raceAddresses(ctx, s, dest)
+	if len(ips) < 2 {
+		conn, err := s.Establish(ctx, clientConn, dest)
+		if err != nil {
+			return nil, err
+		}
+		return awaitServerResponse(ctx, conn, dest)
+	}
+
+	logger := sessionLog(ctx)
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := time.Now()
+	results := make(chan racer, len(ips))
+	for i, ip := range ips {
+		d := dest
+		d.pinned = ip
+		if i > 0 {
+			// The prepared connection is the first racer's
+			d.prepared = nil
+		}
+		go func() {
+			if i > 0 && o.race.Stagger > 0 {
+				select {
+				case <-time.After(time.Duration(i*o.race.Stagger) * time.Millisecond):
+				case <-raceCtx.Done():
+					results <- racer{addr: ip.String(), err: raceCtx.Err()}
+					return
+				}
+			}
+			r := racer{addr: ip.String(), keep: func() bool { return true }}
+			if r.conn, r.err = s.Establish(raceCtx, clientConn, d); r.err == nil {
+				conn := r.conn
+				r.keep = context.AfterFunc(raceCtx, func() { conn.Close() })
+				r.conn, r.err = awaitServerResponse(raceCtx, r.conn, d)
+			}
+			results <- r
+		}()
+	}
+	logger.Printf("🏁 Racing the handshake over %d addresses of %s", len(ips), dest.Host)
+
+	// The first racer the target answered properly wins; failing that, the
+	// first one it answered with an alert, then the last error
+	var alerted *racer
+	var lastErr error
+	for range ips {
+		r := <-results
+		var alert *tlsAlertError
+		switch {
+		case r.err == nil && r.keep():
+			if alerted != nil {
+				alerted.conn.Close()
+			}
+			logger.Printf("🏁 %s answered first, in %s", r.addr, time.Since(start).Truncate(time.Millisecond))
+			return r.conn, nil
+		case errors.As(r.err, &alert) && alerted == nil && r.keep():
+			alerted = &r
+		case r.err != nil:
+			if r.conn != nil {
+				r.conn.Close()
+			}
+			lastErr = r.err
+		}
+	}
+	if alerted != nil {
+		return alerted.conn, alerted.err
+	}
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	return nil, lastErr
+}
+
+// raceAddresses returns the addresses to race dest over with s, or nil if
+// it isn't raced: racing is off, s doesn't dial addresses itself, or dest
+// has to be reached at one address or by name.
+func (o *strategyOrchestrator) raceAddresses(ctx context.Context, s ConnectionStrategy, dest Destination) []net.IP {
+	if o.race.Addresses < 2 || !racingStrategies[s.Name()] || dest.resolver == nil || dest.Affinity != "" ||
+		upstream.Proxies(dest.Addr()) {
+		return nil
+	}
+	resolved, err := dest.resolver.wait(ctx)
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range resolved[:min(len(resolved), min(o.race.Addresses, maxRacers))] {
+		ips = append(ips, addr.IP)
+	}
+	return ips
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Redaction
+//
+// Logs and audit events name destinations, clients and URLs, which an
+// operator sharing them may not want to give away. How each of those fields
+// appears is configured once, and applied where lines and events are
+// written: session loggers rewrite the values they've been told about
+// wherever they turn up in a line, and audit redacts the fields of every
+// event. Lines logged outside a session logger, including errors that name
+// a destination, pass through scrubbingWriter, which rewrites the values of
+// every request and relay session in progress (see redactWhileLive).
+
+// RedactConfig chooses how sensitive fields are logged and audited: "full"
+// (default), "hashed" (a short hash, like the dest field, so lines can still
+// be correlated), "truncated" (the parent domain, the client's network, the
+// URL's origin) or "omitted".
+type RedactConfig struct {
+	SNI      string `json:"sni,omitempty"`       // Destination hostnames, from CONNECT requests and ClientHellos
+	ClientIP string `json:"client_ip,omitempty"` // Addresses of clients and OOB peers connecting in
+	URL      string `json:"url,omitempty"`       // URLs of plain HTTP requests
+}
+
+// sensitiveKind is a kind of field RedactConfig has a mode for.
+type sensitiveKind int
+
+const (
+	sensitiveSNI sensitiveKind = iota
+	sensitiveClientIP
+	sensitiveURL
+)
+
+// Redaction modes.
+const (
+	redactFull      = "full"
+	redactHashed    = "hashed"
+	redactTruncated = "truncated"
+	redactOmitted   = "omitted"
+)
+
+// redactedPlaceholder replaces omitted values in log lines.
+const redactedPlaceholder = "[redacted]"
+
+// redaction is the configuration installed by setupLogging.
+var redaction RedactConfig
+
+// validate rejects unknown modes.
+func (r RedactConfig) validate() error {
+	for field, mode := range map[string]string{"sni": r.SNI, "client_ip": r.ClientIP, "url": r.URL} {
+		switch mode {
+		case "", redactFull, redactHashed, redactTruncated, redactOmitted:
+		default:
+			return fmt.Errorf("unknown redaction %q for %s", mode, field)
+		}
+	}
+	return nil
+}
+
+func (r RedactConfig) mode(kind sensitiveKind) string {
+	var mode string
+	switch kind {
+	case sensitiveSNI:
+		mode = r.SNI
+	case sensitiveClientIP:
+		mode = r.ClientIP
+	case sensitiveURL:
+		mode = r.URL
+	}
+	if mode == "" {
+		return redactFull
+	}
+	return mode
+}
+
+// apply returns value as the configured mode for kind shows it, reporting
+// false if it's omitted altogether.
+func (r RedactConfig) apply(kind sensitiveKind, value string) (string, bool) {
+	mode := r.mode(kind)
+	if mode == redactFull || value == "" {
+		return value, true
+	}
+	if mode == redactOmitted {
+		return "", false
+	}
+
+	// Client addresses keep their port, which says nothing about the client
+	if kind == sensitiveClientIP {
+		if host, port, err := net.SplitHostPort(value); err == nil {
+			redacted, _ := r.apply(kind, host)
+			return net.JoinHostPort(redacted, port), true
+		}
+	}
+	if mode == redactHashed {
+		return destHash(value), true
+	}
+	switch kind {
+	case sensitiveClientIP:
+		return truncateIP(value), true
+	case sensitiveURL:
+		if u, err := url.Parse(value); err == nil && u.Host != "" {
+			return u.Scheme + "://" + u.Host + "/…", true
+		}
+		return redactedPlaceholder, true
+	default:
+		if ip := net.ParseIP(value); ip != nil {
+			return truncateIP(value), true
+		}
+		labels := strings.Split(strings.TrimSuffix(value, "."), ".")
+		if len(labels) <= 2 {
+			return value, true
+		}
+		return "*." + strings.Join(labels[len(labels)-2:], "."), true
+	}
+}
+
+// truncateIP returns the network an address is in: its /24 for IPv4, its
+// /48 for IPv6.
+func truncateIP(value string) string {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return redactedPlaceholder
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// redacted returns value as it may appear in a log line.
+func redacted(kind sensitiveKind, value string) string {
+	if shown, ok := redaction.apply(kind, value); ok {
+		return shown
+	}
+	return redactedPlaceholder
+}
+
+// redactions rewrites the sensitive values it has been given wherever they
+// appear in a string, longest first so a hostname isn't partly rewritten
+// by a rule for its parent domain.
+type redactions []redactionRule
+
+type redactionRule struct {
+	value, shown string
+}
+
+// with returns the redactions extended with value, a field of the given
+// kind. Values the configuration shows in full aren't added, and client
+// addresses are added without their port.
+func (r redactions) with(kind sensitiveKind, value string) redactions {
+	if host, _, err := net.SplitHostPort(value); err == nil && kind == sensitiveClientIP {
+		value = host
+	}
+	shown := redacted(kind, value)
+	if value == "" || shown == value || slices.ContainsFunc(r, func(rule redactionRule) bool { return rule.value == value }) {
+		return r
+	}
+	next := append(slices.Clip(r), redactionRule{value: value, shown: shown})
+	slices.SortStableFunc(next, func(a, b redactionRule) int { return len(b.value) - len(a.value) })
+	return next
+}
+
+// scrub rewrites the values in s.
+func (r redactions) scrub(s string) string {
+	for _, rule := range r {
+		s = strings.ReplaceAll(s, rule.value, rule.shown)
+	}
+	return s
+}
+
+// liveRedactions are the sensitive values of the requests and sessions in
+// progress, counted by how many of them hold each, and the replacer
+// scrubbingWriter rewrites them with.
+type liveRedactions struct {
+	mu       sync.Mutex
+	held     map[redactionRule]int
+	replacer atomic.Pointer[strings.Replacer]
+}
+
+var live liveRedactions
+
+// redactWhileLive rewrites value, a sensitive field of the given kind, in
+// every line written to the log until the returned function is called.
+// Values the configuration shows in full are left alone.
+func redactWhileLive(kind sensitiveKind, value string) (release func()) {
+	r := redactions(nil).with(kind, value)
+	if len(r) == 0 {
+		return func() {}
+	}
+	rule := r[0]
+	live.mu.Lock()
+	defer live.mu.Unlock()
+	if live.held == nil {
+		live.held = make(map[redactionRule]int)
+	}
+	if live.held[rule]++; live.held[rule] == 1 {
+		live.rebuild()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			live.mu.Lock()
+			defer live.mu.Unlock()
+			if live.held[rule]--; live.held[rule] == 0 {
+				delete(live.held, rule)
+				live.rebuild()
+			}
+		})
+	}
+}
+
+// rebuild replaces the replacer after the held values changed. Longer
+// values come first, so a hostname isn't partly rewritten by a rule for its
+// parent domain. l.mu must be held.
+func (l *liveRedactions) rebuild() {
+	if len(l.held) == 0 {
+		l.replacer.Store(nil)
+		return
+	}
+	rules := make(redactions, 0, len(l.held))
+	for rule := range l.held {
+		rules = append(rules, rule)
+	}
+	slices.SortFunc(rules, func(a, b redactionRule) int { return len(b.value) - len(a.value) })
+	oldnew := make([]string, 0, 2*len(rules))
+	for _, rule := range rules {
+		oldnew = append(oldnew, rule.value, rule.shown)
+	}
+	l.replacer.Store(strings.NewReplacer(oldnew...))
+}
+
+// scrubbingWriter rewrites the values held by redactWhileLive in everything
+// written through it. setupLogging installs it as the log output.
+type scrubbingWriter struct {
+	w io.Writer
+}
+
+func (s scrubbingWriter) Write(p []byte) (int, error) {
+	replacer := live.replacer.Load()
+	if replacer == nil {
+		return s.w.Write(p)
+	}
+	// One write per line, so lines written concurrently don't interleave
+	if _, err := s.w.Write([]byte(replacer.Replace(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactingClients keeps the address of the client making a request
+// redacted in every log line while the request is served.
+func redactingClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer redactWhileLive(sensitiveClientIP, r.RemoteAddr)()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redactAuditEvent applies the configured redaction to the fields of an
+// audit event; omitted ones are left empty. Errors are scrubbed of the
+// values too, since they often name the destination.
+func redactAuditEvent(event *auditEvent) {
+	var r redactions
+	r = r.with(sensitiveSNI, event.SNI).with(sensitiveSNI, event.Coalesced).with(sensitiveClientIP, event.Client)
+	if host, _, err := net.SplitHostPort(event.Dest); err == nil {
+		r = r.with(sensitiveSNI, host)
+	}
+	if len(r) == 0 {
+		return
+	}
+	event.Error = r.scrub(event.Error)
+	event.SNI, _ = redaction.apply(sensitiveSNI, event.SNI)
+	event.Coalesced, _ = redaction.apply(sensitiveSNI, event.Coalesced)
+	event.Dest, _ = redactHostPort(event.Dest)
+	event.Client, _ = redaction.apply(sensitiveClientIP, event.Client)
+}
+
+// redactHostPort redacts the host of a host:port destination as a hostname,
+// keeping the port.
+func redactHostPort(hostPort string) (string, bool) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return redaction.apply(sensitiveSNI, hostPort)
+	}
+	shown, ok := redaction.apply(sensitiveSNI, host)
+	if !ok {
+		return "", false
+	}
+	return net.JoinHostPort(shown, port), true
+}
+
+// redactedConfig returns config as JSON with every field tagged
+// `secret:"true"` masked: tokens, passwords, passphrases and URLs that may
+// carry credentials. Usernames, the keys of password maps, are kept.
+func redactedConfig(config *Config) string {
+	// The masking works on a copy decoded from JSON, which shares nothing
+	// with config
+	data, err := json.Marshal(config)
+	if err != nil {
+		return redactedPlaceholder
+	}
+	var masked Config
+	if err := json.Unmarshal(data, &masked); err != nil {
+		return redactedPlaceholder
+	}
+	maskSecrets(reflect.ValueOf(&masked).Elem())
+	data, err = json.Marshal(masked)
+	if err != nil {
+		return redactedPlaceholder
+	}
+	return string(data)
+}
+
+// maskSecrets replaces the non-empty strings held by secret fields of v,
+// and of the structs v contains, with redactedPlaceholder.
+func maskSecrets(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			maskSecrets(v.Elem())
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range v.Len() {
+			maskSecrets(v.Index(i))
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			maskSecrets(value)
+			v.SetMapIndex(key, value)
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			field := v.Field(i)
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			if v.Type().Field(i).Tag.Get("secret") == "true" {
+				maskStrings(field)
+			} else {
+				maskSecrets(field)
+			}
+		}
+	}
+}
+
+// maskStrings replaces every non-empty string in v with redactedPlaceholder.
+func maskStrings(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.String() != "" {
+			v.SetString(redactedPlaceholder)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range v.Len() {
+			maskStrings(v.Index(i))
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			maskStrings(value)
+			v.SetMapIndex(key, value)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	sultrytls "sultry/pkg/tls"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// relayPair runs both directions of a relay between a and b and waits for
+// them. aToB copies from a to b and bToA the other way; each returns nil
+// when its source ends normally. A direction that ends normally half-closes
+// its destination so the peer sees EOF, while the other direction keeps
+// going. If either direction fails or panics, or ctx ends, both connections
+// are closed so the other direction stops instead of hanging on a read.
+// Both connections are closed on return, and the first error is returned.
+func relayPair(ctx context.Context, a, b net.Conn, aToB, bToA func() error) error {
+	g, ctx := errgroup.WithContext(ctx)
+	stop := context.AfterFunc(ctx, func() {
+		a.Close()
+		b.Close()
+	})
+
+	direction := func(run func() error, dst net.Conn) func() error {
+		return func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic in relay: %v", r)
+				}
+			}()
+			if err := run(); err != nil {
+				return err
+			}
+			closeWrite(dst)
+			return nil
+		}
+	}
+	g.Go(direction(aToB, b))
+	g.Go(direction(bToA, a))
+	err := g.Wait()
+	stop()
+	a.Close()
+	b.Close()
+	return err
+}
+
+// closeWrite shuts down the writing side of conn if it supports half-close.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// countingConn counts the bytes written through it, for relays that report
+// their volume.
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// relayData implements an efficient bidirectional data relay with TLS inspection.
+//
+// This function is the core of all connection strategies, providing:
+// 1. Reliable TCP data transfer with proper timeout handling
+// 2. TLS record inspection for debugging without modifying the data
+// 3. Logging of connection state, and of every record with log.debug
+// 4. Graceful handling of connection resets and network errors
+//
+// TLS streams are reassembled and forwarded in whole records, those each
+// read completes together in one write, so records read in fragments are
+// never split on their way, which would cause "decryption failed or bad
+// record mac" errors. Streams that aren't TLS are passed through as they are
+// read. Each write waits for limit, which may be nil, to allow it.
+func relayData(logger *sessionLogger, source, destination net.Conn, buffer []byte, label string,
+	phase *relayTimeouts, limit *relayThrottle, fromClient bool) error {
+	var totalBytes int64
+	var records sultrytls.Reassembler
+	batch := make([]byte, 0, len(buffer))
+	var fatalAlert *sultrytls.Alert // Sent in the clear, so the connection is about to end
+	passthrough := false
+
+	write := func(data []byte) error {
+		limit.wait(len(data))
+		destination.SetWriteDeadline(phase.writeDeadline())
+		written, err := destination.Write(data)
+		destination.SetWriteDeadline(time.Time{})
+		phase.observe(fromClient, data)
+
+		if err != nil {
+			logger.Printf("❌ %s: Error writing: %v", label, err)
+			return fmt.Errorf("%s: write failed: %w", label, err)
+		}
+
+		if written != len(data) {
+			logger.Printf("⚠️ %s: Short write: %d/%d bytes", label, written, len(data))
+		} else {
+			before := totalBytes
+			totalBytes += int64(written)
+			if debugLogging && totalBytes/32768 > before/32768 { // Log every 32KB
+				logger.Printf("DEBUG: %s: Relayed %d bytes total", label, totalBytes)
+			}
+		}
+		return nil
+	}
+
+	for {
+		// The handshake must be done by its deadline, later reads only
+		// time out once the relay has been idle
+		source.SetReadDeadline(phase.readDeadline())
+		n, err := source.Read(buffer)
+		source.SetReadDeadline(time.Time{})
+
+		if err != nil {
+			if err == io.EOF || strings.Contains(err.Error(), "use of closed") {
+				logger.Printf("🔹 %s: Connection closed normally", label)
+				// Whatever is left of a truncated record still belongs to the peer
+				if rest := records.Rest(); len(rest) > 0 {
+					logger.Printf("⚠️ %s: Closed inside a TLS record, forwarding %d trailing bytes", label, len(rest))
+					if err := write(rest); err != nil {
+						return err
+					}
+				}
+				break
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if err := phase.expired(); err != nil {
+					logger.Printf("⚠️ %s: %v", label, err)
+					return fmt.Errorf("%s: %w", label, err)
+				}
+				continue
+			}
+			logger.Printf("❌ %s: Error reading: %v", label, err)
+			return fmt.Errorf("%s: read failed: %w", label, err)
+		}
+
+		if n == 0 {
+			continue
+		}
+		if passthrough {
+			if debugLogging {
+				logger.Printf("DEBUG: %s: Application data: %d bytes", label, n)
+			}
+			if err := write(buffer[:n]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		complete, parseErr := records.Feed(buffer[:n])
+		batch = batch[:0]
+		for _, record := range complete {
+			if debugLogging {
+				logger.Printf("DEBUG: %s: TLS Record: Type=%d, Version=0x%04x, Length=%d",
+					label, record.Type, record.Version, len(record.Payload))
+			}
+			batch = append(batch, record.Raw...)
+			if alert, ok := record.Alert(); ok {
+				relayedAlerts.record(label, alert)
+				if alert.Fatal() {
+					logger.Printf("🚨 %s: TLS %s", label, alert)
+					fatalAlert = &alert
+				}
+			}
+		}
+		if len(batch) > 0 {
+			if err := write(batch); err != nil {
+				return err
+			}
+		}
+		if parseErr != nil {
+			// Not TLS (or no longer): relay the rest without inspection
+			logger.Printf("🔹 %s: %v, relaying data as is", label, parseErr)
+			passthrough = true
+			phase.endHandshake()
+			if err := write(records.Rest()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if fatalAlert != nil {
+		return relayAlertError(label, *fatalAlert)
+	}
+	logger.Printf("✅ %s: Relay complete, %d bytes transferred", label, totalBytes)
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	sultrytls "sultry/pkg/tls"
+)
+
+// scriptedConn returns one of reads from each Read, then EOF, and keeps
+// what is written to it one write at a time.
+type scriptedConn struct {
+	net.Conn
+	reads  [][]byte
+	writes [][]byte
+}
+
+func (c *scriptedConn) Read(b []byte) (int, error) {
+	if len(c.reads) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.reads[0])
+	c.reads = c.reads[1:]
+	return n, nil
+}
+
+func (c *scriptedConn) Write(b []byte) (int, error) {
+	c.writes = append(c.writes, bytes.Clone(b))
+	return len(b), nil
+}
+
+func (c *scriptedConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *scriptedConn) SetWriteDeadline(time.Time) error { return nil }
+
+// tlsRecord returns a record of type typ with a payload of n bytes.
+func tlsRecord(typ uint8, n int) []byte {
+	raw := binary.BigEndian.AppendUint16([]byte{typ, 3, 3}, uint16(n))
+	return append(raw, bytes.Repeat([]byte{typ}, n)...)
+}
+
+func TestRelayDataBatchesRecords(t *testing.T) {
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	r1, r2, r3 := tlsRecord(sultrytls.RecordApplicationData, 100), tlsRecord(sultrytls.RecordApplicationData, 300),
+		tlsRecord(sultrytls.RecordApplicationData, 5)
+	fatal := []byte{sultrytls.RecordAlert, 3, 3, 0, 2, 2, 40}
+
+	tests := []struct {
+		name   string
+		reads  [][]byte
+		writes [][]byte
+		err    bool
+	}{
+		{"records in one read", [][]byte{cat(r1, r2, r3)}, [][]byte{cat(r1, r2, r3)}, false},
+		{"record across reads", [][]byte{cat(r1, r2[:10]), cat(r2[10:], r3)}, [][]byte{r1, cat(r2, r3)}, false},
+		{"header across reads", [][]byte{r1[:3], r1[3:50], r1[50:]}, [][]byte{r1}, false},
+		{"closed inside a record", [][]byte{cat(r1, r2[:10])}, [][]byte{r1, r2[:10]}, false},
+		{"not TLS", [][]byte{[]byte("GET / "), []byte("HTTP/1.1")}, [][]byte{[]byte("GET / "), []byte("HTTP/1.1")}, false},
+		{"fatal alert", [][]byte{cat(r1, fatal)}, [][]byte{cat(r1, fatal)}, true},
+	}
+	for _, tt := range tests {
+		source, destination := &scriptedConn{reads: tt.reads}, &scriptedConn{}
+		err := relayData(newSessionLogger(), source, destination, make([]byte, 1024), "Target -> Client",
+			newRelayTimeouts(nil), nil, false)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: relay = %v, want error %v", tt.name, err, tt.err)
+		}
+		if len(destination.writes) != len(tt.writes) {
+			t.Errorf("%s: %d writes, want %d", tt.name, len(destination.writes), len(tt.writes))
+			continue
+		}
+		for i := range tt.writes {
+			if !bytes.Equal(destination.writes[i], tt.writes[i]) {
+				t.Errorf("%s: write %d is %d bytes, want %d", tt.name, i, len(destination.writes[i]), len(tt.writes[i]))
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+//go:build relay
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+)
+
+// Relay-only builds
+//
+// Built with -tags relay, sultry is only the server component: the relay
+// port, the OOB API and what they share, such as logging, the audit log and
+// the status endpoints. The client, its strategies and listeners, the plain
+// HTTP fetch path and the subcommands that work with them are left out, so
+// the binary is smaller and a relay host carries no code it never runs.
+// The stand-ins below keep the shared code building without them.
+
+// defaultMode is the mode sultry runs in without -mode.
+const defaultMode = "server"
+
+var errRelayOnly = errors.New("not available in a relay-only build")
+
+// client refuses to run, there is no client component to run.
+func client(config *Config) {
+	log.Fatalf("❌ This is a relay-only build, it can only run with -mode server")
+}
+
+// setupClient has nothing to install without a client.
+func setupClient(config *Config) error { return nil }
+
+// checkClientConfig has no client settings to check.
+func checkClientConfig(config *Config) []configIssue { return nil }
+
+// migrateClientConfig has no client settings to migrate.
+func migrateClientConfig(config *Config) []string { return nil }
+
+// coverPeers returns no peers, a relay has none to compare cover_sni with.
+func coverPeers(config *Config) []string { return nil }
+
+func reportSNI(args []string, out io.Writer) error        { return errRelayOnly }
+func checkIntegrity(args []string, out io.Writer) error   { return errRelayOnly }
+func benchHandshake(args []string, out io.Writer) error   { return errRelayOnly }
+func replayTranscript(args []string, out io.Writer) error { return errRelayOnly }
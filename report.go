@@ -0,0 +1,203 @@
+//go:build !relay
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// concealingStrategies keep a host out of the client's network: cover sends
+// its ClientHello through a relay, and oob has a relay look it up, though
+// the ClientHello it sends still names the host. Failures of the other
+// strategies are what shows that a host needs concealment.
+var concealingStrategies = map[string]bool{"cover": true, "oob": true}
+
+// sniHidingStrategies never send a ClientHello with the real SNI over the
+// client's network. They are all the kill switch tries.
+var sniHidingStrategies = map[string]bool{"cover": true}
+
+// sniReport is what the audit log says about one hostname.
+type sniReport struct {
+	Host       string         `json:"host"` // SNI, or a hash of it
+	Tunnels    int            `json:"tunnels"`
+	Connected  int            `json:"connected"`
+	Concealed  int            `json:"concealed"` // Connected through a concealing strategy
+	Failed     int            `json:"failed"`    // No strategy connected
+	Interfered int            `json:"interfered"`
+	Strategies map[string]int `json:"strategies,omitempty"` // Connections by strategy
+	Causes     map[string]int `json:"causes,omitempty"`     // Failed attempts by cause
+	LastSeen   time.Time      `json:"last_seen"`
+}
+
+// NeedsConcealment reports whether a strategy that leaves the SNI visible
+// failed the way interference does.
+func (r *sniReport) NeedsConcealment() bool {
+	return r.Interfered > 0
+}
+
+// reportSNI summarizes the audit log per hostname: which were contacted,
+// which needed concealment and which failed, as a starting point for
+// per-route policies.
+func reportSNI(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("report sni", flag.ContinueOnError)
+	path := flags.String("audit", "", "audit log to read (default: audit.path from config.json)")
+	hash := flags.Bool("hash", false, "replace hostnames with hashes, matching the dest field of the logs")
+	salt := flags.String("salt", "", "salt the hashes, so hostnames can't be recovered by hashing guesses (implies -hash)")
+	since := flags.Duration("since", 0, "only include events from this long ago")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *path == "" {
+		config, err := LoadConfig("config.json")
+		if err != nil {
+			return fmt.Errorf("no -audit given and failed to load config: %w", err)
+		}
+		if config.Audit.Path == "" {
+			return errors.New("no -audit given and audit.path is not configured")
+		}
+		*path = config.Audit.Path
+	}
+	file, err := os.Open(*path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var cutoff time.Time
+	if *since > 0 {
+		cutoff = time.Now().Add(-*since)
+	}
+	hosts := make(map[string]*sniReport)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var event auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("%s:%d: %w", *path, line, err)
+		}
+		if event.Time.Before(cutoff) {
+			continue
+		}
+		host := event.SNI
+		if host == "" {
+			host = strings.TrimSuffix(event.Dest, ":443")
+		}
+		host = strings.ToLower(host)
+		if *salt != "" {
+			sum := sha256.Sum256([]byte(*salt + host))
+			host = hex.EncodeToString(sum[:8])
+		} else if *hash {
+			host = destHash(host)
+		}
+		r, ok := hosts[host]
+		if !ok {
+			r = &sniReport{Host: host, Strategies: make(map[string]int), Causes: make(map[string]int)}
+			hosts[host] = r
+		}
+		r.add(event)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	reports := make([]*sniReport, 0, len(hosts))
+	for _, r := range hosts {
+		reports = append(reports, r)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Tunnels != reports[j].Tunnels {
+			return reports[i].Tunnels > reports[j].Tunnels
+		}
+		return reports[i].Host < reports[j].Host
+	})
+
+	if *asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(reports)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tTUNNELS\tCONCEALED\tFAILED\tNEEDS CONCEALMENT\tSTRATEGIES\tCAUSES")
+	for _, r := range reports {
+		needs := "no"
+		if r.NeedsConcealment() {
+			needs = "likely"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\t%s\n",
+			r.Host, r.Tunnels, r.Concealed, r.Failed, needs, formatCounts(r.Strategies), formatCounts(r.Causes))
+	}
+	return w.Flush()
+}
+
+// add accounts for one audit event.
+func (r *sniReport) add(event auditEvent) {
+	if event.Time.After(r.LastSeen) {
+		r.LastSeen = event.Time
+	}
+	interfered := event.Cause.suggestsInterference() && !concealingStrategies[event.Strategy]
+	switch event.Event {
+	case "connect":
+		r.Tunnels++
+		r.Connected++
+		r.Strategies[event.Strategy]++
+		if concealingStrategies[event.Strategy] {
+			r.Concealed++
+		}
+	case "fallback":
+		r.Causes[string(event.Cause)]++
+		if interfered {
+			r.Interfered++
+		}
+	case "failed":
+		r.Tunnels++
+		r.Failed++
+	case "dry_run":
+		r.Tunnels++
+		if event.Error != "" {
+			r.Failed++
+			r.Causes[string(event.Cause)]++
+		} else {
+			r.Connected++
+			r.Strategies[event.Strategy]++
+		}
+		if event.Concealment == concealmentLikelyNeeded {
+			r.Interfered++
+		}
+	}
+}
+
+// formatCounts lists counts as "name=n" pairs, largest first.
+func formatCounts(counts map[string]int) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%d", name, counts[name])
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,94 @@
+//go:build !relay
+
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryConfig retries OOB requests that fail transiently, so a dropped
+// packet or a restarting load balancer doesn't abort SNI concealment and
+// send the connection down a fallback path.
+type RetryConfig struct {
+	MaxAttempts    int     `json:"max_attempts,omitempty"`    // Attempts per request, including the first; 1 disables retries (default: 3)
+	InitialBackoff int     `json:"initial_backoff,omitempty"` // Milliseconds before the first retry, doubled for each further one (default: 100)
+	MaxBackoff     int     `json:"max_backoff,omitempty"`     // Upper bound on the delay between attempts in ms (default: 2000)
+	Jitter         float64 `json:"jitter,omitempty"`          // Fraction of each delay that is randomized (default: 0.2)
+	RetryStatus    []int   `json:"retry_status,omitempty"`    // HTTP status codes worth retrying (default: 429, 502, 503)
+}
+
+// retryPolicy is a RetryConfig with defaults applied.
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	jitter         float64
+	retryStatus    map[int]bool
+}
+
+func newRetryPolicy(cfg RetryConfig) retryPolicy {
+	p := retryPolicy{
+		maxAttempts:    orDefault(cfg.MaxAttempts, 3),
+		initialBackoff: millis(cfg.InitialBackoff, 100),
+		maxBackoff:     millis(cfg.MaxBackoff, 2000),
+		jitter:         cfg.Jitter,
+		retryStatus:    make(map[int]bool),
+	}
+	if p.jitter == 0 {
+		p.jitter = 0.2
+	}
+	statuses := cfg.RetryStatus
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable}
+	}
+	for _, status := range statuses {
+		p.retryStatus[status] = true
+	}
+	return p
+}
+
+// backoff returns the delay before the given retry, counting from 1.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	delay := p.initialBackoff << (retry - 1)
+	if delay > p.maxBackoff || delay <= 0 {
+		delay = p.maxBackoff
+	}
+	spread := float64(delay) * p.jitter
+	return delay + time.Duration(spread*(2*rand.Float64()-1))
+}
+
+// withRetry runs send until it succeeds, fails permanently or runs out of
+// attempts, and returns its last result. send must build a fresh request on
+// every call. Responses with a retryable status are retried, as are
+// transport errors: all of them for idempotent requests, but only failures
+// to connect otherwise, since a request that reached the server may have
+// been forwarded to the target already.
+func (o *OOBModule) withRetry(peer, path string, idempotent bool, send func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := send()
+		if attempt >= o.retry.maxAttempts {
+			return resp, err
+		}
+
+		var reason string
+		switch {
+		case err != nil && (idempotent || isDialError(err)):
+			reason = err.Error()
+		case err == nil && o.retry.retryStatus[resp.StatusCode]:
+			reason = resp.Status
+		default:
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		delay := o.retry.backoff(attempt)
+		log.Printf("⚠️ OOB request %s to %s failed (attempt %d/%d), retrying in %v: %s",
+			path, peer, attempt, o.retry.maxAttempts, delay.Truncate(time.Millisecond), reason)
+		time.Sleep(delay)
+	}
+}
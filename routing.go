@@ -0,0 +1,252 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+)
+
+// Routing rules
+//
+// The strategies apply to every tunnel alike, ordered once for all hosts by
+// strategies or prioritize_sni_concealment. Rules pick how tunnels to
+// particular hosts connect instead: some are fine connecting directly and
+// only pay for concealment if it's forced on them, some must never be seen
+// by name, some are better not reached at all, and some should go through a
+// relay in a particular place. Each tunnel is routed by the first rule
+// matching its SNI or CONNECT host; tunnels no rule matches use the
+// configured strategies.
+//
+// Rules can also match the networks a host resolves to, so that internal
+// hosts, whatever their names, never go near an OOB peer. Those are only
+// known once the host is resolved, so tunnels wait for the pipeline's DNS
+// stage when a network rule comes before every rule their names match.
+
+// RoutingRule decides how tunnels to matching hosts are connected.
+type RoutingRule struct {
+	Hosts    []string   `json:"hosts,omitempty"`    // "host", "*.example.com", "*", "keyword:..." or "regexp:..."
+	Lists    []HostList `json:"lists,omitempty"`    // Files of more hosts: gfwlist, dnsmasq or plain lists
+	Networks []string   `json:"networks,omitempty"` // CIDRs or addresses the host resolves into, or "private" for RFC 1918, loopback and link-local ones
+	Action   string     `json:"action"`             // "direct", "conceal", "block" or "forward"
+	Peer     string     `json:"peer,omitempty"`     // OOB peer tunnels are forwarded through, "address:port" as in oob_channels (for "forward")
+}
+
+// Routing actions.
+const (
+	routeDirect  = "direct"  // Only strategies that connect from the client, in the configured order
+	routeConceal = "conceal" // Only strategies concealing the SNI, like DoH resolvers
+	routeBlock   = "block"   // Refused
+	routeForward = "forward" // Concealed through one OOB peer
+)
+
+// networkPrivate stands for the networks hosts of a LAN or of the machine
+// itself are in.
+const networkPrivate = "private"
+
+var privateNetworks = []string{
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "169.254.0.0/16",
+	"fc00::/7", "::1/128", "fe80::/10",
+}
+
+// routingTable is a compiled set of rules.
+type routingTable struct {
+	rules    []RoutingRule
+	hosts    *hostMatcher     // Hosts of rules, numbered by rule
+	networks []networkPattern // In rule order
+}
+
+// networkPattern is a network of the rule numbered n.
+type networkPattern struct {
+	network *net.IPNet
+	n       int
+}
+
+// compileRules checks every rule against the OOB peers of channels and
+// files their hosts, and those of their lists, in a matcher, numbered by
+// rule, along with their networks.
+func compileRules(rules []RoutingRule, channels []OOBChannelConfig) (*routingTable, error) {
+	peers := newPeerBalancer(channels, LoadBalancerConfig{}).Peers()
+	matcher := newHostMatcher()
+	var networks []networkPattern
+	for i, rule := range rules {
+		if err := rule.validate(peers); err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		for _, pattern := range rule.Hosts {
+			matcher.add(pattern, i)
+		}
+		for j, list := range rule.Lists {
+			patterns, skipped, err := loadHostList(list)
+			if err != nil {
+				return nil, fmt.Errorf("rules[%d].lists[%d]: %w", i, j, err)
+			}
+			for _, pattern := range patterns {
+				matcher.add(pattern, i)
+			}
+			log.Printf("📜 Loaded %d hosts for %s rule from %s (%d entries skipped)", len(patterns), rule.Action, list.Path, skipped)
+		}
+		for _, network := range rule.Networks {
+			parsed, _ := parseNetworks(network)
+			for _, ipNet := range parsed {
+				networks = append(networks, networkPattern{ipNet, i})
+			}
+		}
+	}
+	return &routingTable{rules: rules, hosts: matcher, networks: networks}, nil
+}
+
+// parseNetworks parses a network of a rule: a CIDR, a single address or
+// "private".
+func parseNetworks(network string) ([]*net.IPNet, error) {
+	if network == networkPrivate {
+		var networks []*net.IPNet
+		for _, cidr := range privateNetworks {
+			_, ipNet, _ := net.ParseCIDR(cidr)
+			networks = append(networks, ipNet)
+		}
+		return networks, nil
+	}
+	if ip := net.ParseIP(network); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return []*net.IPNet{{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q (use a CIDR, an address or %q)", network, networkPrivate)
+	}
+	return []*net.IPNet{ipNet}, nil
+}
+
+// validate checks the hosts, lists, networks and action of r and that a forwarding rule
+// names one of peers.
+func (r RoutingRule) validate(peers []string) error {
+	if len(r.Hosts) == 0 && len(r.Lists) == 0 && len(r.Networks) == 0 {
+		return fmt.Errorf("no hosts, lists or networks")
+	}
+	for _, pattern := range r.Hosts {
+		if err := validHostPattern(pattern); err != nil {
+			return err
+		}
+	}
+	for _, network := range r.Networks {
+		if _, err := parseNetworks(network); err != nil {
+			return err
+		}
+	}
+	for i, list := range r.Lists {
+		if err := list.validate(); err != nil {
+			return fmt.Errorf("lists[%d]: %w", i, err)
+		}
+	}
+	switch r.Action {
+	case routeDirect, routeConceal, routeBlock:
+		if r.Peer != "" {
+			return fmt.Errorf("only forward rules have a peer")
+		}
+	case routeForward:
+		if !slices.Contains(peers, r.Peer) {
+			return fmt.Errorf("peer %q is not one of the oob_channels", r.Peer)
+		}
+	default:
+		return fmt.Errorf("unknown action %q (use direct, conceal, block or forward)", r.Action)
+	}
+	return nil
+}
+
+// route returns the first rule whose hosts match any of names, or nil.
+// Network rules are skipped, since the host isn't resolved yet: requests
+// and CONNECTs are refused by name up front, even when an earlier network
+// rule would route the host's addresses otherwise once routed resolves it.
+func (p *TLSProxy) route(names ...string) *RoutingRule {
+	rule, _ := p.rules.Load().match(names, nil)
+	return rule
+}
+
+// match returns the first rule matching any of names or any of the
+// addresses addrs returns, along with the address if it was a network that
+// matched. addrs is only called when a network rule comes before every
+// rule names match; with addrs nil, network rules are skipped.
+func (t *routingTable) match(names []string, addrs func() []net.IPAddr) (*RoutingRule, net.IP) {
+	if t == nil {
+		return nil, nil
+	}
+	best, ok := t.hosts.match(names...)
+	var by net.IP
+	if addrs != nil && len(t.networks) > 0 && (!ok || t.networks[0].n < best) {
+		for _, addr := range addrs() {
+			for _, pattern := range t.networks {
+				if ok && pattern.n >= best {
+					break
+				}
+				if pattern.network.Contains(addr.IP) {
+					best, ok, by = pattern.n, true, addr.IP
+					break
+				}
+			}
+		}
+	}
+	if !ok {
+		return nil, nil
+	}
+	return &t.rules[best], by
+}
+
+// blocks reports whether a rule refuses tunnels and requests to host.
+func (p *TLSProxy) blocks(host string) bool {
+	rule := p.route(host)
+	return rule != nil && rule.Action == routeBlock
+}
+
+// resetOnClose has conn reset when it's closed rather than shut down in
+// order, so a client refused a blocked host fails at once instead of
+// waiting for a TLS handshake that won't come.
+func resetOnClose(conn net.Conn) {
+	if tcpConn, ok := tcpConnOf(conn); ok {
+		tcpConn.SetLinger(0)
+	}
+}
+
+// routed fills in how dest is connected: by the rule matching it, or, when
+// none does, concealed if it's a DNS-over-HTTPS resolver. Network rules are
+// matched against the addresses of dest's DNS stage, waited for up to the
+// handshake timeout; hosts that don't resolve match none.
+func (p *TLSProxy) routed(ctx context.Context, dest Destination) Destination {
+	addrs := func() []net.IPAddr {
+		if ip := net.ParseIP(dest.Host); ip != nil {
+			return []net.IPAddr{{IP: ip}}
+		}
+		if dest.resolver == nil {
+			return nil
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, timeouts.handshake)
+		defer cancel()
+		ips, _ := dest.resolver.wait(waitCtx)
+		return ips
+	}
+	if rule, by := p.rules.Load().match([]string{dest.SNI, dest.Host}, addrs); rule != nil {
+		if by != nil && dest.ClientHello != nil {
+			// Logged once, when the tunnel is routed for good
+			sessionLog(ctx).Printf("🧭 %s resolves to %s, which a rule routes %s", dest.Host, by, rule.Action)
+		}
+		dest.Route, dest.Peer = rule.Action, rule.Peer
+		return dest
+	}
+	dest.Conceal = p.doh.matches(dest.Host, dest.SNI)
+	return dest
+}
+
+// PeerFor returns the peer a new session to dest uses: the one a rule
+// forwards it through, or else one picked by the balancer.
+func (o *OOBModule) PeerFor(dest Destination) string {
+	if dest.Peer != "" {
+		return dest.Peer
+	}
+	return o.GetServerAddress()
+}
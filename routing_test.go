@@ -0,0 +1,96 @@
+//go:build !relay
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRoutingNetworkRuleBeforeBlockRule(t *testing.T) {
+	table, err := compileRules([]RoutingRule{
+		{Networks: []string{networkPrivate}, Action: routeDirect},
+		{Hosts: []string{"*.ads.example"}, Action: routeBlock},
+		{Hosts: []string{"*"}, Action: routeConceal},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &TLSProxy{}
+	p.rules.Store(table)
+
+	// Blocking by name doesn't wait for the host to resolve
+	for host, blocked := range map[string]bool{
+		"ads.example":         true,
+		"tracker.ads.example": true,
+		"news.example":        false,
+		"10.1.2.3":            false,
+	} {
+		if got := p.blocks(host); got != blocked {
+			t.Errorf("blocks(%q) = %v, want %v", host, got, blocked)
+		}
+	}
+
+	resolved := func(ips ...string) func() []net.IPAddr {
+		return func() []net.IPAddr {
+			var addrs []net.IPAddr
+			for _, ip := range ips {
+				addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+			}
+			return addrs
+		}
+	}
+	tests := []struct {
+		name   string
+		addrs  func() []net.IPAddr
+		action string
+		by     string
+	}{
+		{"ads.example", nil, routeBlock, ""},
+		{"ads.example", resolved("203.0.113.7"), routeBlock, ""},
+		{"ads.example", resolved("203.0.113.7", "192.168.1.20"), routeDirect, "192.168.1.20"},
+		{"intranet.example", resolved("10.0.0.5"), routeDirect, "10.0.0.5"},
+		{"intranet.example", resolved("fd00::5"), routeDirect, "fd00::5"},
+		{"news.example", resolved("198.51.100.1"), routeConceal, ""},
+		{"news.example", nil, routeConceal, ""},
+	}
+	for _, tt := range tests {
+		rule, by := table.match([]string{tt.name}, tt.addrs)
+		if rule == nil || rule.Action != tt.action {
+			t.Errorf("match(%q) = %+v, want %s", tt.name, rule, tt.action)
+			continue
+		}
+		if (by == nil && tt.by != "") || (by != nil && !by.Equal(net.ParseIP(tt.by))) {
+			t.Errorf("match(%q) matched by %v, want %q", tt.name, by, tt.by)
+		}
+	}
+}
+
+func TestRoutingNetworksOnlyConsultedWhenFirst(t *testing.T) {
+	table, err := compileRules([]RoutingRule{
+		{Hosts: []string{"internal.example"}, Action: routeConceal},
+		{Networks: []string{"10.0.0.0/8", "192.0.2.1"}, Action: routeDirect},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	addrs := func() []net.IPAddr {
+		called = true
+		return []net.IPAddr{{IP: net.ParseIP("10.1.1.1")}}
+	}
+	if rule, _ := table.match([]string{"internal.example"}, addrs); rule == nil || rule.Action != routeConceal {
+		t.Errorf("match(internal.example) = %+v, want conceal", rule)
+	}
+	if called {
+		t.Error("addresses looked up although a host rule comes first")
+	}
+	if rule, _ := table.match([]string{"other.example"}, func() []net.IPAddr {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}
+	}); rule == nil || rule.Action != routeDirect {
+		t.Errorf("match(other.example) = %+v, want direct", rule)
+	}
+	if rule, _ := table.match([]string{"other.example"}, nil); rule != nil {
+		t.Errorf("match(other.example) without addresses = %+v, want none", rule)
+	}
+}
@@ -0,0 +1,92 @@
+//go:build !relay
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Reloading rules
+//
+// Blocklists and lists of censored domains change daily, and a gateway
+// serving a household or an office shouldn't drop every tunnel to pick the
+// new ones up. On SIGHUP, or when rules_watch sees config.json or a list
+// file change, the rules are read and compiled again, and the new table
+// replaces the old in one step. Tunnels are routed once, when they start,
+// so those already open carry on as they were; new ones follow the new
+// rules. A configuration or list that fails to load leaves the current
+// rules in place.
+
+// watchRules reloads the rules from path on SIGHUP and, with interval
+// above 0, whenever path or a list file of the rules changes, checking
+// every interval milliseconds.
+func (p *TLSProxy) watchRules(path string, interval int) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	stamp := p.rules.Load().stamp(path)
+	for {
+		select {
+		case <-hup:
+			p.reloadRules(path, "SIGHUP")
+		case <-tick:
+			if p.rules.Load().stamp(path) == stamp {
+				continue
+			}
+			p.reloadRules(path, "files changed")
+		}
+		// Failed reloads aren't retried until the files change again
+		stamp = p.rules.Load().stamp(path)
+	}
+}
+
+// reloadRules compiles the rules of the configuration at path and swaps
+// them in, keeping the current ones if that fails.
+func (p *TLSProxy) reloadRules(path, reason string) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		log.Printf("❌ Failed to reload the routing rules (%s), keeping the current ones: %v", reason, err)
+		return
+	}
+	table, err := compileRules(config.Rules, p.OOB.Channels)
+	if err != nil {
+		log.Printf("❌ Invalid routing rules in %s (%s), keeping the current ones: %v", path, reason, err)
+		return
+	}
+	p.rules.Store(table)
+	log.Printf("🔄 Reloaded %d routing rule(s) from %s (%s)", len(table.rules), path, reason)
+}
+
+// stamp sums up the modification times and sizes of path and of the list
+// files of t, to tell when any of them changed.
+func (t *routingTable) stamp(path string) string {
+	files := []string{path}
+	if t != nil {
+		for _, rule := range t.rules {
+			for _, list := range rule.Lists {
+				files = append(files, list.Path)
+			}
+		}
+	}
+	var b strings.Builder
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			fmt.Fprintf(&b, "%s %d %d\n", file, info.ModTime().UnixNano(), info.Size())
+		} else {
+			fmt.Fprintf(&b, "%s missing\n", file)
+		}
+	}
+	return b.String()
+}
@@ -18,7 +18,9 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -27,9 +29,15 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"strings"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	sultrytls "sultry/pkg/tls"
 )
 
 // SessionState represents the state of a TLS session.
@@ -42,7 +50,32 @@ type SessionState struct {
 	ResponseQueue     chan []byte
 	Adopted           bool
 	ServerMsgIndex    int        // Index into ServerResponses for direct access
+	Streaming         bool       // Responses are delivered over /events instead of /handshake
 	mu                sync.Mutex // Protects all fields in this struct
+
+	// The relayed handshake, followed record by record to tell when it's
+	// complete and which version it negotiated
+	handshake sultrytls.Handshake
+
+	// Accounting against handshake_limits
+	handshakeStarted  time.Time
+	handshakeMessages int
+	handshakeBytes    int
+
+	// Checking the target's certificate against verify_target
+	sni        string
+	verifyDone bool
+	verifyErr  error
+
+	// Whether the ServerHello was checked against legacy_tls
+	legacyChecked bool
+
+	// Ends the redaction of sni in log lines once the session is removed
+	unredact func()
+
+	// Closed once handleTargetResponses stops reading TargetConn, which
+	// adoption waits for before relaying it
+	readerDone chan struct{}
 }
 
 // Global session store
@@ -52,13 +85,39 @@ var (
 )
 
 func server(config *Config) {
-	// Configure more verbose logging
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+	// Configure more verbose logging; JSON lines carry their own time and source
+	if config.Log.Format != "json" {
+		log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+	}
 	log.Println("🚀 Starting Sultry server component...")
-	log.Println("📝 Configuration:", fmt.Sprintf("%+v", *config))
+	log.Println("📝 Configuration:", redactedConfig(config))
+
+	// Visitors that aren't sultry clients get the decoy site, if configured
+	var decoy http.Handler
+	if config.Decoy.Root != "" {
+		handler, err := newDecoyHandler(config.Decoy)
+		if err != nil {
+			log.Fatalf("❌ Failed to set up decoy site: %v", err)
+		}
+		decoy = handler
+		log.Printf("🎭 Serving decoy site from %s", config.Decoy.Root)
+	}
+
+	// Hardened deployments serve only the authenticated API
+	if config.Strict {
+		if err := checkStrict(config); err != nil {
+			log.Fatalf("❌ Strict mode: %v", err)
+		}
+		log.Println("🔒 Strict mode - legacy endpoints are disabled")
+	}
 
 	// Set up HTTP handlers for different endpoints
-	http.HandleFunc("/", legacyServe)              // Legacy endpoint for backward compatibility
+	if config.Strict {
+		http.Handle("/", withDecoy(decoy, http.NotFound))
+	} else {
+		http.Handle("/", withDecoy(decoy, legacyServe)) // Legacy endpoint for backward compatibility
+		http.HandleFunc("/heartbeat", handleHeartbeat)  // Liveness checks from clients predating pings
+	}
 	http.HandleFunc("/handshake", handleHandshake) // New endpoint for handshake messages
 	http.HandleFunc("/appdata", handleAppData)     // New endpoint for application data
 	http.HandleFunc("/complete_handshake", handleCompleteHandshake)
@@ -68,10 +127,21 @@ func server(config *Config) {
 	http.HandleFunc("/get_response", handleGetResponse)             // New endpoint for getting server responses
 	http.HandleFunc("/send_data", handleSendData)                   // New endpoint for sending client data
 	http.HandleFunc("/create_connection", handleCreateConnection)   // New endpoint for simplified SNI concealment
+	http.HandleFunc("/events", handleEvents)                        // Server-sent events stream of handshake responses
+	http.HandleFunc("/ping", handlePing)                            // RTT probes from clients
+	http.HandleFunc("/cover_open", handleCoverOpen)                 // Send a ClientHello to a target for a cover relay
+	http.HandleFunc("/cover_attach", handleCoverAttach)             // Attach the main channel of a cover relay
+	http.HandleFunc("/capabilities", handleCapabilities)            // Version and capability exchange on first contact
+	http.HandleFunc("/version", handleVersion)                      // Build information
+	muxListener := newStreamListener(&net.TCPAddr{Port: config.RelayPort})
+	http.HandleFunc("/mux", muxUpgradeHandler(muxListener)) // Upgrade to a multiplexed session
+	http.HandleFunc("/sessions", handleSessionSync)         // Session re-sync after a dropped multiplexed session
 
 	// Log all registered routes
 	log.Println("📌 Registered HTTP handlers:")
-	log.Println("   - /                   (Legacy endpoint)")
+	if !config.Strict {
+		log.Println("   - /                   (Legacy endpoint)")
+	}
 	log.Println("   - /handshake          (Handshake message handler)")
 	log.Println("   - /appdata            (Application data handler)")
 	log.Println("   - /complete_handshake (Handshake completion handler)")
@@ -81,13 +151,155 @@ func server(config *Config) {
 	log.Println("   - /get_response       (Response retrieval handler)")
 	log.Println("   - /send_data          (Data sending handler)")
 	log.Println("   - /create_connection  (SNI resolution handler)")
+	log.Println("   - /events             (Handshake response stream)")
+	if !config.Strict {
+		log.Println("   - /heartbeat          (Client liveness checks)")
+	}
+	log.Println("   - /ping               (Client RTT probes)")
+	log.Println("   - /cover_open         (Cover relay setup)")
+	log.Println("   - /cover_attach       (Cover relay main channel)")
+	log.Println("   - /mux                (Multiplexed session upgrade)")
+	log.Println("   - /sessions           (Session re-sync)")
+	log.Println("   - /capabilities       (Capability exchange)")
+	log.Println("   - /version            (Build information)")
+
+	handleStatus("/paths", func() any { return pathHealth.Snapshot() })
+	handshakeLimits = config.HandshakeLimits
+	targetVerify = config.VerifyTarget
+	if targetVerify.Enabled {
+		log.Println("🔒 Certificates of relayed targets are verified")
+	}
+	handleStatus("/clients", func() any { return clientLatency.Snapshot() })
+	relayedAlerts.handleStatus()
+	startCoverChecks(config)
 
 	// Start cleanup goroutine
 	go cleanupInactiveSessions()
 
+	tlsConfig, err := serverTLSConfig(config.OOBTLS)
+	if err != nil {
+		log.Fatalf("❌ Failed to configure OOB TLS: %v", err)
+	}
+
+	addr := ":" + fmt.Sprint(config.RelayPort)
+	if len(config.Auth.Tokens) > 0 {
+		log.Printf("🔒 OOB API requires a bearer token (%d accepted)", len(config.Auth.Tokens))
+		serverCapabilities = localCapabilities([]string{"bearer"})
+	}
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: redactingClients(authMiddleware(config.Auth, http.DefaultServeMux, decoy)),
+	}
+	relay := newRelayServer(srv, muxListener, loopbackListener)
+	if config.WebTransport.Listen != "" {
+		relay.webTransport, err = newWebTransportServer(config.WebTransport, tlsConfig, config.Auth, srv.Handler)
+		if err != nil {
+			log.Printf("❌ WebTransport listener stopped: %v", err)
+		}
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("❌ Failed to listen on port %d: %v", config.RelayPort, err)
+	}
+	if config.AcceptProxyProtocol.Enabled {
+		listener, err = newProxyProtocolListener(listener, config.AcceptProxyProtocol)
+		if err != nil {
+			log.Fatalf("❌ Invalid accept_proxy_protocol configuration: %v", err)
+		}
+		log.Println("🔹 Client addresses taken from PROXY protocol headers")
+	}
 	log.Println("🔹 TLS Relay service listening on port", config.RelayPort)
 	log.Println("✅ Server ready to accept connections")
-	log.Fatal(http.ListenAndServe(":"+fmt.Sprint(config.RelayPort), nil))
+	if tlsConfig != nil {
+		log.Println("🔒 OOB API served over HTTPS")
+		srv.TLSConfig = tlsConfig
+		// Disable HTTP/2 so connection adoption can hijack the connection
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	// Everything is served until SIGINT or SIGTERM, or a listener fails
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() { served <- relay.Serve(listener) }()
+	select {
+	case err := <-served:
+		log.Fatalf("❌ Server failed: %v", err)
+	case <-ctx.Done():
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	relay.Shutdown(ctx)
+	if err := <-served; err != nil {
+		log.Fatalf("❌ Server failed: %v", err)
+	}
+	log.Println("✅ Server stopped")
+}
+
+// RelayServer serves the OOB API on the relay port, to the streams of
+// multiplexed sessions and to clients in the same process, and over
+// WebTransport if configured.
+type RelayServer struct {
+	srv          *http.Server // The relay port
+	internal     *http.Server // Streams and in-memory pipes, served like separate connections
+	listeners    []net.Listener
+	webTransport *webTransportServer // Nil unless configured
+	dial         targetDialer        // Connects to targets in place of dialTarget's default, if set
+	stopping     chan struct{}
+	stopOnce     sync.Once
+}
+
+// newRelayServer returns a relay serving srv's handler on the relay port
+// and on the internal listeners.
+func newRelayServer(srv *http.Server, internal ...net.Listener) *RelayServer {
+	return &RelayServer{
+		srv:       srv,
+		internal:  &http.Server{Handler: srv.Handler},
+		listeners: internal,
+		stopping:  make(chan struct{}),
+	}
+}
+
+// Serve serves on listener, the relay port, and the internal listeners
+// until Shutdown, returning nil then. If one of them fails, the others are
+// closed and the error is returned.
+func (r *RelayServer) Serve(listener net.Listener) error {
+	if r.dial != nil {
+		base := func(net.Listener) context.Context { return withTargetDialer(context.Background(), r.dial) }
+		r.srv.BaseContext, r.internal.BaseContext = base, base
+	}
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, l := range r.listeners {
+		g.Go(func() error { return serveUntilShutdown(r.internal.Serve(l)) })
+	}
+	if r.srv.TLSConfig != nil {
+		g.Go(func() error { return serveUntilShutdown(r.srv.ServeTLS(listener, "", "")) })
+	} else {
+		// Main channels of cover relays start with a ClientHello carrying the cover SNI
+		g.Go(func() error { return serveUntilShutdown(r.srv.Serve(coverPrefaceListener{listener})) })
+	}
+	if r.webTransport != nil {
+		go func() {
+			if err := r.webTransport.Serve(); err != nil {
+				log.Printf("❌ WebTransport listener stopped: %v", err)
+			}
+		}()
+	}
+	g.Go(func() error {
+		select {
+		case <-ctx.Done():
+			r.close()
+		case <-r.stopping:
+		}
+		return nil
+	})
+	return g.Wait()
+}
+
+// ClientHelloRequest represents the payload for an SNI request.
+type ClientHelloRequest struct {
+	SNI  string `json:"sni"`
+	Data []byte `json:"client_hello"`
 }
 
 // Legacy handler for backward compatibility
@@ -101,6 +313,7 @@ func legacyServe(w http.ResponseWriter, r *http.Request) {
 
 	clientHello := req.Data
 	sni := req.SNI
+	defer redactWhileLive(sensitiveSNI, sni)()
 
 	if len(clientHello) == 0 {
 		http.Error(w, "ClientHello data is required", http.StatusBadRequest)
@@ -110,7 +323,7 @@ func legacyServe(w http.ResponseWriter, r *http.Request) {
 	log.Println("🔹 Performing TLS handshake with real server for:", sni)
 
 	// Forward the ClientHello to the real target
-	serverHello, err := forwardClientHello(clientHello, sni)
+	serverHello, err := forwardClientHello(r.Context(), clientHello, sni)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to fetch ServerHello: %v", err), http.StatusInternalServerError)
 		return
@@ -121,8 +334,7 @@ func legacyServe(w http.ResponseWriter, r *http.Request) {
 
 // Handler for new handshake messages
 func handleHandshake(w http.ResponseWriter, r *http.Request) {
-	var req HandshakeMessageRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	req, err := decodeOOBMessage(r)
 	if err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
@@ -131,6 +343,7 @@ func handleHandshake(w http.ResponseWriter, r *http.Request) {
 	sessionID := req.SessionID
 	clientMsg := req.Data
 	sni := req.SNI
+	defer redactWhileLive(sensitiveSNI, sni)()
 
 	if len(clientMsg) == 0 {
 		http.Error(w, "Client message data is required", http.StatusBadRequest)
@@ -144,8 +357,8 @@ func handleHandshake(w http.ResponseWriter, r *http.Request) {
 
 	if !exists {
 		// This is a new session, initialize it
-		log.Printf("🔹 Initiating new TLS handshake session %s for SNI: %s", sessionID, sni)
-		err = handleOOBRequest(sessionID, clientMsg, sni)
+		log.Printf("🔹 Initiating new TLS handshake session %s for SNI: %s", sessionID, redacted(sensitiveSNI, sni))
+		err = handleOOBRequest(r.Context(), sessionID, clientMsg, sni)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to initialize handshake: %v", err), http.StatusInternalServerError)
 			return
@@ -164,8 +377,8 @@ func handleHandshake(w http.ResponseWriter, r *http.Request) {
 		// Wait for the first response from the server
 		select {
 		case serverResponse := <-session.ResponseQueue:
-			w.Write(serverResponse)
-		case <-time.After(30 * time.Second):
+			writeHandshakeResponse(w, session, serverResponse)
+		case <-time.After(time.Until(session.handshakeDeadline())):
 			http.Error(w, "Timeout waiting for server response", http.StatusGatewayTimeout)
 		}
 		return
@@ -173,6 +386,10 @@ func handleHandshake(w http.ResponseWriter, r *http.Request) {
 
 	// This is an existing session, forward the client message
 	isComplete, err := handleClientMessage(sessionID, clientMsg)
+	if errors.Is(err, sultrytls.ErrUnexpectedClientHello) {
+		http.Error(w, fmt.Sprintf("Rejected client message: %v", err), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to process client message: %v", err), http.StatusInternalServerError)
 		return
@@ -187,16 +404,15 @@ func handleHandshake(w http.ResponseWriter, r *http.Request) {
 	// Wait for the server's response
 	select {
 	case serverResponse := <-session.ResponseQueue:
-		w.Write(serverResponse)
-	case <-time.After(30 * time.Second):
+		writeHandshakeResponse(w, session, serverResponse)
+	case <-time.After(time.Until(session.handshakeDeadline())):
 		http.Error(w, "Timeout waiting for server response", http.StatusGatewayTimeout)
 	}
 }
 
 // Handler for application data
 func handleAppData(w http.ResponseWriter, r *http.Request) {
-	var req AppDataRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	req, err := decodeOOBMessage(r)
 	if err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
@@ -220,8 +436,8 @@ func handleAppData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Forward the application data to the target with timeout
-	session.TargetConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	// Forward the application data to the target, which may take as long as the data phase allows
+	session.TargetConn.SetWriteDeadline(session.targetWriteDeadline())
 	_, err = session.TargetConn.Write(data)
 	session.TargetConn.SetWriteDeadline(time.Time{})
 	if err != nil {
@@ -235,7 +451,11 @@ func handleAppData(w http.ResponseWriter, r *http.Request) {
 }
 
 // Initialize a new OOB handshake session
-func handleOOBRequest(sessionID string, clientHello []byte, sni string) error {
+func handleOOBRequest(ctx context.Context, sessionID string, clientHello []byte, sni string) error {
+	if err := checkLegacyClientHello(log.Printf, clientHello); err != nil {
+		return err
+	}
+
 	// Connect to the target server with optimized settings
 	// Use a dialer with timeout for better connection performance
 	dialer := &net.Dialer{
@@ -243,21 +463,19 @@ func handleOOBRequest(sessionID string, clientHello []byte, sni string) error {
 		KeepAlive: 30 * time.Second,
 	}
 
-	targetConn, err := dialer.Dial("tcp", sni+":443")
+	targetConn, err := dialTarget(ctx, dialer, sni+":443")
 	if err != nil {
-		log.Printf("❌ Failed to connect to %s: %v", sni, err)
+		log.Printf("❌ Failed to connect to %s: %v", redacted(sensitiveSNI, sni), err)
 		return fmt.Errorf("failed to connect to %s: %w", sni, err)
 	}
 
-	if tcpConn, ok := targetConn.(*net.TCPConn); ok {
-		// Optimize TCP settings for TLS handshake performance
-		tcpConn.SetNoDelay(true) // Disable Nagle's algorithm
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	// Optimize TCP settings for TLS handshake performance
+	connTuner.Tune(targetConn, sni+":443")
+	if tcpConn, ok := tcpConnOf(targetConn); ok {
 		tcpConn.SetReadBuffer(32768)  // 32KB read buffer
 		tcpConn.SetWriteBuffer(32768) // 32KB write buffer
 	}
-	log.Printf("🔒 Connected to target server via SNI-concealed channel: %s", sni)
+	log.Printf("🔒 Connected to target server via SNI-concealed channel: %s", redacted(sensitiveSNI, sni))
 
 	// Create a new session
 	session := &SessionState{
@@ -265,7 +483,12 @@ func handleOOBRequest(sessionID string, clientHello []byte, sni string) error {
 		HandshakeComplete: false,
 		LastActivity:      time.Now(),
 		ServerResponses:   make([][]byte, 0),
+		ClientMessages:    [][]byte{clientHello},
 		ResponseQueue:     make(chan []byte, 100), // Much larger buffer
+		handshakeStarted:  time.Now(),
+		sni:               sni,
+		unredact:          redactWhileLive(sensitiveSNI, sni),
+		readerDone:        make(chan struct{}),
 	}
 
 	// Store the session
@@ -274,6 +497,10 @@ func handleOOBRequest(sessionID string, clientHello []byte, sni string) error {
 	sessionsMu.Unlock()
 
 	// Send ClientHello to target
+	if err := countHandshakeMessage(sessionID, session, len(clientHello)); err != nil {
+		return err
+	}
+	session.trackHandshake(sessionID, true, clientHello)
 	_, err = targetConn.Write(clientHello)
 	if err != nil {
 		log.Printf("❌ Failed to send ClientHello to target: %v", err)
@@ -283,14 +510,22 @@ func handleOOBRequest(sessionID string, clientHello []byte, sni string) error {
 	log.Printf("🔹 Sent ClientHello to target server for session: %s", sessionID)
 
 	// Start reading responses from target
-	go handleTargetResponses(sessionID, targetConn)
+	go handleTargetResponses(sessionID, targetConn, session.readerDone)
 
 	return nil
 }
 
-// In handleTargetResponses function in server.go:
-func handleTargetResponses(sessionID string, targetConn net.Conn) {
+// handleTargetResponses queues what the target sends during the handshake
+// for the client, until the session is adopted and the target connection is
+// handed over to the relay, or the target closes it. done is closed once it
+// stops reading.
+func handleTargetResponses(sessionID string, targetConn net.Conn, done chan<- struct{}) {
+	handedOver := false
 	defer func() {
+		close(done)
+		if handedOver {
+			return
+		}
 		log.Printf("🔹 Closing target connection for session %s", sessionID)
 		targetConn.Close()
 	}()
@@ -298,45 +533,56 @@ func handleTargetResponses(sessionID string, targetConn net.Conn) {
 	// Use a larger buffer for more reliable handshake processing
 	buffer := make([]byte, 1048576) // Increase buffer size to 1MB for large TLS records
 
-	// When session is adopted, we should stop processing in this function
-	var directConnStarted bool = false
+	// Responses are queued in whole records, so the client never gets a
+	// fragment it would relay on its own
+	var records sultrytls.Reassembler
+	passthrough := false
 
 	// We don't want to send ChangeCipherSpec during this phase anymore
 	// It's better to let the normal TLS handshake complete naturally
 
 	for {
-		// Check if the session has been adopted and hijacked to a direct connection
 		sessionsMu.Lock()
 		session, exists := sessions[sessionID]
-		sessionAdopted := exists && session.Adopted
 		sessionsMu.Unlock()
 
-		if sessionAdopted && !directConnStarted {
-			// Session has been adopted, but direct connection hasn't been fully established yet
-			log.Printf("🔹 Session %s is adopted, waiting for direct connection setup...", sessionID)
-			directConnStarted = true
-
-			// We'll continue reading data for a short time to make sure the transition is smooth
-			// After this cycle, we'll keep checking if the session still exists
-		} else if sessionAdopted && directConnStarted {
-			// Check if the session still exists - if not, direct relay is fully taking over
-			sessionsMu.Lock()
-			_, stillExists := sessions[sessionID]
-			sessionsMu.Unlock()
-
-			if !stillExists {
-				log.Printf("🔹 Session %s has been transferred to direct relay, stopping target reader", sessionID)
-				return
-			}
+		// The handshake must be done by its deadline; afterwards the
+		// target may stay quiet until the client adopts the connection
+		handshaking := false
+		if session != nil {
+			session.mu.Lock()
+			handshaking = !session.HandshakeComplete
+			session.mu.Unlock()
+		}
+		deadline := time.Now().Add(relayWake)
+		if handshaking {
+			deadline = session.handshakeDeadline()
+		}
+		targetConn.SetReadDeadline(deadline)
+
+		// Adoption marks the session before cutting this read short, so
+		// nothing is read from the target once the relay reads it
+		adopted := false
+		if session != nil {
+			session.mu.Lock()
+			adopted = session.Adopted
+			session.mu.Unlock()
+		}
+		if adopted {
+			log.Printf("🔹 Session %s is adopted, handing the target connection over", sessionID)
+			targetConn.SetReadDeadline(time.Time{})
+			handedOver = true
+			return
 		}
-
-		// Read response from target server with reasonable timeout
-		targetConn.SetReadDeadline(time.Now().Add(30 * time.Second))
 		n, err := targetConn.Read(buffer)
 		targetConn.SetReadDeadline(time.Time{}) // Reset the deadline after read
 
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if handshaking && !time.Now().Before(deadline) {
+					abortHandshake(sessionID, session, time.Since(session.handshakeStarted).Truncate(time.Millisecond).String())
+					return
+				}
 				log.Printf("⚠️ Read timeout from target server for session %s, continuing", sessionID)
 				continue
 			} else if err != io.EOF {
@@ -344,6 +590,9 @@ func handleTargetResponses(sessionID string, targetConn net.Conn) {
 			} else {
 				log.Printf("🔹 Target server closed connection for session %s", sessionID)
 			}
+			if records.Buffered() > 0 {
+				log.Printf("⚠️ Target closed inside a TLS record for session %s, dropping %d bytes", sessionID, records.Buffered())
+			}
 
 			// IMPORTANT: Signal any waiting clients about connection close
 			sessionsMu.Lock()
@@ -362,7 +611,50 @@ func handleTargetResponses(sessionID string, targetConn net.Conn) {
 		}
 
 		// Store and forward the response data
-		responseData := buffer[:n]
+		responseData := append([]byte(nil), buffer[:n]...)
+		if !passthrough {
+			complete, err := records.Feed(buffer[:n])
+			responseData = nil
+			for _, record := range complete {
+				responseData = append(responseData, record.Raw...)
+			}
+			if err != nil {
+				log.Printf("⚠️ Target of session %s: %v, relaying data as is", sessionID, err)
+				passthrough = true
+				responseData = append(responseData, records.Rest()...)
+			}
+			if len(responseData) == 0 {
+				// The rest of the record is still on its way
+				continue
+			}
+		}
+		if session != nil && countHandshakeMessage(sessionID, session, len(responseData)) != nil {
+			return
+		}
+		if session != nil {
+			session.trackHandshake(sessionID, false, responseData)
+			if err := session.checkLegacyTLS(sessionID); err != nil {
+				select {
+				case session.ResponseQueue <- alertProtocolVersion:
+				default:
+				}
+				return
+			}
+			if err := session.verifyTarget(sessionID); err != nil {
+				// The target isn't relayed; the waiting client gets the error,
+				// or an alert to relay if the target's key isn't pinned
+				response := []byte{}
+				var pinErr *pinMismatchError
+				if errors.As(err, &pinErr) {
+					response = alertBadCertificate
+				}
+				select {
+				case session.ResponseQueue <- response:
+				default:
+				}
+				return
+			}
+		}
 
 		sessionsMu.Lock()
 		session, exists = sessions[sessionID]
@@ -370,6 +662,13 @@ func handleTargetResponses(sessionID string, targetConn net.Conn) {
 			// Always keep track of server responses
 			session.ServerResponses = append(session.ServerResponses, responseData)
 
+			// TLS 1.2 tickets arrive in the clear among the server's first flights
+			if len(responseData) > 0 && responseData[0] == sultrytls.RecordHandshake {
+				if sni := session.clientSNI(); sni != "" {
+					captureSessionTickets(sni, responseData)
+				}
+			}
+
 			// Always log what we received
 			if !session.Adopted {
 				session.ResponseQueue <- responseData
@@ -380,24 +679,10 @@ func handleTargetResponses(sessionID string, targetConn net.Conn) {
 				log.Printf("🔹 Session %s is adopted, target sent %d bytes (handled by direct connection)",
 					sessionID, len(responseData))
 
-				// Check first few bytes of response data to help debug
-				if len(responseData) > 0 {
-					if len(responseData) >= 5 {
-						recordType := responseData[0]
-						// Only interpret as TLS record if it's a valid TLS record type (20-24)
-						if recordType >= 20 && recordType <= 24 {
-							version := (uint16(responseData[1]) << 8) | uint16(responseData[2])
-							length := (uint16(responseData[3]) << 8) | uint16(responseData[4])
-							log.Printf("🔹 Target TLS record: Type=%d, Version=0x%04x, Length=%d",
-								recordType, version, length)
-							log.Printf("🔹 First 16 bytes: %x", responseData[:min(16, len(responseData))])
-						} else {
-							// This is likely application data
-							log.Printf("🔹 Target application data: %d bytes", len(responseData))
-						}
-					} else {
-						log.Printf("🔹 Short data: %x", responseData)
-					}
+				// Whole records, unless the target stopped speaking TLS
+				if !passthrough {
+					log.Printf("🔹 Target TLS records starting with Type=%d, Version=0x%04x",
+						responseData[0], uint16(responseData[1])<<8|uint16(responseData[2]))
 				}
 			}
 		}
@@ -418,41 +703,126 @@ func handleClientMessage(sessionID string, message []byte) (bool, error) {
 	// Update last activity
 	session.LastActivity = time.Now()
 
+	if err := countHandshakeMessage(sessionID, session, len(message)); err != nil {
+		return false, err
+	}
+	isComplete, err := session.acceptClientMessage(sessionID, message)
+	if err != nil {
+		return false, err
+	}
+
 	// Forward the message to the target with timeout
-	session.TargetConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-	_, err := session.TargetConn.Write(message)
+	session.TargetConn.SetWriteDeadline(session.targetWriteDeadline())
+	_, err = session.TargetConn.Write(message)
 	session.TargetConn.SetWriteDeadline(time.Time{})
 	if err != nil {
 		log.Printf("❌ Failed to write client message to target: %v", err)
 		return false, fmt.Errorf("failed to write client message: %w", err)
 	}
+	return isComplete, nil
+}
 
-	// Analyze if this message completes the handshake
-	_, isComplete := analyzeHandshakeStatus(message)
-
-	// Mark the handshake as complete if determined
-	if isComplete {
-		session.HandshakeComplete = true
+// acceptClientMessage records a client flight of the handshake before it's
+// forwarded, and reports whether the handshake is complete. ClientHellos
+// the handshake doesn't allow are refused and end the session: after a
+// HelloRetryRequest, the updated ClientHello must name the server the
+// session was opened for.
+func (s *SessionState) acceptClientMessage(sessionID string, message []byte) (bool, error) {
+	s.mu.Lock()
+	if !s.HandshakeComplete {
+		s.ClientMessages = append(s.ClientMessages, message)
 	}
+	before := s.handshake.ClientHello()
+	s.mu.Unlock()
+
+	isComplete := s.trackHandshake(sessionID, true, message)
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.handshake.Err(); errors.Is(err, sultrytls.ErrUnexpectedClientHello) {
+		log.Printf("❌ Refusing ClientHello of session %s: %v", sessionID, err)
+		s.TargetConn.Close()
+		return false, err
+	}
+	if hello := s.handshake.ClientHello(); before != nil && hello != before {
+		log.Printf("🔁 Updated ClientHello for %s after HelloRetryRequest in session %s", redacted(sensitiveSNI, hello.ServerName), sessionID)
+	}
 	return isComplete, nil
 }
 
-// Analyze if a message is part of the handshake and if it completes the handshake
-func analyzeHandshakeStatus(data []byte) (isHandshake bool, isComplete bool) {
-	if len(data) < 5 {
-		return false, false
+// clientSNI returns the server name of the session's ClientHello, or "" if
+// it names none.
+func (s *SessionState) clientSNI() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hello := s.handshake.ClientHello(); hello != nil {
+		return hello.ServerName
 	}
+	return ""
+}
 
-	recordType := data[0]
+// trackHandshake feeds data sent by the client or the target to the
+// session's handshake state machine, marks the handshake complete once both
+// sides finished it, and reports whether it is.
+func (s *SessionState) trackHandshake(sessionID string, fromClient bool, data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.HandshakeComplete {
+		return true
+	}
+	before := s.handshake.State()
+	var err error
+	if fromClient {
+		err = s.handshake.FromClient(data)
+	} else {
+		err = s.handshake.FromServer(data)
+	}
+	if err != nil && before != sultrytls.StateFailed {
+		log.Printf("⚠️ Handshake of session %s failed in state %s: %v", sessionID, before, err)
+	}
+	if s.handshake.Complete() {
+		s.HandshakeComplete = true
+		log.Printf("✅ Handshake complete for session %s (%s)", sessionID, versionName(s.handshake.Version()))
+	}
+	return s.HandshakeComplete
+}
 
-	// TLS handshake record type is 22
-	isHandshake = (recordType == 22)
+// tlsVersion returns the version the session's handshake negotiated, or 0
+// before the ServerHello.
+func (s *SessionState) tlsVersion() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handshake.Version()
+}
 
-	// Don't try to detect handshake completion by record inspection
-	// Instead, rely on receiving application data or the client's explicit signal
+// checkLegacyTLS applies the legacy_tls policy to the version the session's
+// ServerHello negotiated, once it has arrived.
+func (s *SessionState) checkLegacyTLS(sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hello := s.handshake.ServerHello()
+	if s.legacyChecked || hello == nil || hello.HelloRetryRequest {
+		return nil
+	}
+	s.legacyChecked = true
+	return checkLegacyTLS(log.Printf, fmt.Sprintf("Target of session %s negotiated", sessionID), hello.Version)
+}
 
-	return isHandshake, false // Never auto-complete based on record inspection
+// versionName names a TLS version for logs.
+func versionName(version uint16) string {
+	switch version {
+	case 0:
+		return "version unknown"
+	case sultrytls.VersionTLS10:
+		return "TLSv1.0"
+	case sultrytls.VersionTLS11:
+		return "TLSv1.1"
+	case sultrytls.VersionTLS12:
+		return "TLSv1.2"
+	case sultrytls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return fmt.Sprintf("TLS-0x%04x", version)
 }
 
 // Periodic cleanup of inactive sessions
@@ -473,6 +843,7 @@ func cleanupInactiveSessions() {
 				}
 
 				delete(sessions, sessionID)
+				session.unredact()
 			}
 		}
 
@@ -481,13 +852,13 @@ func cleanupInactiveSessions() {
 }
 
 // Legacy function for backward compatibility
-func forwardClientHello(clientHelloData []byte, sni string) ([]byte, error) {
+func forwardClientHello(ctx context.Context, clientHelloData []byte, sni string) ([]byte, error) {
 	log.Println("🔹 Starting TLS handshake with:", sni)
 
 	// Connect to the target server
-	conn, err := net.Dial("tcp", sni+":443")
+	conn, err := dialTarget(ctx, &net.Dialer{}, sni+":443")
 	if err != nil {
-		log.Printf("❌ Failed to connect to %s: %v", sni, err)
+		log.Printf("❌ Failed to connect to %s: %v", redacted(sensitiveSNI, sni), err)
 		return nil, fmt.Errorf("failed to connect to %s: %w", sni, err)
 	}
 	defer conn.Close()
@@ -597,7 +968,9 @@ func handleCompleteHandshake(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Mark handshake as complete
+	session.mu.Lock()
 	session.HandshakeComplete = true
+	session.mu.Unlock()
 	log.Printf("✅ Handshake explicitly marked complete for session %s", req.SessionID)
 
 	w.WriteHeader(http.StatusOK)
@@ -635,7 +1008,10 @@ func handleAdoptConnection(w http.ResponseWriter, r *http.Request) {
 	log.Printf("🔹 Adoption request received for session %s", sessionID)
 
 	// Check if handshake is complete
-	if !session.HandshakeComplete {
+	session.mu.Lock()
+	complete := session.HandshakeComplete
+	session.mu.Unlock()
+	if !complete {
 		log.Printf("❌ Handshake not complete for session %s, rejecting adoption", sessionID)
 		http.Error(w, fmt.Sprintf("Handshake not complete for session %s", sessionID), http.StatusBadRequest)
 		return
@@ -666,23 +1042,16 @@ func handleAdoptConnection(w http.ResponseWriter, r *http.Request) {
 	session.mu.Unlock()
 	log.Printf("✅ Session %s marked as adopted", sessionID)
 
+	// Wake the target reader, so the relay is the only one reading the
+	// target from now on
+	session.TargetConn.SetReadDeadline(time.Now())
+	<-session.readerDone
+	session.TargetConn.SetReadDeadline(time.Time{})
+
 	// Send HTTP 200 OK
 	log.Printf("🔹 Sending 200 OK response for session %s", sessionID)
 
-	// Detect TLS version from ServerHello - for logging only
-	tlsVersion := "TLSv1.2" // Default
-	session.mu.Lock()
-	if len(session.ServerResponses) > 0 && len(session.ServerResponses[0]) >= 5 {
-		ver := (uint16(session.ServerResponses[0][1]) << 8) | uint16(session.ServerResponses[0][2])
-		switch ver {
-		case 0x0303:
-			tlsVersion = "TLSv1.2" // TLS 1.2 record version
-		case 0x0304:
-			tlsVersion = "TLSv1.3" // TLS 1.3 record version
-		}
-		log.Printf("🔹 Detected TLS version in use: %s (0x%04x)", tlsVersion, ver)
-	}
-	session.mu.Unlock()
+	log.Printf("🔹 Negotiated TLS version: %s", versionName(session.tlsVersion()))
 	
 	// This is the initial HTTP response to the CONNECT request, which happens BEFORE the TLS handshake
 	// So it's safe to send HTTP here
@@ -709,17 +1078,13 @@ func handleAdoptConnection(w http.ResponseWriter, r *http.Request) {
 	log.Printf("✅ Sent 200 OK response for session %s", sessionID)
 
 	// Set proper TCP options for improved performance
-	if tcpConn, ok := session.TargetConn.(*net.TCPConn); ok {
-		tcpConn.SetNoDelay(true)
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	connTuner.Tune(session.TargetConn, session.clientSNI()+":443")
+	connTuner.Tune(clientConn, clientConn.RemoteAddr().String())
+	if tcpConn, ok := tcpConnOf(session.TargetConn); ok {
 		tcpConn.SetReadBuffer(1048576)  // 1MB buffer
 		tcpConn.SetWriteBuffer(1048576) // 1MB buffer
 	}
 	if tcpConn, ok := clientConn.(*net.TCPConn); ok {
-		tcpConn.SetNoDelay(true)
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(30 * time.Second)
 		tcpConn.SetReadBuffer(1048576)  // 1MB buffer
 		tcpConn.SetWriteBuffer(1048576) // 1MB buffer
 	}
@@ -733,24 +1098,18 @@ func handleAdoptConnection(w http.ResponseWriter, r *http.Request) {
 	log.Printf("🔹 Using pure relay mode, letting the protocol flow naturally")
 
 	// Extract the SNI for logging purposes
+	sni := session.clientSNI()
+	if sni == "" {
+		sni = "unknown"
+	}
 	session.mu.Lock()
-	var sni string = "unknown"
-	if len(session.ClientMessages) > 0 {
-		// Extract SNI
-		extractedSNI, err := extractSNIFromClientHello(session.ClientMessages[0])
-		if err == nil && extractedSNI != "" {
-			sni = extractedSNI
-		}
-
-		// Check for HTTP/2 support - just for logging
-		if bytes.Contains(session.ClientMessages[0], []byte("h2")) {
-			log.Printf("🔹 Detected HTTP/2 ALPN in ClientHello message")
-		}
+	if req.Protocol != "" {
+		log.Printf("🔹 Relaying %s for session %s", req.Protocol, sessionID)
 	}
 	session.mu.Unlock()
 
 	// Don't send an initial GET request - let the client send its own request
-	log.Printf("🔹 Waiting for client to send HTTP request for: %s", sni)
+	log.Printf("🔹 Waiting for client to send HTTP request for: %s", redacted(sensitiveSNI, sni))
 
 	log.Printf("✅ Connection ready for bidirectional relay (session %s)", sessionID)
 
@@ -780,20 +1139,7 @@ func handleAdoptConnection(w http.ResponseWriter, r *http.Request) {
 
 		// Phase 2: Direct communication with maintained TLS state
 		// Get the negotiated TLS version for logging
-		tlsVersionStr := "TLS-Unknown"
-		session.mu.Lock()
-		if len(session.ServerResponses) > 0 && len(session.ServerResponses[0]) >= 5 {
-			ver := (uint16(session.ServerResponses[0][1]) << 8) | uint16(session.ServerResponses[0][2])
-			switch ver {
-			case 0x0303:
-				tlsVersionStr = "TLSv1.2"
-			case 0x0304:
-				tlsVersionStr = "TLSv1.3"
-			default:
-				tlsVersionStr = fmt.Sprintf("TLS-0x%04x", ver)
-			}
-		}
-		session.mu.Unlock()
+		tlsVersionStr := versionName(session.tlsVersion())
 		
 		// CRITICAL: Don't send any HTTP response at this point!
 		// The TLS handshake is already complete and sending unencrypted HTTP over
@@ -812,10 +1158,6 @@ func handleAdoptConnection(w http.ResponseWriter, r *http.Request) {
 		log.Printf("🔹 Enabling graceful shutdown behavior to handle connection resets")
 
 		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("❌ PANIC in bidirectional relay: %v", r)
-			}
-
 			// Close connections
 			if session.TargetConn != nil {
 				session.TargetConn.Close()
@@ -829,179 +1171,45 @@ func handleAdoptConnection(w http.ResponseWriter, r *http.Request) {
 			sessionsMu.Lock()
 			delete(sessions, sessionID)
 			sessionsMu.Unlock()
+			session.unredact()
 		}()
 
-		// Start bidirectional relay immediately without direct fetch
-		log.Printf("🔹 Starting pure bidirectional relay for phase 2 communication")
-
-		// Use wait group for the two copy operations
-		var wg sync.WaitGroup
-		wg.Add(2)
-
-		// Client -> Target with enhanced progress logging
-		go func() {
-			defer wg.Done()
-			// Use a much larger buffer to handle large TLS records and HTTP requests
-			buffer := make([]byte, 1048576) // 1MB buffer
-			var totalBytes int64
-
-			for {
-				// Read from client with longer timeout
-				clientConn.SetReadDeadline(time.Now().Add(120 * time.Second))
-				nr, err := clientConn.Read(buffer)
-				clientConn.SetReadDeadline(time.Time{})
-
-				if err != nil {
-					if err == io.EOF || strings.Contains(err.Error(), "use of closed") {
-						log.Printf("🔹 Client closed connection (normal)")
-					} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-						log.Printf("🔹 Client read timeout, continuing...")
-						continue
-					} else {
-						log.Printf("❌ Server side: Client->Target relay error: %v", err)
-					}
-					break
-				}
-
-				if nr > 0 {
-					// Log application data details
-					log.Printf("🔹 SERVER DATA: Client->Target: Read %d bytes", nr)
-					if nr >= 5 {
-						recordType := buffer[0]
-						// Only interpret as TLS record if it's a valid TLS record type (20-24)
-						if recordType >= 20 && recordType <= 24 {
-							version := (uint16(buffer[1]) << 8) | uint16(buffer[2])
-							length := (uint16(buffer[3]) << 8) | uint16(buffer[4])
-							log.Printf("🔹 SERVER DATA: Client->Target TLS record: Type=%d, Version=0x%04x, Length=%d",
-								recordType, version, length)
-							log.Printf("🔹 SERVER DATA: First 16 bytes: %x", buffer[:min(16, nr)])
-						} else {
-							// This is likely application data
-							log.Printf("🔹 SERVER DATA: Client->Target application data: %d bytes", nr)
-						}
-					}
-
-					// Write to target with timeout
-					session.TargetConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-					nw, err := session.TargetConn.Write(buffer[:nr])
-					session.TargetConn.SetWriteDeadline(time.Time{})
-					if err != nil {
-						log.Printf("❌ Server side: Client->Target relay error writing: %v", err)
-						break
-					}
-
-					if nw != nr {
-						log.Printf("⚠️ Server side: Short write to target %d/%d bytes", nw, nr)
-					} else {
-						log.Printf("✅ Server side: Client->Target: Successfully forwarded %d bytes", nw)
-					}
-
-					totalBytes += int64(nw)
+		// What the target sent after the client stopped asking, such as
+		// TLS 1.3 session tickets, goes first; the client's records are
+		// numbered with it
+		for len(session.ResponseQueue) > 0 {
+			if pending := <-session.ResponseQueue; len(pending) > 0 {
+				log.Printf("🔹 Forwarding %d bytes the target sent before adoption for session %s", len(pending), sessionID)
+				if _, err := clientConn.Write(pending); err != nil {
+					log.Printf("❌ Failed to forward them for session %s: %v", sessionID, err)
+					return
 				}
 			}
+		}
 
-			log.Printf("🔹 Server side: Client->Target relay finished: %d bytes total", totalBytes)
-		}()
-
-		// Target -> Client with enhanced progress logging
-		go func() {
-			defer wg.Done()
-			// Use a much larger buffer to handle large TLS records and HTTP responses
-			buffer := make([]byte, 1048576) // 1MB buffer
-			var totalBytes int64
-
-			for {
-				// Read from target with longer timeout
-				session.TargetConn.SetReadDeadline(time.Now().Add(120 * time.Second))
-				nr, err := session.TargetConn.Read(buffer)
-				session.TargetConn.SetReadDeadline(time.Time{})
-
-				if err != nil {
-					if err == io.EOF || strings.Contains(err.Error(), "use of closed") {
-						log.Printf("🔹 Target closed connection (normal)")
-					} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-						log.Printf("🔹 Target read timeout, continuing...")
-						continue
-					} else {
-						log.Printf("❌ Server side: Target->Client relay error: %v", err)
-					}
-					break
-				}
-
-				if nr > 0 {
-					// Try to detect if this is HTTP response data
-					if nr > 10 && bytes.HasPrefix(buffer[:nr], []byte("HTTP/1.")) {
-						log.Printf("🔹 SERVER DATA: Received HTTP response from target: %d bytes", nr)
-
-						// Get the status line
-						statusLine := ""
-						for i, b := range buffer[:min(100, nr)] {
-							if b == '\n' {
-								statusLine = string(buffer[:i])
-								break
-							}
-						}
-						log.Printf("🔹 HTTP RESPONSE: %s", statusLine)
-
-						// Try to find response body
-						bodyStart := bytes.Index(buffer[:nr], []byte("\r\n\r\n"))
-						if bodyStart > 0 {
-							bodyStart += 4 // Skip \r\n\r\n
-							bodyLen := nr - bodyStart
-							if bodyLen > 0 {
-								log.Printf("🔹 HTTP BODY: %d bytes", bodyLen)
-								previewLen := min(100, bodyLen)
-								log.Printf("🔹 BODY PREVIEW: %s", string(buffer[bodyStart:bodyStart+previewLen]))
-							}
-						}
-					} else {
-						// Regular TLS data
-						log.Printf("🔹 SERVER DATA: Target->Client: Read %d bytes", nr)
-						if nr >= 5 {
-							recordType := buffer[0]
-							// Only interpret as TLS record if it's a valid TLS record type (20-24)
-							if recordType >= 20 && recordType <= 24 {
-								version := (uint16(buffer[1]) << 8) | uint16(buffer[2])
-								length := (uint16(buffer[3]) << 8) | uint16(buffer[4])
-								log.Printf("🔹 SERVER DATA: Target->Client TLS record: Type=%d, Version=0x%04x, Length=%d",
-									recordType, version, length)
-								log.Printf("🔹 SERVER DATA: First 16 bytes: %x", buffer[:min(16, nr)])
-							} else {
-								// This is likely application data
-								log.Printf("🔹 SERVER DATA: Target->Client application data: %d bytes", nr)
-							}
-						}
-					}
-
-					// Write to client with better error handling
-					clientConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-					nw, err := clientConn.Write(buffer[:nr])
-					clientConn.SetWriteDeadline(time.Time{})
-					if err != nil {
-						if strings.Contains(err.Error(), "broken pipe") ||
-							strings.Contains(err.Error(), "use of closed") {
-							log.Printf("ℹ️ Client connection closed, stopping relay gracefully")
-							return
-						}
-						log.Printf("❌ Server side: Target->Client relay error writing: %v", err)
-						break
-					}
-
-					if nw != nr {
-						log.Printf("⚠️ Server side: Short write to client %d/%d bytes", nw, nr)
-					} else {
-						log.Printf("✅ Server side: Target->Client: Successfully forwarded %d bytes", nw)
-					}
-
-					totalBytes += int64(nw)
-				}
-			}
+		// Start bidirectional relay immediately without direct fetch
+		log.Printf("🔹 Starting pure bidirectional relay for phase 2 communication")
 
-			log.Printf("🔹 Server side: Target->Client relay finished: %d bytes total", totalBytes)
-		}()
+		// Both directions forward whole TLS records
+		// The handshake is done, so the relay is in its data phase
+		relayLogger := sessionLog(context.Background()).With("session", sessionID)
+		phase := newRelayTimeouts(nil)
+		limit := throttling.open(clientConn.RemoteAddr())
+		defer limit.close()
+		clientToTarget := func() error {
+			buffer := make([]byte, relayBufferSize(req.Protocol))
+			return relayData(relayLogger, clientConn, session.TargetConn, buffer, "Client -> Target", phase, limit, true)
+		}
+		targetToClient := func() error {
+			buffer := make([]byte, relayBufferSize(req.Protocol))
+			return relayData(relayLogger, session.TargetConn, clientConn, buffer, "Target -> Client", phase, limit, false)
+		}
 
-		// Wait for both directions to complete
-		wg.Wait()
+		// Wait for both directions; an error in one closes both connections
+		if err := relayPair(context.Background(), clientConn, session.TargetConn, clientToTarget, targetToClient); err != nil {
+			log.Printf("❌ Bidirectional relay failed for session %s: %v", sessionID, err)
+			return
+		}
 		log.Printf("✅ Bidirectional relay completed for session %s", sessionID)
 	}()
 }
@@ -1014,97 +1222,6 @@ func min(a, b int) int {
 	return b
 }
 
-// Extract SNI from ClientHello for target info
-func extractSNIFromClientHello(clientHello []byte) (string, error) {
-	if len(clientHello) < 43 { // Minimum length for a valid ClientHello
-		return "", errors.New("ClientHello too short")
-	}
-
-	// Ensure this is a TLS ClientHello by checking the first few bytes
-	if clientHello[0] != 0x16 { // TLS handshake type
-		return "", errors.New("Not a TLS handshake")
-	}
-	if clientHello[5] != 0x01 { // ClientHello message type
-		return "", errors.New("Not a ClientHello message")
-	}
-
-	// Find the TLS extensions section
-	var pos = 43 // Start after fixed-length fields
-	if pos+2 > len(clientHello) {
-		return "", errors.New("Malformed ClientHello")
-	}
-
-	// Skip session ID
-	sessionIDLen := int(clientHello[pos])
-	pos += 1 + sessionIDLen
-	if pos+2 > len(clientHello) {
-		return "", errors.New("Malformed ClientHello (session ID too short)")
-	}
-
-	// Skip cipher suites
-	cipherSuitesLen := int(clientHello[pos])<<8 | int(clientHello[pos+1])
-	pos += 2 + cipherSuitesLen
-	if pos+1 > len(clientHello) {
-		return "", errors.New("Malformed ClientHello (cipher suites too short)")
-	}
-
-	// Skip compression methods
-	compressionLen := int(clientHello[pos])
-	pos += 1 + compressionLen
-	if pos+2 > len(clientHello) {
-		return "", errors.New("Malformed ClientHello (compression methods too short)")
-	}
-
-	// Read extensions length
-	extensionsLen := int(clientHello[pos])<<8 | int(clientHello[pos+1])
-	pos += 2
-	if pos+extensionsLen > len(clientHello) {
-		return "", errors.New("Malformed ClientHello (extensions too short)")
-	}
-
-	// Iterate through TLS extensions to find the SNI
-	for pos+4 <= len(clientHello) {
-		extType := int(clientHello[pos])<<8 | int(clientHello[pos+1])
-		extLen := int(clientHello[pos+2])<<8 | int(clientHello[pos+3])
-		pos += 4
-
-		// Check if this is the SNI extension (type 0x0000)
-		if extType == 0x0000 {
-			if pos+2 > len(clientHello) {
-				return "", errors.New("Malformed SNI extension")
-			}
-			sniListLen := int(clientHello[pos])<<8 | int(clientHello[pos+1])
-			pos += 2
-
-			if pos+sniListLen > len(clientHello) {
-				return "", errors.New("SNI list length mismatch")
-			}
-
-			// Only one name is typically present
-			if sniListLen < 3 || clientHello[pos] != 0x00 { // Ensure it's a valid host_name entry
-				return "", errors.New("Invalid SNI entry")
-			}
-
-			// Read the hostname length
-			hostnameLen := int(clientHello[pos+1])<<8 | int(clientHello[pos+2])
-			pos += 3
-
-			if pos+hostnameLen > len(clientHello) {
-				return "", errors.New("Hostname length mismatch")
-			}
-
-			// Extract the hostname
-			sni := string(clientHello[pos : pos+hostnameLen])
-			return sni, nil
-		}
-
-		// Move to next extension
-		pos += extLen
-	}
-
-	return "", errors.New("SNI not found in ClientHello")
-}
-
 // Enhanced handleGetTargetInfo provides target server connection details
 func handleGetTargetInfo(w http.ResponseWriter, r *http.Request) {
 	// Parse request
@@ -1141,7 +1258,10 @@ func handleGetTargetInfo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if handshake is complete
-	if !session.HandshakeComplete {
+	session.mu.Lock()
+	complete := session.HandshakeComplete
+	session.mu.Unlock()
+	if !complete {
 		log.Printf("❌ Handshake not complete for session %s, can't provide target info", sessionID)
 		http.Error(w, fmt.Sprintf("Handshake not complete for session %s", sessionID), http.StatusBadRequest)
 		return
@@ -1160,27 +1280,28 @@ func handleGetTargetInfo(w http.ResponseWriter, r *http.Request) {
 		if hostname[len(hostname)-1] == '.' {
 			hostname = hostname[:len(hostname)-1]
 		}
-		log.Printf("🔹 Resolved %s to hostname %s", targetHost, hostname)
+		defer redactWhileLive(sensitiveSNI, hostname)()
+		log.Printf("🔹 Resolved %s to hostname %s", targetHost, redacted(sensitiveSNI, hostname))
 		targetHost = hostname
 	}
 
 	// Use the SNI as the hostname if available
 	var sni string = targetHost // Default to IP/hostname
-	if len(session.ClientMessages) > 0 {
-		extractedSNI, err := extractSNIFromClientHello(session.ClientMessages[0])
-		if err == nil && extractedSNI != "" {
-			sni = extractedSNI
-			log.Printf("🔹 Using original SNI from ClientHello: %s", sni)
-		}
+	if extractedSNI := session.clientSNI(); extractedSNI != "" {
+		sni = extractedSNI
+		log.Printf("🔹 Using SNI from ClientHello: %s", redacted(sensitiveSNI, sni))
 	}
 
-	// Detect TLS version from the handshake
-	var tlsVersion int = 0x0301 // Default to TLS 1.0
-	if len(session.ServerResponses) > 0 && len(session.ServerResponses[0]) >= 5 {
-		serverHello := session.ServerResponses[0]
-		// Extract TLS version from ServerHello
-		tlsVersion = int(uint16(serverHello[1])<<8 | uint16(serverHello[2]))
-		log.Printf("🔹 Detected TLS version: 0x%04x", tlsVersion)
+	// The version the ServerHello negotiated, not the record layer's
+	tlsVersion := int(session.tlsVersion())
+	log.Printf("🔹 Negotiated TLS version: %s", versionName(uint16(tlsVersion)))
+
+	// The client picks its relay behavior by the negotiated protocol
+	alpn, known := negotiatedALPN(session.ServerResponses)
+	if known {
+		log.Printf("🔹 Negotiated ALPN: %q", alpn)
+	} else {
+		log.Printf("🔹 Negotiated ALPN not visible to the relay (encrypted in TLS 1.3)")
 	}
 
 	// Construct comprehensive response for direct connection
@@ -1188,25 +1309,37 @@ func handleGetTargetInfo(w http.ResponseWriter, r *http.Request) {
 		TargetHost    string `json:"target_host"`
 		TargetIP      string `json:"target_ip"`
 		TargetPort    int    `json:"target_port"`
-		SessionTicket []byte `json:"session_ticket,omitempty"`
-		MasterSecret  []byte `json:"master_secret,omitempty"`
-		SNI           string `json:"sni"`
-		Version       int    `json:"tls_version"`
+		SessionTicket  []byte `json:"session_ticket,omitempty"`
+		TicketLifetime int    `json:"ticket_lifetime,omitempty"`
+		MasterSecret   []byte `json:"master_secret,omitempty"`
+		SNI            string `json:"sni"`
+		Version        int    `json:"tls_version"`
+		ALPN           string `json:"alpn,omitempty"`
+		SessionID      []byte `json:"session_id,omitempty"`
 	}{
 		TargetHost: targetHost,
 		TargetIP:   targetAddr.IP.String(),
 		TargetPort: targetPort,
-		// In a full implementation, we would extract these from the TLS session
-		// SessionTicket: extractedTicket,
-		// MasterSecret:  extractedSecret,
-		SNI:     sni,
-		Version: tlsVersion,
+		SNI:        sni,
+		Version:    tlsVersion,
+		ALPN:       alpn,
+	}
+	// Resuming by session ID needs this target's address, see sessionids.go
+	session.mu.Lock()
+	if hello := session.handshake.ServerHello(); hello != nil && hello.Version < sultrytls.VersionTLS13 {
+		response.SessionID = hello.SessionID
+	}
+	session.mu.Unlock()
+	// The master secret never leaves the TLS endpoints, see sessiontickets.go
+	if ticket, ok := sessionTickets.Get(sni); ok {
+		response.SessionTicket = ticket.Ticket
+		response.TicketLifetime = int(time.Until(ticket.Expires).Seconds())
 	}
 
 	// Send response
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
-	log.Printf("✅ Sent target info for session %s: %s:%d", sessionID, targetHost, targetPort)
+	log.Printf("✅ Sent target info for session %s: %s:%d", sessionID, redacted(sensitiveSNI, targetHost), targetPort)
 }
 
 // Handler for releasing OOB resources
@@ -1252,12 +1385,8 @@ func handleReleaseConnection(w http.ResponseWriter, r *http.Request) {
 
 // Handle client requests for server responses during handshake
 func handleGetResponse(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		SessionID string `json:"session_id"`
-		Action    string `json:"action"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	req, err := decodeOOBMessage(r)
+	if err != nil {
 		log.Printf("❌ Invalid get_response request: %v", err)
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
@@ -1282,6 +1411,10 @@ func handleGetResponse(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Session %s not found", sessionID), http.StatusNotFound)
 		return
 	}
+	if err := session.targetError(); err != nil {
+		writeOOBError(w, http.StatusBadGateway, oobErrorTargetCertificate, err)
+		return
+	}
 
 	// Try to read from ResponseQueue with a timeout to avoid blocking
 	var responseData []byte
@@ -1328,6 +1461,9 @@ func handleGetResponse(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Completion is reported once every response has been delivered
+	handshakeComplete = handshakeComplete && len(responseData) == 0 && len(session.ResponseQueue) == 0
+
 	// Send response
 	response := struct {
 		Data              []byte `json:"data"`
@@ -1350,19 +1486,26 @@ func handleGetResponse(w http.ResponseWriter, r *http.Request) {
 			sessionID, handshakeComplete)
 	}
 
+	// Answer in the format the client used
+	if isFramed(r) {
+		frame := &oobFrame{Type: frameResponse, SessionID: sessionID, Payload: responseData}
+		if handshakeComplete {
+			frame.Flags |= frameFlagHandshakeComplete
+		}
+		body, _ := frame.MarshalBinary()
+		w.Header().Set("Content-Type", frameContentType)
+		w.Write(body)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
 // Handle client data sent during handshake
 func handleSendData(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		SessionID string `json:"session_id"`
-		Action    string `json:"action"`
-		Data      []byte `json:"data"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	req, err := decodeOOBMessage(r)
+	if err != nil {
 		log.Printf("❌ Invalid send_data request: %v", err)
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
@@ -1388,19 +1531,18 @@ func handleSendData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Analyze handshake status if needed
-	isHandshake, _ := analyzeHandshakeStatus(req.Data)
-
-	// Store the client message if it's a handshake
-	if isHandshake {
-		session.mu.Lock()
-		session.ClientMessages = append(session.ClientMessages, req.Data)
-		session.mu.Unlock()
+	if err := countHandshakeMessage(sessionID, session, len(req.Data)); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if _, err := session.acceptClientMessage(sessionID, req.Data); err != nil {
+		http.Error(w, fmt.Sprintf("Rejected client message: %v", err), http.StatusBadRequest)
+		return
 	}
 
 	// Forward the data to the target with timeout
-	session.TargetConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-	_, err := session.TargetConn.Write(req.Data)
+	session.TargetConn.SetWriteDeadline(session.targetWriteDeadline())
+	_, err = session.TargetConn.Write(req.Data)
 	session.TargetConn.SetWriteDeadline(time.Time{})
 	if err != nil {
 		log.Printf("❌ Failed to forward data to target: %v", err)
@@ -1420,6 +1562,90 @@ func handleSendData(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"status":"ok"}`))
 }
 
+// handleEvents streams a session's target responses as server-sent events
+// as soon as they arrive, so clients don't have to poll /get_response. Each
+// "response" event carries base64 data; the stream ends with "complete" once
+// the handshake is done or "closed" if the target hung up.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("session_id")
+	if sessionID == "" {
+		http.Error(w, "Session ID is required", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sessionsMu.Lock()
+	session, exists := sessions[sessionID]
+	sessionsMu.Unlock()
+	if !exists {
+		http.Error(w, fmt.Sprintf("Session %s not found", sessionID), http.StatusNotFound)
+		return
+	}
+
+	session.mu.Lock()
+	session.Streaming = true
+	session.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	log.Printf("🔹 Streaming handshake responses for session %s", sessionID)
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	check := time.NewTicker(100 * time.Millisecond)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data := <-session.ResponseQueue:
+			if err := session.targetError(); err != nil {
+				body, _ := json.Marshal(oobErrorBody{Code: oobErrorTargetCertificate, Error: err.Error()})
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", body)
+				flusher.Flush()
+				return
+			}
+			if len(data) == 0 {
+				// Queued by handleTargetResponses when the target closed
+				fmt.Fprint(w, "event: closed\ndata:\n\n")
+				flusher.Flush()
+				log.Printf("🔹 Target closed, ending event stream for session %s", sessionID)
+				return
+			}
+			fmt.Fprintf(w, "event: response\ndata: %s\n\n", base64.StdEncoding.EncodeToString(data))
+			flusher.Flush()
+			session.mu.Lock()
+			session.LastActivity = time.Now()
+			session.mu.Unlock()
+			log.Printf("✅ Streamed %d bytes to client for session %s", len(data), sessionID)
+		case <-check.C:
+			sessionsMu.Lock()
+			_, alive := sessions[sessionID]
+			sessionsMu.Unlock()
+			session.mu.Lock()
+			done := session.HandshakeComplete || session.Adopted
+			session.mu.Unlock()
+			if (done || !alive) && len(session.ResponseQueue) == 0 {
+				fmt.Fprint(w, "event: complete\ndata:\n\n")
+				flusher.Flush()
+				log.Printf("✅ Handshake complete, ending event stream for session %s", sessionID)
+				return
+			}
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
 // handleCreateConnection is a simplified handler for SNI concealment
 // without TLS record manipulation. It takes a host:port from the client,
 // creates a connection to that target, and returns the real IP and port.
@@ -1437,10 +1663,11 @@ func handleCreateConnection(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
 		return
 	}
+	defer redactWhileLive(sensitiveSNI, req.SNI)()
 	
 	log.Printf("📝 SNI RESOLUTION REQUEST DETAILS:")
 	log.Printf("   Session ID: %s", req.SessionID)
-	log.Printf("   SNI Value: %s", req.SNI)
+	log.Printf("   SNI Value: %s", redacted(sensitiveSNI, req.SNI))
 	log.Printf("   Port: %s", req.Port)
 	
 	if req.SessionID == "" || req.SNI == "" {
@@ -1456,7 +1683,7 @@ func handleCreateConnection(w http.ResponseWriter, r *http.Request) {
 		log.Printf("ℹ️ Using default port 443")
 	}
 	
-	log.Printf("🔹 CREATING CONNECTION TO %s:%s FOR SNI CONCEALMENT", req.SNI, port)
+	log.Printf("🔹 CREATING CONNECTION TO %s:%s FOR SNI CONCEALMENT", redacted(sensitiveSNI, req.SNI), port)
 	
 	// Establish connection to target
 	target := fmt.Sprintf("%s:%s", req.SNI, port)
@@ -1465,7 +1692,7 @@ func handleCreateConnection(w http.ResponseWriter, r *http.Request) {
 		KeepAlive: 30 * time.Second,
 	}
 	
-	log.Printf("🔹 Attempting DNS resolution for %s", req.SNI)
+	log.Printf("🔹 Attempting DNS resolution for %s", redacted(sensitiveSNI, req.SNI))
 	ips, err := net.LookupIP(req.SNI)
 	if err != nil {
 		log.Printf("⚠️ DNS resolution failed: %v", err)
@@ -1474,7 +1701,7 @@ func handleCreateConnection(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	log.Printf("🔹 Dialing TCP connection to %s", target)
-	conn, err := dialer.Dial("tcp", target)
+	conn, err := dialTarget(r.Context(), dialer, target)
 	if err != nil {
 		log.Printf("❌ SNI RESOLUTION FAILED: Could not connect to target: %v", err)
 		http.Error(w, fmt.Sprintf("Failed to connect to target: %v", err), http.StatusInternalServerError)
@@ -1501,7 +1728,7 @@ func handleCreateConnection(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	log.Printf("✅ SNI RESOLUTION COMPLETE: %s (%s:%d)",
-		req.SNI, remoteAddr.IP.String(), remoteAddr.Port)
+		redacted(sensitiveSNI, req.SNI), remoteAddr.IP.String(), remoteAddr.Port)
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -0,0 +1,150 @@
+//go:build !relay
+
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	sultrytls "sultry/pkg/tls"
+)
+
+// TLS 1.2 session-ID resumption
+//
+// A TLS 1.2 server resuming by session ID looks the ID up in its own session
+// cache, so behind a load balancer or DNS rotation a resumption only
+// succeeds if the reconnect reaches the address that issued the ID. Session
+// IDs travel in the clear in the ServerHello, so the client remembers which
+// address issued each one, whether it saw the ServerHello in a tunnel or
+// the relay reported it in the target info. When a later ClientHello offers
+// one of them, direct connections dial that address first. As with tickets
+// (see sessiontickets.go), the browser does the resuming, since only it
+// holds the session's secret; the proxy only makes sure it lands where it
+// can succeed.
+
+// maxSessionIDs bounds the session IDs remembered; the one issued longest
+// ago is forgotten first.
+const maxSessionIDs = 4096
+
+// sessionIDLifetime is how long a session ID is remembered. Servers keep
+// their session caches for minutes to hours.
+const sessionIDLifetime = time.Hour
+
+// issuedSession is where a session ID came from.
+type issuedSession struct {
+	host    string
+	addr    string // ip:port of the target that issued it
+	issued  time.Time
+	expires time.Time
+}
+
+// sessionIDCache maps session IDs to the addresses that issued them.
+type sessionIDCache struct {
+	mu       sync.Mutex
+	sessions map[string]issuedSession // By hex session ID
+}
+
+func newSessionIDCache() *sessionIDCache {
+	return &sessionIDCache{sessions: make(map[string]issuedSession)}
+}
+
+// Put records that addr issued session ID id for host.
+func (c *sessionIDCache) Put(host string, id []byte, addr string) {
+	if len(id) == 0 {
+		return
+	}
+	now := time.Now()
+	key := hex.EncodeToString(id)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.sessions[key]; !exists && len(c.sessions) >= maxSessionIDs {
+		oldest := ""
+		for k, s := range c.sessions {
+			if oldest == "" || s.issued.Before(c.sessions[oldest].issued) {
+				oldest = k
+			}
+		}
+		delete(c.sessions, oldest)
+	}
+	c.sessions[key] = issuedSession{host: strings.ToLower(host), addr: addr, issued: now, expires: now.Add(sessionIDLifetime)}
+}
+
+// Lookup returns the address that issued the session ID clientHello offers
+// to resume with host, or "" if it's unknown. TLS 1.3 clients offer random
+// IDs for compatibility, which are never found.
+func (c *sessionIDCache) Lookup(host string, clientHello []byte) string {
+	id := clientHelloSessionID(clientHello)
+	if len(id) == 0 {
+		return ""
+	}
+	key := hex.EncodeToString(id)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.sessions[key]
+	if !ok || s.host != strings.ToLower(host) {
+		return ""
+	}
+	if time.Now().After(s.expires) {
+		delete(c.sessions, key)
+		return ""
+	}
+	return s.addr
+}
+
+// clientHelloSessionID returns the legacy_session_id of the ClientHello in
+// the first record of hello.
+func clientHelloSessionID(hello []byte) []byte {
+	// Record header, handshake header, client_version and random
+	const offset = sultrytls.HeaderLen + 4 + 2 + 32
+	if len(hello) <= offset || hello[0] != sultrytls.RecordHandshake || hello[5] != sultrytls.HandshakeClientHello {
+		return nil
+	}
+	n := int(hello[offset])
+	if n > 32 || len(hello) < offset+1+n {
+		return nil
+	}
+	return hello[offset+1 : offset+1+n]
+}
+
+// tap returns conn, the client's side of a tunnel to host over target,
+// with the session ID of the ServerHello written to it recorded. Only
+// targets dialed at one of ips, the host's own addresses, are recorded:
+// a relay's address wouldn't help resuming.
+func (c *sessionIDCache) tap(conn net.Conn, host string, target net.Conn, ips []net.IPAddr) net.Conn {
+	addr, ok := target.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return conn
+	}
+	for _, ip := range ips {
+		if ip.IP.Equal(addr.IP) {
+			return &sessionIDTap{Conn: conn, cache: c, host: host, addr: addr.String()}
+		}
+	}
+	return conn
+}
+
+type sessionIDTap struct {
+	net.Conn
+	cache *sessionIDCache
+	host  string
+	addr  string
+	done  bool
+}
+
+// Write parses the first write, which relayData makes whole records, for
+// the ServerHello.
+func (t *sessionIDTap) Write(b []byte) (int, error) {
+	if !t.done {
+		t.done = true
+		hello, err := sultrytls.ParseServerHello(b)
+		if err == nil && !hello.HelloRetryRequest && hello.Version < sultrytls.VersionTLS13 {
+			t.cache.Put(t.host, hello.SessionID, t.addr)
+		}
+	}
+	return t.Conn.Write(b)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// sessionSync is what a client posts to /sessions once its multiplexed
+// session to the server is back after dropping: the handshake sessions it
+// still believes are active on the server, and those it gave up on after a
+// request for them failed.
+type sessionSync struct {
+	Active []string `json:"active"`
+	Closed []string `json:"closed,omitempty"`
+}
+
+// sessionSyncResult lists the active sessions the server still holds.
+type sessionSyncResult struct {
+	Held []string `json:"held"`
+}
+
+// handleSessionSync reconciles the sessions a client and the server hold
+// after the client's connection dropped. The server decides about the
+// sessions the client still has: those it no longer holds are gone for
+// good, since their target connections are closed. The client decides about
+// the sessions it gave up on: the server closes those it still holds.
+// Sessions neither side mentions are left to the idle cleanup.
+func handleSessionSync(w http.ResponseWriter, r *http.Request) {
+	var req sessionSync
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	result := sessionSyncResult{Held: []string{}}
+	var closed []*SessionState
+	sessionsMu.Lock()
+	for _, sessionID := range req.Active {
+		if _, ok := sessions[sessionID]; ok {
+			result.Held = append(result.Held, sessionID)
+		}
+	}
+	for _, sessionID := range req.Closed {
+		if session, ok := sessions[sessionID]; ok {
+			delete(sessions, sessionID)
+			closed = append(closed, session)
+		}
+	}
+	sessionsMu.Unlock()
+	for _, session := range closed {
+		if session.TargetConn != nil {
+			session.TargetConn.Close()
+		}
+		session.unredact()
+	}
+
+	log.Printf("🔄 Session re-sync: %d of %d active session(s) held, %d abandoned one(s) closed",
+		len(result.Held), len(req.Active), len(closed))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,77 @@
+//go:build !relay
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// maxAbandonedSessions bounds the sessions remembered per peer for the
+// next re-sync; the server closes older ones when they go idle.
+const maxAbandonedSessions = 256
+
+// abandon remembers a session on peer the client gave up on after a
+// request for it failed, so the server is told to close it at the next
+// re-sync. o.mu must be held.
+func (o *OOBModule) abandon(peer, sessionID string) {
+	abandoned := append(o.abandoned[peer], sessionID)
+	if len(abandoned) > maxAbandonedSessions {
+		abandoned = abandoned[len(abandoned)-maxAbandonedSessions:]
+	}
+	o.abandoned[peer] = abandoned
+}
+
+// resyncSessions reconciles the handshake sessions on peer with the server
+// once the multiplexed session to it is back, see handleSessionSync:
+// sessions the server no longer holds are dropped, and it closes those the
+// client gave up on. Both lists are sorted, so the outcome doesn't depend
+// on map order.
+func (o *OOBModule) resyncSessions(peer string) {
+	if !o.Supports(peer, capSessionSync) {
+		return
+	}
+	o.mu.Lock()
+	req := sessionSync{Active: []string{}, Closed: slices.Clone(o.abandoned[peer])}
+	for sessionID, session := range o.sessionStore {
+		if session.Peer == peer {
+			req.Active = append(req.Active, sessionID)
+		}
+	}
+	o.mu.Unlock()
+	slices.Sort(req.Active)
+	slices.Sort(req.Closed)
+
+	body, _ := json.Marshal(req)
+	resp, err := o.Client(o.Timeout(peer, 5*time.Second)).Post(o.URL(peer, "/sessions"), "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		log.Printf("⚠️ Failed to re-sync sessions with OOB peer %s: %v", peer, err)
+		return
+	}
+	defer resp.Body.Close()
+	var result sessionSyncResult
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&result) != nil {
+		log.Printf("⚠️ OOB peer %s refused the session re-sync: %s", peer, resp.Status)
+		return
+	}
+
+	o.mu.Lock()
+	var dropped int
+	for _, sessionID := range req.Active {
+		if session, ok := o.sessionStore[sessionID]; ok && session.Peer == peer && !slices.Contains(result.Held, sessionID) {
+			delete(o.sessionStore, sessionID)
+			dropped++
+		}
+	}
+	o.abandoned[peer] = slices.DeleteFunc(o.abandoned[peer], func(sessionID string) bool {
+		return slices.Contains(req.Closed, sessionID)
+	})
+	o.mu.Unlock()
+	log.Printf("🔄 Re-synced sessions with %s: %d still held, %d lost and dropped, %d abandoned and closed",
+		peer, len(result.Held), dropped, len(req.Closed))
+}
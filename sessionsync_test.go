@@ -0,0 +1,111 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newMuxTestModule returns an OOB module multiplexing its requests to the
+// single peer at addr.
+func newMuxTestModule(addr *net.TCPAddr) *OOBModule {
+	return NewOOBModule(&Config{
+		OOBChannels: []OOBChannelConfig{{Type: "http", Address: addr.IP.String(), Port: addr.Port}},
+		OOBMux:      true,
+		OOBRetry:    RetryConfig{InitialBackoff: 10, MaxBackoff: 50},
+	})
+}
+
+func TestMuxReconnectResyncsSessions(t *testing.T) {
+	streams := newStreamListener(&net.TCPAddr{})
+	api := http.NewServeMux()
+	api.Handle("/mux", muxUpgradeHandler(streams))
+	api.HandleFunc("/sessions", handleSessionSync)
+	go http.Serve(streams, api)
+	defer streams.Close()
+	relay := httptest.NewServer(api)
+	defer relay.Close()
+
+	addr := relay.Listener.Addr().(*net.TCPAddr)
+	peer := net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+	o := newMuxTestModule(addr)
+
+	// The relay holds "kept", "abandoned" and "unmentioned"; the client
+	// believes "kept" and "lost" are active and gave up on "abandoned"
+	targets := make(map[string]net.Conn)
+	sessionsMu.Lock()
+	for _, id := range []string{"kept", "abandoned", "unmentioned"} {
+		target, relayEnd := net.Pipe()
+		targets[id] = target
+		sessions[id] = &SessionState{TargetConn: relayEnd, LastActivity: time.Now(), unredact: func() {}}
+	}
+	sessionsMu.Unlock()
+	defer func() {
+		sessionsMu.Lock()
+		for id, target := range targets {
+			target.Close()
+			delete(sessions, id)
+		}
+		sessionsMu.Unlock()
+	}()
+	o.sessionStore["kept"] = &SessionData{Peer: peer}
+	o.sessionStore["lost"] = &SessionData{Peer: peer}
+	o.sessionStore["elsewhere"] = &SessionData{Peer: "192.0.2.1:9443"}
+	o.abandon(peer, "abandoned")
+
+	first, err := o.mux.session(context.Background(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		o.mu.Lock()
+		_, lost := o.sessionStore["lost"]
+		o.mu.Unlock()
+		if !lost {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sessions not re-synced after the multiplexed session dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	o.mux.mu.Lock()
+	second := o.mux.sessions[peer]
+	o.mux.mu.Unlock()
+	if second == first || second.IsClosed() {
+		t.Error("multiplexed session not re-established")
+	}
+	o.mu.Lock()
+	for id, want := range map[string]bool{"kept": true, "lost": false, "elsewhere": true} {
+		if _, ok := o.sessionStore[id]; ok != want {
+			t.Errorf("client holds %q = %v, want %v", id, ok, want)
+		}
+	}
+	if len(o.abandoned[peer]) != 0 {
+		t.Errorf("abandoned sessions still pending after re-sync: %v", o.abandoned[peer])
+	}
+	o.mu.Unlock()
+
+	sessionsMu.Lock()
+	for id, want := range map[string]bool{"kept": true, "abandoned": false, "unmentioned": true} {
+		if _, ok := sessions[id]; ok != want {
+			t.Errorf("relay holds %q = %v, want %v", id, ok, want)
+		}
+	}
+	sessionsMu.Unlock()
+	targets["abandoned"].SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := targets["abandoned"].Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("target connection of the abandoned session still open: %v", err)
+	}
+}
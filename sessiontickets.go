@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+	"time"
+)
+
+// Session tickets and resumption
+//
+// A TLS 1.2 server sends its NewSessionTicket in the clear, ahead of its
+// ChangeCipherSpec, so the relay can capture it while relaying a handshake.
+// It is handed to the client in TargetInfo, keyed by SNI. TLS 1.3 tickets
+// travel inside encrypted records and are never visible to the relay.
+//
+// A ticket alone doesn't allow resuming: that also needs the session's
+// master secret (or, in TLS 1.3, its resumption secret), which only the
+// endpoints of the TLS session hold — the browser, not the proxy. Resumed
+// and 0-RTT handshakes are therefore started by the browser itself, and the
+// proxy only sees them as ClientHellos carrying a ticket or PSK.
+
+// maxSessionTickets bounds the number of hosts tickets are kept for; the
+// ticket captured longest ago is forgotten first.
+const maxSessionTickets = 1024
+
+// defaultTicketLifetime applies to tickets whose server gave no lifetime hint.
+const defaultTicketLifetime = time.Hour
+
+// capturedTicket is a NewSessionTicket seen while relaying a handshake.
+type capturedTicket struct {
+	Ticket   []byte
+	Captured time.Time
+	Expires  time.Time
+}
+
+// sessionTicketStore keeps the latest ticket issued for each SNI.
+type sessionTicketStore struct {
+	tickets map[string]capturedTicket
+	mu      sync.Mutex
+}
+
+var sessionTickets = &sessionTicketStore{tickets: make(map[string]capturedTicket)}
+
+// Put records ticket as the latest one issued for sni.
+func (s *sessionTicketStore) Put(sni string, ticket []byte, lifetime time.Duration) {
+	if lifetime <= 0 {
+		lifetime = defaultTicketLifetime
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.tickets[sni]; !exists && len(s.tickets) >= maxSessionTickets {
+		oldest := ""
+		for host, t := range s.tickets {
+			if oldest == "" || t.Captured.Before(s.tickets[oldest].Captured) {
+				oldest = host
+			}
+		}
+		delete(s.tickets, oldest)
+	}
+	now := time.Now()
+	s.tickets[sni] = capturedTicket{Ticket: ticket, Captured: now, Expires: now.Add(lifetime)}
+}
+
+// Get returns the unexpired ticket for sni.
+func (s *sessionTicketStore) Get(sni string) (capturedTicket, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tickets[sni]
+	if !ok {
+		return capturedTicket{}, false
+	}
+	if time.Now().After(t.Expires) {
+		delete(s.tickets, sni)
+		return capturedTicket{}, false
+	}
+	return t, true
+}
+
+// captureSessionTickets records NewSessionTicket messages found in data, a
+// chunk of a target's handshake flight, for sni. Only whole handshake
+// records within data are inspected.
+func captureSessionTickets(sni string, data []byte) {
+	for len(data) >= 5 {
+		recordType := data[0]
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if 5+length > len(data) {
+			return
+		}
+		record := data[5 : 5+length]
+		data = data[5+length:]
+
+		switch recordType {
+		case 20, 23:
+			// Everything after ChangeCipherSpec is encrypted
+			return
+		case 22:
+		default:
+			continue
+		}
+		for len(record) >= 4 {
+			msgType := record[0]
+			msgLen := int(record[1])<<16 | int(record[2])<<8 | int(record[3])
+			if 4+msgLen > len(record) {
+				break
+			}
+			body := record[4 : 4+msgLen]
+			record = record[4+msgLen:]
+
+			// NewSessionTicket: uint32 lifetime hint, opaque ticket<0..2^16-1>
+			if msgType != 4 || len(body) < 6 {
+				continue
+			}
+			lifetime := time.Duration(binary.BigEndian.Uint32(body[0:4])) * time.Second
+			ticketLen := int(binary.BigEndian.Uint16(body[4:6]))
+			if ticketLen == 0 || 6+ticketLen > len(body) {
+				continue
+			}
+			sessionTickets.Put(sni, append([]byte(nil), body[6:6+ticketLen]...), lifetime)
+			log.Printf("🎫 Captured session ticket for %s (%d bytes, lifetime %v)", redacted(sensitiveSNI, sni), ticketLen, lifetime)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"math/big"
+)
+
+// ShapingConfig disrupts simple first-packet classifiers on the main channel.
+//
+// TLS forbids any bytes before the ClientHello, so on direct connections the
+// first flight is only cut into randomly sized TCP segments. Padding is added
+// where our own protocol allows it: the opening request on the relay channel.
+type ShapingConfig struct {
+	Enabled    bool `json:"enabled"`
+	Segments   int  `json:"segments,omitempty"`    // Number of randomly sized leading segments (default: 3)
+	MinSegment int  `json:"min_segment,omitempty"` // Smallest leading segment in bytes (default: 16)
+	MaxSegment int  `json:"max_segment,omitempty"` // Largest leading segment in bytes (default: 256)
+	PaddingMin int  `json:"padding_min,omitempty"` // Minimum padding bytes on the relay channel's first request
+	PaddingMax int  `json:"padding_max,omitempty"` // Maximum padding bytes on the relay channel's first request
+}
+
+// randomSplitPoints returns cut points for the leading segments of a
+// first flight of the given length.
+func randomSplitPoints(length int, cfg ShapingConfig) []int {
+	segments := cfg.Segments
+	if segments <= 0 {
+		segments = 3
+	}
+	minSize := cfg.MinSegment
+	if minSize <= 0 {
+		minSize = 16
+	}
+	maxSize := cfg.MaxSegment
+	if maxSize < minSize {
+		maxSize = max(256, minSize)
+	}
+
+	var points []int
+	offset := 0
+	for i := 0; i < segments; i++ {
+		offset += minSize + randomInt(maxSize-minSize+1)
+		if offset >= length {
+			break
+		}
+		points = append(points, offset)
+	}
+	return points
+}
+
+// randomPadding returns a printable padding value with a length in the
+// configured range, or "" when padding is not configured.
+func randomPadding(cfg ShapingConfig) string {
+	if cfg.PaddingMax <= 0 {
+		return ""
+	}
+	size := cfg.PaddingMin
+	if cfg.PaddingMax > cfg.PaddingMin {
+		size += randomInt(cfg.PaddingMax - cfg.PaddingMin + 1)
+	}
+	if size <= 0 {
+		return ""
+	}
+
+	raw := make([]byte, size)
+	rand.Read(raw)
+	return base64.RawURLEncoding.EncodeToString(raw)[:size]
+}
+
+// shapeHeaders shuffles the header order of the relay channel's first
+// request and inserts a random padding header, so its layout and size vary
+// from connection to connection.
+func shapeHeaders(headers []string, cfg ShapingConfig) []string {
+	if !cfg.Enabled {
+		return headers
+	}
+	shaped := append([]string(nil), headers...)
+	for i := len(shaped) - 1; i > 0; i-- {
+		j := randomInt(i + 1)
+		shaped[i], shaped[j] = shaped[j], shaped[i]
+	}
+	if pad := randomPadding(cfg); pad != "" {
+		at := randomInt(len(shaped) + 1)
+		shaped = append(shaped[:at], append([]string{"X-Padding: " + pad}, shaped[at:]...)...)
+	}
+	return shaped
+}
+
+// randomInt returns a uniform random int in [0, n).
+func randomInt(n int) int {
+	if n <= 1 {
+		return 0
+	}
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0
+	}
+	return int(v.Int64())
+}
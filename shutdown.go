@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// shutdownTimeout bounds how long in-flight OOB requests may take to finish
+// once the server is stopped by a signal.
+const shutdownTimeout = 10 * time.Second
+
+// serveUntilShutdown turns the error a Serve call returns once the server
+// is shut down into nil.
+func serveUntilShutdown(err error) error {
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops the relay from accepting on any of its listeners,
+// WebTransport included, and waits for in-flight requests until ctx is
+// done, closing what's left then and returning ctx's error. Then every
+// session is closed, which ends the goroutines relaying target responses
+// and adopted connections: those were hijacked, so the servers no longer
+// wait for them.
+func (r *RelayServer) Shutdown(ctx context.Context) error {
+	log.Println("🛑 Shutting down, finishing in-flight requests")
+	r.stopOnce.Do(func() { close(r.stopping) })
+
+	servers := []interface {
+		Shutdown(context.Context) error
+		Close() error
+	}{r.srv, r.internal}
+	if r.webTransport != nil {
+		servers = append(servers, r.webTransport)
+	}
+	var g errgroup.Group
+	for _, srv := range servers {
+		g.Go(func() error {
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+				return err
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		log.Printf("⚠️ Requests still running at the deadline, closed them: %v", err)
+	}
+	closeSessions()
+	return err
+}
+
+// close closes every listener and connection of the relay at once, after
+// one of its listeners failed.
+func (r *RelayServer) close() {
+	r.srv.Close()
+	r.internal.Close()
+	if r.webTransport != nil {
+		r.webTransport.Close()
+	}
+}
+
+// closeSessions closes the target connections of every session.
+func closeSessions() {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	closed := len(sessions)
+	for sessionID, session := range sessions {
+		if session.TargetConn != nil {
+			session.TargetConn.Close()
+		}
+		delete(sessions, sessionID)
+		session.unredact()
+	}
+	log.Printf("🛑 Closed %d session(s)", closed)
+}
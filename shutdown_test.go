@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestRelay returns a relay serving handler, listening on an ephemeral
+// port, and its internal listener.
+func newTestRelay(t *testing.T, handler http.Handler) (*RelayServer, net.Listener, *streamListener) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal := newStreamListener(listener.Addr())
+	return newRelayServer(&http.Server{Handler: handler}, internal), listener, internal
+}
+
+// serveRelay runs Serve, delivering its result.
+func serveRelay(relay *RelayServer, listener net.Listener) <-chan error {
+	served := make(chan error, 1)
+	go func() { served <- relay.Serve(listener) }()
+	return served
+}
+
+func TestRelayShutdownDrainsInFlightRequests(t *testing.T) {
+	started, finish := make(chan struct{}), make(chan struct{})
+	relay, listener, internal := newTestRelay(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		fmt.Fprint(w, "done")
+	}))
+	addr := listener.Addr().String()
+
+	tlsConfig, err := serverTLSConfig(OOBTLSConfig{SelfSigned: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.webTransport, err = newWebTransportServer(WebTransportConfig{Listen: "127.0.0.1:0"}, tlsConfig, AuthConfig{}, relay.srv.Handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webTransportAddr := relay.webTransport.conn.LocalAddr().String()
+	served := serveRelay(relay, listener)
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- relay.Shutdown(context.Background()) }()
+
+	// Listeners close at once, while the request is still running
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("relay port still accepting after Shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := internal.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("internal listener Accept = %v, want net.ErrClosed", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the in-flight request finished", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(finish)
+	if got := <-body; got != "done" {
+		t.Errorf("in-flight request got %q, want done", got)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve = %v", err)
+	}
+
+	// The WebTransport socket is released too
+	udpAddr, _ := net.ResolveUDPAddr("udp", webTransportAddr)
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatalf("WebTransport socket still bound after Shutdown: %v", err)
+	}
+	conn.Close()
+}
+
+func TestRelayShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	relay, listener, _ := newTestRelay(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	addr := listener.Addr().String()
+	served := serveRelay(relay, listener)
+
+	failed := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/stuck")
+		if err == nil {
+			resp.Body.Close()
+		}
+		failed <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := relay.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown = %v, want the deadline's error", err)
+	}
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Error("request cut short by Shutdown succeeded")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request still running after Shutdown returned")
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve = %v", err)
+	}
+}
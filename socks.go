@@ -0,0 +1,234 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKSConfig accepts SOCKS5 connections next to the HTTP proxy, for
+// applications that only speak SOCKS (RFC 1928). Only the CONNECT command is
+// supported, and tunnels go through the same strategies as CONNECT requests.
+type SOCKSConfig struct {
+	Listen string            `json:"listen,omitempty"`              // Address to accept SOCKS5 clients on; empty disables it
+	Users  map[string]string `json:"users,omitempty" secret:"true"` // Passwords by username (RFC 1929); empty accepts anyone
+}
+
+// SOCKS5 protocol constants.
+const (
+	socksVersion = 5
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthUnacceptable = 0xff
+	socksPasswordVersion  = 1
+
+	socksCmdConnect = 1
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+
+	socksSucceeded            = 0
+	socksGeneralFailure       = 1
+	socksNotAllowed           = 2
+	socksCommandNotSupported  = 7
+	socksAddrTypeNotSupported = 8
+)
+
+// socksNegotiationTimeout bounds the greeting, authentication and request.
+const socksNegotiationTimeout = 10 * time.Second
+
+// StartSOCKS accepts SOCKS5 clients on cfg.Listen.
+func (p *TLSProxy) StartSOCKS(cfg ListenerConfig) {
+	listener, err := cfg.listen()
+	if err != nil {
+		log.Fatalf("❌ Failed to start SOCKS5 listener: %v", err)
+	}
+	defer listener.Close()
+	if len(cfg.Users) == 0 {
+		log.Printf("🔹 SOCKS5 listener on %s (no authentication)", cfg.Listen)
+	} else {
+		log.Printf("🔹 SOCKS5 listener on %s (%d user(s))", cfg.Listen, len(cfg.Users))
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("❌ Connection error:", err)
+			continue
+		}
+		go p.handleSOCKSConnection(cfg.Users, conn)
+	}
+}
+
+// handleSOCKSConnection negotiates a SOCKS5 CONNECT and serves the tunnel.
+func (p *TLSProxy) handleSOCKSConnection(users map[string]string, clientConn net.Conn) {
+	defer clientConn.Close()
+	ctx := withSessionLogger(context.Background(),
+		newSessionLogger().Redacting(sensitiveClientIP, clientConn.RemoteAddr().String()))
+	logger := sessionLog(ctx)
+
+	clientConn.SetDeadline(time.Now().Add(socksNegotiationTimeout))
+	host, port, err := socksHandshake(clientConn, users)
+	if err != nil {
+		logger.Printf("❌ SOCKS5: %s: %v", clientConn.RemoteAddr(), err)
+		return
+	}
+	clientConn.SetDeadline(time.Time{})
+	ctx = withSessionLogger(ctx, logger.Redacting(sensitiveSNI, host))
+	logger = sessionLog(ctx)
+	logger.Printf("🔹 SOCKS5: CONNECT to %s", net.JoinHostPort(host, port))
+	if !connectPorts.allows(port) {
+		logger.Printf("🚫 SOCKS5: Refusing CONNECT to port %s, which connect_ports doesn't allow", port)
+		socksReply(clientConn, socksNotAllowed)
+		return
+	}
+	if p.blocks(host) {
+		logger.Printf("🚫 SOCKS5: Refusing CONNECT to %s, which a rule blocks", host)
+		socksReply(clientConn, socksNotAllowed)
+		return
+	}
+
+	p.openTunnel(ctx, clientConn, host, port, func(string) {
+		socksReply(clientConn, socksSucceeded)
+	})
+}
+
+// socksHandshake reads the client's greeting, authenticates it against
+// users and reads its CONNECT request, returning the target. Failures are
+// answered as SOCKS5 says before they're returned.
+func socksHandshake(conn net.Conn, users map[string]string) (host, port string, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", fmt.Errorf("failed to read greeting: %w", err)
+	}
+	if header[0] != socksVersion {
+		return "", "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", "", fmt.Errorf("failed to read authentication methods: %w", err)
+	}
+
+	method := byte(socksAuthNone)
+	if len(users) > 0 {
+		method = socksAuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksAuthUnacceptable})
+		return "", "", errors.New("client offers no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", "", err
+	}
+	if method == socksAuthPassword {
+		if err := socksAuthenticate(conn, users); err != nil {
+			return "", "", err
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", "", fmt.Errorf("failed to read request: %w", err)
+	}
+	if request[0] != socksVersion {
+		return "", "", fmt.Errorf("unsupported SOCKS version %d in request", request[0])
+	}
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		addr := make([]byte, net.IPv4len)
+		if request[3] == socksAddrIPv6 {
+			addr = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", "", fmt.Errorf("failed to read address: %w", err)
+		}
+		host = net.IP(addr).String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", "", fmt.Errorf("failed to read address: %w", err)
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", "", fmt.Errorf("failed to read address: %w", err)
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksAddrTypeNotSupported)
+		return "", "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return "", "", fmt.Errorf("failed to read port: %w", err)
+	}
+	port = strconv.Itoa(int(portBytes[0])<<8 | int(portBytes[1]))
+
+	if request[1] != socksCmdConnect {
+		socksReply(conn, socksCommandNotSupported)
+		return "", "", fmt.Errorf("unsupported command %d for %s", request[1], net.JoinHostPort(host, port))
+	}
+	if host == "" {
+		socksReply(conn, socksGeneralFailure)
+		return "", "", errors.New("empty target host")
+	}
+	return host, port, nil
+}
+
+// socksAuthenticate runs the username/password subnegotiation (RFC 1929).
+func socksAuthenticate(conn net.Conn, users map[string]string) error {
+	readField := func() (string, error) {
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		field := make([]byte, length[0])
+		_, err := io.ReadFull(conn, field)
+		return string(field), err
+	}
+
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return fmt.Errorf("failed to read credentials: %w", err)
+	}
+	if version[0] != socksPasswordVersion {
+		return fmt.Errorf("unsupported authentication version %d", version[0])
+	}
+	user, err := readField()
+	if err != nil {
+		return fmt.Errorf("failed to read credentials: %w", err)
+	}
+	password, err := readField()
+	if err != nil {
+		return fmt.Errorf("failed to read credentials: %w", err)
+	}
+
+	want, ok := users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 {
+		conn.Write([]byte{socksPasswordVersion, 1})
+		recordAuthFailure(conn.RemoteAddr().String())
+		return fmt.Errorf("authentication failed for user %q", user)
+	}
+	_, err = conn.Write([]byte{socksPasswordVersion, 0})
+	return err
+}
+
+// socksReply answers a request with status. The bound address is left
+// unspecified, since tunnels may not have a local socket of their own.
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
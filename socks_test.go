@@ -0,0 +1,82 @@
+//go:build !relay
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// socksClientConn reads what a SOCKS5 client sends from in and records what
+// it is answered.
+type socksClientConn struct {
+	net.Conn
+	in  *strings.Reader
+	out bytes.Buffer
+}
+
+func (c *socksClientConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *socksClientConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *socksClientConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 51234}
+}
+
+func TestSOCKSHandshake(t *testing.T) {
+	const (
+		noAuth   = "\x05\x01\x00"
+		password = "\x05\x01\x02"
+		connect  = "\x05\x01\x00\x03\x0bexample.com\x01\xbb"
+		accepted = "\x05\x00"
+		reply    = "\x00\x01\x00\x00\x00\x00\x00\x00" // After the version and status
+	)
+	users := map[string]string{"alice": "hunter2"}
+	tests := []struct {
+		name  string
+		users map[string]string
+		input string
+		host  string // Empty if the handshake fails
+		port  string
+		err   string // Substring of the expected error
+		out   string // What the server answers
+	}{
+		{name: "domain", input: noAuth + connect, host: "example.com", port: "443", out: accepted},
+		{name: "IPv4", input: noAuth + "\x05\x01\x00\x01\xc0\x00\x02\x01\x20\xfb", host: "192.0.2.1", port: "8443", out: accepted},
+		{name: "IPv6", input: noAuth + "\x05\x01\x00\x04\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01\xff\xff", host: "2001:db8::1", port: "65535", out: accepted},
+		{name: "several methods", input: "\x05\x03\x01\x02\x00" + connect, host: "example.com", port: "443", out: accepted},
+		{name: "password", users: users, input: password + "\x01\x05alice\x07hunter2" + connect, host: "example.com", port: "443", out: "\x05\x02\x01\x00"},
+
+		{name: "empty", input: "", err: "greeting"},
+		{name: "SOCKS4", input: "\x04\x01\x00\x50", err: "unsupported SOCKS version 4"},
+		{name: "truncated methods", input: "\x05\x03\x00", err: "authentication methods"},
+		{name: "no methods", input: "\x05\x00", err: "no acceptable", out: "\x05\xff"},
+		{name: "password required", users: users, input: noAuth + connect, err: "no acceptable", out: "\x05\xff"},
+		{name: "wrong password", users: users, input: password + "\x01\x05alice\x05wrong" + connect, err: "authentication failed", out: "\x05\x02\x01\x01"},
+		{name: "unknown user", users: users, input: password + "\x01\x03bob\x07hunter2", err: "authentication failed", out: "\x05\x02\x01\x01"},
+		{name: "auth version", users: users, input: password + "\x05\x05alice\x07hunter2", err: "authentication version 5", out: "\x05\x02"},
+		{name: "truncated credentials", users: users, input: password + "\x01\x05alice\x07hun", err: "credentials", out: "\x05\x02"},
+		{name: "truncated request", input: noAuth + "\x05\x01", err: "read request", out: accepted},
+		{name: "request version", input: noAuth + "\x04\x01\x00\x03", err: "in request", out: accepted},
+		{name: "address type", input: noAuth + "\x05\x01\x00\x05", err: "address type 5", out: accepted + "\x05\x08" + reply},
+		{name: "truncated domain", input: noAuth + "\x05\x01\x00\x03\x0bexample", err: "read address", out: accepted},
+		{name: "truncated IPv6", input: noAuth + "\x05\x01\x00\x04\x20\x01", err: "read address", out: accepted},
+		{name: "truncated port", input: noAuth + "\x05\x01\x00\x01\xc0\x00\x02\x01\x01", err: "read port", out: accepted},
+		{name: "BIND", input: noAuth + "\x05\x02\x00\x03\x0bexample.com\x01\xbb", err: "unsupported command 2", out: accepted + "\x05\x07" + reply},
+		{name: "empty domain", input: noAuth + "\x05\x01\x00\x03\x00\x01\xbb", err: "empty target host", out: accepted + "\x05\x01" + reply},
+	}
+	for _, tt := range tests {
+		conn := &socksClientConn{in: strings.NewReader(tt.input)}
+		host, port, err := socksHandshake(conn, tt.users)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+			}
+		} else if err != nil || host != tt.host || port != tt.port {
+			t.Errorf("%s: got %s %s, %v, want %s %s", tt.name, host, port, err, tt.host, tt.port)
+		}
+		if conn.out.String() != tt.out {
+			t.Errorf("%s: answered % x, want % x", tt.name, conn.out.Bytes(), tt.out)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Source ports of relay connections
+//
+// Some targets rate-limit or track clients by source address and port, and
+// a relay connecting to them on behalf of many clients looks like one busy
+// client. By default the system picks the relay's local port for each
+// connection; with a range configured the relay picks them itself, from the
+// range, so a deployment can give each relay its own slice of ports, and it
+// doesn't reconnect to a target from a port it just used with it, which the
+// target may still hold in TIME_WAIT or count against the same tuple.
+
+// SourcePortConfig controls the local ports the relay connects to targets
+// from.
+type SourcePortConfig struct {
+	Range      string `json:"range,omitempty"`       // Local ports to connect from, e.g. "40000-40999" (default: the system's ephemeral range)
+	Policy     string `json:"policy,omitempty"`      // How the next port is picked: "random" (default) or "sequential"
+	ReuseDelay int    `json:"reuse_delay,omitempty"` // Milliseconds before a port connects to the same target again (default: 60000; negative: right away)
+}
+
+const (
+	sourcePortRandom     = "random"
+	sourcePortSequential = "sequential"
+)
+
+// defaultSourcePortReuseDelay outlasts TIME_WAIT on Linux.
+const defaultSourcePortReuseDelay = 60 * time.Second
+
+// sourcePortAttempts bounds how many ports a dial tries when the ones it
+// picks turn out to be taken by other sockets.
+const sourcePortAttempts = 8
+
+var errSourcePortsExhausted = errors.New("every source port is in use or waiting to be reused")
+
+// sourcePorts allocates the relay's source ports, or is nil when the
+// system picks them.
+var sourcePorts *sourcePortAllocator
+
+// sourcePortUse is a port's last connection to a target.
+type sourcePortUse struct {
+	port   int
+	target string
+}
+
+// sourcePortAllocator hands out the ports of a range, keeping track of the
+// ones in use and of when each was last released by each target.
+type sourcePortAllocator struct {
+	low, high  int
+	sequential bool
+	reuseDelay time.Duration
+
+	mu       sync.Mutex
+	next     int // Offset of the next port tried by the sequential policy
+	inUse    map[int]bool
+	released map[sourcePortUse]time.Time
+}
+
+// validate checks the range and the policy.
+func (cfg SourcePortConfig) validate() error {
+	if cfg.Range != "" {
+		if _, _, err := parsePortRange(cfg.Range); err != nil {
+			return fmt.Errorf("source_ports.range: %w", err)
+		}
+	}
+	if p := cfg.Policy; p != "" && p != sourcePortRandom && p != sourcePortSequential {
+		return fmt.Errorf("source_ports.policy: unknown policy %q (use random or sequential)", p)
+	}
+	return nil
+}
+
+// setupSourcePorts configures the source ports of relay connections.
+func setupSourcePorts(cfg SourcePortConfig) error {
+	if err := cfg.validate(); err != nil || cfg.Range == "" {
+		return err
+	}
+	low, high, _ := parsePortRange(cfg.Range)
+	policy := cfg.Policy
+	if policy == "" {
+		policy = sourcePortRandom
+	}
+	delay := time.Duration(cfg.ReuseDelay) * time.Millisecond
+	if cfg.ReuseDelay == 0 {
+		delay = defaultSourcePortReuseDelay
+	}
+	sourcePorts = &sourcePortAllocator{low: low, high: high, sequential: policy == sourcePortSequential,
+		reuseDelay: max(delay, 0), inUse: make(map[int]bool), released: make(map[sourcePortUse]time.Time)}
+	log.Printf("🔌 Connecting to targets from local ports %d-%d (%s, reused for a target after %v)", low, high, policy,
+		sourcePorts.reuseDelay)
+	return nil
+}
+
+// parsePortRange parses "low-high", or a single port.
+func parsePortRange(s string) (int, int, error) {
+	lowText, highText, isRange := strings.Cut(s, "-")
+	if !isRange {
+		highText = lowText
+	}
+	low, err := strconv.Atoi(strings.TrimSpace(lowText))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(highText))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	if low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q: ports go from 1 to 65535, low to high", s)
+	}
+	return low, high, nil
+}
+
+// dial connects to address with dialer from a port of the range, moving on
+// to another port when one is taken by a socket the allocator doesn't know
+// about. Without a range, the system picks the port.
+func (a *sourcePortAllocator) dial(dialer *net.Dialer, address string) (net.Conn, func(), error) {
+	if a == nil {
+		conn, err := dialer.DialContext(context.Background(), "tcp", address)
+		return conn, func() {}, err
+	}
+	var lastErr error
+	for attempt := 0; attempt < sourcePortAttempts; attempt++ {
+		port, err := a.acquire(address)
+		if err != nil {
+			return nil, nil, err
+		}
+		bound := *dialer
+		bound.LocalAddr = &net.TCPAddr{Port: port}
+		bound.Control = reuseAddr // Ports lingering in TIME_WAIT with other targets can still be bound
+		conn, err := bound.DialContext(context.Background(), "tcp", address)
+		if err == nil {
+			return conn, func() { a.release(port, address) }, nil
+		}
+		a.release(port, address)
+		if !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil, nil, err
+		}
+		lastErr = err
+	}
+	return nil, nil, fmt.Errorf("no free source port after %d attempts: %w", sourcePortAttempts, lastErr)
+}
+
+// acquire picks a port that is neither in use nor released by target less
+// than the reuse delay ago.
+func (a *sourcePortAllocator) acquire(target string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	size := a.high - a.low + 1
+	start := a.next
+	if !a.sequential {
+		start = rand.IntN(size)
+	}
+	now := time.Now()
+	for i := 0; i < size; i++ {
+		offset := (start + i) % size
+		port := a.low + offset
+		if a.inUse[port] {
+			continue
+		}
+		if at, ok := a.released[sourcePortUse{port, target}]; ok && now.Sub(at) < a.reuseDelay {
+			continue
+		}
+		a.inUse[port] = true
+		a.next = (offset + 1) % size
+		return port, nil
+	}
+	return 0, errSourcePortsExhausted
+}
+
+// release returns port, used with target, to the range.
+func (a *sourcePortAllocator) release(port int, target string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.inUse, port)
+	if a.reuseDelay <= 0 {
+		return
+	}
+	now := time.Now()
+	a.released[sourcePortUse{port, target}] = now
+	if len(a.released) > 4*(a.high-a.low+1) {
+		for use, at := range a.released {
+			if now.Sub(at) >= a.reuseDelay {
+				delete(a.released, use)
+			}
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "syscall"
+
+// reuseAddr leaves sockets as they are: SO_REUSEADDR means something else
+// outside Unix, so ports in TIME_WAIT are skipped like ports in use.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	return nil
+}
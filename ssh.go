@@ -0,0 +1,191 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHConfig carries OOB traffic over an SSH connection to the server host,
+// for oob_channels entries of type "ssh" (address and port of the SSH
+// server). Every OOB request is forwarded through the SSH connection to the
+// OOB API on the server host, so no port besides SSH needs to be reachable.
+type SSHConfig struct {
+	User                  string `json:"user,omitempty"`
+	KeyFile               string `json:"key_file,omitempty"`                 // Private key (PEM or OpenSSH format)
+	Passphrase            string `json:"passphrase,omitempty" secret:"true"` // Passphrase of key_file, if encrypted
+	Agent                 bool   `json:"agent,omitempty"`                    // Authenticate with keys from the agent at SSH_AUTH_SOCK
+	KnownHosts            string `json:"known_hosts,omitempty"`              // Host keys the server is verified against (default: ~/.ssh/known_hosts)
+	InsecureIgnoreHostKey bool   `json:"insecure_ignore_host_key,omitempty"` // Accept any host key (testing only)
+	Remote                string `json:"remote,omitempty"`                   // OOB API address as seen from the SSH server (default: 127.0.0.1:relay_port)
+	TLS                   bool   `json:"tls,omitempty"`                      // The OOB API behind the tunnel is served over HTTPS
+}
+
+// sshDialer keeps one SSH connection per OOB peer and opens a forwarded
+// channel to the OOB API on it for every connection.
+type sshDialer struct {
+	config  *ssh.ClientConfig
+	remote  string
+	tls     bool
+	clients map[string]*ssh.Client
+	mu      sync.Mutex
+}
+
+// newSSHDialer returns nil if no channel uses SSH, so that missing keys
+// only matter when SSH is actually configured.
+func newSSHDialer(config *Config) (*sshDialer, error) {
+	used := false
+	for _, channel := range config.OOBChannels {
+		used = used || channel.Type == "ssh"
+	}
+	if !used {
+		return nil, nil
+	}
+
+	cfg := config.SSH
+	if cfg.User == "" {
+		return nil, errors.New("ssh.user is required for ssh OOB channels")
+	}
+	remote := cfg.Remote
+	if remote == "" {
+		if config.RelayPort == 0 {
+			return nil, errors.New("ssh.remote or relay_port is required for ssh OOB channels")
+		}
+		remote = net.JoinHostPort("127.0.0.1", fmt.Sprint(config.RelayPort))
+	}
+
+	var methods []ssh.AuthMethod
+	if cfg.KeyFile != "" {
+		pem, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH key: %w", err)
+		}
+		var signer ssh.Signer
+		if cfg.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(cfg.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(pem)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH key %s: %w", cfg.KeyFile, err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if cfg.Agent {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, errors.New("ssh.agent is set but SSH_AUTH_SOCK is empty")
+		}
+		// The agent is asked for its keys on every authentication, so a
+		// restarted agent is picked up by the next connection
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			conn, err := net.Dial("unix", socket)
+			if err != nil {
+				return nil, fmt.Errorf("failed to reach SSH agent: %w", err)
+			}
+			defer conn.Close()
+			return agent.NewClient(conn).Signers()
+		}))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("ssh.key_file or ssh.agent is required for ssh OOB channels")
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !cfg.InsecureIgnoreHostKey {
+		path := cfg.KnownHosts
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("failed to locate known_hosts: %w", err)
+			}
+			path = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		var err error
+		hostKeyCallback, err = knownhosts.New(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known hosts: %w", err)
+		}
+	}
+
+	return &sshDialer{
+		config: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            methods,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         10 * time.Second,
+		},
+		remote:  remote,
+		tls:     cfg.TLS,
+		clients: make(map[string]*ssh.Client),
+	}, nil
+}
+
+// DialContext opens a channel to the OOB API through the SSH connection to
+// peer, connecting first if needed.
+func (d *sshDialer) DialContext(ctx context.Context, peer string) (net.Conn, error) {
+	client, err := d.client(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, "tcp", d.remote)
+	if err != nil {
+		return nil, fmt.Errorf("SSH server %s failed to forward to %s: %w", peer, d.remote, err)
+	}
+	return conn, nil
+}
+
+// client returns the live SSH connection to peer, connecting again if the
+// previous connection was lost.
+func (d *sshDialer) client(ctx context.Context, peer string) (*ssh.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if client, ok := d.clients[peer]; ok {
+		return client, nil
+	}
+
+	conn, err := upstream.DialContext(ctx, &net.Dialer{}, peer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSH server %s: %w", peer, err)
+	}
+	// Abort the SSH handshake along with the context
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, peer, d.config)
+	if !stop() {
+		if err == nil {
+			sshConn.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH handshake with %s failed: %w", peer, err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	log.Printf("🔑 SSH connection established to %s as %s", peer, d.config.User)
+	d.clients[peer] = client
+
+	go func() {
+		err := client.Wait()
+		log.Printf("⚠️ SSH connection to %s closed: %v", peer, err)
+		d.mu.Lock()
+		if d.clients[peer] == client {
+			delete(d.clients, peer)
+		}
+		d.mu.Unlock()
+	}()
+	return client, nil
+}
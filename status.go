@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// StatusConfig serves health information as JSON over HTTP, for dashboards
+// and scripts. It carries no authentication, so keep it on a loopback or
+// otherwise private address.
+type StatusConfig struct {
+	Listen string `json:"listen,omitempty"` // Address of the status listener, e.g. "127.0.0.1:9100"
+}
+
+// statusMux collects the status endpoints of the components running in
+// this process.
+var statusMux = http.NewServeMux()
+
+// statusSnapshots holds what each status endpoint reports.
+var (
+	statusMu        sync.Mutex
+	statusSnapshots = make(map[string]func() any)
+)
+
+// handleStatus registers a status endpoint at path that reports the result
+// of snapshot as JSON. Registering a path again replaces its snapshot, so
+// components built more than once, like the proxies of "bench handshake"
+// and tests, report their latest instance.
+func handleStatus(path string, snapshot func() any) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	if _, ok := statusSnapshots[path]; !ok {
+		statusMux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			statusMu.Lock()
+			snapshot := statusSnapshots[path]
+			statusMu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(snapshot())
+		})
+	}
+	statusSnapshots[path] = snapshot
+}
+
+// serveStatus starts the status listener, if one is configured.
+func serveStatus(cfg StatusConfig) {
+	if cfg.Listen == "" {
+		return
+	}
+	go func() {
+		log.Printf("📊 Status endpoints served on http://%s", cfg.Listen)
+		err := http.ListenAndServe(cfg.Listen, statusMux)
+		log.Printf("❌ Status listener stopped: %v", err)
+	}()
+}
@@ -0,0 +1,495 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Destination describes where a tunneled connection is headed.
+type Destination struct {
+	Host        string // Host from the CONNECT request
+	Port        string
+	SNI         string // Server name from the ClientHello, or Host if it carries none
+	ClientHello []byte // First flight read from the client
+
+	// PROXY protocol header version sent ahead of the ClientHello (0 for
+	// none), describing a connection from Source
+	ProxyProtocol int
+	Source        net.Addr
+
+	// Address that issued the TLS 1.2 session ID the ClientHello offers,
+	// dialed first so the session can be resumed (see sessionids.go)
+	Affinity string
+
+	// Set for DNS-over-HTTPS resolvers, which only strategies concealing the
+	// SNI may connect to (see doh.go)
+	Conceal bool
+
+	// Action of the routing rule matching the destination, "" for none, and
+	// the OOB peer a forwarding rule names (see routing.go)
+	Route string
+	Peer  string
+
+	resolver *dnsStage     // Shared DNS result, if resolution was started early
+	prepared *preparedConn // Connection a strategy started before the ClientHello arrived
+	pinned   net.IP        // The only address to dial, for one racer of a handshake race (see race.go)
+}
+
+// Addr returns the host:port to dial.
+func (d Destination) Addr() string {
+	return net.JoinHostPort(d.Host, d.Port)
+}
+
+// mustConceal reports whether only concealing strategies may connect d: DoH
+// resolvers, and destinations of conceal and forward rules.
+func (d Destination) mustConceal() bool {
+	return d.Conceal || d.Route == routeConceal || d.Route == routeForward
+}
+
+// ConnectionStrategy is a technique for reaching a destination, such as a
+// plain dial, OOB SNI concealment or ClientHello fragmentation.
+//
+// Establish must send dest.ClientHello itself, since how the first flight is
+// written is usually what distinguishes one technique from another. The
+// returned connection is then relayed to clientConn by the caller.
+type ConnectionStrategy interface {
+	Name() string
+	Applicable(dest Destination) bool
+	Establish(ctx context.Context, clientConn net.Conn, dest Destination) (net.Conn, error)
+}
+
+// StrategyFactory builds a strategy bound to a proxy's configuration.
+type StrategyFactory func(p *TLSProxy) ConnectionStrategy
+
+var (
+	strategyFactories   = make(map[string]StrategyFactory)
+	strategyFactoriesMu sync.Mutex
+)
+
+// RegisterStrategy makes a strategy available under name for the
+// "strategies" config option. Built-ins register themselves from init; files
+// added to the package can register new techniques the same way.
+func RegisterStrategy(name string, factory StrategyFactory) {
+	strategyFactoriesMu.Lock()
+	defer strategyFactoriesMu.Unlock()
+
+	if _, exists := strategyFactories[name]; exists {
+		panic("sultry: strategy registered twice: " + name)
+	}
+	strategyFactories[name] = factory
+}
+
+// registeredStrategies returns the names of all registered strategies.
+func registeredStrategies() []string {
+	strategyFactoriesMu.Lock()
+	defer strategyFactoriesMu.Unlock()
+
+	names := make([]string, 0, len(strategyFactories))
+	for name := range strategyFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StrategyStats are the uniform measurements kept for every strategy.
+type StrategyStats struct {
+	Attempts    int                   `json:"attempts"`
+	Successes   int                   `json:"successes"`
+	Failures    int                   `json:"failures"`
+	Causes      map[FallbackCause]int `json:"causes,omitempty"` // Failures by cause
+	LastError   string                `json:"last_error,omitempty"`
+	LastLatency time.Duration         `json:"last_latency_ns"`
+
+	// End of the cooldown of a strategy the error budget disabled
+	DisabledUntil *time.Time `json:"disabled_until,omitempty"`
+}
+
+// strategyOrchestrator tries strategies in order until one establishes a
+// connection, recording the outcome of every attempt.
+type strategyOrchestrator struct {
+	strategies []ConnectionStrategy
+	conceal    []ConnectionStrategy // Strategies for destinations that must be concealed
+	hiding     []ConnectionStrategy // Strategies never sending the SNI in the clear, for the kill switch
+	direct     []ConnectionStrategy // Strategies for destinations routed directly
+	timeout    time.Duration        // Per-attempt budget
+	diary      *failureDiary        // Past failures, used to try the least failing strategies first
+	budget     *errorBudget         // Disables strategies failing everywhere, if configured
+	dryRun     *dryRunObserver      // Set when tunnels only connect directly (see dryrun.go)
+	race       RaceConfig           // Racing the handshake over several addresses (see race.go)
+	killSwitch bool                 // Only strategies hiding the SNI are tried, unless a rule routes directly
+	stats      map[string]*StrategyStats
+	mu         sync.Mutex
+}
+
+// newStrategyOrchestrator instantiates the named strategies for p. Without
+// explicit names, the order follows the legacy flags: OOB first when SNI
+// concealment is prioritized (behind a cover SNI, if one is set), then
+// desync and fragmentation if enabled, and finally a direct connection.
+func newStrategyOrchestrator(p *TLSProxy, names []string, diary *failureDiary) (*strategyOrchestrator, error) {
+	if len(names) == 0 {
+		names = legacyStrategies(p.PrioritizeSNI, p.FakeSNI, p.Desync.Enabled, p.Fragment.Enabled)
+	}
+
+	o := &strategyOrchestrator{
+		timeout: 10 * time.Second,
+		diary:   diary,
+		race:    p.Race,
+		stats:   make(map[string]*StrategyStats),
+	}
+
+	strategyFactoriesMu.Lock()
+	defer strategyFactoriesMu.Unlock()
+	for _, name := range names {
+		factory, ok := strategyFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown connection strategy %q", name)
+		}
+		o.strategies = append(o.strategies, factory(p))
+		o.stats[name] = &StrategyStats{}
+		if concealingStrategies[name] {
+			o.conceal = append(o.conceal, o.strategies[len(o.strategies)-1])
+		} else {
+			o.direct = append(o.direct, o.strategies[len(o.strategies)-1])
+		}
+		if sniHidingStrategies[name] {
+			o.hiding = append(o.hiding, o.strategies[len(o.strategies)-1])
+		}
+	}
+	if p.KillSwitch {
+		if o.killSwitch = len(o.hiding) > 0; !o.killSwitch {
+			log.Println("⚠️ kill_switch has no effect, since no strategy hiding the SNI (cover) is configured")
+		}
+	}
+	if len(o.direct) == 0 {
+		o.direct = append(o.direct, strategyFactories["direct"](p))
+	}
+	if len(o.conceal) == 0 {
+		// Destinations that must be concealed still are when no concealing
+		// strategy is in the order
+		for _, name := range []string{"cover", "oob"} {
+			o.conceal = append(o.conceal, strategyFactories[name](p))
+		}
+	}
+	if p.DryRun {
+		o.dryRun = newDryRunObserver(p)
+	}
+	return o, nil
+}
+
+// legacyStrategies derives the strategy order from the flags that selected
+// techniques before the "strategies" option existed.
+func legacyStrategies(prioritizeSNI bool, coverSNI string, desync, fragment bool) []string {
+	var names []string
+	if prioritizeSNI {
+		if coverSNI != "" {
+			names = append(names, "cover")
+		}
+		names = append(names, "oob")
+	}
+	if desync {
+		names = append(names, "desync")
+	}
+	if fragment {
+		names = append(names, "fragment")
+	}
+	return append(names, "direct")
+}
+
+// Names returns the configured strategy order.
+func (o *strategyOrchestrator) Names() []string {
+	names := make([]string, len(o.strategies))
+	for i, s := range o.strategies {
+		names[i] = s.Name()
+	}
+	return names
+}
+
+// Establish runs the applicable strategies and returns the first connection
+// that succeeds along with the strategy's name, and the failed attempts
+// before it. Strategies are tried in the configured order, except that ones
+// with recent failures against dest are moved behind those without.
+func (o *strategyOrchestrator) Establish(ctx context.Context, clientConn net.Conn, dest Destination) (net.Conn, string, []Fallback, error) {
+	candidates, scores := o.candidates(dest)
+	session := sessionLog(ctx).ID()
+
+	var errs []string
+	var fallbacks []Fallback
+	for i, s := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, "", fallbacks, err
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, o.timeout)
+		logger := sessionLog(ctx).With("strategy", s.Name())
+		attemptCtx = withSessionLogger(attemptCtx, logger)
+		start := time.Now()
+		transcriptOf(ctx).State("trying %s for %s", s.Name(), dest.Addr())
+		conn, err := o.attempt(attemptCtx, s, clientConn, dest)
+		if conn != nil {
+			// Alerts that another strategy might avoid count as failures
+			// while there are strategies left; otherwise they are relayed
+			// to the client, which reports them itself
+			var alert *tlsAlertError
+			if errors.As(err, &alert) {
+				logger.Printf("⚠️ %v: %s", alert, alert.Hint())
+				if !alert.Retryable() || i == len(candidates)-1 {
+					err = nil
+				}
+			}
+			if err != nil {
+				conn.Close()
+			}
+		}
+		cancel()
+		o.record(s.Name(), time.Since(start), err)
+		if err != nil {
+			o.diary.Record(dest.Addr(), s.Name(), err)
+		} else if scores[s.Name()] > 0 {
+			o.diary.Forget(dest.Addr(), s.Name())
+		}
+
+		if err == nil {
+			logger.Printf("✅ Strategy %s connected to %s in %s", s.Name(), dest.Addr(), time.Since(start).Truncate(time.Millisecond))
+			transcriptOf(ctx).State("%s connected", s.Name())
+			audit(auditEvent{Event: "connect", Session: session, Dest: dest.Addr(), SNI: dest.SNI, Strategy: s.Name(),
+				LatencyMs: time.Since(start).Milliseconds()})
+			return conn, s.Name(), fallbacks, nil
+		}
+
+		cause := fallbackCause(err)
+		next := ""
+		if i < len(candidates)-1 {
+			next = candidates[i+1].Name()
+		}
+		logger.With("cause", cause).Printf("⚠️ Strategy %s failed for %s: %v", s.Name(), dest.Addr(), err)
+		transcriptOf(ctx).State("%s failed (%s): %v", s.Name(), cause, err)
+		audit(auditEvent{Event: "fallback", Session: session, Dest: dest.Addr(), SNI: dest.SNI, Strategy: s.Name(),
+			Next: next, Cause: cause, Error: err.Error(), LatencyMs: time.Since(start).Milliseconds()})
+		fallbacks = append(fallbacks, Fallback{Strategy: s.Name(), Cause: cause, Error: err.Error()})
+		errs = append(errs, fmt.Sprintf("%s: %v", s.Name(), err))
+	}
+
+	if len(errs) == 0 {
+		audit(auditEvent{Event: "failed", Session: session, Dest: dest.Addr(), SNI: dest.SNI, Error: "no applicable strategy"})
+		return nil, "", nil, fmt.Errorf("no applicable strategy for %s", dest.Addr())
+	}
+	audit(auditEvent{Event: "failed", Session: session, Dest: dest.Addr(), SNI: dest.SNI, Cause: fallbacks[len(fallbacks)-1].Cause,
+		Error: fallbackSummary(fallbacks)})
+	return nil, "", fallbacks, fmt.Errorf("all strategies failed (%s)", strings.Join(errs, "; "))
+}
+
+// candidates returns the strategies applicable to dest in the order they
+// should be tried, with their failure scores. Destinations that must be
+// concealed only get concealing strategies, those routed directly only the
+// others, and blocked ones none; with the kill switch on, all but those
+// routed directly only get strategies hiding the SNI. Strategies the error
+// budget disabled are left out, unless that would leave none.
+func (o *strategyOrchestrator) candidates(dest Destination) ([]ConnectionStrategy, map[string]float64) {
+	var candidates, disabled []ConnectionStrategy
+	scores := make(map[string]float64)
+	pool := o.strategies
+	switch {
+	case dest.Route == routeBlock:
+		pool = nil
+	case dest.Route == routeDirect:
+		pool = o.direct
+	case o.killSwitch:
+		pool = o.hiding
+	case dest.mustConceal():
+		pool = o.conceal
+	}
+	for _, s := range pool {
+		if !s.Applicable(dest) {
+			continue
+		}
+		scores[s.Name()] = o.diary.Score(dest.Addr(), s.Name())
+		if !o.budget.disabledUntil(s.Name()).IsZero() {
+			disabled = append(disabled, s)
+			continue
+		}
+		candidates = append(candidates, s)
+	}
+	if len(candidates) == 0 {
+		candidates = disabled
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i].Name()] < scores[candidates[j].Name()]
+	})
+	return candidates, scores
+}
+
+// failsClosed reports whether the kill switch refuses dest when no
+// strategy connects it, rather than it merely failing.
+func (o *strategyOrchestrator) failsClosed(dest Destination) bool {
+	return o.killSwitch && dest.Route != routeDirect
+}
+
+// Prepare starts connecting with the strategy that will be tried first, if
+// it supports preparation, so the connection is under way while the
+// ClientHello is still being read. It returns nil when nothing was started.
+func (o *strategyOrchestrator) Prepare(ctx context.Context, dest Destination) *preparedConn {
+	candidates, _ := o.candidates(dest)
+	if len(candidates) == 0 {
+		return nil
+	}
+	first := candidates[0]
+	if o.dryRun != nil {
+		first = o.dryRun.direct
+	}
+	preparable, ok := first.(PreparableStrategy)
+	if !ok {
+		return nil
+	}
+
+	prepared := &preparedConn{strategy: first.Name(), dest: dest, done: make(chan struct{})}
+	go func() {
+		defer close(prepared.done)
+		attemptCtx, cancel := context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+		attemptCtx = withSessionLogger(attemptCtx, sessionLog(ctx).With("strategy", first.Name()))
+		prepared.conn, prepared.err = preparable.Prepare(attemptCtx, dest)
+	}()
+	return prepared
+}
+
+func (o *strategyOrchestrator) record(name string, latency time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	stats, ok := o.stats[name]
+	if !ok {
+		// Dry runs connect directly even if "direct" isn't configured
+		stats = &StrategyStats{}
+		o.stats[name] = stats
+	}
+	stats.Attempts++
+	stats.LastLatency = latency
+	o.budget.record(name, err)
+	if err != nil {
+		if stats.Causes == nil {
+			stats.Causes = make(map[FallbackCause]int)
+		}
+		stats.Failures++
+		stats.Causes[fallbackCause(err)]++
+		stats.LastError = err.Error()
+	} else {
+		stats.Successes++
+	}
+}
+
+// Stats returns a snapshot of the per-strategy measurements.
+func (o *strategyOrchestrator) Stats() map[string]StrategyStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	snapshot := make(map[string]StrategyStats, len(o.stats))
+	for name, stats := range o.stats {
+		copied := *stats
+		copied.Causes = maps.Clone(stats.Causes)
+		if until := o.budget.disabledUntil(name); !until.IsZero() {
+			copied.DisabledUntil = &until
+		}
+		snapshot[name] = copied
+	}
+	return snapshot
+}
+
+func init() {
+	RegisterStrategy("direct", func(p *TLSProxy) ConnectionStrategy { return &directStrategy{proxy: p} })
+	RegisterStrategy("oob", func(p *TLSProxy) ConnectionStrategy { return &oobStrategy{proxy: p} })
+}
+
+// directStrategy dials the target and sends the ClientHello unmodified
+// (apart from first-flight shaping, if configured).
+type directStrategy struct {
+	proxy *TLSProxy
+}
+
+func (s *directStrategy) Name() string { return "direct" }
+
+func (s *directStrategy) Applicable(dest Destination) bool { return true }
+
+func (s *directStrategy) Prepare(ctx context.Context, dest Destination) (net.Conn, error) {
+	return dialDestination(ctx, dest)
+}
+
+func (s *directStrategy) Establish(ctx context.Context, clientConn net.Conn, dest Destination) (net.Conn, error) {
+	conn, err := dest.takePrepared(ctx, s.Name())
+	if conn == nil && err == nil {
+		conn, err = dialDestination(ctx, dest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := sendClientHello(ctx, conn, dest, s.proxy.writeClientHello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// oobStrategy resolves and connects to the target through an OOB server so
+// the hostname is never looked up or dialed by name from the client's network.
+type oobStrategy struct {
+	proxy *TLSProxy
+}
+
+func (s *oobStrategy) Name() string { return "oob" }
+
+func (s *oobStrategy) Applicable(dest Destination) bool {
+	return s.proxy.OOB != nil && dest.SNI != ""
+}
+
+// Prepare opens the OOB session using the CONNECT host as the SNI; it's only
+// used if the ClientHello names the same host.
+func (s *oobStrategy) Prepare(ctx context.Context, dest Destination) (net.Conn, error) {
+	return s.proxy.getTargetConnViaOOB(ctx, dest)
+}
+
+func (s *oobStrategy) Establish(ctx context.Context, clientConn net.Conn, dest Destination) (net.Conn, error) {
+	conn, err := dest.takePrepared(ctx, s.Name())
+	if conn == nil && err == nil {
+		conn, err = s.proxy.getTargetConnViaOOB(ctx, dest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := sendClientHello(ctx, conn, dest, s.proxy.writeClientHello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// sendClientHello writes dest's first flight with write, bounded by ctx's
+// deadline, preceded by a PROXY protocol header if the route asks for one.
+func sendClientHello(ctx context.Context, conn net.Conn, dest Destination, write func(net.Conn, []byte) error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	if dest.ProxyProtocol != 0 {
+		header, err := proxyProtocolHeader(dest.ProxyProtocol, dest.Source, conn.RemoteAddr())
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(header); err != nil {
+			return fmt.Errorf("failed to send PROXY protocol header: %w", err)
+		}
+	}
+	if err := write(conn, dest.ClientHello); err != nil {
+		return fmt.Errorf("failed to send ClientHello: %w", err)
+	}
+	return nil
+}
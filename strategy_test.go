@@ -0,0 +1,160 @@
+//go:build !relay
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// wireRecorder accepts connections and keeps everything sent over them,
+// standing in for the network between the client and a target.
+type wireRecorder struct {
+	net.Listener
+	mu    sync.Mutex
+	bytes bytes.Buffer
+	conns []net.Conn
+}
+
+func newWireRecorder(t *testing.T) *wireRecorder {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &wireRecorder{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			w.mu.Lock()
+			w.conns = append(w.conns, conn)
+			w.mu.Unlock()
+			go func() {
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					w.mu.Lock()
+					w.bytes.Write(buf[:n])
+					w.mu.Unlock()
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		w.hangUp()
+	})
+	return w
+}
+
+// hangUp closes the connections accepted so far.
+func (w *wireRecorder) hangUp() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, conn := range w.conns {
+		conn.Close()
+	}
+}
+
+// saw reports whether s was sent over the wire.
+func (w *wireRecorder) saw(s string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return bytes.Contains(w.bytes.Bytes(), []byte(s))
+}
+
+func TestKillSwitchKeepsSNIOffTheWire(t *testing.T) {
+	const sni = "hidden.example"
+	wire := newWireRecorder(t)
+	_, port, _ := net.SplitHostPort(wire.Addr().String())
+
+	// A relay nobody answers at
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayPort := dead.Addr().(*net.TCPAddr).Port
+	dead.Close()
+
+	for _, killSwitch := range []bool{true, false} {
+		proxy, err := newClientProxy(&Config{
+			OOBChannels: []OOBChannelConfig{{Type: "http", Address: "127.0.0.1", Port: relayPort}},
+			CoverSNI:    "cover.example",
+			Strategies:  []string{"cover", "oob", "fragment", "direct"},
+			Fragment:    FragmentConfig{Enabled: true},
+			KillSwitch:  killSwitch,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A relay resolved the host before, and the CONNECT names an
+		// address reaching the wire directly
+		proxy.addresses.Put(sni, "127.0.0.1")
+
+		client, tunnelEnd := net.Pipe()
+		go tls.Client(client, &tls.Config{ServerName: sni}).Handshake()
+		clientHello, err := readClientHello(tunnelEnd, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			pipeline := proxy.startPipeline(ctx, "127.0.0.1", port)
+			defer pipeline.Close()
+			proxy.tunnel(ctx, tunnelEnd, pipeline, "127.0.0.1", port, sni, clientHello)
+		}()
+
+		if killSwitch {
+			<-done
+			if wire.saw(sni) {
+				t.Errorf("a ClientHello naming %s reached the wire with the kill switch on", sni)
+			}
+		} else {
+			// Without it, the tunnel falls back to strategies sending the SNI
+			// in the clear, which shows the wire is watched
+			deadline := time.Now().Add(5 * time.Second)
+			for !wire.saw(sni) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if !wire.saw(sni) {
+				t.Errorf("no ClientHello naming %s reached port %s with the kill switch off", sni, port)
+			}
+			wire.hangUp()
+		}
+		cancel()
+		client.Close()
+		tunnelEnd.Close()
+		<-done
+	}
+}
+
+func TestKillSwitchRefusesDryRun(t *testing.T) {
+	if err := checkKillSwitch(&Config{KillSwitch: true, DryRun: true}); err == nil {
+		t.Error("kill_switch with dry_run accepted")
+	}
+	for _, config := range []*Config{{KillSwitch: true}, {DryRun: true}} {
+		if err := checkKillSwitch(config); err != nil {
+			t.Errorf("%+v: %v", config, err)
+		}
+	}
+	issues := checkConfig(&Config{KillSwitch: true, DryRun: true, Strategies: []string{"cover", "direct"}})
+	found := false
+	for _, issue := range issues {
+		found = found || (issue.Level == lintError && issue.Path == "kill_switch")
+	}
+	if !found {
+		t.Errorf("config lint issues %v lack an error for kill_switch", issues)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// checkStrict returns why config can't be served in strict mode, which
+// exposes only the authenticated OOB API: without tokens every endpoint
+// would be open, and the status listener has no authentication of its own.
+// The legacy "/" endpoint, which forwards a ClientHello for anyone, and the
+// heartbeat endpoint of clients predating pings aren't served at all.
+func checkStrict(config *Config) error {
+	if len(config.Auth.Tokens) == 0 {
+		return errors.New("auth.tokens must be set")
+	}
+	if config.Status.Listen != "" {
+		host, _, err := net.SplitHostPort(config.Status.Listen)
+		if ip := net.ParseIP(host); err != nil || host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("status.listen %q must be a loopback address", config.Status.Listen)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditSyslogConfig sends audit events to a syslog collector as RFC 5424
+// messages, for deployments whose retention is handled by a central log
+// store.
+type AuditSyslogConfig struct {
+	Address  string `json:"address,omitempty"`  // host:port of the collector; empty disables the exporter
+	Network  string `json:"network,omitempty"`  // "udp" (default), "tcp" or "tls"
+	Facility int    `json:"facility,omitempty"` // Syslog facility number (default: 16, local0)
+	AppName  string `json:"app_name,omitempty"` // APP-NAME of the messages (default: "sultry")
+}
+
+// Syslog severities used for audit events.
+const (
+	syslogWarning = 4
+	syslogInfo    = 6
+)
+
+// syslogSDID is the structured data ID of the fields in each message, under
+// the enterprise number reserved for documentation like the IPFIX fields.
+const syslogSDID = "audit@32473"
+
+// syslogExporter writes one message per audit event. Stream transports
+// frame messages by octet counting (RFC 6587) and reconnect after errors.
+type syslogExporter struct {
+	cfg      AuditSyslogConfig
+	hostname string
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+func init() {
+	registerAuditExporter("syslog", newSyslogExporter)
+}
+
+func newSyslogExporter(cfg AuditConfig) (auditExporter, error) {
+	if cfg.Syslog.Address == "" {
+		return nil, nil
+	}
+	switch cfg.Syslog.Network {
+	case "", "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("unknown syslog network %q", cfg.Syslog.Network)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	e := &syslogExporter{cfg: cfg.Syslog, hostname: hostname}
+	if err := e.connect(); err != nil {
+		return nil, fmt.Errorf("failed to set up syslog export: %w", err)
+	}
+	log.Printf("📒 Audit events sent to syslog at %s", cfg.Syslog.Address)
+	return e, nil
+}
+
+// connect dials the collector. The caller holds e.mu, or is the constructor.
+func (e *syslogExporter) connect() error {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	switch e.cfg.Network {
+	case "tls":
+		conn, err = tls.DialWithDialer(dialer, "tcp", e.cfg.Address, &tls.Config{KeyLogWriter: keyLog})
+	case "tcp":
+		conn, err = dialer.Dial("tcp", e.cfg.Address)
+	default:
+		conn, err = dialer.Dial("udp", e.cfg.Address)
+	}
+	e.conn = conn
+	return err
+}
+
+func (e *syslogExporter) Export(event auditEvent) {
+	message := e.message(event)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == nil {
+		if err := e.connect(); err != nil {
+			log.Printf("⚠️ Failed to reconnect to syslog collector: %v", err)
+			return
+		}
+	}
+	if e.cfg.Network == "tcp" || e.cfg.Network == "tls" {
+		message = append([]byte(strconv.Itoa(len(message))+" "), message...)
+	}
+	e.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := e.conn.Write(message); err != nil {
+		log.Printf("⚠️ Failed to send audit event to syslog: %v", err)
+		e.conn.Close()
+		e.conn = nil
+	}
+}
+
+// message formats event as an RFC 5424 message: the identifying fields as
+// structured data, the whole event as JSON in the body.
+func (e *syslogExporter) message(event auditEvent) []byte {
+	severity := syslogInfo
+	if event.Event == "failed" {
+		severity = syslogWarning
+	}
+	facility := e.cfg.Facility
+	if facility == 0 {
+		facility = 16
+	}
+	appName := e.cfg.AppName
+	if appName == "" {
+		appName = "sultry"
+	}
+
+	var sd strings.Builder
+	sd.WriteString("[" + syslogSDID)
+	for _, param := range [][2]string{{"session", event.Session}, {"dest", event.Dest}, {"strategy", event.Strategy}} {
+		if param[1] != "" {
+			fmt.Fprintf(&sd, ` %s="%s"`, param[0], syslogEscape(param[1]))
+		}
+	}
+	sd.WriteString("]")
+
+	body, _ := json.Marshal(event)
+	return fmt.Appendf(nil, "<%d>1 %s %s %s %d %s %s %s", facility*8+severity,
+		event.Time.UTC().Format("2006-01-02T15:04:05.000000Z"), e.hostname, appName, os.Getpid(), event.Event,
+		sd.String(), body)
+}
+
+// syslogEscape escapes a structured data parameter value (RFC 5424,
+// section 6.3.3).
+func syslogEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	sultrytls "sultry/pkg/tls"
+)
+
+// TargetVerifyConfig has the server check the certificates of the targets it
+// relays handshakes to, rather than relaying whatever answers at sni:443, so
+// clients learn when the server's resolver or route led somewhere else.
+type TargetVerifyConfig struct {
+	Enabled bool `json:"enabled,omitempty"` // Verify certificate chains against the system roots for the SNI
+	Probe   bool `json:"probe,omitempty"`   // Verify TLS 1.3 targets, whose certificates are encrypted, with a handshake of the server's own
+
+	// Pins maps host names to base64 SHA-256 hashes of the SubjectPublicKeyInfo
+	// one of their certificates must have, checked whether or not Enabled is
+	Pins map[string][]string `json:"pins,omitempty"`
+}
+
+// targetVerify is set from the configuration when the server starts.
+var targetVerify TargetVerifyConfig
+
+// oobErrorTargetCertificate is the code of the OOB error sent when a
+// target's certificate doesn't verify.
+const oobErrorTargetCertificate = "target_certificate"
+
+// oobErrorBody is the JSON body of an OOB error that clients act on rather
+// than just log.
+type oobErrorBody struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// writeOOBError answers an OOB request with a structured error.
+func writeOOBError(w http.ResponseWriter, status int, code string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(oobErrorBody{Code: code, Error: err.Error()})
+}
+
+// writeHandshakeResponse answers with a target's response, or with the
+// verification failure that ended the session instead.
+func writeHandshakeResponse(w http.ResponseWriter, session *SessionState, response []byte) {
+	if err := session.targetError(); err != nil {
+		writeOOBError(w, http.StatusBadGateway, oobErrorTargetCertificate, err)
+		return
+	}
+	w.Write(response)
+}
+
+// targetError returns why the session's target failed verification, if it
+// did.
+func (s *SessionState) targetError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.verifyErr
+}
+
+// verifyTarget checks the target's certificate once the handshake shows it,
+// and returns an error if it doesn't verify or match the SNI's pins. TLS 1.2
+// targets are checked from the Certificate message relayed to the client;
+// TLS 1.3 encrypts it, so those are checked by probing, which pinned names
+// always are, and otherwise let through.
+func (s *SessionState) verifyTarget(sessionID string) error {
+	pins := targetVerify.Pins[s.sni]
+	if !targetVerify.Enabled && len(pins) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	if s.verifyDone || s.HandshakeComplete {
+		err := s.verifyErr
+		s.mu.Unlock()
+		return err
+	}
+	version := s.handshake.Version()
+	chain := s.handshake.Certificates()
+	s.mu.Unlock()
+
+	if len(chain) == 0 {
+		if version < sultrytls.VersionTLS13 {
+			return nil // The Certificate message hasn't arrived yet
+		}
+		if targetVerify.Probe || len(pins) > 0 {
+			var err error
+			if chain, err = probeTarget(s.TargetConn.RemoteAddr().String(), s.sni); err != nil {
+				log.Printf("⚠️ Failed to probe %s for session %s: %v", redacted(sensitiveSNI, s.sni), sessionID, err)
+			}
+		}
+	}
+
+	var err error
+	switch {
+	case len(chain) == 0:
+		log.Printf("⚠️ Certificate of %s not verified for session %s: TLS 1.3 encrypts it", redacted(sensitiveSNI, s.sni), sessionID)
+	case len(pins) > 0 && !matchesPin(chain, pins):
+		err = &pinMismatchError{Host: s.sni}
+	case targetVerify.Enabled:
+		err = verifyChain(chain, s.sni)
+	}
+
+	s.mu.Lock()
+	s.verifyDone = true
+	var pinErr *pinMismatchError
+	if !errors.As(err, &pinErr) {
+		s.verifyErr = err // Pin mismatches are answered with an alert instead
+	}
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("🛑 Certificate of %s failed verification for session %s: %v", redacted(sensitiveSNI, s.sni), sessionID, err)
+		return err
+	}
+	if len(chain) > 0 {
+		log.Printf("✅ Certificate of %s verified for session %s", redacted(sensitiveSNI, s.sni), sessionID)
+	}
+	return nil
+}
+
+// pinMismatchError is returned when no certificate of a target's chain has
+// a pinned key: someone between the server and the target presented their
+// own.
+type pinMismatchError struct {
+	Host string
+}
+
+func (e *pinMismatchError) Error() string {
+	return fmt.Sprintf("no certificate presented for %s matches its pinned keys", e.Host)
+}
+
+// matchesPin reports whether a certificate of chain has one of pins, the
+// base64 SHA-256 hashes of SubjectPublicKeyInfos, optionally prefixed
+// "sha256/".
+func matchesPin(chain [][]byte, pins []string) bool {
+	for _, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		hash := base64.StdEncoding.EncodeToString(sum[:])
+		for _, pin := range pins {
+			if strings.TrimPrefix(pin, "sha256/") == hash {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// alertBadCertificate is the record sent to a client instead of a target's
+// flight when the target's key doesn't match a pin: a fatal bad_certificate
+// alert, which browsers report as a certificate error.
+var alertBadCertificate = []byte{sultrytls.RecordAlert, 0x03, 0x03, 0x00, 0x02, 2, 42}
+
+// verifyChain verifies a DER certificate chain, leaf first, against the
+// system roots for name.
+func verifyChain(chain [][]byte, name string) error {
+	var leaf *x509.Certificate
+	intermediates := x509.NewCertPool()
+	for i, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("invalid certificate: %w", err)
+		}
+		if i == 0 {
+			leaf = cert
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Intermediates: intermediates})
+	return err
+}
+
+// probeTTL is how long the outcome of a probe is reused for the same
+// address and name, so a site's connections don't each cost a handshake.
+const probeTTL = 10 * time.Minute
+
+type probeResult struct {
+	chain   [][]byte
+	expires time.Time
+}
+
+var (
+	probeResults   = make(map[string]probeResult)
+	probeResultsMu sync.Mutex
+)
+
+// probeTarget returns the certificate chain addr presents for name, from a
+// handshake of its own.
+func probeTarget(addr, name string) ([][]byte, error) {
+	key := name + "@" + addr
+	probeResultsMu.Lock()
+	result, ok := probeResults[key]
+	probeResultsMu.Unlock()
+	if ok && time.Now().Before(result.expires) {
+		return result.chain, nil
+	}
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	// The chain is verified by the caller, against pins too
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: name, InsecureSkipVerify: true,
+		KeyLogWriter: keyLog})
+	if err != nil {
+		return nil, err
+	}
+	var chain [][]byte
+	for _, cert := range conn.ConnectionState().PeerCertificates {
+		chain = append(chain, cert.Raw)
+	}
+	conn.Close()
+
+	probeResultsMu.Lock()
+	for k, r := range probeResults {
+		if time.Now().After(r.expires) {
+			delete(probeResults, k)
+		}
+	}
+	probeResults[key] = probeResult{chain: chain, expires: time.Now().Add(probeTTL)}
+	probeResultsMu.Unlock()
+	return chain, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Bandwidth throttling
+//
+// A bulk download can fill the link and starve the interactive sessions
+// sharing it. Relays can be held to a rate per connection and to one per
+// client address shared by all of that client's connections; relayData
+// waits for both before forwarding each write. Limits are token buckets:
+// a connection that was quiet may send a burst at full speed, and one that
+// keeps sending is slowed to the rate.
+
+// ThrottleConfig limits how fast relays forward data, counting both
+// directions together.
+type ThrottleConfig struct {
+	PerConnection int `json:"per_connection,omitempty"` // Bytes per second one relay may forward; 0 is unlimited
+	PerClient     int `json:"per_client,omitempty"`     // Bytes per second the relays of one client address share; 0 is unlimited
+	Burst         int `json:"burst,omitempty"`          // Bytes forwarded at full speed after a pause (default: one second's worth)
+}
+
+// byteBucket is a token bucket handing out bytes at rate per second, holding
+// up to burst. Reservations may take it below zero; callers then wait for
+// the debt to be paid off, so large writes are slowed rather than refused.
+type byteBucket struct {
+	rate   float64
+	burst  float64
+	mu     sync.Mutex
+	bucket tokenBucket
+}
+
+func newByteBucket(rate, burst int) *byteBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &byteBucket{rate: float64(rate), burst: float64(burst),
+		bucket: tokenBucket{tokens: float64(burst), last: time.Now()}}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait
+// before sending them.
+func (b *byteBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.bucket.tokens = math.Min(b.burst, b.bucket.tokens+now.Sub(b.bucket.last).Seconds()*b.rate)
+	b.bucket.last = now
+	b.bucket.tokens -= float64(n)
+	if b.bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.bucket.tokens / b.rate * float64(time.Second))
+}
+
+// throttles holds the configured limits and the buckets of the clients
+// with live relays.
+type throttles struct {
+	cfg     ThrottleConfig
+	mu      sync.Mutex
+	clients map[string]*clientThrottle
+}
+
+type clientThrottle struct {
+	bucket *byteBucket
+	relays int
+}
+
+// throttling limits every relay, with the configuration installed by
+// setupThrottling.
+var throttling = &throttles{clients: make(map[string]*clientThrottle)}
+
+// setupThrottling installs the configured limits.
+func setupThrottling(cfg ThrottleConfig) error {
+	if cfg.PerConnection < 0 || cfg.PerClient < 0 || cfg.Burst < 0 {
+		return fmt.Errorf("throttle limits can't be negative")
+	}
+	throttling = &throttles{cfg: cfg, clients: make(map[string]*clientThrottle)}
+	if cfg.PerConnection > 0 {
+		log.Printf("🐢 Relays are limited to %d bytes/s each", cfg.PerConnection)
+	}
+	if cfg.PerClient > 0 {
+		log.Printf("🐢 Relays are limited to %d bytes/s per client address", cfg.PerClient)
+	}
+	return nil
+}
+
+// relayThrottle is what a relay waits for before each write.
+type relayThrottle struct {
+	t      *throttles
+	client string
+	conn   *byteBucket // nil without a per-connection limit
+	shared *byteBucket // nil without a per-client limit
+}
+
+// open returns the throttle of a new relay for the client at addr, which
+// must be closed when the relay ends, or nil if nothing is limited.
+func (t *throttles) open(addr net.Addr) *relayThrottle {
+	if t.cfg.PerConnection == 0 && t.cfg.PerClient == 0 {
+		return nil
+	}
+	r := &relayThrottle{t: t}
+	if t.cfg.PerConnection > 0 {
+		r.conn = newByteBucket(t.cfg.PerConnection, t.cfg.Burst)
+	}
+	if t.cfg.PerClient > 0 {
+		r.client = addr.String()
+		if host, _, err := net.SplitHostPort(r.client); err == nil {
+			r.client = host
+		}
+		t.mu.Lock()
+		c, ok := t.clients[r.client]
+		if !ok {
+			c = &clientThrottle{bucket: newByteBucket(t.cfg.PerClient, t.cfg.Burst)}
+			t.clients[r.client] = c
+		}
+		c.relays++
+		r.shared = c.bucket
+		t.mu.Unlock()
+	}
+	return r
+}
+
+// wait blocks until n more bytes may be sent.
+func (r *relayThrottle) wait(n int) {
+	if r == nil {
+		return
+	}
+	var delay time.Duration
+	if r.conn != nil {
+		delay = r.conn.reserve(n)
+	}
+	if r.shared != nil {
+		delay = max(delay, r.shared.reserve(n))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// close releases the relay's share of its client's bucket, forgetting the
+// client once it has no relays left.
+func (r *relayThrottle) close() {
+	if r == nil || r.shared == nil {
+		return
+	}
+	r.t.mu.Lock()
+	defer r.t.mu.Unlock()
+	if c := r.t.clients[r.client]; c != nil {
+		if c.relays--; c.relays == 0 {
+			delete(r.t.clients, r.client)
+		}
+	}
+}
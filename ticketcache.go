@@ -0,0 +1,194 @@
+//go:build !relay
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TicketCacheConfig controls the client's cache of session tickets the relay
+// captured for each host (see sessiontickets.go for what they can and can't
+// be used for).
+type TicketCacheConfig struct {
+	Path       string `json:"path,omitempty"`        // JSON file the cache persists to; empty keeps it in memory
+	TTL        int    `json:"ttl,omitempty"`         // Minutes a ticket is kept at most, even if the server allows longer (default: 1440)
+	PerHost    int    `json:"per_host,omitempty"`    // Tickets kept per host as servers rotate them, newest first (default: 2)
+	MaxEntries int    `json:"max_entries,omitempty"` // Hosts kept; the least recently updated is dropped first (default: 1000)
+}
+
+// CachedTicket is a session ticket issued by a host.
+type CachedTicket struct {
+	Ticket   []byte    `json:"ticket"`
+	Received time.Time `json:"received"`
+	Expires  time.Time `json:"expires"`
+}
+
+// ticketCache keeps the latest tickets per hostname, dropping them when they
+// expire or when the host has rotated to newer ones.
+type ticketCache struct {
+	path       string
+	ttl        time.Duration
+	perHost    int
+	maxEntries int
+
+	hosts map[string][]CachedTicket // Newest first
+	mu    sync.Mutex
+}
+
+// newTicketCache loads the cache from cfg.Path if it exists.
+func newTicketCache(cfg TicketCacheConfig) *ticketCache {
+	c := &ticketCache{
+		path:       cfg.Path,
+		ttl:        time.Duration(orDefault(cfg.TTL, 1440)) * time.Minute,
+		perHost:    orDefault(cfg.PerHost, 2),
+		maxEntries: orDefault(cfg.MaxEntries, 1000),
+		hosts:      make(map[string][]CachedTicket),
+	}
+	if c.path == "" {
+		return c
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("⚠️ Failed to read ticket cache %s: %v", c.path, err)
+		}
+		return c
+	}
+	if err := json.Unmarshal(data, &c.hosts); err != nil {
+		log.Printf("⚠️ Ignoring corrupt ticket cache %s: %v", c.path, err)
+		c.hosts = make(map[string][]CachedTicket)
+		return c
+	}
+	c.prune(time.Now())
+	log.Printf("🎫 Loaded session tickets for %d hosts from %s", len(c.hosts), c.path)
+	return c
+}
+
+// Store adds ticket for host, valid for lifetime (capped by the TTL). A
+// ticket that's already cached only has its expiry refreshed.
+func (c *ticketCache) Store(host string, ticket []byte, lifetime time.Duration) {
+	if len(ticket) == 0 {
+		return
+	}
+	if lifetime <= 0 || lifetime > c.ttl {
+		lifetime = c.ttl
+	}
+	host = strings.ToLower(host)
+	now := time.Now()
+	entry := CachedTicket{Ticket: ticket, Received: now, Expires: now.Add(lifetime)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tickets := []CachedTicket{entry}
+	for _, t := range c.hosts[host] {
+		if !bytes.Equal(t.Ticket, ticket) {
+			tickets = append(tickets, t)
+		}
+	}
+	if len(tickets) > c.perHost {
+		tickets = tickets[:c.perHost]
+	}
+	c.hosts[host] = tickets
+	c.prune(now)
+	c.save()
+}
+
+// Lookup returns the newest unexpired ticket for host.
+func (c *ticketCache) Lookup(host string) (CachedTicket, bool) {
+	host = strings.ToLower(host)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range c.hosts[host] {
+		if now.Before(t.Expires) {
+			return t, true
+		}
+	}
+	return CachedTicket{}, false
+}
+
+// ticketCacheStatus summarizes the tickets of one host without the tickets
+// themselves.
+type ticketCacheStatus struct {
+	Host    string    `json:"host"`
+	Tickets int       `json:"tickets"`
+	Expires time.Time `json:"expires"` // Of the newest ticket
+}
+
+// Status lists the hosts with cached tickets.
+func (c *ticketCache) Status() []ticketCacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make([]ticketCacheStatus, 0, len(c.hosts))
+	for host, tickets := range c.hosts {
+		result = append(result, ticketCacheStatus{Host: host, Tickets: len(tickets), Expires: tickets[0].Expires})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Host < result[j].Host })
+	return result
+}
+
+// prune drops expired tickets and, beyond maxEntries, the hosts whose newest
+// ticket is oldest. Callers must hold c.mu.
+func (c *ticketCache) prune(now time.Time) {
+	for host, tickets := range c.hosts {
+		kept := tickets[:0]
+		for _, t := range tickets {
+			if now.Before(t.Expires) {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == 0 {
+			delete(c.hosts, host)
+		} else {
+			c.hosts[host] = kept
+		}
+	}
+	for len(c.hosts) > c.maxEntries {
+		oldest := ""
+		for host, tickets := range c.hosts {
+			if oldest == "" || tickets[0].Received.Before(c.hosts[oldest][0].Received) {
+				oldest = host
+			}
+		}
+		delete(c.hosts, oldest)
+	}
+}
+
+// save writes the cache atomically; tickets are credentials of sorts, so
+// the file is only readable by its owner. Callers must hold c.mu.
+func (c *ticketCache) save() {
+	if c.path == "" {
+		return
+	}
+	data, err := json.Marshal(c.hosts)
+	if err != nil {
+		log.Printf("⚠️ Failed to encode ticket cache: %v", err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".tickets-*")
+	if err != nil {
+		log.Printf("⚠️ Failed to save ticket cache: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("⚠️ Failed to save ticket cache: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sultrytls "sultry/pkg/tls"
+)
+
+// Handshake and data phase timeouts
+//
+// A relayed connection goes through two phases that need different
+// timeouts. During the handshake, peers answer within a few round trips, so
+// a stall means something is broken and is better given up on early: the
+// whole handshake gets handshake_timeout (on the relay, handshake_limits'
+// max_duration), measured from its start rather than per read. Afterwards a
+// quiet connection is normal, whether it's a tunnel a browser keeps for
+// later requests or a download waiting on a slow reader, so the data phase
+// is only bounded by idle_timeout: how long neither direction may carry
+// anything, and how long a single write may stall.
+
+// dataWriteTimeout bounds a write in the data phase when no idle timeout is
+// configured: a peer that hasn't taken any data for this long is gone.
+const dataWriteTimeout = 2 * time.Minute
+
+// relayWake is how often a data-phase read without an idle timeout wakes
+// up, so a relay notices its connections closing.
+const relayWake = 60 * time.Second
+
+var (
+	errHandshakeTimeout = errors.New("handshake not complete within the handshake timeout")
+	errIdleTimeout      = errors.New("no traffic within the idle timeout")
+)
+
+// phaseTimeouts are the configured budgets of both phases.
+type phaseTimeouts struct {
+	handshake time.Duration
+	idle      time.Duration // 0 never closes idle relays
+}
+
+// timeouts is set from the configuration at startup.
+var timeouts = phaseTimeouts{handshake: 5 * time.Second}
+
+// orDefault returns value, or def if value is unset.
+func orDefault(value, def int) int {
+	if value == 0 {
+		return def
+	}
+	return value
+}
+
+// millis converts a millisecond setting to a duration, using def if unset.
+func millis(value, def int) time.Duration {
+	return time.Duration(orDefault(value, def)) * time.Millisecond
+}
+
+// setupTimeouts installs the configured timeouts, in milliseconds.
+func setupTimeouts(handshake, idle int) {
+	timeouts = phaseTimeouts{handshake: millis(handshake, 5000), idle: time.Duration(idle) * time.Millisecond}
+}
+
+// dataWriteDeadline returns the deadline of a write in the data phase.
+func (t phaseTimeouts) dataWriteDeadline() time.Time {
+	if t.idle > 0 {
+		return time.Now().Add(t.idle)
+	}
+	return time.Now().Add(dataWriteTimeout)
+}
+
+// relayTimeouts follows a relayed connection through its phases, telling
+// both directions of the relay what deadlines to set. The handshake is
+// followed from the records relayed, starting with the ClientHello already
+// sent; relays that start after the handshake or aren't TLS are in the data
+// phase from the start.
+type relayTimeouts struct {
+	phaseTimeouts
+	handshakeDeadline time.Time
+	lastActivity      atomic.Int64 // Unix nanoseconds of the last data in either direction
+
+	mu      sync.Mutex
+	tracker sultrytls.Handshake
+	done    bool // The handshake phase is over
+}
+
+// newRelayTimeouts returns the timeouts of a relay whose client sent
+// clientHello, or of one that starts in the data phase if it's nil.
+func newRelayTimeouts(clientHello []byte) *relayTimeouts {
+	t := &relayTimeouts{phaseTimeouts: timeouts, done: clientHello == nil}
+	t.lastActivity.Store(time.Now().UnixNano())
+	if !t.done {
+		t.handshakeDeadline = time.Now().Add(t.handshake)
+		t.tracker.FromClient(clientHello)
+	}
+	return t
+}
+
+// observe records data relayed in one direction: whole records for TLS
+// relays, which follow the handshake.
+func (t *relayTimeouts) observe(fromClient bool, records []byte) {
+	t.lastActivity.Store(time.Now().UnixNano())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return
+	}
+	if fromClient {
+		t.tracker.FromClient(records)
+	} else {
+		t.tracker.FromServer(records)
+	}
+	state := t.tracker.State()
+	t.done = state == sultrytls.StateComplete || state == sultrytls.StateFailed
+}
+
+// endHandshake moves a relay that turned out not to carry TLS to the data
+// phase.
+func (t *relayTimeouts) endHandshake() {
+	t.mu.Lock()
+	t.done = true
+	t.mu.Unlock()
+}
+
+// handshaking reports whether the relay is in its handshake phase.
+func (t *relayTimeouts) handshaking() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.done
+}
+
+// readDeadline returns the deadline of the next read from either peer.
+func (t *relayTimeouts) readDeadline() time.Time {
+	if t.handshaking() {
+		return t.handshakeDeadline
+	}
+	if t.idle > 0 {
+		return time.Unix(0, t.lastActivity.Load()).Add(t.idle)
+	}
+	return time.Now().Add(relayWake)
+}
+
+// writeDeadline returns the deadline of the next write to either peer.
+func (t *relayTimeouts) writeDeadline() time.Time {
+	if t.handshaking() {
+		return t.handshakeDeadline
+	}
+	return t.dataWriteDeadline()
+}
+
+// expired returns the error a read that timed out ends the relay with, or
+// nil if it should go on waiting: the other direction may have carried
+// data meanwhile, and without an idle timeout reads only wake up.
+func (t *relayTimeouts) expired() error {
+	t.mu.Lock()
+	done, state := t.done, t.tracker.State()
+	t.mu.Unlock()
+	if !done {
+		if time.Now().Before(t.handshakeDeadline) {
+			return nil
+		}
+		return fmt.Errorf("%w (%v, in state %s)", errHandshakeTimeout, t.handshake, state)
+	}
+	if t.idle > 0 && time.Since(time.Unix(0, t.lastActivity.Load())) >= t.idle {
+		return fmt.Errorf("%w (%v)", errIdleTimeout, t.idle)
+	}
+	return nil
+}
+
+// targetWriteDeadline returns the deadline of a write to a relayed
+// session's target: the handshake's while it lasts, the data phase's after.
+func (s *SessionState) targetWriteDeadline() time.Time {
+	s.mu.Lock()
+	complete := s.HandshakeComplete
+	s.mu.Unlock()
+	if complete {
+		return timeouts.dataWriteDeadline()
+	}
+	return s.handshakeDeadline()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	sultrytls "sultry/pkg/tls"
+)
+
+// tlsAlertError is a TLS alert a target sent in answer to the ClientHello.
+type tlsAlertError struct {
+	sultrytls.Alert
+}
+
+func (e *tlsAlertError) Error() string {
+	return "target answered with TLS " + e.Alert.String()
+}
+
+// Retryable reports whether another strategy may get a different answer.
+// These alerts are what servers, and middleboxes forging replies, send when
+// they object to the SNI or the shape of the ClientHello, which other
+// strategies present differently.
+func (e *tlsAlertError) Retryable() bool {
+	switch e.Description {
+	case sultrytls.AlertHandshakeFailure, sultrytls.AlertIllegalParameter, sultrytls.AlertDecodeError,
+		sultrytls.AlertProtocolVersion, sultrytls.AlertUnrecognizedName:
+		return true
+	}
+	return false
+}
+
+// Hint explains what the alert usually means for the user.
+func (e *tlsAlertError) Hint() string {
+	switch e.Description {
+	case sultrytls.AlertUnrecognizedName:
+		return "the server doesn't host this name, or something on the path rejected the SNI"
+	case sultrytls.AlertHandshakeFailure:
+		return "the server accepts none of the offered cipher suites or parameters, or the handshake was interfered with"
+	case sultrytls.AlertProtocolVersion:
+		return "the server doesn't support the offered TLS versions"
+	case sultrytls.AlertBadCertificate, sultrytls.AlertUnsupportedCertificate, sultrytls.AlertCertificateRevoked,
+		sultrytls.AlertCertificateExpired, sultrytls.AlertCertificateUnknown, sultrytls.AlertUnknownCA:
+		return "certificate problem; the server wants a (different) client certificate"
+	case sultrytls.AlertCertificateRequired:
+		return "the server requires a client certificate"
+	case sultrytls.AlertNoApplicationProtocol:
+		return "the server supports none of the offered ALPN protocols"
+	case sultrytls.AlertInappropriateFallback:
+		return "the client retried with a lower TLS version and the server refused the downgrade"
+	}
+	return "the server refused the handshake"
+}
+
+// parseTLSAlert decodes an alert record, returning nil if record isn't one.
+func parseTLSAlert(record []byte) *tlsAlertError {
+	alert, ok := sultrytls.ParseAlert(record)
+	if !ok {
+		return nil
+	}
+	return &tlsAlertError{alert}
+}
+
+// relayAlertError explains a relay in direction label that ended with a
+// fatal alert, with a hint when the target sent it.
+func relayAlertError(label string, alert sultrytls.Alert) error {
+	if strings.HasPrefix(label, "Target") {
+		return fmt.Errorf("%s: connection ended by TLS %s: %s", label, alert, (&tlsAlertError{alert}).Hint())
+	}
+	return fmt.Errorf("%s: connection ended by TLS %s", label, alert)
+}
+
+// relayedAlerts counts the alerts relays saw in the clear, for the /alerts
+// status endpoint.
+var relayedAlerts = &alertCounter{counts: make(map[alertCount]int)}
+
+// alertCount is how often alerts of a kind went in a relay direction.
+type alertCount struct {
+	Direction string `json:"direction"`
+	Alert     string `json:"alert"`
+	Count     int    `json:"count"`
+}
+
+type alertCounter struct {
+	once   sync.Once // Registers the status endpoint, which both components share in dual mode
+	mu     sync.Mutex
+	counts map[alertCount]int // Keyed without the count
+}
+
+func (c *alertCounter) handleStatus() {
+	c.once.Do(func() { handleStatus("/alerts", func() any { return c.Snapshot() }) })
+}
+
+func (c *alertCounter) record(direction string, alert sultrytls.Alert) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[alertCount{Direction: direction, Alert: alert.String()}]++
+}
+
+// Snapshot returns the counts, most frequent first.
+func (c *alertCounter) Snapshot() []alertCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshot := make([]alertCount, 0, len(c.counts))
+	for key, count := range c.counts {
+		key.Count = count
+		snapshot = append(snapshot, key)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Count > snapshot[j].Count })
+	return snapshot
+}
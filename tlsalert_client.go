@@ -0,0 +1,67 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// awaitServerResponse reads the start of the target's answer to a TLS
+// ClientHello, within ctx's deadline. An alert is returned as a
+// *tlsAlertError and a connection closed before any answer as an error, so
+// the caller can try another strategy. The bytes read, including an alert,
+// are replayed by the returned connection. A target that doesn't answer in
+// time is passed through as it is.
+func awaitServerResponse(ctx context.Context, conn net.Conn, dest Destination) (net.Conn, error) {
+	if len(dest.ClientHello) == 0 || dest.ClientHello[0] != 0x16 {
+		return conn, nil
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	// An alert record is exactly 7 bytes; anything longer stays in the socket
+	head := make([]byte, 7)
+	n, err := io.ReadFull(conn, head)
+	head = head[:n]
+	if alert := parseTLSAlert(head); alert != nil {
+		return &peekedConn{Conn: conn, peeked: head}, alert
+	}
+	var netErr net.Error
+	switch {
+	case n == 0 && errors.As(err, &netErr) && netErr.Timeout():
+		return conn, nil
+	case n == 0 && err != nil:
+		return conn, fmt.Errorf("target closed the connection without answering the ClientHello: %w", err)
+	}
+	return &peekedConn{Conn: conn, peeked: head}, nil
+}
+
+// peekedConn replays bytes that were read from the connection to inspect
+// them before the relay started.
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(p, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection, so the relay can still
+// signal the end of the client's data.
+func (c *peekedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
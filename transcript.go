@@ -0,0 +1,406 @@
+//go:build !relay
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Session transcripts
+//
+// OOB failures reported from the field are hard to reproduce: they depend
+// on the relay, the target and the network at the time. With transcripts
+// on, the client records what each tunnel did over OOB (the requests and
+// responses with their bodies and timings, and the strategy attempts
+// around them) and writes the transcripts of tunnels that failed to files.
+// "transcript replay" sends a transcript's requests to a server proxy
+// again, in order and with the recorded gaps, and compares the answers
+// with the recorded ones, so a report becomes a reproduction that runs
+// against a local server. Transcripts hold hostnames and ClientHellos, so
+// only their owner may read them.
+
+// TranscriptConfig records the OOB exchanges of tunnels.
+type TranscriptConfig struct {
+	Dir     string `json:"dir,omitempty"`      // Directory transcripts are written to; empty disables recording
+	All     bool   `json:"all,omitempty"`      // Write the transcript of every tunnel, not only of failed ones
+	MaxBody int    `json:"max_body,omitempty"` // Bytes of each request and response body kept (default: 65536)
+}
+
+// defaultTranscriptBody is how much of each body is kept by default.
+const defaultTranscriptBody = 64 << 10
+
+// Transcript outcomes.
+const (
+	transcriptConnected = "connected"
+	transcriptFailed    = "failed"
+	transcriptAbandoned = "abandoned" // The tunnel ended before a strategy was tried
+)
+
+// transcript is what one tunnel did over OOB, as written to its file.
+type transcript struct {
+	Session    string            `json:"session"`
+	Dest       string            `json:"dest"`
+	Version    string            `json:"version"`
+	Started    time.Time         `json:"started"`
+	DurationMs float64           `json:"duration_ms"`
+	Outcome    string            `json:"outcome"`
+	Error      string            `json:"error,omitempty"`
+	Events     []transcriptEvent `json:"events"`
+}
+
+// transcriptEvent is a state transition or an OOB exchange.
+type transcriptEvent struct {
+	AtMs     float64             `json:"at_ms"` // Since the tunnel started
+	State    string              `json:"state,omitempty"`
+	Exchange *transcriptExchange `json:"exchange,omitempty"`
+}
+
+// transcriptExchange is one OOB request and its response.
+type transcriptExchange struct {
+	Peer         string  `json:"peer"`
+	Method       string  `json:"method"`
+	Path         string  `json:"path"` // With the query
+	ContentType  string  `json:"content_type,omitempty"`
+	Request      []byte  `json:"request,omitempty"`
+	Status       int     `json:"status,omitempty"`
+	ResponseType string  `json:"response_type,omitempty"`
+	Response     []byte  `json:"response,omitempty"` // As much as the client read, up to max_body
+	DurationMs   float64 `json:"duration_ms"`        // Until the response headers arrived
+	Error        string  `json:"error,omitempty"`
+	Truncated    bool    `json:"truncated,omitempty"` // A body was longer than max_body
+}
+
+// transcriptRecorder starts the transcripts of tunnels and writes them.
+type transcriptRecorder struct {
+	dir     string
+	all     bool
+	maxBody int
+}
+
+// transcripts records tunnels, or is nil when transcripts are off.
+var transcripts *transcriptRecorder
+
+// setupTranscripts installs the configured recorder.
+func setupTranscripts(cfg TranscriptConfig) error {
+	transcripts = nil
+	if cfg.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create transcript directory: %w", err)
+	}
+	transcripts = &transcriptRecorder{dir: cfg.Dir, all: cfg.All, maxBody: orDefault(cfg.MaxBody, defaultTranscriptBody)}
+	which := "failed tunnels"
+	if cfg.All {
+		which = "every tunnel"
+	}
+	log.Printf("📼 Writing OOB transcripts of %s to %s", which, cfg.Dir)
+	return nil
+}
+
+// sessionTranscript is the transcript of a tunnel being recorded.
+type sessionTranscript struct {
+	rec   *transcriptRecorder
+	start time.Time
+
+	mu   sync.Mutex
+	t    transcript
+	done bool
+}
+
+// start begins the transcript of a tunnel to dest, or returns nil if
+// transcripts are off.
+func (r *transcriptRecorder) start(session, dest string) *sessionTranscript {
+	if r == nil {
+		return nil
+	}
+	now := time.Now()
+	return &sessionTranscript{rec: r, start: now,
+		t: transcript{Session: session, Dest: dest, Version: buildVersion(), Started: now, Outcome: transcriptAbandoned}}
+}
+
+// State records a state transition.
+func (s *sessionTranscript) State(format string, args ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.t.Events = append(s.t.Events, transcriptEvent{AtMs: s.since(), State: fmt.Sprintf(format, args...)})
+}
+
+// record adds an exchange, which may still be filled in under s.mu.
+func (s *sessionTranscript) record(ex *transcriptExchange) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.t.Events = append(s.t.Events, transcriptEvent{AtMs: s.since(), Exchange: ex})
+}
+
+// Outcome records how the tunnel's strategies did.
+func (s *sessionTranscript) Outcome(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.t.Outcome = transcriptConnected
+	if err != nil {
+		s.t.Outcome, s.t.Error = transcriptFailed, err.Error()
+	}
+}
+
+func (s *sessionTranscript) since() float64 {
+	return millisSince(s.start)
+}
+
+// finish ends the transcript, writing it if the tunnel failed or every
+// transcript is kept.
+func (s *sessionTranscript) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.done || (s.t.Outcome != transcriptFailed && !s.rec.all) {
+		s.done = true
+		s.mu.Unlock()
+		return
+	}
+	s.done = true
+	s.t.DurationMs = s.since()
+	data, err := json.MarshalIndent(&s.t, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("⚠️ Failed to encode the transcript of session %s: %v", s.t.Session, err)
+		return
+	}
+
+	path := filepath.Join(s.rec.dir, fmt.Sprintf("%s-%s.json", s.start.Format("20060102-150405"), s.t.Session))
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		log.Printf("⚠️ Failed to write the transcript of session %s: %v", s.t.Session, err)
+		return
+	}
+	log.Printf("📼 Wrote the transcript of session %s to %s", s.t.Session, path)
+}
+
+type transcriptKey struct{}
+
+// withTranscript returns ctx carrying s, so OOB requests made with it are
+// recorded.
+func withTranscript(ctx context.Context, s *sessionTranscript) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, transcriptKey{}, s)
+}
+
+// transcriptOf returns the transcript carried by ctx, or nil.
+func transcriptOf(ctx context.Context) *sessionTranscript {
+	s, _ := ctx.Value(transcriptKey{}).(*sessionTranscript)
+	return s
+}
+
+// transport returns base recording the requests made with a transcript in
+// their context, or base itself when transcripts are off.
+func (r *transcriptRecorder) transport(base http.RoundTripper) http.RoundTripper {
+	if r == nil {
+		return base
+	}
+	return &transcriptTransport{base: base}
+}
+
+// transcriptTransport records OOB requests in the transcript of their
+// context.
+type transcriptTransport struct {
+	base http.RoundTripper
+}
+
+func (t *transcriptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := transcriptOf(req.Context())
+	if s == nil {
+		return t.base.RoundTrip(req)
+	}
+	ex := &transcriptExchange{Peer: req.URL.Host, Method: req.Method, Path: req.URL.RequestURI(),
+		ContentType: req.Header.Get("Content-Type")}
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			ex.Request, _ = io.ReadAll(io.LimitReader(body, int64(s.rec.maxBody)+1))
+			body.Close()
+			if len(ex.Request) > s.rec.maxBody {
+				ex.Request, ex.Truncated = ex.Request[:s.rec.maxBody], true
+			}
+		}
+	}
+	s.record(ex)
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ex.DurationMs = millisSince(start)
+	if err != nil {
+		ex.Error = err.Error()
+		return nil, err
+	}
+	ex.Status, ex.ResponseType = resp.StatusCode, resp.Header.Get("Content-Type")
+	resp.Body = &transcriptBody{ReadCloser: resp.Body, s: s, ex: ex}
+	return resp, nil
+}
+
+// transcriptBody records a response body as the client reads it.
+type transcriptBody struct {
+	io.ReadCloser
+	s  *sessionTranscript
+	ex *transcriptExchange
+}
+
+func (b *transcriptBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.s.mu.Lock()
+		keep := min(n, b.s.rec.maxBody-len(b.ex.Response))
+		b.ex.Response = append(b.ex.Response, p[:keep]...)
+		b.ex.Truncated = b.ex.Truncated || keep < n
+		b.s.mu.Unlock()
+	}
+	return n, err
+}
+
+// millisSince returns the milliseconds since start, to the microsecond.
+func millisSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+// replayTranscript sends the OOB requests of a transcript to a server proxy
+// again and compares its answers with the recorded ones.
+func replayTranscript(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("transcript replay", flag.ContinueOnError)
+	path := flags.String("config", "config.json", "configuration file, for the default server and token")
+	server := flags.String("server", "", "base URL of the server proxy (default: http://127.0.0.1 on the config's relay_port)")
+	token := flags.String("token", "", "bearer token for the server (default: the config's auth.token)")
+	realtime := flags.Bool("realtime", true, "wait the recorded time between requests")
+	timeout := flags.Duration("timeout", 10*time.Second, "time allowed for each request, including reading its response")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: sultry transcript replay [flags] transcript.json")
+	}
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var t transcript
+	if err := json.Unmarshal(data, &t); err != nil {
+		return fmt.Errorf("failed to parse transcript: %w", err)
+	}
+
+	if *server == "" || *token == "" {
+		config, err := LoadConfig(*path)
+		if err != nil && *server == "" {
+			return fmt.Errorf("no -server given and failed to load config: %w", err)
+		}
+		if config != nil {
+			if *server == "" {
+				*server = "http://127.0.0.1:" + strconv.Itoa(config.RelayPort)
+			}
+			if *token == "" {
+				*token = config.Auth.Token
+			}
+			setupUserAgent(config.OOBUserAgent)
+		}
+	}
+	*server = strings.TrimSuffix(*server, "/")
+
+	fmt.Fprintf(out, "Replaying session %s to %s (%s, recorded by %s) against %s\n\n", t.Session, t.Dest, t.Outcome,
+		t.Version, *server)
+	client := &http.Client{Transport: userAgentTransport{base: http.DefaultTransport}, Timeout: *timeout}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "AT\tEVENT\tRECORDED\tREPLAYED\tRESULT")
+	start := time.Now()
+	exchanges, differing := 0, 0
+	for _, event := range t.Events {
+		at := strconv.FormatFloat(event.AtMs, 'f', 0, 64) + "ms"
+		if event.Exchange == nil {
+			// In the last column, so long states don't widen the others
+			fmt.Fprintf(tw, "%s\t▸\t\t\t%s\n", at, strings.Join(strings.Fields(event.State), " "))
+			continue
+		}
+		if *realtime {
+			time.Sleep(time.Until(start.Add(time.Duration(event.AtMs * float64(time.Millisecond)))))
+		}
+		ex := event.Exchange
+		exchanges++
+		replayed := replayExchange(client, *server, *token, ex)
+		verdict := "✅ same"
+		if replayed.Status != ex.Status || (replayed.Error == "") != (ex.Error == "") {
+			verdict = "❌ differs"
+			differing++
+		}
+		fmt.Fprintf(tw, "%s\t%s %s\t%s\t%s\t%s\n", at, ex.Method, ex.Path, exchangeSummary(ex),
+			exchangeSummary(replayed), verdict)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(out, "\n%d of %d requests were answered as recorded\n", exchanges-differing, exchanges)
+	if t.Error != "" {
+		fmt.Fprintf(out, "The tunnel failed with: %s\n", t.Error)
+	}
+	if differing > 0 {
+		return fmt.Errorf("%d requests were answered differently", differing)
+	}
+	return nil
+}
+
+// replayExchange sends the request of ex to server.
+func replayExchange(client *http.Client, server, token string, ex *transcriptExchange) *transcriptExchange {
+	replayed := &transcriptExchange{Method: ex.Method, Path: ex.Path}
+	req, err := http.NewRequest(ex.Method, server+ex.Path, bytes.NewReader(ex.Request))
+	if err != nil {
+		replayed.Error = err.Error()
+		return replayed
+	}
+	if ex.ContentType != "" {
+		req.Header.Set("Content-Type", ex.ContentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", authorizationHeader(token))
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	replayed.DurationMs = millisSince(start)
+	if err != nil {
+		replayed.Error = err.Error()
+		return replayed
+	}
+	defer resp.Body.Close()
+	replayed.Status = resp.StatusCode
+	// Streams, like attached cover relays, are read until the recorded length
+	replayed.Response, _ = io.ReadAll(io.LimitReader(resp.Body, int64(len(ex.Response))))
+	return replayed
+}
+
+// exchangeSummary describes the outcome of an exchange.
+func exchangeSummary(ex *transcriptExchange) string {
+	if ex.Error != "" {
+		return "error (" + strconv.FormatFloat(ex.DurationMs, 'f', 0, 64) + "ms)"
+	}
+	return fmt.Sprintf("%d (%sms)", ex.Status, strconv.FormatFloat(ex.DurationMs, 'f', 0, 64))
+}
@@ -0,0 +1,123 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sultry/pkg/oob/oobtest"
+)
+
+// recordTunnel records a tunnel resolving hosts over relay, one request per
+// host, and returns its transcript file, or "" if none was written.
+func recordTunnel(t *testing.T, relay *oobtest.Server, hosts ...string) string {
+	t.Helper()
+	s := transcripts.start("1700000000", "example.com:443")
+	ctx := withTranscript(context.Background(), s)
+	client := &http.Client{Transport: transcripts.transport(authTransportFor("secret"))}
+	s.State("trying strategy %s", "oob")
+	var failure error
+	for _, host := range hosts {
+		req, _ := http.NewRequestWithContext(ctx, "POST", relay.URL+"/create_connection",
+			strings.NewReader(`{"session_id":"1700000000","sni":"`+host+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			failure = errors.New(resp.Status)
+		}
+	}
+	s.Outcome(failure)
+	s.finish()
+
+	files, _ := filepath.Glob(filepath.Join(transcripts.dir, "*.json"))
+	for _, file := range files {
+		defer os.Remove(file)
+	}
+	if len(files) == 0 {
+		return ""
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := filepath.Join(t.TempDir(), "transcript.json")
+	os.WriteFile(kept, data, 0o600)
+	return kept
+}
+
+// authTransportFor sends token with every request.
+func authTransportFor(token string) http.RoundTripper {
+	return &authTransport{base: http.DefaultTransport, token: token}
+}
+
+func TestTranscriptRecordAndReplay(t *testing.T) {
+	relay := oobtest.NewServer()
+	defer relay.Close()
+	relay.RequireToken("secret")
+	relay.Resolve("example.com", "127.0.0.1", "")
+
+	defer func() { transcripts = nil }()
+	if err := setupTranscripts(TranscriptConfig{Dir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	if path := recordTunnel(t, relay, "example.com"); path != "" {
+		t.Fatal("transcript of a tunnel that connected written without all")
+	}
+	path := recordTunnel(t, relay, "example.com", "unresolved.example")
+	if path == "" {
+		t.Fatal("transcript of a failed tunnel not written")
+	}
+
+	data, _ := os.ReadFile(path)
+	var recorded transcript
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		t.Fatal(err)
+	}
+	if recorded.Outcome != transcriptFailed || len(recorded.Events) != 3 || recorded.Events[0].State != "trying strategy oob" {
+		t.Fatalf("recorded %s with events %+v", recorded.Outcome, recorded.Events)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusInternalServerError} {
+		ex := recorded.Events[i+1].Exchange
+		if ex == nil || ex.Status != want || ex.Path != "/create_connection" || len(ex.Request) == 0 || len(ex.Response) == 0 {
+			t.Errorf("exchange %d: %+v", i, ex)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		script []oobtest.Response
+		token  string
+		err    bool
+		report string
+	}{
+		{"as recorded", nil, "secret", false, "2 of 2 requests were answered as recorded"},
+		{"relay changed", []oobtest.Response{{Status: http.StatusServiceUnavailable}}, "secret", true, "1 of 2 requests"},
+		{"relay dropping", []oobtest.Response{{Drop: true}}, "secret", true, "error ("},
+		{"wrong token", nil, "guess", true, "0 of 2 requests"},
+	}
+	for _, tt := range tests {
+		relay.Script("/create_connection", tt.script...)
+		var out strings.Builder
+		err := replayTranscript([]string{"-server", relay.URL + "/", "-token", tt.token, "-realtime=false", path}, &out)
+		if (err != nil) != tt.err || !strings.Contains(out.String(), tt.report) {
+			t.Errorf("%s: replay = %v, want error %v and %q in\n%s", tt.name, err, tt.err, tt.report, out.String())
+		}
+	}
+	replays := relay.RequestsTo("/create_connection")[3:]
+	if len(replays) != 2*len(tests) || replays[0].Header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("relay got %d replayed requests, first with %q", len(replays), replays[0].Header.Get("Authorization"))
+	}
+}
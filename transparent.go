@@ -0,0 +1,74 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+
+	"sultry/pkg/txparent"
+)
+
+// TransparentConfig accepts connections the firewall diverts to the client,
+// so applications don't need to be configured to use the proxy. Diverting
+// is set up separately: iptables or nftables REDIRECT rules on Linux, pf
+// rdr rules on macOS.
+type TransparentConfig struct {
+	Listen string `json:"listen,omitempty"` // Address diverted connections arrive at; empty disables transparent mode
+}
+
+// StartTransparent accepts diverted TLS connections on cfg.Listen and
+// tunnels them to where they were headed.
+func (p *TLSProxy) StartTransparent(cfg TransparentConfig) {
+	listener, err := txparent.Listen(cfg.Listen)
+	if err != nil {
+		log.Fatalf("❌ Failed to start transparent listener: %v", err)
+	}
+	defer listener.Close()
+	log.Printf("🔹 Transparent listener on %s", cfg.Listen)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("❌ Connection error:", err)
+			continue
+		}
+		go p.handleTransparentConnection(listener, conn)
+	}
+}
+
+// handleTransparentConnection tunnels a diverted connection. There is no
+// CONNECT request naming the host, so it's taken from the SNI, and the
+// original destination's address is used when there is none.
+func (p *TLSProxy) handleTransparentConnection(listener txparent.Listener, clientConn net.Conn) {
+	defer clientConn.Close()
+	ctx := withSessionLogger(context.Background(),
+		newSessionLogger().Redacting(sensitiveClientIP, clientConn.RemoteAddr().String()))
+	logger := sessionLog(ctx)
+
+	original, err := listener.OriginalDestination(clientConn)
+	if err != nil {
+		logger.Printf("❌ TRANSPARENT: No original destination for %s: %v", clientConn.RemoteAddr(), err)
+		return
+	}
+	port := strconv.Itoa(int(original.Port()))
+
+	clientHello, err := readClientHello(clientConn, timeouts.handshake)
+	if err != nil {
+		logger.Printf("❌ Failed to read ClientHello: %v", err)
+		return
+	}
+	host, err := extractSNI(singleRecordHello(clientHello))
+	if err != nil {
+		logger.Printf("⚠️ Failed to extract SNI from ClientHello, using the original destination: %v", err)
+		host = original.Addr().String()
+	}
+
+	ctx = withSessionLogger(ctx, logger.Redacting(sensitiveSNI, host).With("dest", destHash(host)))
+	sessionLog(ctx).Printf("🔹 TRANSPARENT: Target host is %s", host)
+	pipeline := p.startPipeline(ctx, host, port)
+	defer pipeline.Close()
+	p.tunnel(ctx, clientConn, pipeline, host, port, host, clientHello)
+}
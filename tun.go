@@ -0,0 +1,128 @@
+//go:build !relay
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Tun mode
+//
+// Instead of waiting for applications to be pointed at a proxy, or for the
+// firewall to divert their connections, the client can own a tun device:
+// routes send traffic into it, and a userspace TCP/IP stack (gVisor's
+// netstack, see tun_linux.go) terminates each flow the way the kernel
+// would, to whatever address it was headed. TCP flows to ports connect_ports
+// allows then go through the strategies like diverted connections; other
+// TCP flows are relayed directly, as if nothing were in between. UDP
+// datagrams are relayed directly too, except those to port 443: QUIC would
+// carry the SNI past the strategies, and browsers fall back to TCP when it
+// goes unanswered. The client's own connections must not be routed into
+// the device, or they loop back.
+
+// TunConfig makes the client terminate the flows of a tun device.
+type TunConfig struct {
+	Device string `json:"device,omitempty"` // Name of the tun device, e.g. "sultry0"; empty disables tun mode
+	MTU    int    `json:"mtu,omitempty"`    // MTU of the device (default: 1500)
+}
+
+// defaultTunMTU is the MTU assumed for a tun device without one configured.
+const defaultTunMTU = 1500
+
+// tunUDPIdleTimeout is how long a UDP flow is kept without a datagram in
+// either direction.
+const tunUDPIdleTimeout = time.Minute
+
+// handleTunConnection serves a TCP flow from the tun device headed for
+// dst. As for diverted connections, the host is taken from the SNI, and
+// dst's address is used when there is none.
+func (p *TLSProxy) handleTunConnection(clientConn net.Conn, dst netip.AddrPort) {
+	defer clientConn.Close()
+	ctx := withSessionLogger(context.Background(),
+		newSessionLogger().Redacting(sensitiveClientIP, clientConn.RemoteAddr().String()))
+	logger := sessionLog(ctx)
+	port := strconv.Itoa(int(dst.Port()))
+
+	if !connectPorts.allows(port) {
+		p.relayTunDirect(ctx, clientConn, dst)
+		return
+	}
+	clientHello, err := readClientHello(clientConn, timeouts.handshake)
+	if err != nil {
+		logger.Printf("❌ Failed to read ClientHello: %v", err)
+		return
+	}
+	host, err := extractSNI(singleRecordHello(clientHello))
+	if err != nil {
+		logger.Printf("⚠️ Failed to extract SNI from ClientHello, using the original destination: %v", err)
+		host = dst.Addr().String()
+	}
+
+	ctx = withSessionLogger(ctx, logger.Redacting(sensitiveSNI, host).With("dest", destHash(host)))
+	sessionLog(ctx).Printf("🔹 TUN: Target host is %s", host)
+	pipeline := p.startPipeline(ctx, host, port)
+	defer pipeline.Close()
+	p.tunnel(ctx, clientConn, pipeline, host, port, host, clientHello)
+}
+
+// relayTunDirect relays a TCP flow the strategies don't handle to dst.
+func (p *TLSProxy) relayTunDirect(ctx context.Context, clientConn net.Conn, dst netip.AddrPort) {
+	logger := sessionLog(ctx)
+	targetConn, err := upstream.DialContext(ctx, &net.Dialer{Timeout: 10 * time.Second}, dst.String())
+	if err != nil {
+		logger.Printf("❌ TUN: Failed to connect to %s: %v", dst, err)
+		return
+	}
+	defer targetConn.Close()
+	relayPair(ctx, clientConn, targetConn,
+		func() error {
+			_, err := io.Copy(targetConn, clientConn)
+			return err
+		},
+		func() error {
+			_, err := io.Copy(clientConn, targetConn)
+			return err
+		})
+}
+
+// relayTunUDP relays the datagrams of a UDP flow from the tun device to dst
+// and back, until neither direction has carried one for tunUDPIdleTimeout.
+func relayTunUDP(clientConn net.Conn, dst netip.AddrPort) {
+	defer clientConn.Close()
+	targetConn, err := net.Dial("udp", dst.String())
+	if err != nil {
+		return
+	}
+	defer targetConn.Close()
+
+	var active atomic.Int64 // When a datagram last went either way
+	active.Store(time.Now().UnixNano())
+	forward := func(from, to net.Conn) error {
+		buffer := make([]byte, 65535)
+		for {
+			from.SetReadDeadline(time.Now().Add(tunUDPIdleTimeout))
+			n, err := from.Read(buffer)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, active.Load())) < tunUDPIdleTimeout {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			active.Store(time.Now().UnixNano())
+			if _, err := to.Write(buffer[:n]); err != nil {
+				return err
+			}
+		}
+	}
+	relayPair(context.Background(), clientConn, targetConn,
+		func() error { return forward(clientConn, targetConn) },
+		func() error { return forward(targetConn, clientConn) })
+}
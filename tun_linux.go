@@ -0,0 +1,105 @@
+//go:build linux && !relay
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// tunNIC is the only interface of the userspace stack.
+const tunNIC tcpip.NICID = 1
+
+// maxPendingTunFlows bounds the TCP handshakes the stack completes at once;
+// further SYNs are dropped until some finish, and retried by their senders.
+const maxPendingTunFlows = 1024
+
+// StartTun terminates the flows of the tun device cfg names until the
+// process ends. The device must exist and be up, with routes into it.
+func (p *TLSProxy) StartTun(cfg TunConfig) {
+	fd, err := tun.Open(cfg.Device)
+	if err != nil {
+		log.Fatalf("❌ Failed to open tun device %s: %v", cfg.Device, err)
+	}
+	mtu := cfg.MTU
+	if mtu <= 0 {
+		mtu = defaultTunMTU
+	}
+	endpoint, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: uint32(mtu)})
+	if err != nil {
+		log.Fatalf("❌ Failed to attach to tun device %s: %v", cfg.Device, err)
+	}
+	if _, err := p.newTunStack(endpoint); err != nil {
+		log.Fatalf("❌ Failed to start tun mode on %s: %v", cfg.Device, err)
+	}
+	log.Printf("🔹 Tun mode on %s (MTU %d)", cfg.Device, mtu)
+}
+
+// newTunStack returns a userspace TCP/IP stack reading packets from
+// endpoint, which accepts every flow whatever its destination and hands it
+// to the proxy.
+func (p *TLSProxy) newTunStack(endpoint stack.LinkEndpoint) (*stack.Stack, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	if err := s.CreateNIC(tunNIC, endpoint); err != nil {
+		return nil, fmt.Errorf("failed to create interface: %s", err)
+	}
+	// Packets to any address are accepted, and answered from it
+	s.SetPromiscuousMode(tunNIC, true)
+	s.SetSpoofing(tunNIC, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: tunNIC},
+		{Destination: header.IPv6EmptySubnet, NIC: tunNIC},
+	})
+
+	tcpForwarder := tcp.NewForwarder(s, 0, maxPendingTunFlows, func(r *tcp.ForwarderRequest) {
+		// The request is released once completed
+		dst := tunDestination(r.ID())
+		var queue waiter.Queue
+		ep, err := r.CreateEndpoint(&queue)
+		if err != nil {
+			r.Complete(true)
+			return
+		}
+		r.Complete(false)
+		go p.handleTunConnection(gonet.NewTCPConn(&queue, ep), dst)
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+
+	udpForwarder := udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
+		// Unanswered QUIC makes browsers fall back to TCP
+		if r.ID().LocalPort == 443 {
+			return
+		}
+		var queue waiter.Queue
+		ep, err := r.CreateEndpoint(&queue)
+		if err != nil {
+			return
+		}
+		go relayTunUDP(gonet.NewUDPConn(&queue, ep), tunDestination(r.ID()))
+	})
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+	return s, nil
+}
+
+// tunDestination returns where a flow of the stack was headed: its local
+// end, since the stack answers in the destination's place.
+func tunDestination(id stack.TransportEndpointID) netip.AddrPort {
+	addr, _ := netip.AddrFromSlice(id.LocalAddress.AsSlice())
+	return netip.AddrPortFrom(addr.Unmap(), id.LocalPort)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !relay
+
+package main
+
+import "log"
+
+// StartTun fails: tun mode needs Linux.
+func (p *TLSProxy) StartTun(cfg TunConfig) {
+	log.Fatalf("❌ Tun mode is only supported on Linux")
+}
@@ -0,0 +1,205 @@
+//go:build linux && !relay
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/pipe"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// newTunTestHost returns a stack standing in for the host routing its
+// traffic into a tun device, whose other end the proxy's stack reads.
+func newTunTestHost(t *testing.T, proxy *TLSProxy) *stack.Stack {
+	hostEnd, tunEnd := pipe.New("", "", defaultTunMTU)
+	tunStack, err := proxy.newTunStack(tunEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	if err := host.CreateNIC(1, hostEnd); err != nil {
+		t.Fatal(err)
+	}
+	if err := host.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4([4]byte{10, 0, 0, 2}).WithPrefix(),
+	}, stack.AddressProperties{}); err != nil {
+		t.Fatal(err)
+	}
+	host.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+	t.Cleanup(func() {
+		host.Close()
+		tunStack.Close()
+	})
+	return host
+}
+
+// tunTestIP returns an address of this machine the host stack can send to:
+// netstack drops packets to loopback addresses on other interfaces.
+func tunTestIP(t *testing.T) net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4()
+		}
+	}
+	t.Skip("no IPv4 address besides loopback")
+	return nil
+}
+
+// tunAddress returns where the host's flows to addr go.
+func tunAddress(t *testing.T, addr net.Addr) tcpip.FullAddress {
+	dst, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFrom4(dst.Addr().As4()), Port: dst.Port()}
+}
+
+func TestTunTerminatesFlows(t *testing.T) {
+	ip := tunTestIP(t)
+	listen := net.JoinHostPort(ip.String(), "0")
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "through the tun")
+	}))
+	var err error
+	if target.Listener, err = net.Listen("tcp", listen); err != nil {
+		t.Fatal(err)
+	}
+	target.StartTLS()
+	defer target.Close()
+	echo, err := net.Listen("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	udpEcho, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpEcho.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := udpEcho.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpEcho.WriteTo(buf[:n], from)
+		}
+	}()
+
+	// Only the TLS target's port goes through the strategies
+	targetPort := strconv.Itoa(target.Listener.Addr().(*net.TCPAddr).Port)
+	if err := setupConnectPorts(ConnectPortsConfig{Allow: []string{targetPort}, Deny: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+	defer setupConnectPorts(ConnectPortsConfig{})
+	proxy, err := newClientProxy(&Config{Strategies: []string{"direct"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := newTunTestHost(t, proxy)
+
+	t.Run("tls", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := gonet.DialContextTCP(ctx, host, tunAddress(t, target.Listener.Addr()), ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// Without an SNI, the tunnel goes to the original destination
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if !tlsConn.ConnectionState().PeerCertificates[0].Equal(target.Certificate()) {
+			t.Fatal("handshake with another server than the target")
+		}
+		req, _ := http.NewRequest("GET", "https://"+target.Listener.Addr().String()+"/", nil)
+		if err := req.Write(tlsConn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "through the tun" {
+			t.Errorf("body = %q", body)
+		}
+	})
+
+	t.Run("tcp passthrough", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := gonet.DialContextTCP(ctx, host, tunAddress(t, echo.Addr()), ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(conn, "not tls"); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, len("not tls"))
+		if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "not tls" {
+			t.Errorf("echo = %q, %v", reply, err)
+		}
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		conn, err := gonet.DialUDP(host, nil, &tcpip.FullAddress{
+			NIC: 1, Addr: tcpip.AddrFrom4([4]byte(ip)), Port: uint16(udpEcho.LocalAddr().(*net.UDPAddr).Port),
+		}, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("datagram")); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 64)
+		n, err := conn.Read(reply)
+		if err != nil || string(reply[:n]) != "datagram" {
+			t.Errorf("echo = %q, %v", reply[:n], err)
+		}
+	})
+}
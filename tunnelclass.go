@@ -0,0 +1,196 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sultrytls "sultry/pkg/tls"
+)
+
+// Tunnel classes
+//
+// Most tunnels carry HTTP fetches: the client asks, the target answers, and
+// the tunnel goes quiet until the next request or closes. WebSocket (wss://)
+// tunnels stay open for hours and the target sends whenever it has
+// something to push, so they need their own idle policy, shouldn't be
+// rotated, and would skew the numbers of web tunnels. The upgrade happens
+// inside TLS, so tunnels are classified from what's visible: browsers offer
+// only http/1.1 in the ClientHello of a WebSocket connection, never h2, and
+// an HTTP/1.1 target only sends in answer to a request. A tunnel not
+// offering h2 is taken as a WebSocket when its port is configured for them
+// or once the target has spoken unprompted twice.
+
+// Tunnel classes, as reported in audit events and at /tunnels.
+const (
+	tunnelClassWeb       = "web"
+	tunnelClassWebSocket = "websocket"
+)
+
+// unpromptedPause is how long the target must have been quiet, with nothing
+// from the client since, for its next data to count as unprompted.
+const unpromptedPause = 2 * time.Second
+
+// unpromptedPushes is how many unprompted sends classify a tunnel as a
+// WebSocket. One isn't enough: HTTP/1.1 servers end idle keep-alive
+// connections with an unprompted close_notify.
+const unpromptedPushes = 2
+
+// TunnelClassesConfig tunes how tunnels are classified and when idle ones
+// are closed.
+type TunnelClassesConfig struct {
+	WebSocketPorts []string `json:"websocket_ports,omitempty"` // Ports whose tunnels not offering h2 are WebSockets from the start
+	WebIdle        int      `json:"web_idle,omitempty"`        // Milliseconds without traffic after which web tunnels are closed (default: never)
+	WebSocketIdle  int      `json:"websocket_idle,omitempty"`  // Milliseconds without traffic after which WebSocket tunnels are closed (default: never)
+}
+
+// idle returns how long tunnels of class may go without traffic, or 0.
+func (c TunnelClassesConfig) idle(class string) time.Duration {
+	if class == tunnelClassWebSocket {
+		return time.Duration(c.WebSocketIdle) * time.Millisecond
+	}
+	return time.Duration(c.WebIdle) * time.Millisecond
+}
+
+// tunnelClass follows one tunnel's class while it relays.
+type tunnelClass struct {
+	class atomic.Value // string
+	done  chan struct{}
+}
+
+// classifyTunnel starts following the class of a tunnel to port that began
+// with clientHello, from its traffic counted by up and down. Tunnels idle
+// for longer than their class allows are closed with closeTunnel. The
+// returned tunnelClass must be stopped when the relay ends.
+func classifyTunnel(logger *sessionLogger, cfg TunnelClassesConfig, clientHello []byte, port string,
+	up, down *atomic.Int64, closeTunnel func()) *tunnelClass {
+	t := &tunnelClass{done: make(chan struct{})}
+	t.class.Store(tunnelClassWeb)
+
+	hello, err := sultrytls.ParseClientHello(clientHello)
+	candidate := err == nil && !slices.Contains(hello.ALPN, "h2")
+	if candidate && slices.Contains(cfg.WebSocketPorts, port) {
+		t.class.Store(tunnelClassWebSocket)
+		logger.Printf("🔌 TUNNEL: Classified as a WebSocket tunnel (port %s)", port)
+	}
+	tunnelClasses.open(t.Class())
+
+	if !candidate && cfg.WebIdle == 0 {
+		return t // Nothing to watch for
+	}
+	lastUp, lastDown := up.Load(), down.Load()
+	clientSpoke, targetSpoke, quietSince := true, time.Now(), time.Now()
+	go func() {
+		check := time.NewTicker(250 * time.Millisecond)
+		defer check.Stop()
+		pushes := 0
+		for {
+			select {
+			case <-t.done:
+				return
+			case now := <-check.C:
+				if u := up.Load(); u != lastUp {
+					lastUp, clientSpoke, quietSince = u, true, now
+				}
+				if d := down.Load(); d != lastDown {
+					if !clientSpoke && now.Sub(targetSpoke) >= unpromptedPause {
+						pushes++
+					}
+					lastDown, clientSpoke, targetSpoke, quietSince = d, false, now, now
+				}
+
+				class := t.Class()
+				if candidate && class == tunnelClassWeb && pushes >= unpromptedPushes {
+					class = tunnelClassWebSocket
+					t.class.Store(class)
+					tunnelClasses.reclassify(tunnelClassWeb, class)
+					logger.Printf("🔌 TUNNEL: Classified as a WebSocket tunnel (target sends unprompted)")
+				}
+				if idle := cfg.idle(class); idle > 0 && now.Sub(quietSince) >= idle {
+					logger.Printf("💤 TUNNEL: Closing %s tunnel idle for %v", class, idle)
+					closeTunnel()
+					return
+				}
+			}
+		}
+	}()
+	return t
+}
+
+// Class returns the tunnel's class so far.
+func (t *tunnelClass) Class() string {
+	return t.class.Load().(string)
+}
+
+// WebSocket reports whether the tunnel has been classified as a WebSocket.
+func (t *tunnelClass) WebSocket() bool {
+	return t.Class() == tunnelClassWebSocket
+}
+
+// stop ends following the tunnel and counts it as closed.
+func (t *tunnelClass) stop(bytesUp, bytesDown int64, duration time.Duration) {
+	close(t.done)
+	tunnelClasses.close(t.Class(), bytesUp, bytesDown, duration)
+}
+
+// tunnelClasses counts tunnels by class, for the /tunnels status endpoint.
+var tunnelClasses = &tunnelClassCounter{stats: make(map[string]*tunnelClassStats)}
+
+// tunnelClassStats describes the tunnels of a class.
+type tunnelClassStats struct {
+	Active     int   `json:"active"`
+	Closed     int   `json:"closed"`
+	BytesUp    int64 `json:"bytes_up"`    // Sent to destinations by closed tunnels
+	BytesDown  int64 `json:"bytes_down"`  // Received from destinations by closed tunnels
+	DurationMs int64 `json:"duration_ms"` // Total duration of closed tunnels
+}
+
+type tunnelClassCounter struct {
+	mu    sync.Mutex
+	stats map[string]*tunnelClassStats
+}
+
+func (c *tunnelClassCounter) get(class string) *tunnelClassStats {
+	stats, ok := c.stats[class]
+	if !ok {
+		stats = &tunnelClassStats{}
+		c.stats[class] = stats
+	}
+	return stats
+}
+
+func (c *tunnelClassCounter) open(class string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(class).Active++
+}
+
+func (c *tunnelClassCounter) reclassify(from, to string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(from).Active--
+	c.get(to).Active++
+}
+
+func (c *tunnelClassCounter) close(class string, bytesUp, bytesDown int64, duration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.get(class)
+	stats.Active--
+	stats.Closed++
+	stats.BytesUp += bytesUp
+	stats.BytesDown += bytesDown
+	stats.DurationMs += duration.Milliseconds()
+}
+
+// Snapshot returns the stats of each class seen so far.
+func (c *tunnelClassCounter) Snapshot() map[string]tunnelClassStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshot := make(map[string]tunnelClassStats, len(c.stats))
+	for class, stats := range c.stats {
+		snapshot[class] = *stats
+	}
+	return snapshot
+}
@@ -0,0 +1,341 @@
+//go:build !relay
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Upstream proxies
+//
+// Where the network has no direct egress, as in many corporate networks,
+// every connection the client makes has to go through a proxy there. Routes
+// choose that proxy by the address dialed, so targets and OOB peers can go
+// through different proxies, or some of them directly: the first route
+// matching a host:port decides, and addresses no route matches are dialed
+// directly. HTTP proxies are asked for a CONNECT tunnel and SOCKS5 proxies
+// for a CONNECT, both to the hostname, which the proxy resolves ("socks5"
+// proxies get an address the client resolved instead, like curl's). Only
+// the TCP connections are proxied: desync, which needs to see its own
+// packets, and WebTransport peers, which are reached over QUIC, can't be.
+
+// UpstreamProxyRoute sends connections to matching addresses through an
+// upstream proxy.
+type UpstreamProxyRoute struct {
+	Match string `json:"match"`               // "host", "*.example.com" or "*", optionally with ":port"
+	Proxy string `json:"proxy" secret:"true"` // "http", "https", "socks5" or "socks5h" URL, optionally with user:password@, or "direct"
+}
+
+// upstreamDirect is the proxy of routes that exempt addresses from later ones.
+const upstreamDirect = "direct"
+
+// upstreamHandshakeTimeout bounds the exchange with the proxy when the
+// dial has no deadline of its own.
+const upstreamHandshakeTimeout = 10 * time.Second
+
+// upstreamProxies holds the parsed routes.
+type upstreamProxies struct {
+	routes []upstreamRoute
+}
+
+type upstreamRoute struct {
+	match string
+	proxy *url.URL // nil for direct connections
+}
+
+// upstream routes every connection the client makes, with the routes of the
+// config.
+var upstream = &upstreamProxies{}
+
+// setupUpstreamProxies installs the configured routes.
+func setupUpstreamProxies(routes []UpstreamProxyRoute) error {
+	parsed := &upstreamProxies{}
+	for _, route := range routes {
+		proxy, err := parseUpstreamProxy(route.Proxy)
+		if err != nil {
+			return fmt.Errorf("upstream proxy for %s: %w", route.Match, err)
+		}
+		parsed.routes = append(parsed.routes, upstreamRoute{match: route.Match, proxy: proxy})
+		if proxy != nil {
+			log.Printf("🔀 Connections to %s go through the %s proxy at %s", route.Match, proxy.Scheme, proxy.Host)
+		}
+	}
+	upstream = parsed
+	return nil
+}
+
+// parseUpstreamProxy parses a route's proxy, returning nil for "direct".
+func parseUpstreamProxy(proxy string) (*url.URL, error) {
+	if proxy == upstreamDirect {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy %q (use an http, https, socks5 or socks5h URL, or direct)", proxy)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy %q has no host", proxy)
+	}
+	return u, nil
+}
+
+// proxyFor returns the proxy of the first route matching address, a
+// host:port, or nil if it's dialed directly. matched reports whether any
+// route decided.
+func (u *upstreamProxies) proxyFor(address string) (proxy *url.URL, matched bool) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, ""
+	}
+	for _, route := range u.routes {
+		if matchRoute(route.match, host, port) {
+			return route.proxy, true
+		}
+	}
+	return nil, false
+}
+
+// Proxies reports whether connections to address go through a proxy.
+func (u *upstreamProxies) Proxies(address string) bool {
+	proxy, _ := u.proxyFor(address)
+	return proxy != nil
+}
+
+// Proxy is an http.Transport Proxy function choosing by the routes, and by
+// the environment for requests no route matches.
+func (u *upstreamProxies) Proxy(req *http.Request) (*url.URL, error) {
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if proxy, matched := u.proxyFor(net.JoinHostPort(req.URL.Hostname(), port)); matched {
+		return proxy, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// EnvironmentProxy is an http.Transport Proxy function for transports that
+// dial through DialContext, which already takes the routes: it only leaves
+// the environment's proxy to requests no route matches.
+func (u *upstreamProxies) EnvironmentProxy(req *http.Request) (*url.URL, error) {
+	if _, matched := u.proxyFor(req.URL.Host); matched {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// DialContext connects to address over TCP with dialer, through the proxy
+// of its route if it has one. The connection is tuned for the address
+// actually dialed.
+func (u *upstreamProxies) DialContext(ctx context.Context, dialer *net.Dialer, address string) (net.Conn, error) {
+	proxy, _ := u.proxyFor(address)
+	if proxy == nil {
+		return connTuner.Dialer(dialer, address).DialContext(ctx, "tcp", address)
+	}
+
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), map[string]string{
+			"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}[proxy.Scheme])
+	}
+	conn, err := connTuner.Dialer(dialer, proxyAddr).DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to upstream proxy %s: %w", proxyAddr, err)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(upstreamHandshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname(), KeyLogWriter: keyLog})
+		if err = tlsConn.HandshakeContext(ctx); err == nil {
+			conn = tlsConn
+		}
+	}
+	if err == nil {
+		switch proxy.Scheme {
+		case "http", "https":
+			conn, err = httpConnect(conn, proxy, address)
+		default:
+			err = socksConnect(ctx, conn, proxy, address)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s failed to connect to %s: %w", proxyAddr, address, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// DialTLSContext connects to address like DialContext and starts TLS over
+// the connection, naming address's host unless config names a server.
+func (u *upstreamProxies) DialTLSContext(ctx context.Context, dialer *net.Dialer, address string, config *tls.Config) (net.Conn, error) {
+	if !u.Proxies(address) {
+		return (&tls.Dialer{NetDialer: connTuner.Dialer(dialer, address), Config: config}).DialContext(ctx, "tcp", address)
+	}
+	conn, err := u.DialContext(ctx, dialer, address)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// httpConnect asks an HTTP proxy for a tunnel to address. Anything the
+// proxy sent after its response belongs to the tunnel and is replayed.
+func httpConnect(conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	request := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		return conn, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return conn, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT refused: %s", resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		peeked, _ := reader.Peek(reader.Buffered())
+		return &peekedConn{Conn: conn, peeked: peeked}, nil
+	}
+	return conn, nil
+}
+
+// socksConnect runs a SOCKS5 CONNECT to address over conn (RFC 1928),
+// authenticating with the proxy URL's credentials (RFC 1929) if it has any.
+func socksConnect(ctx context.Context, conn net.Conn, proxy *url.URL, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port in %s", address)
+	}
+
+	method := byte(socksAuthNone)
+	if proxy.User != nil {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 greeting: %w", err)
+	}
+	if reply[0] != socksVersion || reply[1] != method {
+		return errors.New("SOCKS5 proxy accepts no offered authentication method")
+	}
+	if method == socksAuthPassword {
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 credentials are too long")
+		}
+		auth := append([]byte{socksPasswordVersion, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("failed to read SOCKS5 authentication status: %w", err)
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 proxy rejected the credentials")
+		}
+	}
+
+	// socks5 proxies are given an address, socks5h ones the name
+	ip := net.ParseIP(host)
+	if ip == nil && proxy.Scheme == "socks5" {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		ip = ips[0].IP
+	}
+	request := []byte{socksVersion, socksCmdConnect, 0}
+	switch {
+	case ip.To4() != nil:
+		request = append(append(request, socksAddrIPv4), ip.To4()...)
+	case ip != nil:
+		request = append(append(request, socksAddrIPv6), ip.To16()...)
+	case len(host) > 255:
+		return fmt.Errorf("hostname %s is too long for SOCKS5", host)
+	default:
+		request = append(append(request, socksAddrDomain, byte(len(host))), host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// The reply ends with the address the proxy bound, which isn't needed
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+	}
+	if header[1] != socksSucceeded {
+		return fmt.Errorf("SOCKS5 CONNECT failed with reply %d", header[1])
+	}
+	var bound int
+	switch header[3] {
+	case socksAddrIPv4:
+		bound = net.IPv4len
+	case socksAddrIPv6:
+		bound = net.IPv6len
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+		}
+		bound = int(length[0])
+	default:
+		return fmt.Errorf("unknown address type %d in SOCKS5 reply", header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, bound+2)); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Build information
+//
+// Release builds stamp the version, commit and build date with
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Builds without them fall back to what the Go toolchain records: the module
+// version, and the commit and its time when built from a checkout.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// versionInfo describes this build, as served on /version.
+type versionInfo struct {
+	Version      string   `json:"version"`
+	Commit       string   `json:"commit,omitempty"`
+	BuildDate    string   `json:"build_date,omitempty"`
+	Go           string   `json:"go"`
+	Protocol     int      `json:"protocol"` // OOB protocol version
+	Capabilities []string `json:"capabilities"`
+	UserAgent    string   `json:"user_agent"` // Sent on OOB requests
+}
+
+// buildVersion returns the version the binary was built as.
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// currentVersion returns the build information of this binary.
+func currentVersion() versionInfo {
+	v := versionInfo{Version: buildVersion(), Commit: commit, BuildDate: buildDate, Go: runtime.Version(),
+		Protocol: protocolVersion, Capabilities: supportedCapabilities, UserAgent: oobUserAgent}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && v.Commit == "":
+				v.Commit = setting.Value
+			case setting.Key == "vcs.time" && v.BuildDate == "":
+				v.BuildDate = setting.Value
+			}
+		}
+	}
+	return v
+}
+
+// handleVersion answers with the build information, for deployment checks
+// and for deciding whether a client is compatible.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentVersion())
+}
+
+func init() {
+	handleStatus("/version", func() any { return currentVersion() })
+}
+
+// defaultUserAgent identifies this build and the OOB protocol it speaks, so
+// servers can tell clients apart by their requests alone.
+func defaultUserAgent() string {
+	v := buildVersion()
+	if strings.HasPrefix(v, "(") {
+		v = "devel" // Parentheses would start a comment
+	}
+	return "Sultry/" + v + " (OOB protocol " + strconv.Itoa(protocolVersion) + ")"
+}
+
+// oobUserAgent is sent as the User-Agent of every OOB request.
+var oobUserAgent = defaultUserAgent()
+
+// setupUserAgent configures the User-Agent of OOB requests; "" keeps the
+// default.
+func setupUserAgent(userAgent string) {
+	if userAgent != "" {
+		oobUserAgent = userAgent
+	}
+}
+
+// userAgentTransport sets the User-Agent of every OOB request.
+type userAgentTransport struct {
+	base http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", oobUserAgent)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Operator notifications
+//
+// Some failures need a person: every OOB peer unreachable, someone
+// hammering the relay with bad credentials, a certificate about to lapse.
+// They're logged like everything else, but nobody watches logs around the
+// clock, so they're also posted to webhooks, e.g. a Slack channel. Each
+// endpoint hears about an event at most once per interval, and deliveries
+// are retried with backoff in the background.
+
+// Operator events sent to webhooks.
+const (
+	eventPeersDown    = "peers_down"    // Every OOB peer is down or has its circuit open
+	eventAuthFailures = "auth_failures" // Rejected authentications spiked
+	eventCertExpiry   = "cert_expiry"   // A certificate expires soon
+)
+
+// WebhooksConfig posts operator notifications of critical events.
+type WebhooksConfig struct {
+	Endpoints    []WebhookEndpoint `json:"endpoints,omitempty"`
+	AuthFailures int               `json:"auth_failures,omitempty"` // Rejected authentications per minute that make a spike (default: 20)
+	CertExpiry   int               `json:"cert_expiry,omitempty"`   // Days before a certificate expires to warn (default: 14)
+}
+
+// WebhookEndpoint is where notifications are posted.
+type WebhookEndpoint struct {
+	URL         string   `json:"url" secret:"true"`
+	Format      string   `json:"format,omitempty"`       // "json" (default) or "slack"
+	Events      []string `json:"events,omitempty"`       // Events to post (default: all)
+	MinInterval int      `json:"min_interval,omitempty"` // Milliseconds between notifications of the same event (default: 600000)
+	Retries     int      `json:"retries,omitempty"`      // Further attempts after a failed delivery (default: 3)
+}
+
+// operatorEvent is the body posted to "json" endpoints.
+type operatorEvent struct {
+	Time    time.Time      `json:"time"`
+	Event   string         `json:"event"`
+	Host    string         `json:"host"` // Machine the event happened on
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// webhookNotifier delivers operator events to the configured endpoints.
+type webhookNotifier struct {
+	cfg    WebhooksConfig
+	client *http.Client
+	host   string
+
+	mu           sync.Mutex
+	last         map[webhookKey]time.Time // Last notification by endpoint and event
+	authFailures []time.Time              // Rejections within the last minute
+}
+
+// webhookKey identifies an event sent to one of the endpoints.
+type webhookKey struct {
+	endpoint int // Index in the configuration
+	event    string
+}
+
+// webhooks is set up by setupWebhooks; nil means no endpoint is configured.
+var webhooks *webhookNotifier
+
+// setupWebhooks starts posting operator events, if endpoints are configured.
+func setupWebhooks(cfg WebhooksConfig) error {
+	if len(cfg.Endpoints) == 0 {
+		return nil
+	}
+	for _, endpoint := range cfg.Endpoints {
+		if endpoint.URL == "" {
+			return errors.New("webhook endpoint without a url")
+		}
+		if endpoint.Format != "" && endpoint.Format != "json" && endpoint.Format != "slack" {
+			return fmt.Errorf("unknown webhook format %q for %s", endpoint.Format, endpoint.URL)
+		}
+	}
+	host, _ := os.Hostname()
+	webhooks = &webhookNotifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		host:   host,
+		last:   make(map[webhookKey]time.Time),
+	}
+	log.Printf("🔔 Operator notifications posted to %d webhook(s)", len(cfg.Endpoints))
+	return nil
+}
+
+// notifyOperator posts event to every endpoint that wants it and hasn't
+// been told about it within its interval.
+func notifyOperator(event, message string, details map[string]any) {
+	n := webhooks
+	if n == nil {
+		return
+	}
+	notification := operatorEvent{Time: time.Now(), Event: event, Host: n.host, Message: message, Details: details}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, endpoint := range n.cfg.Endpoints {
+		if len(endpoint.Events) > 0 && !slices.Contains(endpoint.Events, event) {
+			continue
+		}
+		key := webhookKey{endpoint: i, event: event}
+		if last, ok := n.last[key]; ok && notification.Time.Sub(last) < millis(endpoint.MinInterval, 600000) {
+			continue
+		}
+		n.last[key] = notification.Time
+		go n.deliver(endpoint, notification)
+	}
+}
+
+// deliver posts notification to endpoint, retrying with backoff.
+func (n *webhookNotifier) deliver(endpoint WebhookEndpoint, notification operatorEvent) {
+	var body any = notification
+	if endpoint.Format == "slack" {
+		body = map[string]string{"text": fmt.Sprintf("🚨 *sultry* on %s: %s", n.host, notification.Message)}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+
+	retries := orDefault(endpoint.Retries, 3)
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = n.post(endpoint.URL, payload)
+		if err == nil {
+			return
+		}
+		if attempt >= retries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	log.Printf("⚠️ Failed to post %s notification to webhook: %v", notification.Event, err)
+}
+
+func (n *webhookNotifier) post(url string, payload []byte) error {
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// recordAuthFailure counts a rejected authentication, notifying the
+// operator when a minute holds more than the configured number.
+func recordAuthFailure(source string) {
+	n := webhooks
+	if n == nil {
+		return
+	}
+	now := time.Now()
+	n.mu.Lock()
+	n.authFailures = append(n.authFailures, now)
+	for len(n.authFailures) > 0 && now.Sub(n.authFailures[0]) > time.Minute {
+		n.authFailures = n.authFailures[1:]
+	}
+	count := len(n.authFailures)
+	n.mu.Unlock()
+
+	if count >= orDefault(n.cfg.AuthFailures, 20) {
+		notifyOperator(eventAuthFailures, fmt.Sprintf("%d rejected authentications in the last minute, the latest from %s", count, source),
+			map[string]any{"count": count, "source": source})
+	}
+}
+
+// watchCertExpiry warns the operator, now and twice a day, once the
+// certificate der described by name is about to expire.
+func watchCertExpiry(name string, der []byte) {
+	n := webhooks
+	if n == nil {
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return
+	}
+	warnBefore := time.Duration(orDefault(n.cfg.CertExpiry, 14)) * 24 * time.Hour
+	go func() {
+		for {
+			if left := time.Until(cert.NotAfter); left < warnBefore {
+				message := fmt.Sprintf("%s certificate for %s expires in %d days (%s)", name, cert.Subject.CommonName,
+					int(left.Hours()/24), cert.NotAfter.Format(time.DateOnly))
+				if left <= 0 {
+					message = fmt.Sprintf("%s certificate for %s expired on %s", name, cert.Subject.CommonName,
+						cert.NotAfter.Format(time.DateOnly))
+				}
+				log.Printf("⚠️ %s", message)
+				notifyOperator(eventCertExpiry, message, map[string]any{"certificate": name,
+					"subject": cert.Subject.CommonName, "not_after": cert.NotAfter})
+			}
+			time.Sleep(12 * time.Hour)
+		}
+	}()
+}
@@ -0,0 +1,132 @@
+//go:build !relay
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// WebSocket upgrades
+//
+// A ws:// handshake is an HTTP request that, once the target answers 101
+// Switching Protocols, turns the connection into a stream of frames in both
+// directions. The direct HTTP handler can't relay that as a request and a
+// response, so WebSocket handshakes are sent to the target over a
+// connection of their own, and after the 101 is forwarded both connections
+// are relayed byte for byte, like a CONNECT tunnel.
+
+// isWebSocketUpgrade reports whether r asks to switch to WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relayWebSocket forwards the WebSocket handshake in to target and, if the
+// target accepts it, relays the connection until either side closes it.
+// reader holds whatever the client sent after the handshake.
+func (p *TLSProxy) relayWebSocket(ctx context.Context, clientConn net.Conn, reader *bufio.Reader, in *http.Request,
+	target *url.URL) {
+	logger := sessionLog(ctx)
+	address := target.Host
+	if target.Port() == "" {
+		address = net.JoinHostPort(target.Hostname(), "80")
+	}
+
+	logger.Printf("🔌 Forwarding WebSocket handshake to %s", address)
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	targetConn, err := upstream.DialContext(dialCtx, &net.Dialer{}, address)
+	cancel()
+	if err != nil {
+		logger.Printf("❌ ERROR connecting to WebSocket target %s: %v", address, err)
+		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	defer targetConn.Close()
+
+	// The handshake is sent on in origin form, with the headers that ask
+	// for the upgrade but not the proxy's own
+	out := &http.Request{Method: in.Method, URL: &url.URL{Path: target.Path, RawPath: target.RawPath,
+		RawQuery: target.RawQuery}, Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1, Header: make(http.Header),
+		Host: target.Host, Body: http.NoBody}
+	for key, values := range in.Header {
+		switch http.CanonicalHeaderKey(key) {
+		case "Proxy-Connection", "Proxy-Authorization":
+			continue
+		}
+		out.Header[key] = values
+	}
+	targetConn.SetDeadline(time.Now().Add(timeouts.handshake))
+	if err := out.Write(targetConn); err != nil {
+		logger.Printf("❌ ERROR sending WebSocket handshake: %v", err)
+		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	targetReader := bufio.NewReader(targetConn)
+	resp, err := http.ReadResponse(targetReader, out)
+	if err != nil {
+		logger.Printf("❌ ERROR reading WebSocket handshake response: %v", err)
+		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	targetConn.SetDeadline(time.Time{})
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Refused, or answered as a plain request: relayed like any response
+		defer resp.Body.Close()
+		logger.Printf("⚠️ WebSocket target %s answered %s instead of switching protocols", address, resp.Status)
+		if _, err := writeProxiedResponse(clientConn, resp, in, false); err != nil {
+			logger.Printf("❌ ERROR writing response to client: %v", err)
+		}
+		return
+	}
+
+	// The 101 keeps its Connection and Upgrade headers, which complete the
+	// switch for the client
+	head := bufio.NewWriter(clientConn)
+	fmt.Fprintf(head, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(head)
+	head.WriteString("\r\n")
+	if err := head.Flush(); err != nil {
+		logger.Printf("❌ ERROR writing WebSocket handshake response to client: %v", err)
+		return
+	}
+	logger.Printf("✅ WebSocket connection to %s established, relaying frames", address)
+
+	// Frames either side sent right after the handshake may already be
+	// buffered, and are relayed first
+	fromClient := &bufferedConn{Conn: clientConn, reader: reader}
+	fromTarget := &bufferedConn{Conn: targetConn, reader: targetReader}
+	phase := newRelayTimeouts(nil)
+	limit := throttling.open(clientConn.RemoteAddr())
+	defer limit.close()
+	err = relayPair(ctx, clientConn, targetConn,
+		func() error {
+			buffer := make([]byte, relayBufferSize(""))
+			return relayData(logger, fromClient, targetConn, buffer, "Client -> Target", phase, limit, true)
+		},
+		func() error {
+			buffer := make([]byte, relayBufferSize(""))
+			return relayData(logger, fromTarget, clientConn, buffer, "Target -> Client", phase, limit, false)
+		})
+	if err != nil {
+		logger.Printf("⚠️ WebSocket relay to %s ended: %v", address, err)
+		return
+	}
+	logger.Printf("✅ WebSocket connection to %s closed", address)
+}
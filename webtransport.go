@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// WebTransportConfig serves the OOB API over WebTransport (HTTP/3), so the
+// server component can sit behind CDNs that terminate HTTP/3 and the OOB
+// channel looks like ordinary web traffic. Every OOB request, including
+// connection adoption, travels over its own WebTransport stream. Clients use
+// it for oob_channels entries of type "webtransport".
+type WebTransportConfig struct {
+	Listen string `json:"listen,omitempty"` // Server: UDP address of the HTTP/3 listener, e.g. ":443"
+	Path   string `json:"path,omitempty"`   // URL path of the WebTransport endpoint (default: /sultry)
+}
+
+func (c WebTransportConfig) path() string {
+	if c.Path == "" {
+		return "/sultry"
+	}
+	return c.Path
+}
+
+// streamConn adapts a WebTransport stream to net.Conn.
+type streamConn struct {
+	*webtransport.Stream
+	session *webtransport.Session
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.session.LocalAddr() }
+func (c *streamConn) RemoteAddr() net.Addr { return c.session.RemoteAddr() }
+
+// Close closes both directions; Stream.Close only closes the send side.
+func (c *streamConn) Close() error {
+	c.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// streamListener hands the streams of all WebTransport or multiplexed
+// sessions to an http.Server as if they were accepted connections.
+type streamListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newStreamListener(addr net.Addr) *streamListener {
+	return &streamListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *streamListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr { return l.addr }
+
+// deliver queues conn for Accept. It returns false, closing conn, if the
+// listener is closed.
+func (l *streamListener) deliver(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		conn.Close()
+		return false
+	}
+}
+
+// serve accepts streams on session until it ends.
+func (l *streamListener) serve(session *webtransport.Session) {
+	for {
+		stream, err := session.AcceptStream(session.Context())
+		if err != nil {
+			log.Printf("🔹 WebTransport session from %s ended: %v", redacted(sensitiveClientIP, session.RemoteAddr().String()), err)
+			return
+		}
+		if !l.deliver(&streamConn{Stream: stream, session: session}) {
+			return
+		}
+	}
+}
+
+// webTransportServer runs the HTTP/3 listener. Sessions are authenticated
+// like any other OOB request; their streams are then served by an HTTP
+// server of their own.
+type webTransportServer struct {
+	h3       *webtransport.Server
+	conn     net.PacketConn
+	streams  *http.Server
+	listener *streamListener
+	path     string
+}
+
+// newWebTransportServer binds the UDP socket of the listener, whose
+// streams are served by handler.
+func newWebTransportServer(cfg WebTransportConfig, tlsConfig *tls.Config, auth AuthConfig, handler http.Handler) (*webTransportServer, error) {
+	if tlsConfig == nil {
+		return nil, errors.New("WebTransport requires oob_tls to be configured")
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebTransport listen address: %w", err)
+	}
+	// Bound before serving, so Shutdown can't race with ListenAndServe
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &webTransportServer{
+		h3: &webtransport.Server{
+			H3: http3.Server{
+				TLSConfig: http3.ConfigureTLSConfig(tlsConfig.Clone()),
+			},
+			// Sessions come from our own client, not from browsers
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+		conn:     conn,
+		streams:  &http.Server{Handler: handler},
+		listener: newStreamListener(conn.LocalAddr()),
+		path:     cfg.Listen + cfg.path(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.path(), func(w http.ResponseWriter, r *http.Request) {
+		session, err := s.h3.Upgrade(w, r)
+		if err != nil {
+			log.Printf("❌ WebTransport upgrade from %s failed: %v", redacted(sensitiveClientIP, r.RemoteAddr), err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		log.Printf("🔹 WebTransport session established from %s", redacted(sensitiveClientIP, r.RemoteAddr))
+		go s.listener.serve(session)
+	})
+	s.h3.H3.Handler = authMiddleware(auth, mux, nil)
+	return s, nil
+}
+
+// Serve serves sessions until Shutdown, returning nil then.
+func (s *webTransportServer) Serve() error {
+	go s.streams.Serve(s.listener)
+	log.Printf("🔹 WebTransport OOB endpoint listening on udp %s", s.path)
+	return serveUntilShutdown(s.h3.Serve(s.conn))
+}
+
+// Shutdown stops accepting streams and waits for the requests on them
+// until ctx is done, then closes every session.
+func (s *webTransportServer) Shutdown(ctx context.Context) error {
+	err := s.streams.Shutdown(ctx)
+	s.Close()
+	return err
+}
+
+// Close closes every session and the listener at once.
+func (s *webTransportServer) Close() error {
+	s.streams.Close()
+	err := s.h3.Close()
+	s.conn.Close()
+	return err
+}
+
+// webTransportDialer keeps one WebTransport session per OOB peer and opens
+// a new stream on it for every connection.
+type webTransportDialer struct {
+	dialer    *webtransport.Dialer
+	path      string
+	authToken string
+	sessions  map[string]*webtransport.Session
+	mu        sync.Mutex
+}
+
+func newWebTransportDialer(cfg WebTransportConfig, tlsConfig *tls.Config, authToken string) *webTransportDialer {
+	h3Config := tlsConfig.Clone()
+	h3Config.NextProtos = []string{http3.NextProtoH3}
+	return &webTransportDialer{
+		dialer:    &webtransport.Dialer{TLSClientConfig: h3Config},
+		path:      cfg.path(),
+		authToken: authToken,
+		sessions:  make(map[string]*webtransport.Session),
+	}
+}
+
+// DialContext opens a stream to peer, establishing a session if needed.
+func (d *webTransportDialer) DialContext(ctx context.Context, peer string) (net.Conn, error) {
+	session, err := d.session(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WebTransport stream: %w", err)
+	}
+	return &streamConn{Stream: stream, session: session}, nil
+}
+
+// session returns the live session to peer, dialing a new one if the
+// previous session ended.
+func (d *webTransportDialer) session(ctx context.Context, peer string) (*webtransport.Session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if session, ok := d.sessions[peer]; ok && session.Context().Err() == nil {
+		return session, nil
+	}
+
+	header := http.Header{"User-Agent": {oobUserAgent}}
+	if d.authToken != "" {
+		header.Set("Authorization", authorizationHeader(d.authToken))
+	}
+	resp, session, err := d.dialer.Dial(ctx, "https://"+peer+d.path, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("WebTransport session to %s rejected: HTTP %d", peer, resp.StatusCode)
+		}
+		return nil, fmt.Errorf("failed to establish WebTransport session to %s: %w", peer, err)
+	}
+	log.Printf("🔹 WebTransport session established to %s", peer)
+	d.sessions[peer] = session
+	return session, nil
+}